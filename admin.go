@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// The admin API runs the chat from scripts and dashboards, without the chat interface, for
+// whoever presents ADMIN_TOKEN as a bearer token, moderators not being enough (see
+// adminTokenAuthorized): /api/admin/sessions lists the sessions, by handle (see sessionHandle),
+// /api/admin/sessions/rename and /api/admin/sessions/kick rename and kick one,
+// /api/admin/images/delete deletes an uploaded image and /api/admin/broadcast posts an
+// announcement to the main room. It lives under /api/admin rather than /admin, with the rest of
+// the HTTP API in openapi.json and next to /api/admin/load, which already took the token. Changes
+// are audited, as done by "admin". Renames, kicks, bans and announcements can also be made
+// through the control socket, see ctl.go.
+//
+// A kicked session's stream ends, and it can't connect again for kickCooldown. It isn't banned.
+
+const kickCooldown = time.Minute
+
+var (
+	errNicknameTaken   = errors.New("Invalid nickname: already taken")
+	errKicked          = errors.New("You were kicked, try again in a minute")
+	errUnknownSession  = errors.New("Unknown session")
+	errMessageRequired = errors.New("Message is required")
+)
+
+type AdminSession struct {
+	// Handle of the session, see sessionHandle, which the endpoints taking a session accept.
+	ID       string `json:"id"`
+	Nickname string `json:"nickname,omitempty"`
+	Role     Role   `json:"role"`
+	// Whether it has a stream connected.
+	Connected bool `json:"connected"`
+	Banned    bool `json:"banned,omitempty"`
+	// Room it is switched to, empty for the main room.
+	Room      string    `json:"room,omitempty"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// adminPost checks that r is a POST made by an admin, answering it otherwise.
+func (s *ChatServer) adminPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if !adminTokenAuthorized(r) {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return false
+	}
+	r.ParseForm()
+	return true
+}
+
+// sessions returns every session known, most recently seen first.
+func (s *ChatServer) sessions() []AdminSession {
+	s.sessionFirstSeenMu.Lock()
+	sessions := make([]AdminSession, 0, len(s.sessionFirstSeen))
+	for id, firstSeen := range s.sessionFirstSeen {
+		sessions = append(sessions, AdminSession{ID: id, FirstSeen: firstSeen, LastSeen: s.sessionLastSeen[id]})
+	}
+	s.sessionFirstSeenMu.Unlock()
+
+	var connected map[string]bool
+	s.hub.read(func(clients map[string]chan string) {
+		connected = make(map[string]bool, len(clients))
+		for id := range clients {
+			connected[id] = true
+		}
+	})
+	for i := range sessions {
+		session := &sessions[i]
+		id := session.ID
+		s.nicknamesMu.Lock()
+		session.Nickname = s.nicknames[id]
+		s.nicknamesMu.Unlock()
+		session.Role = s.roleOf(id)
+		session.Connected = connected[id]
+		session.Banned = s.isBanned(id)
+		session.Room = s.currentRoom(id)
+		session.ID = sessionHandle(id)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeen.After(sessions[j].LastSeen) })
+	return sessions
+}
+
+// setNickname renames sessionID and announces it.
+func (s *ChatServer) setNickname(sessionID, nickname string) error {
+	if err := validateNickname(nickname); err != nil {
+		return err
+	}
+	s.nicknamesMu.Lock()
+	for _, nick := range s.nicknames {
+		if nickname == nick {
+			s.nicknamesMu.Unlock()
+			return errNicknameTaken
+		}
+	}
+	old := s.nicknames[sessionID]
+	s.nicknames[sessionID] = nickname
+	s.nicknamesMu.Unlock()
+
+	s.nicknameColorsMu.Lock()
+	if _, exists := s.nicknameColors[sessionID]; !exists {
+		s.nicknameColors[sessionID] = s.generateRandomColor()
+	}
+	s.nicknameColorsMu.Unlock()
+
+	if old == "" {
+		old = "no previous nicknames"
+	} else {
+		old = fmt.Sprintf("previously [%s]", escapeText(old))
+	}
+
+	messageContent := fmt.Sprintf("client %s ([%s]) changed nickname to [%s]", sessionHandle(sessionID), old, escapeText(nickname))
+	s.broadcastMessage(Message{
+		Private:  false,
+		FromApp:  true,
+		Kind:     "text",
+		Content:  messageContent,
+		Activity: "nick",
+	})
+	return nil
+}
+
+// kick ends the stream of sessionID, telling it why, and keeps it from connecting again for
+// kickCooldown.
+func (s *ChatServer) kick(sessionID, reason string) {
+	s.kicksMu.Lock()
+	s.kicked[sessionID] = s.clock.Now().Add(kickCooldown)
+	s.kicksMu.Unlock()
+
+	content := "You were kicked"
+	if reason != "" {
+		content += ": " + escapeText(reason)
+	}
+	ch, connected := s.hub.lookup(sessionID)
+	if !connected || !s.hub.disconnect(sessionID, ch) {
+		// Forget a stream that dropped and could be resumed.
+		s.leave(sessionID)
+		return
+	}
+	data, _ := json.Marshal(s.stamp(Message{FromApp: true, Kind: "text", Private: true, Content: content}))
+	s.kicksMu.Lock()
+	if end, ok := s.kicks[ch]; ok {
+		end <- string(data)
+		delete(s.kicks, ch)
+	}
+	s.kicksMu.Unlock()
+	s.announceLeave(sessionID)
+}
+
+// isKicked reports whether sessionID was kicked too recently to connect.
+func (s *ChatServer) isKicked(sessionID string) bool {
+	s.kicksMu.Lock()
+	defer s.kicksMu.Unlock()
+	until, ok := s.kicked[sessionID]
+	if ok && !s.clock.Now().Before(until) {
+		delete(s.kicked, sessionID)
+		return false
+	}
+	return ok
+}
+
+// watchKick returns a channel receiving the last event of the stream ch, should it be kicked.
+func (s *ChatServer) watchKick(ch chan string) <-chan string {
+	end := make(chan string, 1)
+	s.kicksMu.Lock()
+	s.kicks[ch] = end
+	s.kicksMu.Unlock()
+	return end
+}
+
+// forgetKick stops watching the stream ch, once it ends.
+func (s *ChatServer) forgetKick(ch chan string) {
+	s.kicksMu.Lock()
+	delete(s.kicks, ch)
+	s.kicksMu.Unlock()
+}
+
+func (s *ChatServer) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	if !adminTokenAuthorized(r) {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.sessions())
+}
+
+// handleAdminRooms lists every room, unlisted ones too.
+func (s *ChatServer) handleAdminRooms(w http.ResponseWriter, r *http.Request) {
+	if !adminTokenAuthorized(r) {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.roomList())
+}
+
+// adminTarget returns the session of the "session" form value, a nickname or session identifier,
+// answering the request if there is none.
+func (s *ChatServer) adminTarget(w http.ResponseWriter, r *http.Request) string {
+	target := s.findSession(r.FormValue("session"))
+	if target == "" {
+		http.Error(w, errUnknownSession.Error(), http.StatusNotFound)
+	}
+	return target
+}
+
+func (s *ChatServer) handleAdminRename(w http.ResponseWriter, r *http.Request) {
+	if !s.adminPost(w, r) {
+		return
+	}
+	target := s.adminTarget(w, r)
+	if target == "" {
+		return
+	}
+	switch err := s.adminRename("admin", target, r.FormValue("nickname")); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errNicknameTaken:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// adminRename renames target, done by actor through the admin API or the control socket.
+func (s *ChatServer) adminRename(actor, target, nickname string) error {
+	old, nickname := s.getNickname(target), normalizeNickname(nickname)
+	if err := s.setNickname(target, nickname); err != nil {
+		return err
+	}
+	s.audit(actor, "session.rename", target, old+" to "+nickname)
+	return nil
+}
+
+func (s *ChatServer) handleAdminKick(w http.ResponseWriter, r *http.Request) {
+	if !s.adminPost(w, r) {
+		return
+	}
+	target := s.adminTarget(w, r)
+	if target == "" {
+		return
+	}
+	s.adminKick("admin", target, normalizeMessage(r.FormValue("reason")))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminKick kicks target, done by actor through the admin API or the control socket.
+func (s *ChatServer) adminKick(actor, target, reason string) {
+	s.kick(target, reason)
+	s.audit(actor, "session.kick", target, reason)
+	s.logModAction(fmt.Sprintf("[%s] was kicked", escapeText(s.getNickname(target))))
+}
+
+func (s *ChatServer) handleAdminDeleteImage(w http.ResponseWriter, r *http.Request) {
+	if !s.adminPost(w, r) {
+		return
+	}
+	id := r.FormValue("id")
+	s.imageStoreMu.Lock()
+	_, ok := s.imageStore[id]
+	if ok {
+		s.deleteImageLocked(id)
+	}
+	s.imageStoreMu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	s.audit("admin", "image.delete", id, "")
+	s.archiveEvent("delete", "admin", Message{Kind: "image", Content: id}, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *ChatServer) handleAdminBroadcast(w http.ResponseWriter, r *http.Request) {
+	if !s.adminPost(w, r) {
+		return
+	}
+	message, err := s.announce("admin", r.FormValue("message"), r.FormValue("room"))
+	switch err {
+	case nil:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(message)
+	case errUnknownRoom:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// announce posts text as the app in room, or the main room, done by actor, and returns the
+// message as sent.
+func (s *ChatServer) announce(actor, text, room string) (Message, error) {
+	text = normalizeMessage(text)
+	if text == "" {
+		return Message{}, errMessageRequired
+	}
+	if err := validateMessage(text); err != nil {
+		return Message{}, err
+	}
+	message := Message{FromApp: true, Kind: "text", Content: escapeText(text)}
+	if room = normalizeRoom(room); room != "" {
+		var err error
+		if message, err = s.broadcastToRoom(room, message); err != nil {
+			return Message{}, err
+		}
+	} else {
+		message = s.broadcastMessage(message)
+	}
+	s.audit(actor, "broadcast", message.ID, text)
+	return message, nil
+}
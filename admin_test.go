@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"alantern/chattest"
+)
+
+// adminDo sends a request to srv with ADMIN_TOKEN, which the test sets to "test-token".
+func adminDo(t *testing.T, srv *chattest.Server, method, path string, form url.Values) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer test-token")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestAdminAPITakesTheTokenAlone(t *testing.T) {
+	key, token := moderatorKey, adminToken
+	moderatorKey, adminToken = "test-key", "test-token"
+	t.Cleanup(func() { moderatorKey, adminToken = key, token })
+
+	_, srv := newTestServer(t)
+	mod := srv.Connect()
+	mod.Send(";mod test-key")
+	mod.Collect(settle)
+	for _, path := range []string{"/api/admin/sessions", "/api/admin/bans", "/api/admin/load"} {
+		if status, body := mod.Do(http.MethodGet, path, nil); status != http.StatusUnauthorized {
+			t.Errorf("GET %s as a moderator: %d %s, want 401", path, status, body)
+		}
+	}
+	if status, body := mod.Do(http.MethodPost, "/api/admin/broadcast", url.Values{"message": {"hi"}}); status != http.StatusUnauthorized {
+		t.Errorf("broadcast as a moderator: %d %s, want 401", status, body)
+	}
+	if status, body := adminDo(t, srv, http.MethodGet, "/api/admin/sessions", nil); status != http.StatusOK {
+		t.Errorf("GET /api/admin/sessions with the token: %d %s", status, body)
+	}
+}
+
+func TestModeratorsSeeHandlesNotSessionIDs(t *testing.T) {
+	key, token := moderatorKey, adminToken
+	moderatorKey, adminToken = "test-key", "test-token"
+	t.Cleanup(func() { moderatorKey, adminToken = key, token })
+
+	s, srv := newTestServer(t)
+	mod, alice := srv.Connect(), srv.Connect()
+	mod.Send(";mod test-key")
+	alice.SetNickname("alice")
+	mod.Collect(settle)
+	aliceID := s.findSession("alice")
+	handle := sessionHandle(aliceID)
+	if handle == aliceID || strings.Contains(handle, aliceID) {
+		t.Fatalf("handle %q gives the session away", handle)
+	}
+
+	status, body := adminDo(t, srv, http.MethodGet, "/api/admin/sessions", nil)
+	if status != http.StatusOK {
+		t.Fatalf("/api/admin/sessions: %d %s", status, body)
+	}
+	var sessions []struct{ ID, Nickname string }
+	if err := json.Unmarshal([]byte(body), &sessions); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, session := range sessions {
+		if session.ID == aliceID {
+			t.Errorf("/api/admin/sessions lists the session identifier of %s", session.Nickname)
+		}
+		found = found || session.ID == handle && session.Nickname == "alice"
+	}
+	if !found {
+		t.Errorf("/api/admin/sessions: %s, want alice by handle %s", body, handle)
+	}
+
+	mod.Send(";kick " + handle + " testing")
+	var notice string
+	for _, e := range mod.Collect(settle) {
+		if e.Private && strings.Contains(e.Content, "kicked [alice]") {
+			notice = e.Content
+		}
+	}
+	if strings.Contains(notice, aliceID) || !strings.Contains(notice, handle) {
+		t.Errorf("kick notice %q, want alice by handle %s", notice, handle)
+	}
+	if status, body := adminDo(t, srv, http.MethodPost, "/api/admin/sessions/rename", url.Values{"session": {handle}, "nickname": {"alicia"}}); status != http.StatusNoContent {
+		t.Errorf("renaming by handle: %d %s", status, body)
+	}
+}
+
+func TestOthersSeeHandlesNotSessionIDs(t *testing.T) {
+	s, srv := newTestServer(t)
+	alice, bob := srv.Connect(), srv.Connect()
+	alice.SetNickname("alice")
+	bob.SetNickname("bob")
+	bob.Send("hello")
+	bobID := s.findSession("bob")
+
+	seen, err := json.Marshal(alice.Collect(settle))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, members := alice.Do(http.MethodGet, "/members", nil)
+	for what, body := range map[string]string{"events": string(seen), "/members": members} {
+		if strings.Contains(body, bobID) {
+			t.Errorf("%s give bob's session identifier away: %s", what, body)
+		}
+		if !strings.Contains(body, sessionHandle(bobID)) {
+			t.Errorf("%s: %s, want bob by handle", what, body)
+		}
+	}
+}
+
+func TestRolesNameSessionsByHandle(t *testing.T) {
+	s, srv := newTestServer(t)
+	owner, alice := srv.Connect(), srv.Connect()
+	owner.SetNickname("owner")
+	alice.SetNickname("alice")
+	ownerID, aliceID := s.findSession("owner"), s.findSession("alice")
+	s.claimOwnership(ownerID)
+
+	status, body := owner.Do(http.MethodPost, "/mod/roles", url.Values{"action": {"promote"}, "target": {sessionHandle(aliceID)}})
+	if status != http.StatusOK {
+		t.Fatalf("promoting by handle: %d %s", status, body)
+	}
+	status, body = alice.Do(http.MethodGet, "/mod/roles", nil)
+	if status != http.StatusOK {
+		t.Fatalf("/mod/roles: %d %s", status, body)
+	}
+	if strings.Contains(body, ownerID) || !strings.Contains(body, sessionHandle(ownerID)) {
+		t.Errorf("/mod/roles: %s, want the owner by handle", body)
+	}
+}
+
+func TestModeratorListsNameSessionsByHandle(t *testing.T) {
+	key := moderatorKey
+	moderatorKey = "test-key"
+	t.Cleanup(func() { moderatorKey = key })
+
+	s, srv := newTestServer(t)
+	alice, mod := srv.Connect(), srv.Connect()
+	alice.SetNickname("alice")
+	mod.Send(";mod test-key")
+	mod.SetNickname("mod")
+	mod.Collect(settle)
+	aliceID := s.findSession("alice")
+
+	mod.Send(";members")
+	members := mod.Expect(chattest.Private("Online members"))[0].Content
+	status, body := mod.Do(http.MethodGet, "/mod/sessions?limit=1", nil)
+	if status != http.StatusOK {
+		t.Fatalf("/mod/sessions: %d %s", status, body)
+	}
+	var page struct{ Next string }
+	json.Unmarshal([]byte(body), &page)
+	cursor, err := base64.RawURLEncoding.DecodeString(page.Next)
+	if err != nil || page.Next == "" {
+		t.Fatalf("/mod/sessions: next %q, want a cursor", page.Next)
+	}
+	for what, shown := range map[string]string{";members": members, "/mod/sessions": body, "its cursor": string(cursor)} {
+		if strings.Contains(shown, aliceID) || !strings.Contains(shown, sessionHandle(aliceID)) {
+			t.Errorf("%s: %s, want alice by handle", what, shown)
+		}
+	}
+}
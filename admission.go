@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// When many clients connect at once, a class all opening the page together say, new /events
+// streams are let in at JOIN_RATE per second, after a first JOIN_BURST right away. Those over the
+// rate wait in line, are told their place in it and get it updated while they wait.
+
+const (
+	defaultJoinRate  = 20
+	defaultJoinBurst = 100
+	// How often streams waiting in line are let in.
+	admissionTick = 100 * time.Millisecond
+	// How often those still waiting are told their place in line.
+	admissionUpdateInterval = 5 * time.Second
+)
+
+type admissionState struct {
+	// Streams let in per second, and how many can be let in at once.
+	rate  float64
+	burst float64
+	// Streams that can be let in right away.
+	tokens float64
+	// Streams waiting in line, first come first served. Each is closed when let in.
+	queue []chan struct{}
+}
+
+func (s *ChatServer) initAdmission() {
+	s.admission = admissionState{rate: defaultJoinRate, burst: defaultJoinBurst}
+	if rate, err := strconv.Atoi(os.Getenv("JOIN_RATE")); err == nil && rate > 0 {
+		s.admission.rate = float64(rate)
+	}
+	if burst, err := strconv.Atoi(os.Getenv("JOIN_BURST")); err == nil && burst > 0 {
+		s.admission.burst = float64(burst)
+	}
+	s.admission.tokens = s.admission.burst
+}
+
+// admitStream waits for the stream of w to be let in, telling it its place in line meanwhile.
+// It reports false if the client went away first.
+func (s *ChatServer) admitStream(ctx context.Context, w http.ResponseWriter, flusher http.Flusher) bool {
+	s.admissionMu.Lock()
+	if len(s.admission.queue) == 0 && s.admission.tokens >= 1 {
+		s.admission.tokens--
+		s.admissionMu.Unlock()
+		return true
+	}
+	admitted := make(chan struct{})
+	s.admission.queue = append(s.admission.queue, admitted)
+	s.admissionMu.Unlock()
+
+	for {
+		if position := s.admissionPosition(admitted); position > 0 {
+			writeMessage(w, s.stamp(Message{
+				FromApp: true,
+				Kind:    "text",
+				Private: true,
+				Content: fmt.Sprintf("The room is busy, you&#39;re #%d in line", position),
+			}), nil)
+			flusher.Flush()
+		}
+
+		select {
+		case <-admitted:
+			return true
+		case <-ctx.Done():
+			s.leaveAdmissionQueue(admitted)
+			return false
+		case <-s.clock.After(admissionUpdateInterval):
+		}
+	}
+}
+
+// admissionPosition returns the place in line of admitted, starting at 1, or 0 if it isn't
+// waiting anymore.
+func (s *ChatServer) admissionPosition(admitted chan struct{}) int {
+	s.admissionMu.Lock()
+	defer s.admissionMu.Unlock()
+	for i, waiting := range s.admission.queue {
+		if waiting == admitted {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (s *ChatServer) leaveAdmissionQueue(admitted chan struct{}) {
+	s.admissionMu.Lock()
+	defer s.admissionMu.Unlock()
+	for i, waiting := range s.admission.queue {
+		if waiting == admitted {
+			s.admission.queue = append(s.admission.queue[:i], s.admission.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// admitStreams refills the streams that can be let in and lets in those waiting in line.
+func (s *ChatServer) admitStreams() {
+	s.admissionMu.Lock()
+	defer s.admissionMu.Unlock()
+	admission := &s.admission
+	admission.tokens += admission.rate * admissionTick.Seconds()
+	if admission.tokens > admission.burst {
+		admission.tokens = admission.burst
+	}
+	for len(admission.queue) > 0 && admission.tokens >= 1 {
+		close(admission.queue[0])
+		admission.queue = admission.queue[1:]
+		admission.tokens--
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Animated images (GIF, APNG and animated WebP) are heavy on low-end devices, so uploads of them
+// are held to tighter limits than still images: at most ANIMATION_MAX_MB and ANIMATION_MAX_FRAMES
+// each, and ANIMATIONS_PER_MINUTE per member, moderators aside. Moderators can also turn
+// animations off in a room, the one they are in, with ;animations off.
+
+const (
+	defaultAnimationMaxMB     = 2
+	defaultAnimationMaxFrames = 300
+	defaultAnimationsPerMin   = 3
+)
+
+var (
+	animationMaxBytes  = loadMegabytes("ANIMATION_MAX_MB", defaultAnimationMaxMB)
+	animationMaxFrames = loadPositiveInt("ANIMATION_MAX_FRAMES", defaultAnimationMaxFrames)
+	animationsPerMin   = loadPositiveInt("ANIMATIONS_PER_MINUTE", defaultAnimationsPerMin)
+)
+
+var (
+	errAnimationsOff     = errors.New("Animated images are off in this room")
+	errAnimationTooLarge = errors.New("Animated image is too large")
+	errAnimationTooLong  = errors.New("Animated image has too many frames")
+	errTooManyAnimations = errors.New("Too many animated images: wait a minute before posting another")
+)
+
+func loadPositiveInt(name string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
+
+// imageFrames returns how many frames the image data has, 1 for still images and formats it
+// doesn't know.
+func imageFrames(data []byte) int {
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return gifFrames(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return apngFrames(data)
+	case len(data) >= 12 && bytes.Equal(data[:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return webpFrames(data)
+	}
+	return 1
+}
+
+// gifFrames counts the image descriptors of a GIF, skipping over everything else.
+func gifFrames(data []byte) int {
+	frames := 0
+	pos := 13
+	if len(data) < pos {
+		return 1
+	}
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1)
+	}
+	skipSubBlocks := func() bool {
+		for pos < len(data) {
+			size := int(data[pos])
+			pos += 1 + size
+			if size == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // Extension: label, then sub-blocks.
+			pos += 2
+			if !skipSubBlocks() {
+				return max(frames, 1)
+			}
+		case 0x2c: // Image descriptor, local colour table, LZW code size, then sub-blocks.
+			frames++
+			if pos+10 > len(data) {
+				return frames
+			}
+			if flags := data[pos+9]; flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			pos += 11
+			if !skipSubBlocks() {
+				return frames
+			}
+		default: // Trailer, or garbage.
+			return max(frames, 1)
+		}
+	}
+	return max(frames, 1)
+}
+
+// apngFrames returns the frame count of the acTL chunk of an animated PNG.
+func apngFrames(data []byte) int {
+	for pos := 8; pos+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		kind := string(data[pos+4 : pos+8])
+		if kind == "acTL" && pos+12 <= len(data) {
+			return max(int(binary.BigEndian.Uint32(data[pos+8:])), 1)
+		}
+		if kind == "IDAT" {
+			break
+		}
+		pos += 12 + length
+	}
+	return 1
+}
+
+// webpFrames counts the ANMF chunks of an animated WebP.
+func webpFrames(data []byte) int {
+	frames := 0
+	for pos := 12; pos+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		if string(data[pos:pos+4]) == "ANMF" {
+			frames++
+		}
+		pos += 8 + size + size%2
+	}
+	return max(frames, 1)
+}
+
+// animationsAllowed reports whether animated images may be posted in the room name.
+func (s *ChatServer) animationsAllowed(name string) bool {
+	if name == "" {
+		s.animationsMu.Lock()
+		defer s.animationsMu.Unlock()
+		return !s.animationsOff
+	}
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	room, ok := s.rooms[name]
+	return !ok || !room.animationsOff
+}
+
+// setAnimations turns animated images off, or back on, in the room name.
+func (s *ChatServer) setAnimations(name string, off bool) error {
+	if name == "" {
+		s.animationsMu.Lock()
+		s.animationsOff = off
+		s.animationsMu.Unlock()
+		return nil
+	}
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	room, ok := s.rooms[name]
+	if !ok {
+		return errUnknownRoom
+	}
+	room.animationsOff = off
+	return nil
+}
+
+// checkAnimation returns why sessionID may not post the image data in the room name, or nil. Still
+// images are always fine; an animated one counts towards the poster's limit per minute.
+func (s *ChatServer) checkAnimation(sessionID, room string, data []byte) error {
+	frames := imageFrames(data)
+	if frames < 2 {
+		return nil
+	}
+	if !s.animationsAllowed(room) {
+		return errAnimationsOff
+	}
+	if int64(len(data)) > animationMaxBytes {
+		return errAnimationTooLarge
+	}
+	if frames > animationMaxFrames {
+		return errAnimationTooLong
+	}
+	if s.isModerator(sessionID) {
+		return nil
+	}
+
+	now := s.clock.Now()
+	s.animationsMu.Lock()
+	defer s.animationsMu.Unlock()
+	var recent []time.Time
+	for _, at := range s.animationPosts[sessionID] {
+		if now.Sub(at) < time.Minute {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) >= animationsPerMin {
+		s.animationPosts[sessionID] = recent
+		return errTooManyAnimations
+	}
+	s.animationPosts[sessionID] = append(recent, now)
+	return nil
+}
+
+// handleAnimationsCommand turns animated images on or off in the room the moderator is in.
+func (s *ChatServer) handleAnimationsCommand(sessionID string, args []string) {
+	room := s.currentRoom(sessionID)
+	if !s.moderatesRoom(sessionID, room) {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Only moderators can use ;animations",
+		})
+		return
+	}
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Usage: ;animations on|off"})
+		return
+	}
+
+	if err := s.setAnimations(room, args[0] == "off"); err != nil {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: escapeText(err.Error())})
+		return
+	}
+
+	where := "the main room"
+	if room != "" {
+		where = "#" + room
+	}
+	s.audit(sessionID, "animations."+args[0], room, "")
+	notice := Message{
+		FromApp: true,
+		Kind:    "text",
+		Content: fmt.Sprintf("Animated images turned %s in %s by [%s]", args[0], where, escapeText(s.getNickname(sessionID))),
+	}
+	if room == "" {
+		s.broadcastMessage(notice)
+	} else {
+		s.broadcastToRoom(room, notice)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// The OpenAPI document describing every endpoint is maintained by hand next to the handlers; keep
+// it in sync when adding or changing one. It is served at /api/spec, and /api/docs renders it
+// with Swagger UI so client developers can try requests against the running instance.
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>alantern API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    SwaggerUIBundle({ url: "/api/spec", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+func (s *ChatServer) handleAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+func (s *ChatServer) handleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setPolicyHeaders(w, docsContentSecurityPolicy)
+	w.Write([]byte(swaggerUIPage))
+}
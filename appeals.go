@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Longest appeal message accepted, in bytes.
+const maxAppealLength = 2000
+
+type Appeal struct {
+	// Appeal identifier.
+	ID string `json:"id"`
+	// Session of the banned user, by handle (see sessionHandle) for moderators.
+	SessionID string `json:"sessionId"`
+	// Nickname the user was banned under.
+	Nickname string `json:"nickname"`
+	// Appeal message written by the user.
+	Message string `json:"message"`
+	// Either "pending", "accepted" or "rejected".
+	Status string `json:"status"`
+	// When the appeal was submitted.
+	SubmittedAt time.Time `json:"submittedAt"`
+	// When a moderator resolved the appeal. Zero while pending.
+	ResolvedAt time.Time `json:"resolvedAt,omitempty"`
+}
+
+// queueNotice privately sends message to sessionID, or if it isn't connected, stores it until the
+// next time it connects to /events (e.g. banned users waiting on an appeal).
+func (s *ChatServer) queueNotice(sessionID string, message Message) {
+	if _, connected := s.hub.lookup(sessionID); connected {
+		s.sendPrivateMessage(sessionID, message)
+		return
+	}
+
+	s.noticesMu.Lock()
+	s.notices[sessionID] = append(s.notices[sessionID], message)
+	s.noticesMu.Unlock()
+}
+
+func (s *ChatServer) deliverNotices(sessionID string) {
+	s.noticesMu.Lock()
+	notices := s.notices[sessionID]
+	delete(s.notices, sessionID)
+	s.noticesMu.Unlock()
+
+	for _, notice := range notices {
+		s.sendPrivateMessage(sessionID, notice)
+	}
+}
+
+// handleAppeal lets a banned session look up (GET) or submit (POST) its single ban appeal.
+func (s *ChatServer) handleAppeal(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+
+	switch r.Method {
+	case http.MethodGet:
+		s.appealsMu.Lock()
+		appeal, ok := s.appeals[sessionID]
+		var found Appeal
+		if ok {
+			found = *appeal
+		}
+		s.appealsMu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(found)
+
+	case http.MethodPost:
+		s.bansMu.Lock()
+		ban, banned := s.bans[sessionID]
+		var nickname string
+		if banned {
+			nickname = ban.Nickname
+		}
+		s.bansMu.Unlock()
+		if !banned {
+			http.Error(w, "You are not banned", http.StatusBadRequest)
+			return
+		}
+
+		r.ParseForm()
+		message := strings.TrimSpace(normalizeMessage(r.FormValue("message")))
+		if message == "" || len(message) > maxAppealLength {
+			http.Error(w, fmt.Sprintf("Appeal message must be between 1 and %d characters", maxAppealLength), http.StatusBadRequest)
+			return
+		}
+
+		s.appealsMu.Lock()
+		if _, exists := s.appeals[sessionID]; exists {
+			s.appealsMu.Unlock()
+			http.Error(w, "You have already appealed this ban", http.StatusConflict)
+			return
+		}
+		appeal := &Appeal{
+			ID:          s.newID(),
+			SessionID:   sessionID,
+			Nickname:    nickname,
+			Message:     message,
+			Status:      "pending",
+			SubmittedAt: s.clock.Now(),
+		}
+		s.appeals[sessionID] = appeal
+		s.appealsMu.Unlock()
+
+		s.notifyModerators(Message{
+			Kind:    "text",
+			Content: fmt.Sprintf("New ban appeal %s from [%s]: %s", escapeText(appeal.ID), escapeText(nickname), escapeText(message)),
+		})
+		fmt.Fprintf(w, "Appeal submitted")
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *ChatServer) listAppeals() []Appeal {
+	s.appealsMu.Lock()
+	appeals := make([]Appeal, 0, len(s.appeals))
+	for _, appeal := range s.appeals {
+		appeals = append(appeals, *appeal)
+	}
+	s.appealsMu.Unlock()
+
+	for i := range appeals {
+		appeals[i].SessionID = sessionHandle(appeals[i].SessionID)
+	}
+	sort.Slice(appeals, func(i, j int) bool {
+		return appeals[i].SubmittedAt.Before(appeals[j].SubmittedAt)
+	})
+	return appeals
+}
+
+// resolveAppeal accepts (lifting the ban) or rejects the pending appeal with the given identifier.
+func (s *ChatServer) resolveAppeal(id string, accept bool) (Appeal, bool) {
+	s.appealsMu.Lock()
+	var appeal *Appeal
+	for _, a := range s.appeals {
+		if a.ID == id && a.Status == "pending" {
+			appeal = a
+			break
+		}
+	}
+	if appeal == nil {
+		s.appealsMu.Unlock()
+		return Appeal{}, false
+	}
+	appeal.Status = "rejected"
+	if accept {
+		appeal.Status = "accepted"
+	}
+	appeal.ResolvedAt = s.clock.Now()
+	resolved := *appeal
+	s.appealsMu.Unlock()
+
+	if accept {
+		s.unban(resolved.SessionID)
+		s.logModAction(fmt.Sprintf("[%s] was unbanned after an appeal", escapeText(resolved.Nickname)))
+		s.queueNotice(resolved.SessionID, Message{
+			Kind:    "text",
+			Content: "Your ban appeal was accepted, welcome back!",
+		})
+	} else {
+		s.queueNotice(resolved.SessionID, Message{
+			Kind:    "text",
+			Content: "Your ban appeal was rejected",
+		})
+	}
+	return resolved, true
+}
+
+// handleModAppeals lists appeals (GET) or resolves the one given by the "id" form value with
+// "decision" set to "accept" or "reject" (POST).
+func (s *ChatServer) handleModAppeals(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	if !s.isModerator(sessionID) {
+		http.Error(w, "Moderators only", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writePage(w, r, s.listAppeals(), func(a Appeal) string { return timeKey(a.SubmittedAt, a.ID) })
+
+	case http.MethodPost:
+		r.ParseForm()
+		decision := r.FormValue("decision")
+		if decision != "accept" && decision != "reject" {
+			http.Error(w, "decision must be accept or reject", http.StatusBadRequest)
+			return
+		}
+		appeal, ok := s.resolveAppeal(r.FormValue("id"), decision == "accept")
+		if !ok {
+			http.Error(w, "No pending appeal with that id", http.StatusNotFound)
+			return
+		}
+		s.audit(sessionID, "appeal."+decision, appeal.SessionID, appeal.ID)
+		s.notifyModerators(Message{
+			Kind:    "text",
+			Content: fmt.Sprintf("[%s] %sed the ban appeal of [%s]", escapeText(s.getNickname(sessionID)), decision, escapeText(appeal.Nickname)),
+		})
+		appeal.SessionID = sessionHandle(appeal.SessionID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(appeal)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
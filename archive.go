@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logged messages, of the main room and of rooms, can be archived for compliance by streaming
+// them to the sinks listed in ARCHIVE_SINKS, comma-separated:
+//   - file:///var/log/alantern/messages.jsonl appends them to the file as JSON lines, renamed
+//     after the time once it is ARCHIVE_FILE_MB large, so that a new one starts
+//   - s3://bucket/prefix puts an object of JSON lines per batch under prefix/2006/01/02/, signed
+//     with AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN if set, in AWS_REGION
+//     unless ?region= says; ?endpoint=http://host:9000 is for S3-compatible stores, by path
+//   - kafka+http://proxy:8082/topic, or kafka+https://, produces them to topic through a Kafka
+//     REST proxy, keyed by message identifier, with the user and password of the URL if any
+//
+// A record is the message as broadcast and when it was archived, or an upload or deletion, see
+// legalhold.go. Each sink has its own queue and worker, which sends what it got every ARCHIVE_FLUSH
+// or archiveBatchSize messages, and tries a failed batch again, waiting longer each time, so chat
+// never waits for a sink: once the queue of one that is slow or down is full, messages are dropped
+// for it, logged, and counted in alantern_archive_dropped_total. What is queued at shutdown gets
+// archiveShutdownTimeout. Under legal hold records are spooled to disk instead of queued, and
+// none is dropped, see legalhold.go. -selftest traffic and private messages aren't archived, and
+// relay edges archive nothing.
+
+const (
+	defaultArchiveFlush  = 10 * time.Second
+	defaultArchiveFileMB = 100
+	archiveQueueSize     = 4096
+	archiveBatchSize     = 500
+	// Longest wait before sending a failed batch again.
+	archiveMaxBackoff      = 5 * time.Minute
+	archiveShutdownTimeout = 5 * time.Second
+	// Least time between two warnings about dropped messages, per sink.
+	archiveDropWarning = time.Minute
+)
+
+// archiveRecord is a message as archived.
+type archiveRecord struct {
+	At time.Time `json:"at"`
+	// What happened to Message, "" when it was sent, "upload" for an image uploaded and "delete"
+	// when it was deleted, see legalhold.go.
+	Event string `json:"event,omitempty"`
+	// Who uploaded or deleted it.
+	Actor   string  `json:"actor,omitempty"`
+	Message Message `json:"message"`
+	// The image uploaded, under legal hold.
+	Image []byte `json:"image,omitempty"`
+	// SHA-256 of the line of the previous record sent to the sink, under legal hold, "" for the
+	// first one.
+	Prev *string `json:"prev,omitempty"`
+}
+
+// archiveLine is a record encoded for a sink, as a line of JSON without the newline.
+type archiveLine struct {
+	// Identifier of the message.
+	key  string
+	data []byte
+}
+
+// archiveSink is where archived messages end up.
+type archiveSink interface {
+	// write archives lines, in order, failing as a whole.
+	write(lines []archiveLine, now time.Time) error
+	close() error
+}
+
+// archiver feeds a sink from its queue.
+type archiver struct {
+	// The sink's URL, without password, for logs.
+	name  string
+	sink  archiveSink
+	queue chan archiveRecord
+	stop  chan struct{}
+	done  chan struct{}
+	// Where records wait for the sink instead of queue, under legal hold.
+	spool *spool
+
+	mu          sync.Mutex
+	dropped     uint64
+	lastWarning time.Time
+}
+
+// loadArchivers returns the archivers of ARCHIVE_SINKS, not started.
+func loadArchivers(newID func() string) ([]*archiver, error) {
+	maxSize := int64(defaultArchiveFileMB) << 20
+	if value := os.Getenv("ARCHIVE_FILE_MB"); value != "" {
+		mb, err := strconv.Atoi(value)
+		if err != nil || mb <= 0 {
+			return nil, fmt.Errorf("ARCHIVE_FILE_MB: expected a positive number, got %q", value)
+		}
+		maxSize = int64(mb) << 20
+	}
+
+	var archivers []*archiver
+	for _, value := range strings.Split(os.Getenv("ARCHIVE_SINKS"), ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("ARCHIVE_SINKS: %v", err)
+		}
+		var sink archiveSink
+		switch u.Scheme {
+		case "file":
+			if u.Path == "" {
+				return nil, fmt.Errorf("ARCHIVE_SINKS: %s has no path", value)
+			}
+			sink = &fileSink{path: filepath.FromSlash(u.Path), maxSize: maxSize}
+		case "s3":
+			sink, err = newS3Sink(u, newID)
+		case "kafka+http", "kafka+https":
+			sink, err = newKafkaSink(u)
+		default:
+			return nil, fmt.Errorf("ARCHIVE_SINKS: %s is not a file://, s3:// or kafka+http(s):// URL", u.Redacted())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ARCHIVE_SINKS: %s: %v", u.Redacted(), err)
+		}
+		archivers = append(archivers, &archiver{
+			name:  u.Redacted(),
+			sink:  sink,
+			queue: make(chan archiveRecord, archiveQueueSize),
+			stop:  make(chan struct{}),
+			done:  make(chan struct{}),
+		})
+	}
+	return archivers, nil
+}
+
+func loadArchiveFlush() (time.Duration, error) {
+	value := os.Getenv("ARCHIVE_FLUSH")
+	if value == "" {
+		return defaultArchiveFlush, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("ARCHIVE_FLUSH: expected a duration such as 10s, got %q", value)
+	}
+	return d, nil
+}
+
+// loadArchive sets up the sinks of ARCHIVE_SINKS, unless this is a relay edge, which archives
+// nothing since the primary does.
+func (s *ChatServer) loadArchive() (err error) {
+	if relayUpstream != "" {
+		return nil
+	}
+	if s.archiveFlush, err = loadArchiveFlush(); err != nil {
+		return err
+	}
+	s.archivers, err = loadArchivers(s.newID)
+	return err
+}
+
+// startArchive starts a worker per sink, sending from its spool under legal hold.
+func (s *ChatServer) startArchive() error {
+	for _, a := range s.archivers {
+		if legalHold {
+			spool, err := openSpool(archiveSpool, a.name)
+			if err != nil {
+				return fmt.Errorf("%s: %w", a.name, err)
+			}
+			a.spool = spool
+			detail := "a new chain starts"
+			if spool.head != "" {
+				detail = "going on from " + spool.head
+			}
+			s.audit("archive", "archive.head", a.name, detail)
+			go s.runSpooledArchiver(a)
+		} else {
+			go s.runArchiver(a)
+		}
+		slog.Info("Archiving messages", "sink", a.name)
+	}
+	return nil
+}
+
+// stopArchive sends what is queued, for archiveShutdownTimeout at most, and closes the sinks.
+func (s *ChatServer) stopArchive() {
+	deadline := time.After(archiveShutdownTimeout)
+	for _, a := range s.archivers {
+		close(a.stop)
+	}
+	for _, a := range s.archivers {
+		select {
+		case <-a.done:
+		case <-deadline:
+			if a.spool != nil {
+				slog.Warn("Archive sink still sending at shutdown, the rest stays spooled for the next start", "sink", a.name)
+			} else {
+				slog.Warn("Archive sink still sending at shutdown", "sink", a.name, "queued", len(a.queue))
+			}
+			continue
+		}
+		if err := a.sink.close(); err != nil {
+			slog.Warn("Could not close archive sink", "sink", a.name, "err", err)
+		}
+	}
+}
+
+// archive queues message for every sink, dropping it for those whose queue is full.
+func (s *ChatServer) archive(message Message) {
+	if message.Private || message.Test || !contentKinds[message.Kind].Message {
+		return
+	}
+	s.archiveEvent("", "", message, nil)
+}
+
+// archiveEvent queues the record of event, by actor, on message for every sink.
+func (s *ChatServer) archiveEvent(event, actor string, message Message, image []byte) {
+	if len(s.archivers) == 0 {
+		return
+	}
+	now := s.clock.Now()
+	if message.Timestamp.IsZero() {
+		message.Timestamp = now.UTC()
+	}
+	record := archiveRecord{At: now.UTC(), Event: event, Actor: actor, Message: message, Image: image}
+	for _, a := range s.archivers {
+		if a.spool != nil {
+			if err := a.spool.add(record); err != nil {
+				a.mu.Lock()
+				a.dropped++
+				a.mu.Unlock()
+				slog.Error("Could not spool archive record", "sink", a.name, "id", message.ID, "err", err)
+			}
+			continue
+		}
+		select {
+		case a.queue <- record:
+			continue
+		default:
+		}
+		a.mu.Lock()
+		a.dropped++
+		warn := now.Sub(a.lastWarning) >= archiveDropWarning
+		if warn {
+			a.lastWarning = now
+		}
+		dropped := a.dropped
+		a.mu.Unlock()
+		if warn {
+			slog.Warn("Archive queue full, dropping messages", "sink", a.name, "dropped", dropped)
+		}
+	}
+}
+
+// archiveDropped returns how many messages were dropped for full archive queues since start.
+func (s *ChatServer) archiveDropped() uint64 {
+	var total uint64
+	for _, a := range s.archivers {
+		a.mu.Lock()
+		total += a.dropped
+		a.mu.Unlock()
+	}
+	return total
+}
+
+// runArchiver sends what a gets to its sink in batches until a is stopped.
+func (s *ChatServer) runArchiver(a *archiver) {
+	defer close(a.done)
+	ticker := time.NewTicker(s.archiveFlush)
+	defer ticker.Stop()
+
+	var batch []archiveLine
+	var retryAt time.Time
+	failures := 0
+	for {
+		queue := a.queue
+		if len(batch) >= archiveBatchSize {
+			// Waiting to send it again: let the queue fill up.
+			queue = nil
+		}
+		select {
+		case record := <-queue:
+			if line, ok := a.encode(record); ok {
+				batch = append(batch, line)
+			}
+			if len(batch) < archiveBatchSize || s.clock.Now().Before(retryAt) {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 || s.clock.Now().Before(retryAt) {
+				continue
+			}
+		case <-a.stop:
+			s.drainArchiver(a, batch)
+			return
+		}
+
+		if err := a.sink.write(batch, s.clock.Now()); err != nil {
+			failures++
+			backoff := min(archiveMaxBackoff, s.archiveFlush<<min(failures, 10))
+			retryAt = s.clock.Now().Add(backoff)
+			slog.Warn("Could not archive messages", "sink", a.name, "count", len(batch), "retry", backoff, "err", err)
+			continue
+		}
+		batch, retryAt, failures = nil, time.Time{}, 0
+	}
+}
+
+// drainArchiver sends batch and what is left in the queue of a, once.
+func (s *ChatServer) drainArchiver(a *archiver, batch []archiveLine) {
+	for {
+		for len(batch) < archiveBatchSize && len(a.queue) > 0 {
+			if line, ok := a.encode(<-a.queue); ok {
+				batch = append(batch, line)
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := a.sink.write(batch, s.clock.Now()); err != nil {
+			slog.Error("Could not archive messages at shutdown", "sink", a.name, "lost", len(batch)+len(a.queue), "err", err)
+			return
+		}
+		batch = nil
+	}
+}
+
+// encode encodes record for the sink of a.
+func (a *archiver) encode(record archiveRecord) (archiveLine, bool) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("Could not encode archive record", "id", record.Message.ID, "err", err)
+		return archiveLine{}, false
+	}
+	return archiveLine{key: record.Message.ID, data: data}, true
+}
+
+// encodeArchive returns lines as a file of JSON lines.
+func encodeArchive(lines []archiveLine) []byte {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.Write(line.data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// fileSink appends records to a file, rotated once it reaches maxSize.
+type fileSink struct {
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+func (f *fileSink) write(lines []archiveLine, now time.Time) error {
+	data := encodeArchive(lines)
+	if f.file != nil && f.size > 0 && f.size+int64(len(data)) > f.maxSize {
+		if err := f.rotate(now); err != nil {
+			return err
+		}
+	}
+	if f.file == nil {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0o700); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		f.file, f.size = file, info.Size()
+		if f.size > 0 && f.size+int64(len(data)) > f.maxSize {
+			if err := f.rotate(now); err != nil {
+				return err
+			}
+			return f.write(lines, now)
+		}
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+// rotate renames the file after now, for the next write to start a new one.
+func (f *fileSink) rotate(now time.Time) error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file, f.size = nil, 0
+	extension := filepath.Ext(f.path)
+	rotated := strings.TrimSuffix(f.path, extension) + "-" + now.UTC().Format("20060102T150405Z") + extension
+	return os.Rename(f.path, rotated)
+}
+
+func (f *fileSink) close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+// s3Sink puts each batch as an object, signed with AWS Signature Version 4.
+type s3Sink struct {
+	// Where objects are put, with the bucket in the host or the path.
+	base   string
+	prefix string
+	region string
+
+	accessKey, secretKey, sessionToken string
+
+	client *http.Client
+	newID  func() string
+}
+
+func newS3Sink(u *url.URL, newID func() string) (*s3Sink, error) {
+	bucket := u.Host
+	if bucket == "" {
+		return nil, errors.New("no bucket")
+	}
+	sink := &s3Sink{
+		prefix:       strings.Trim(u.Path, "/"),
+		region:       u.Query().Get("region"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: 30 * time.Second},
+		newID:        newID,
+	}
+	if sink.accessKey == "" || sink.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	if sink.region == "" {
+		sink.region = envOr("AWS_REGION", "us-east-1")
+	}
+	if endpoint := u.Query().Get("endpoint"); endpoint != "" {
+		if _, err := url.Parse(endpoint); err != nil {
+			return nil, err
+		}
+		sink.base = strings.TrimRight(endpoint, "/") + "/" + bucket
+	} else {
+		sink.base = "https://" + bucket + ".s3." + sink.region + ".amazonaws.com"
+	}
+	return sink, nil
+}
+
+func (s3 *s3Sink) write(lines []archiveLine, now time.Time) error {
+	body := encodeArchive(lines)
+	now = now.UTC()
+	key := now.Format("2006/01/02/150405") + "-" + s3.newID() + ".jsonl"
+	if s3.prefix != "" {
+		key = s3.prefix + "/" + key
+	}
+	req, err := http.NewRequest(http.MethodPut, s3.base+"/"+awsEscapePath(key), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	s3.sign(req, body, now)
+
+	resp, err := s3.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("S3 answered %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// sign adds the Signature Version 4 headers of the request with body to req.
+func (s3 *s3Sink) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + s3.region + "/s3/aws4_request"
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s3.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s3.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	fmt.Fprintf(&canonical, "%s\n%s\n\n", req.Method, req.URL.EscapedPath())
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%s", signedHeaders, hex.EncodeToString(payloadHash[:]))
+
+	canonicalHash := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	key := []byte("AWS4" + s3.secretKey)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s3.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscapePath escapes every byte of an object key but unreserved ones and slashes, as AWS
+// expects them in signed paths.
+func awsEscapePath(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s3 *s3Sink) close() error {
+	return nil
+}
+
+// kafkaSink produces records to a topic through a Kafka REST proxy, with its v2 API.
+type kafkaSink struct {
+	url                string
+	username, password string
+	client             *http.Client
+}
+
+func newKafkaSink(u *url.URL) (*kafkaSink, error) {
+	topic := strings.Trim(u.Path, "/")
+	if topic == "" || strings.Contains(topic, "/") {
+		return nil, errors.New("expected the topic as the path, e.g. kafka+http://proxy:8082/messages")
+	}
+	sink := &kafkaSink{
+		url:    strings.TrimPrefix(u.Scheme, "kafka+") + "://" + u.Host + "/topics/" + url.PathEscape(topic),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	if u.User != nil {
+		sink.username = u.User.Username()
+		sink.password, _ = u.User.Password()
+	}
+	return sink, nil
+}
+
+func (k *kafkaSink) write(lines []archiveLine, now time.Time) error {
+	type kafkaRecord struct {
+		Key   string          `json:"key"`
+		Value json.RawMessage `json:"value"`
+	}
+	produce := struct {
+		Records []kafkaRecord `json:"records"`
+	}{make([]kafkaRecord, len(lines))}
+	for i, line := range lines {
+		produce.Records[i] = kafkaRecord{Key: line.key, Value: line.data}
+	}
+	body, err := json.Marshal(produce)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, k.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if k.username != "" {
+		req.SetBasicAuth(k.username, k.password)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Kafka REST proxy answered %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	// Records can fail one by one even so.
+	var result struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	for _, offset := range result.Offsets {
+		if offset.ErrorCode != nil {
+			return fmt.Errorf("Kafka REST proxy could not produce a record: %s", offset.Error)
+		}
+	}
+	return nil
+}
+
+func (k *kafkaSink) close() error {
+	return nil
+}
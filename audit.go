@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Number of audit entries kept in memory.
+const auditHistory = 1000
+
+type AuditEntry struct {
+	// Position of the entry in the log, increasing by one with every entry.
+	Seq uint64 `json:"seq"`
+	// When the action happened.
+	At time.Time `json:"at"`
+	// Session identifier of whoever performed the action.
+	Actor string `json:"actor"`
+	// Nickname of the actor at the time of the action.
+	ActorNickname string `json:"actorNickname"`
+	// What was done, e.g. "ban" or "ownership.transfer".
+	Action string `json:"action"`
+	// Session or object the action was performed on, if any.
+	Target string `json:"target,omitempty"`
+	// Free-form details.
+	Detail string `json:"detail,omitempty"`
+}
+
+// audit records a privileged action. Unlike the moderation log, audit entries are unredacted and
+// only visible to moderators.
+func (s *ChatServer) audit(actor, action, target, detail string) {
+	entry := AuditEntry{
+		At:            s.clock.Now(),
+		Actor:         actor,
+		ActorNickname: s.getNickname(actor),
+		Action:        action,
+		Target:        target,
+		Detail:        detail,
+	}
+
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	s.auditSeq++
+	entry.Seq = s.auditSeq
+	s.auditLog = append(s.auditLog, entry)
+	if len(s.auditLog) > auditHistory {
+		s.auditLog = s.auditLog[len(s.auditLog)-auditHistory:]
+	}
+}
+
+// handleModAudit lists the audit log, oldest first, a page at a time.
+func (s *ChatServer) handleModAudit(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	if !s.isModerator(sessionID) {
+		http.Error(w, "Moderators only", http.StatusForbidden)
+		return
+	}
+
+	s.auditMu.Lock()
+	entries := append([]AuditEntry(nil), s.auditLog...)
+	s.auditMu.Unlock()
+
+	writePage(w, r, entries, func(e AuditEntry) string { return seqKey(e.Seq) })
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+// Automation rules run actions when something happens in the room: a message matching a
+// pattern, someone joining, or a time of day (UTC) coming around. Actions post a message, give
+// or take the moderator role of whoever triggered the rule, call a webhook, or start slow mode.
+// Co-owners and the owner manage rules through /mod/automation. They are saved to
+// AUTOMATION_FILE, when set, and loaded from it on start. Webhooks only reach public addresses,
+// checked as they are dialed, so that a rule can't make the server call itself, the network it
+// runs in or a cloud metadata endpoint.
+
+var automationFile = os.Getenv("AUTOMATION_FILE")
+
+const (
+	maxAutomationActions = 5
+	// Least time between two runs of the same rule, so a chatty room can't make it flood.
+	automationCooldown = 5 * time.Second
+	webhookTimeout     = 5 * time.Second
+)
+
+var errWebhookNotPublic = errors.New("Webhooks can only call public addresses")
+
+var errInvalidRule = errors.New("Invalid rule: expected a name, a message (with a pattern), join or schedule (with at as HH:MM) trigger, and 1 to 5 post, role, webhook or slowmode actions")
+
+type AutomationTrigger struct {
+	// "message", "join" or "schedule".
+	Type string `json:"type"`
+	// Regular expression matched against messages, case-insensitively. Only for "message".
+	Pattern string `json:"pattern,omitempty"`
+	// Time of day in UTC, as HH:MM. Only for "schedule".
+	At string `json:"at,omitempty"`
+}
+
+type AutomationAction struct {
+	// "post", "role", "webhook" or "slowmode".
+	Type string `json:"type"`
+	// Message to post, {nickname} is replaced with whoever triggered the rule. Only for "post".
+	Text string `json:"text,omitempty"`
+	// "moderator" or "member", given to whoever triggered the rule. Only for "role".
+	Role string `json:"role,omitempty"`
+	// Receives the AutomationEvent as a JSON POST. Only for "webhook".
+	URL string `json:"url,omitempty"`
+	// Time between messages, and how long slow mode lasts (until switched off if unset). Only
+	// for "slowmode".
+	Interval string `json:"interval,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+type AutomationRule struct {
+	ID      string             `json:"id"`
+	Name    string             `json:"name"`
+	Enabled bool               `json:"enabled"`
+	Trigger AutomationTrigger  `json:"trigger"`
+	Actions []AutomationAction `json:"actions"`
+	// Session identifier of who last saved the rule.
+	UpdatedBy string    `json:"updatedBy"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	LastRun   time.Time `json:"lastRun"`
+
+	pattern *regexp.Regexp
+}
+
+// AutomationEvent is what webhooks receive.
+type AutomationEvent struct {
+	Rule    string    `json:"rule"`
+	Trigger string    `json:"trigger"`
+	At      time.Time `json:"at"`
+	// Session that triggered the rule and its nickname, unset for schedules.
+	Session  string `json:"session,omitempty"`
+	Nickname string `json:"nickname,omitempty"`
+	// Message that matched, as sent.
+	Message string `json:"message,omitempty"`
+}
+
+// webhookClient calls webhooks, refusing to connect to addresses that aren't public, whatever the
+// host name resolves to and wherever redirects lead. It ignores HTTP_PROXY, which would have it
+// check the address of the proxy instead.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if addr, err := netip.ParseAddr(host); err != nil || !publicAddress(addr) {
+					return errWebhookNotPublic
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+	},
+}
+
+// Networks that aren't public but which netip doesn't count as private: "this network" and the
+// shared address space of carrier-grade NAT.
+var nonPublicPrefixes = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/8"), netip.MustParsePrefix("100.64.0.0/10")}
+
+// publicAddress reports whether addr is reachable on the internet, rather than this host, its
+// network or a link-local address such as a cloud metadata endpoint.
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// validate checks the rule and compiles its pattern.
+func (rule *AutomationRule) validate() error {
+	if rule.Name == "" || utf8.RuneCountInString(rule.Name) > maxComponentLabel || validateMessage(rule.Name) != nil {
+		return errInvalidRule
+	}
+
+	switch rule.Trigger.Type {
+	case "message":
+		pattern, err := regexp.Compile("(?i)" + rule.Trigger.Pattern)
+		if rule.Trigger.Pattern == "" || len(rule.Trigger.Pattern) > 200 || err != nil {
+			return errInvalidRule
+		}
+		rule.pattern = pattern
+	case "join":
+	case "schedule":
+		if _, err := time.Parse("15:04", rule.Trigger.At); err != nil {
+			return errInvalidRule
+		}
+	default:
+		return errInvalidRule
+	}
+
+	if len(rule.Actions) == 0 || len(rule.Actions) > maxAutomationActions {
+		return errInvalidRule
+	}
+	for _, action := range rule.Actions {
+		switch action.Type {
+		case "post":
+			if action.Text == "" || validateMessage(action.Text) != nil {
+				return errInvalidRule
+			}
+		case "role":
+			if (action.Role != "moderator" && action.Role != "member") || rule.Trigger.Type == "schedule" {
+				return errInvalidRule
+			}
+		case "webhook":
+			target, err := url.Parse(action.URL)
+			if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+				return errInvalidRule
+			}
+			// Host names are checked when dialed, since they may resolve to anything.
+			if addr, err := netip.ParseAddr(target.Hostname()); (err == nil && !publicAddress(addr)) || strings.EqualFold(target.Hostname(), "localhost") {
+				return errWebhookNotPublic
+			}
+		case "slowmode":
+			interval, err := time.ParseDuration(action.Interval)
+			if err != nil || interval <= 0 || interval > time.Hour {
+				return errInvalidRule
+			}
+			if action.Duration != "" {
+				if d, err := time.ParseDuration(action.Duration); err != nil || d <= 0 || d > 24*time.Hour {
+					return errInvalidRule
+				}
+			}
+		default:
+			return errInvalidRule
+		}
+	}
+	return nil
+}
+
+func (s *ChatServer) automationRules() []AutomationRule {
+	s.automationMu.Lock()
+	defer s.automationMu.Unlock()
+	return s.automationRulesLocked()
+}
+
+func (s *ChatServer) automationRulesLocked() []AutomationRule {
+	rules := make([]AutomationRule, 0, len(s.automation))
+	for _, rule := range s.automation {
+		rules = append(rules, *rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules
+}
+
+// saveRule creates the rule, or replaces the one with the same identifier.
+func (s *ChatServer) saveRule(by string, rule AutomationRule) (AutomationRule, error) {
+	if err := rule.validate(); err != nil {
+		return rule, err
+	}
+
+	s.automationMu.Lock()
+	if existing, ok := s.automation[rule.ID]; ok {
+		rule.LastRun = existing.LastRun
+	} else {
+		rule.ID = s.newID()
+	}
+	rule.UpdatedBy = by
+	rule.UpdatedAt = s.clock.Now()
+	s.automation[rule.ID] = &rule
+	s.persistAutomationLocked()
+	s.automationMu.Unlock()
+
+	s.audit(by, "automation.save", rule.ID, rule.Name)
+	return rule, nil
+}
+
+func (s *ChatServer) deleteRule(by, id string) bool {
+	s.automationMu.Lock()
+	rule, ok := s.automation[id]
+	delete(s.automation, id)
+	if ok {
+		s.persistAutomationLocked()
+	}
+	s.automationMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	s.audit(by, "automation.delete", id, rule.Name)
+	return true
+}
+
+// persistAutomationLocked writes the rules to automationFile, if set.
+func (s *ChatServer) persistAutomationLocked() {
+	if automationFile == "" {
+		return
+	}
+	if err := saveJSONFile(automationFile, s.automationRulesLocked()); err != nil {
+		slog.Error("Could not save automation rules", "err", err)
+	}
+}
+
+// loadAutomation reads the rules saved in automationFile, if it exists.
+func (s *ChatServer) loadAutomation() error {
+	if automationFile == "" {
+		return nil
+	}
+	var rules []AutomationRule
+	if err := loadJSONFile(automationFile, &rules); err != nil {
+		return fmt.Errorf("%s: %w", automationFile, err)
+	}
+	s.automationMu.Lock()
+	defer s.automationMu.Unlock()
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return fmt.Errorf("%s: rule %q: %w", automationFile, rules[i].Name, err)
+		}
+		s.automation[rules[i].ID] = &rules[i]
+	}
+	return nil
+}
+
+// runAutomation runs the enabled rules with the given trigger, for sessionID and the message
+// text when it is a "message" trigger.
+func (s *ChatServer) runAutomation(trigger, sessionID, text string) {
+	now := s.clock.Now()
+	var matched []AutomationRule
+	s.automationMu.Lock()
+	for _, rule := range s.automation {
+		if rule.due(trigger, text, now) {
+			rule.LastRun = now
+			matched = append(matched, *rule)
+		}
+	}
+	s.automationMu.Unlock()
+
+	for _, rule := range matched {
+		event := AutomationEvent{Rule: rule.Name, Trigger: trigger, At: now, Message: text}
+		if sessionID != "" {
+			event.Session, event.Nickname = sessionID, s.getNickname(sessionID)
+		}
+		for _, action := range rule.Actions {
+			s.runAutomationAction(rule, action, event)
+		}
+	}
+}
+
+// due reports whether the rule should run at now for trigger, and the message text when it is a
+// "message" trigger.
+func (rule *AutomationRule) due(trigger, text string, now time.Time) bool {
+	if !rule.Enabled || rule.Trigger.Type != trigger || now.Sub(rule.LastRun) < automationCooldown {
+		return false
+	}
+	switch trigger {
+	case "message":
+		return rule.pattern.MatchString(text)
+	case "schedule":
+		return rule.Trigger.At == now.UTC().Format("15:04") && now.Sub(rule.LastRun) >= time.Minute
+	}
+	return true
+}
+
+func (s *ChatServer) runAutomationAction(rule AutomationRule, action AutomationAction, event AutomationEvent) {
+	switch action.Type {
+	case "post":
+		s.broadcastMessage(Message{
+			FromApp: true,
+			Kind:    "text",
+			Content: strings.ReplaceAll(escapeText(action.Text), "{nickname}", escapeText(event.Nickname)),
+		})
+
+	case "role":
+		s.rolesMu.Lock()
+		current := s.roles[event.Session]
+		changed := false
+		if action.Role == "moderator" && current < RoleModerator {
+			s.roles[event.Session] = RoleModerator
+			changed = true
+		} else if action.Role == "member" && current == RoleModerator {
+			delete(s.roles, event.Session)
+			changed = true
+		}
+		if changed {
+			s.rolesVersion++
+		}
+		s.rolesMu.Unlock()
+		if changed {
+			s.audit(rule.UpdatedBy, "automation.role", event.Session, rule.Name+": "+action.Role)
+		}
+
+	case "webhook":
+		body, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		go func() {
+			resp, err := webhookClient.Post(action.URL, "application/json", bytes.NewReader(body))
+			if err != nil {
+				slog.Warn("Automation webhook failed", "rule", rule.Name, "err", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+
+	case "slowmode":
+		interval, _ := time.ParseDuration(action.Interval)
+		d, _ := time.ParseDuration(action.Duration)
+		s.setSlowmode("", interval, d)
+		s.broadcastMessage(Message{
+			FromApp: true,
+			Kind:    "text",
+			Content: fmt.Sprintf("Slow mode is on: one message every %s", interval),
+		})
+	}
+}
+
+// runScheduledAutomation runs the rules due at the current time of day.
+func (s *ChatServer) runScheduledAutomation() {
+	s.runAutomation("schedule", "", "")
+}
+
+// handleModAutomation lists rules (GET), saves the JSON AutomationRule in the body (POST), new
+// when it has no identifier, or deletes the rule "id" (DELETE). Co-owners and the owner only.
+func (s *ChatServer) handleModAutomation(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	if s.roleOf(sessionID) < RoleCoOwner {
+		http.Error(w, "Co-owners only", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var rule AutomationRule
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&rule); err != nil {
+			http.Error(w, "Invalid rule", http.StatusBadRequest)
+			return
+		}
+		saved, err := s.saveRule(sessionID, rule)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(saved)
+		return
+	case http.MethodDelete:
+		if !s.deleteRule(sessionID, r.URL.Query().Get("id")) {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.automationRules())
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestPublicAddress(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":        true,
+		"2606:2800:220:1::":    true,
+		"127.0.0.1":            false,
+		"::1":                  false,
+		"10.1.2.3":             false,
+		"172.16.0.1":           false,
+		"192.168.1.1":          false,
+		"169.254.169.254":      false,
+		"fe80::1":              false,
+		"fd00:ec2::254":        false,
+		"100.64.0.1":           false,
+		"0.0.0.0":              false,
+		"0.1.2.3":              false,
+		"::ffff:127.0.0.1":     false,
+		"::ffff:93.184.216.34": true,
+		"224.0.0.1":            false,
+	} {
+		if got := publicAddress(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("publicAddress(%s) = %t, want %t", addr, got, want)
+		}
+	}
+}
+
+func TestWebhooksDontReachInternalAddresses(t *testing.T) {
+	called := false
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+	defer internal.Close()
+
+	_, err := webhookClient.Post(internal.URL, "application/json", strings.NewReader("{}"))
+	if !errors.Is(err, errWebhookNotPublic) {
+		t.Errorf("calling %s: %v, want %v", internal.URL, err, errWebhookNotPublic)
+	}
+	if called {
+		t.Error("the webhook reached a loopback server")
+	}
+
+	for _, target := range []string{"http://169.254.169.254/latest/meta-data/", "http://localhost:8080/", "http://[::1]/", "https://10.0.0.1/"} {
+		rule := AutomationRule{
+			Name:    "leak",
+			Trigger: AutomationTrigger{Type: "join"},
+			Actions: []AutomationAction{{Type: "webhook", URL: target}},
+		}
+		if err := rule.validate(); err != errWebhookNotPublic {
+			t.Errorf("rule calling %s: %v, want %v", target, err, errWebhookNotPublic)
+		}
+	}
+}
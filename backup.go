@@ -0,0 +1,244 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// "alantern backup" writes what the server saved (the files of savedFiles, under their names in
+// the data directory, and a consistent copy of the message database) to a .tar.gz archive,
+// which can be done while it runs. "alantern restore" puts them back from one, which is meant to
+// be done with the server stopped: it won't overwrite a file that exists unless given -force.
+// Both take the -data-dir of serve, and the settings of the files, to find them. Let's Encrypt
+// certificates aren't backed up, they are asked for again.
+
+func backup(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	dataDir := flags.String("data-dir", os.Getenv("DATA_DIR"), "data directory of the server ($DATA_DIR)")
+	output := flags.String("o", "", "archive to write, alantern-backup-<time>.tar.gz by default")
+	flags.Parse(args)
+	if *dataDir != "" {
+		if err := useDataDir(*dataDir); err != nil {
+			fmt.Printf("Could not use the data directory: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	name := *output
+	if name == "" {
+		name = fmt.Sprintf("alantern-backup-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	}
+	n, err := writeBackup(name)
+	if err != nil {
+		fmt.Printf("Could not back up: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Backed up %d files to %s\n", n, name)
+}
+
+func restore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dataDir := flags.String("data-dir", os.Getenv("DATA_DIR"), "data directory of the server ($DATA_DIR)")
+	force := flags.Bool("force", false, "overwrite the files that exist")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: alantern restore [flags] <archive>, with the server stopped")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *dataDir != "" {
+		if err := useDataDir(*dataDir); err != nil {
+			fmt.Printf("Could not use the data directory: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	n, err := readBackup(flags.Arg(0), *force)
+	if err != nil {
+		fmt.Printf("Could not restore: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Restored %d files\n", n)
+}
+
+// backedUpFiles returns the files of savedFiles that are backed up, by name.
+func backedUpFiles() map[string]string {
+	files := make(map[string]string)
+	for _, file := range savedFiles() {
+		if file.path != &autocertCache && *file.path != "" {
+			files[file.name] = *file.path
+		}
+	}
+	return files
+}
+
+// writeBackup writes the files that exist to the archive name, and returns how many there were.
+func writeBackup(name string) (n int, err error) {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(name)
+		}
+	}()
+	compressed := gzip.NewWriter(file)
+	archive := tar.NewWriter(compressed)
+
+	for entry, path := range backedUpFiles() {
+		if path == messageDB {
+			if path, err = snapshotMessageDB(); err != nil {
+				return 0, fmt.Errorf("%s: %w", messageDB, err)
+			}
+			if path == "" {
+				continue
+			}
+			defer os.RemoveAll(filepath.Dir(path))
+		}
+		added, err := addToArchive(archive, entry, path)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", path, err)
+		}
+		if added {
+			n++
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return 0, err
+	}
+	if err := compressed.Close(); err != nil {
+		return 0, err
+	}
+	return n, file.Close()
+}
+
+// snapshotMessageDB copies the message database to a temporary directory and returns the copy,
+// or "" if there is no database.
+func snapshotMessageDB() (string, error) {
+	if _, err := os.Stat(messageDB); errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	store, err := openSQLiteStore(messageDB)
+	if err != nil {
+		return "", err
+	}
+	defer store.Close()
+	dir, err := os.MkdirTemp("", "alantern-backup-")
+	if err != nil {
+		return "", err
+	}
+	snapshot := filepath.Join(dir, "messages.db")
+	if err := store.backup(snapshot); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return snapshot, nil
+}
+
+// addToArchive adds the file at path to archive as entry, and reports whether it exists.
+func addToArchive(archive *tar.Writer, entry, path string) (bool, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	header := &tar.Header{Name: entry, Mode: 0o600, Size: info.Size(), ModTime: info.ModTime()}
+	if err := archive.WriteHeader(header); err != nil {
+		return false, err
+	}
+	_, err = io.Copy(archive, file)
+	return err == nil, err
+}
+
+// readBackup restores the files in the archive name, overwriting those that exist only if
+// force, and returns how many there were. Nothing is restored if any of them can't be.
+func readBackup(name string, force bool) (int, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	compressed, err := gzip.NewReader(file)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	archive := tar.NewReader(compressed)
+
+	files := backedUpFiles()
+	// Files read so far, written next to where they go until all are.
+	restored := make(map[string]string)
+	defer func() {
+		for _, tmp := range restored {
+			os.Remove(tmp)
+		}
+	}()
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("%s: %w", name, err)
+		}
+		path, ok := files[header.Name]
+		if !ok || header.Typeflag != tar.TypeReg {
+			return 0, fmt.Errorf("%s: %s is not a file alantern backs up", name, header.Name)
+		}
+		if _, err := os.Stat(path); err == nil && !force {
+			return 0, fmt.Errorf("%s exists, restore with -force to overwrite it", path)
+		}
+		tmp := path + ".restore"
+		if err := writeRestored(tmp, archive); err != nil {
+			return 0, err
+		}
+		restored[path] = tmp
+	}
+
+	n := 0
+	for path, tmp := range restored {
+		if path == messageDB {
+			// What the write-ahead log holds is of the database replaced.
+			os.Remove(path + "-wal")
+			os.Remove(path + "-shm")
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return n, err
+		}
+		delete(restored, path)
+		n++
+	}
+	return n, nil
+}
+
+func writeRestored(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bans are kept in BANS_FILE when set, saved on every change and loaded on start, so they
+// survive restarts. Besides sessions (see bans.go), whole networks can be banned by CIDR, e.g.
+// "203.0.113.0/24", or a single address: no request from them gets through, whichever session
+// it comes with, but for moderators and ADMIN_TOKEN. Either kind of ban may expire, after which
+// the bans.expire job lifts it. The admin API lists them with GET /api/admin/bans, adds one
+// with a POST of "session" or "cidr", and an optional "duration" and "reason", and lifts one
+// with a POST of either to /api/admin/bans/delete.
+
+var bansFile = os.Getenv("BANS_FILE")
+
+var (
+	errInvalidBan   = errors.New("Invalid ban: expected a session or a cidr, and a positive duration if any")
+	errBanModerator = errors.New("Moderators can't be banned")
+	errNotBanned    = errors.New("Not banned")
+)
+
+type AddressBan struct {
+	// Network banned, in CIDR notation. A single address is banned as a /32, or a /128.
+	CIDR string `json:"cidr"`
+	// Who issued the ban, a session or "admin". /api/admin/bans names sessions by handle.
+	By       string    `json:"by"`
+	BannedAt time.Time `json:"bannedAt"`
+	// When the ban lifts itself. Zero for never.
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+
+	network *net.IPNet
+}
+
+func (ban *AddressBan) expired(now time.Time) bool {
+	return !ban.ExpiresAt.IsZero() && !now.Before(ban.ExpiresAt)
+}
+
+// parseCIDR returns the network cidr, a CIDR or a single address, names.
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	if ip := net.ParseIP(cidr); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, errInvalidBan
+	}
+	return network, nil
+}
+
+// BanList is what BANS_FILE holds, and /api/admin/bans lists.
+type BanList struct {
+	Sessions  []savedBan    `json:"sessions"`
+	Addresses []*AddressBan `json:"addresses"`
+}
+
+// savedBan is a BanRecord with what ban evasion is detected from, see evasionScore.
+type savedBan struct {
+	BanRecord
+	IP          string `json:"ip,omitempty"`
+	Device      string `json:"device,omitempty"`
+	Hint        string `json:"hint,omitempty"`
+	HeaderPrint string `json:"headerPrint,omitempty"`
+	ASN         uint   `json:"asn,omitempty"`
+}
+
+// banListLocked returns every ban, latest first. Called with bansMu held.
+func (s *ChatServer) banListLocked() BanList {
+	list := BanList{Sessions: []savedBan{}, Addresses: []*AddressBan{}}
+	for _, ban := range s.bans {
+		list.Sessions = append(list.Sessions, savedBan{
+			BanRecord:   *ban,
+			IP:          ban.traits.ip,
+			Device:      ban.traits.device,
+			Hint:        ban.traits.hint,
+			HeaderPrint: ban.traits.headerPrint,
+			ASN:         ban.asn,
+		})
+	}
+	for _, ban := range s.addressBans {
+		list.Addresses = append(list.Addresses, ban)
+	}
+	sort.Slice(list.Sessions, func(i, j int) bool { return list.Sessions[i].BannedAt.After(list.Sessions[j].BannedAt) })
+	sort.Slice(list.Addresses, func(i, j int) bool { return list.Addresses[i].BannedAt.After(list.Addresses[j].BannedAt) })
+	return list
+}
+
+// saveBansLocked writes the bans to bansFile, if set. Called with bansMu held.
+func (s *ChatServer) saveBansLocked() {
+	if bansFile == "" {
+		return
+	}
+	if err := saveJSONFile(bansFile, s.banListLocked()); err != nil {
+		slog.Error("Could not save bans", "err", err)
+	}
+}
+
+// loadBans reads the bans saved in bansFile, if it exists.
+func (s *ChatServer) loadBans() error {
+	if bansFile == "" {
+		return nil
+	}
+	var saved BanList
+	if err := loadJSONFile(bansFile, &saved); err != nil {
+		return fmt.Errorf("%s: %w", bansFile, err)
+	}
+	s.bansMu.Lock()
+	defer s.bansMu.Unlock()
+	for _, ban := range saved.Sessions {
+		record := ban.BanRecord
+		record.traits = sessionTraits{ip: ban.IP, device: ban.Device, hint: ban.Hint, headerPrint: ban.HeaderPrint}
+		record.asn = ban.ASN
+		s.bans[record.SessionID] = &record
+	}
+	for _, ban := range saved.Addresses {
+		network, err := parseCIDR(ban.CIDR)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %w", bansFile, ban.CIDR, err)
+		}
+		ban.network = network
+		s.addressBans[network.String()] = ban
+	}
+	return nil
+}
+
+// banIssuer returns by, who issued a ban, as the admin API shows it: sessions by handle.
+func banIssuer(by string) string {
+	if by == "admin" || by == "spam" {
+		return by
+	}
+	return sessionHandle(by)
+}
+
+// bannedSession resolves a nickname, a session handle or a session identifier to a session, as
+// findSession does, or else to a banned session no longer known but from the ban list, such as
+// after a restart. It returns "" if none matches.
+func (s *ChatServer) bannedSession(nameOrID string) string {
+	if id := s.findSession(nameOrID); id != "" {
+		return id
+	}
+	s.bansMu.Lock()
+	defer s.bansMu.Unlock()
+	for id, ban := range s.bans {
+		if id == nameOrID || sessionHandle(id) == nameOrID || ban.Nickname == nameOrID {
+			return id
+		}
+	}
+	return ""
+}
+
+// unban lifts the ban of sessionID and returns it, if there was one.
+func (s *ChatServer) unban(sessionID string) (*BanRecord, bool) {
+	s.bansMu.Lock()
+	defer s.bansMu.Unlock()
+	ban, ok := s.bans[sessionID]
+	if ok {
+		delete(s.bans, sessionID)
+		s.saveBansLocked()
+	}
+	return ban, ok
+}
+
+// banAddress bans the network cidr for d, or for good if d is 0.
+func (s *ChatServer) banAddress(cidr, by, reason string, d time.Duration) (*AddressBan, error) {
+	network, err := parseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ban := &AddressBan{CIDR: network.String(), By: by, BannedAt: s.clock.Now(), Reason: reason, network: network}
+	if d > 0 {
+		ban.ExpiresAt = ban.BannedAt.Add(d)
+	}
+	s.bansMu.Lock()
+	s.addressBans[ban.CIDR] = ban
+	s.saveBansLocked()
+	s.bansMu.Unlock()
+	return ban, nil
+}
+
+// unbanAddress lifts the ban of the network cidr and reports whether there was one.
+func (s *ChatServer) unbanAddress(cidr string) bool {
+	network, err := parseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	s.bansMu.Lock()
+	defer s.bansMu.Unlock()
+	_, ok := s.addressBans[network.String()]
+	if ok {
+		delete(s.addressBans, network.String())
+		s.saveBansLocked()
+	}
+	return ok
+}
+
+// addressBanned reports whether ip is that of a banned session, or in a banned network.
+func (s *ChatServer) addressBanned(ip string) bool {
+	now := s.clock.Now()
+	s.bansMu.Lock()
+	for _, ban := range s.bans {
+		if ban.traits.ip == ip && !ban.expired(now) {
+			s.bansMu.Unlock()
+			return true
+		}
+	}
+	s.bansMu.Unlock()
+	return s.networkBanned(ip)
+}
+
+// expireBans lifts the bans that ran out.
+func (s *ChatServer) expireBans() {
+	now := s.clock.Now()
+	var lifted []string
+	s.bansMu.Lock()
+	for id, ban := range s.bans {
+		if ban.expired(now) {
+			delete(s.bans, id)
+			lifted = append(lifted, fmt.Sprintf("[%s]", escapeText(ban.Nickname)))
+		}
+	}
+	for cidr, ban := range s.addressBans {
+		if ban.expired(now) {
+			delete(s.addressBans, cidr)
+			lifted = append(lifted, "a network")
+		}
+	}
+	if len(lifted) > 0 {
+		s.saveBansLocked()
+	}
+	s.bansMu.Unlock()
+
+	for _, who := range lifted {
+		s.logModAction(fmt.Sprintf("The ban of %s expired", who))
+	}
+}
+
+// blockBannedAddresses answers the requests from banned networks, but for moderators' and those
+// presenting ADMIN_TOKEN, before they reach next.
+func (s *ChatServer) blockBannedAddresses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.networkBanned(clientIP(r)) {
+			token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			cookie, err := r.Cookie("session_id")
+			if !(bearer && validAdminToken(token)) && (err != nil || !s.isModerator(cookie.Value)) {
+				http.Error(w, "Your address is banned", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// networkBanned reports whether ip is in a banned network.
+func (s *ChatServer) networkBanned(ip string) bool {
+	address := net.ParseIP(ip)
+	if address == nil {
+		return false
+	}
+	now := s.clock.Now()
+	s.bansMu.Lock()
+	defer s.bansMu.Unlock()
+	for _, ban := range s.addressBans {
+		if ban.network.Contains(address) && !ban.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// adminBanDuration returns the duration of the ban r asks for, answering it if it is invalid.
+func adminBanDuration(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	value := r.FormValue("duration")
+	if value == "" {
+		return 0, true
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		http.Error(w, errInvalidBan.Error(), http.StatusBadRequest)
+		return 0, false
+	}
+	return d, true
+}
+
+// handleAdminBans lists the bans (GET) or adds one (POST).
+func (s *ChatServer) handleAdminBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		if !adminTokenAuthorized(r) {
+			http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		s.bansMu.Lock()
+		list := s.banListLocked()
+		s.bansMu.Unlock()
+		for i := range list.Sessions {
+			ban := &list.Sessions[i]
+			ban.SessionID, ban.By = sessionHandle(ban.SessionID), banIssuer(ban.By)
+		}
+		for i, ban := range list.Addresses {
+			shown := *ban
+			shown.By = banIssuer(ban.By)
+			list.Addresses[i] = &shown
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+	if !s.adminPost(w, r) {
+		return
+	}
+	d, ok := adminBanDuration(w, r)
+	if !ok {
+		return
+	}
+	reason := normalizeMessage(r.FormValue("reason"))
+
+	if cidr := r.FormValue("cidr"); cidr != "" {
+		ban, err := s.banAddress(cidr, "admin", reason, d)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.audit("admin", "ban.address", ban.CIDR, reason)
+		s.logModAction("A network was banned")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.FormValue("session") == "" {
+		http.Error(w, errInvalidBan.Error(), http.StatusBadRequest)
+		return
+	}
+	target := s.adminTarget(w, r)
+	if target == "" {
+		return
+	}
+	if err := s.adminBan("admin", target, reason, d); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminBan bans target for d, or for good if d is 0, done by actor through the admin API or the
+// control socket.
+func (s *ChatServer) adminBan(actor, target, reason string, d time.Duration) error {
+	if s.isModerator(target) {
+		return errBanModerator
+	}
+	s.banSession(target, actor, reason, d)
+	s.audit(actor, "ban", target, reason)
+	s.logModAction(fmt.Sprintf("[%s] was banned", escapeText(s.getNickname(target))))
+	s.sendPrivateMessage(target, Message{
+		Kind:    "text",
+		Content: "You have been banned. You can appeal once by sending a message to /appeal",
+	})
+	return nil
+}
+
+// handleAdminUnban lifts the ban of the "session" or the "cidr".
+func (s *ChatServer) handleAdminUnban(w http.ResponseWriter, r *http.Request) {
+	if !s.adminPost(w, r) {
+		return
+	}
+	if cidr := r.FormValue("cidr"); cidr != "" {
+		if !s.unbanAddress(cidr) {
+			http.NotFound(w, r)
+			return
+		}
+		s.audit("admin", "unban.address", cidr, "")
+		s.logModAction("A network was unbanned")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := s.adminUnban("admin", r.FormValue("session")); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminUnban lifts the ban of target, a session as bannedSession takes it, done by actor through
+// the admin API or the control socket.
+func (s *ChatServer) adminUnban(actor, target string) error {
+	ban, ok := s.unban(s.bannedSession(target))
+	if !ok {
+		return errNotBanned
+	}
+	s.audit(actor, "unban", ban.SessionID, "")
+	s.logModAction(fmt.Sprintf("[%s] was unbanned", escapeText(ban.Nickname)))
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestBansNameSessionsByHandle(t *testing.T) {
+	key, token := moderatorKey, adminToken
+	moderatorKey, adminToken = "test-key", "test-token"
+	t.Cleanup(func() { moderatorKey, adminToken = key, token })
+
+	s, srv := newTestServer(t)
+	mod, alice := srv.Connect(), srv.Connect()
+	mod.Send(";mod test-key")
+	mod.SetNickname("mod")
+	alice.SetNickname("alice")
+	modID, aliceID := s.findSession("mod"), s.findSession("alice")
+	handle := sessionHandle(aliceID)
+
+	mod.Send(";ban alice")
+	status, body := adminDo(t, srv, http.MethodGet, "/api/admin/bans", nil)
+	if status != http.StatusOK {
+		t.Fatalf("/api/admin/bans: %d %s", status, body)
+	}
+	var list struct {
+		Sessions []struct{ SessionID, By string }
+	}
+	json.Unmarshal([]byte(body), &list)
+	if strings.Contains(body, aliceID) || strings.Contains(body, modID) ||
+		len(list.Sessions) != 1 || list.Sessions[0].SessionID != handle || list.Sessions[0].By != sessionHandle(modID) {
+		t.Errorf("/api/admin/bans: %s, want alice banned by mod, by handle", body)
+	}
+
+	if status, body := adminDo(t, srv, http.MethodPost, "/api/admin/bans/delete", url.Values{"session": {handle}}); status != http.StatusNoContent {
+		t.Fatalf("unbanning by handle: %d %s", status, body)
+	}
+	if s.isBanned(aliceID) {
+		t.Fatal("alice still banned")
+	}
+
+	mod.Send(";ban alice")
+	mod.Send(";unban " + handle)
+	if s.isBanned(aliceID) {
+		t.Error(";unban by handle left alice banned")
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Heuristic weights used to decide whether a new session looks like a banned one.
+const (
+	evasionDeviceWeight      = 3
+	evasionHintWeight        = 2
+	evasionHeaderPrintWeight = 1
+	evasionIPWeight          = 2
+	evasionSubnetWeight      = 1
+	evasionASNWeight         = 1
+
+	// Score from which moderators are warned about a likely ban evader.
+	evasionWarnScore = 3
+)
+
+type sessionTraits struct {
+	// Address the session was last seen from.
+	ip string
+	// Long-lived device cookie the session was created under. Survives session cookie resets.
+	device string
+	// Fingerprint hint sent by the client in X-Fingerprint, if any.
+	hint string
+	// Hash of User-Agent and Accept-Language, used when the client sends no hint.
+	headerPrint string
+}
+
+type BanRecord struct {
+	// Session identifier of the banned user. /api/admin/bans names it, and By, by handle.
+	SessionID string `json:"sessionId"`
+	// Nickname the user had when banned.
+	Nickname string `json:"nickname"`
+	// Session identifier of the moderator who issued the ban, "admin" or "spam".
+	By string `json:"by"`
+	// When the ban was issued.
+	BannedAt time.Time `json:"bannedAt"`
+	// When the ban lifts itself. Zero for never.
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+	// Why, if the moderator said.
+	Reason string `json:"reason,omitempty"`
+
+	traits sessionTraits
+	asn    uint
+}
+
+func requestTraits(r *http.Request, device string) sessionTraits {
+	sum := sha256.Sum256([]byte(r.UserAgent() + "\n" + r.Header.Get("Accept-Language")))
+	return sessionTraits{
+		ip:          clientIP(r),
+		device:      device,
+		hint:        strings.TrimSpace(r.Header.Get("X-Fingerprint")),
+		headerPrint: hex.EncodeToString(sum[:8]),
+	}
+}
+
+// getOrCreateDevice returns the long-lived device cookie, setting a new one if the client has none.
+func (s *ChatServer) getOrCreateDevice(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie("device_id"); err == nil {
+		return cookie.Value
+	}
+
+	device := s.newID()
+	http.SetCookie(w, &http.Cookie{
+		Name:   "device_id",
+		Value:  device,
+		Path:   "/",
+		MaxAge: 365 * 24 * 60 * 60,
+	})
+	return device
+}
+
+func sameSubnet(a, b net.IP) bool {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil && b4 != nil {
+		return a4.Mask(net.CIDRMask(24, 32)).Equal(b4.Mask(net.CIDRMask(24, 32)))
+	}
+	return a.Mask(net.CIDRMask(48, 128)).Equal(b.Mask(net.CIDRMask(48, 128)))
+}
+
+// evasionScore rates how much traits (seen from an address in asn) look like the banned session,
+// along with the reasons that contributed.
+func evasionScore(traits sessionTraits, asn uint, ban *BanRecord) (int, []string) {
+	score := 0
+	var reasons []string
+
+	if traits.device != "" && traits.device == ban.traits.device {
+		score += evasionDeviceWeight
+		reasons = append(reasons, "same device cookie")
+	}
+	if traits.hint != "" && traits.hint == ban.traits.hint {
+		score += evasionHintWeight
+		reasons = append(reasons, "same client fingerprint")
+	} else if traits.headerPrint == ban.traits.headerPrint {
+		score += evasionHeaderPrintWeight
+		reasons = append(reasons, "same browser headers")
+	}
+
+	ip, banIP := net.ParseIP(traits.ip), net.ParseIP(ban.traits.ip)
+	switch {
+	case ip == nil || banIP == nil:
+	case ip.Equal(banIP):
+		score += evasionIPWeight
+		reasons = append(reasons, "same address")
+	case sameSubnet(ip, banIP):
+		score += evasionSubnetWeight
+		reasons = append(reasons, "same subnet")
+	case asn != 0 && asn == ban.asn:
+		score += evasionASNWeight
+		reasons = append(reasons, "same network provider")
+	}
+	return score, reasons
+}
+
+// isBanned reports whether sessionID is banned, or was last seen from the address of a banned
+// session or in a banned network (see banlist.go). Moderators are never banned by address.
+func (s *ChatServer) isBanned(sessionID string) bool {
+	now := s.clock.Now()
+	s.bansMu.Lock()
+	ban, ok := s.bans[sessionID]
+	s.bansMu.Unlock()
+	if ok && !ban.expired(now) {
+		return true
+	}
+
+	s.sessionFirstSeenMu.Lock()
+	ip := s.sessionTraits[sessionID].ip
+	s.sessionFirstSeenMu.Unlock()
+	if ip == "" || s.isModerator(sessionID) {
+		return false
+	}
+	return s.addressBanned(ip)
+}
+
+func (ban *BanRecord) expired(now time.Time) bool {
+	return !ban.ExpiresAt.IsZero() && !now.Before(ban.ExpiresAt)
+}
+
+func (s *ChatServer) asnOf(ip string) uint {
+	if info := s.geo.lookup(net.ParseIP(ip)); info != nil {
+		return info.ASN
+	}
+	return 0
+}
+
+// checkBanEvasion compares a newly seen session against every ban and warns moderators about the
+// closest match that scores high enough.
+func (s *ChatServer) checkBanEvasion(sessionID string, traits sessionTraits) {
+	asn := s.asnOf(traits.ip)
+
+	s.bansMu.Lock()
+	var best *BanRecord
+	var bestScore int
+	var bestReasons []string
+	for _, ban := range s.bans {
+		if score, reasons := evasionScore(traits, asn, ban); score > bestScore {
+			best, bestScore, bestReasons = ban, score, reasons
+		}
+	}
+	s.bansMu.Unlock()
+
+	if best == nil || bestScore < evasionWarnScore {
+		return
+	}
+
+	s.sessionFirstSeenMu.Lock()
+	s.evasionSuspects[sessionID] = best.SessionID
+	s.sessionFirstSeenMu.Unlock()
+
+	s.notifyModerators(Message{
+		Kind: "text",
+		Content: fmt.Sprintf("Heads up: session %s is likely the same as banned user [%s] (%s)",
+			sessionHandle(sessionID), escapeText(best.Nickname), strings.Join(bestReasons, ", ")),
+	})
+}
+
+// banSession bans sessionID for d, or for good if d is 0.
+func (s *ChatServer) banSession(sessionID, by, reason string, d time.Duration) {
+	s.sessionFirstSeenMu.Lock()
+	traits := s.sessionTraits[sessionID]
+	s.sessionFirstSeenMu.Unlock()
+
+	record := &BanRecord{
+		SessionID: sessionID,
+		Nickname:  s.getNickname(sessionID),
+		By:        by,
+		BannedAt:  s.clock.Now(),
+		Reason:    reason,
+		traits:    traits,
+		asn:       s.asnOf(traits.ip),
+	}
+	if d > 0 {
+		record.ExpiresAt = record.BannedAt.Add(d)
+	}
+
+	s.bansMu.Lock()
+	s.bans[sessionID] = record
+	s.saveBansLocked()
+	s.bansMu.Unlock()
+
+	// Each ban gets its own appeal.
+	s.appealsMu.Lock()
+	delete(s.appeals, sessionID)
+	s.appealsMu.Unlock()
+}
+
+func (s *ChatServer) handleBanCommand(sessionID string, args []string) {
+	if !s.isModerator(sessionID) {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Only moderators can use ;ban",
+		})
+		return
+	}
+
+	if len(args) != 1 && len(args) != 2 {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Usage: ;ban &lt;nickname|session&gt; [duration]",
+		})
+		return
+	}
+	var d time.Duration
+	if len(args) == 2 {
+		var err error
+		if d, err = time.ParseDuration(args[1]); err != nil || d <= 0 {
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Invalid duration, use something like 15m or 1h"})
+			return
+		}
+	}
+
+	target := s.modTarget(sessionID, "ban", args[0])
+	if target == "" {
+		return
+	}
+
+	s.banSession(target, sessionID, "", d)
+	length := "for good"
+	if d > 0 {
+		length = "for " + d.String()
+	}
+	s.audit(sessionID, "ban", target, length)
+	s.logModAction(fmt.Sprintf("[%s] was banned %s", escapeText(s.getNickname(target)), length))
+	s.sendPrivateMessage(target, Message{
+		Kind:    "text",
+		Content: "You have been banned. You can appeal once by sending a message to /appeal",
+	})
+	s.notifyModerators(Message{
+		Kind:    "text",
+		Content: fmt.Sprintf("[%s] banned [%s] (%s)", escapeText(s.getNickname(sessionID)), escapeText(s.getNickname(target)), sessionHandle(target)),
+	})
+}
+
+func (s *ChatServer) handleUnbanCommand(sessionID string, args []string) {
+	if !s.isModerator(sessionID) {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Only moderators can use ;unban",
+		})
+		return
+	}
+
+	if len(args) != 1 {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Usage: ;unban &lt;nickname|session&gt;",
+		})
+		return
+	}
+
+	target := s.bannedSession(args[0])
+	ban, ok := s.unban(target)
+	if !ok {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: fmt.Sprintf("%s is not banned", escapeText(args[0])),
+		})
+		return
+	}
+	s.audit(sessionID, "unban", target, "")
+	s.logModAction(fmt.Sprintf("[%s] was unbanned", escapeText(ban.Nickname)))
+	s.notifyModerators(Message{
+		Kind:    "text",
+		Content: fmt.Sprintf("[%s] unbanned [%s] (%s)", escapeText(s.getNickname(sessionID)), escapeText(ban.Nickname), sessionHandle(target)),
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Bots are ordinary sessions that register command prefixes such as !deploy. Messages starting
+// with a registered prefix are still broadcast as usual, and the bot additionally receives them
+// on its stream as private "command" events with the arguments split out, so it doesn't need to
+// parse every message in the room.
+
+var botPrefixPattern = regexp.MustCompile(`^![a-z0-9_-]{1,32}$`)
+
+var (
+	errInvalidBotPrefix = errors.New("Invalid prefix: must be ! followed by up to 32 lowercase letters, digits, - or _")
+	errBotPrefixTaken   = errors.New("Prefix already registered by another bot")
+	errBotPrefixUnknown = errors.New("Prefix not registered")
+	errBotPrefixForeign = errors.New("Only the bot that registered a prefix and moderators can remove it")
+)
+
+type BotCommand struct {
+	// Prefix the message started with, such as "!deploy".
+	Prefix string `json:"prefix"`
+	// Whitespace-separated words following the prefix.
+	Args []string `json:"args"`
+	// Text following the prefix, as sent.
+	Text string `json:"text"`
+}
+
+type BotRegistration struct {
+	Prefix      string `json:"prefix"`
+	Description string `json:"description,omitempty"`
+	// Session identifier of the bot.
+	Bot string `json:"bot"`
+	// Nickname of the bot.
+	Nickname string `json:"nickname"`
+}
+
+// registerBotCommand routes messages starting with prefix to the bot session.
+func (s *ChatServer) registerBotCommand(bot, prefix, description string) error {
+	prefix = strings.ToLower(prefix)
+	if !botPrefixPattern.MatchString(prefix) {
+		return errInvalidBotPrefix
+	}
+
+	s.botCommandsMu.Lock()
+	defer s.botCommandsMu.Unlock()
+	if existing, ok := s.botCommands[prefix]; ok && existing.Bot != bot {
+		return errBotPrefixTaken
+	}
+	s.botCommands[prefix] = &BotRegistration{Prefix: prefix, Description: description, Bot: bot}
+	return nil
+}
+
+// unregisterBotCommand removes prefix on behalf of `by`, which must be the bot or a moderator.
+func (s *ChatServer) unregisterBotCommand(by, prefix string) error {
+	moderator := s.isModerator(by)
+	prefix = strings.ToLower(prefix)
+
+	s.botCommandsMu.Lock()
+	defer s.botCommandsMu.Unlock()
+	registration, ok := s.botCommands[prefix]
+	if !ok {
+		return errBotPrefixUnknown
+	}
+	if registration.Bot != by && !moderator {
+		return errBotPrefixForeign
+	}
+	delete(s.botCommands, prefix)
+	return nil
+}
+
+// unregisterBot removes every prefix of bot.
+func (s *ChatServer) unregisterBot(bot string) {
+	s.botCommandsMu.Lock()
+	defer s.botCommandsMu.Unlock()
+	for prefix, registration := range s.botCommands {
+		if registration.Bot == bot {
+			delete(s.botCommands, prefix)
+		}
+	}
+}
+
+func (s *ChatServer) botRegistrations() []BotRegistration {
+	s.botCommandsMu.Lock()
+	registrations := make([]BotRegistration, 0, len(s.botCommands))
+	for _, registration := range s.botCommands {
+		registrations = append(registrations, *registration)
+	}
+	s.botCommandsMu.Unlock()
+
+	for i := range registrations {
+		registrations[i].Nickname = s.getNickname(registrations[i].Bot)
+	}
+	sort.Slice(registrations, func(i, j int) bool { return registrations[i].Prefix < registrations[j].Prefix })
+	return registrations
+}
+
+// routeBotCommand delivers message to the bot that registered its prefix, if any.
+func (s *ChatServer) routeBotCommand(message Message, text string) {
+	if !strings.HasPrefix(text, "!") {
+		return
+	}
+	prefix, rest, _ := strings.Cut(text, " ")
+	prefix = strings.ToLower(prefix)
+
+	s.botCommandsMu.Lock()
+	registration, ok := s.botCommands[prefix]
+	s.botCommandsMu.Unlock()
+	if !ok {
+		return
+	}
+
+	s.sendTo(registration.Bot, Message{
+		FromApp: true,
+		Author:  message.Author,
+		ID:      message.ID,
+		Kind:    "command",
+		Private: true,
+		Command: &BotCommand{Prefix: prefix, Args: strings.Fields(rest), Text: strings.TrimSpace(rest)},
+	})
+}
+
+// handleBotCommands lists registered prefixes (GET), registers "prefix" with an optional
+// "description" for the calling session (POST), or removes "prefix" (DELETE).
+func (s *ChatServer) handleBotCommands(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		r.ParseForm()
+		description := normalizeMessage(r.FormValue("description"))
+		if err := validateMessage(description); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch err := s.registerBotCommand(sessionID, r.FormValue("prefix"), description); err {
+		case nil:
+		case errBotPrefixTaken:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		switch err := s.unregisterBotCommand(sessionID, r.URL.Query().Get("prefix")); err {
+		case nil:
+		case errBotPrefixForeign:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.botRegistrations())
+}
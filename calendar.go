@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Anyone in the room can schedule an event with ;event. It is announced with Going, Maybe and
+// Can't go buttons, which keep a count on the announcement up to date, and people can also
+// respond with ;event rsvp or /rsvp. Whoever is going or might go is reminded shortly before it
+// starts, and told when it does. Times are in UTC, like automation schedules.
+
+const (
+	maxCalendarEvents = 100
+	maxEventTitle     = 200
+	// How long before an event starts its attendees are reminded.
+	eventReminderLead = 15 * time.Minute
+	// Events can't be scheduled further ahead than this.
+	maxEventHorizon = 365 * 24 * time.Hour
+	eventTimeLayout = "2006-01-02 15:04"
+)
+
+// A title, quoted when it has spaces, then a date and time.
+var eventCommandPattern = regexp.MustCompile(`^(?:"([^"]+)"|(\S+))\s+(\d{4}-\d{2}-\d{2} \d{2}:\d{2})$`)
+
+var (
+	errInvalidEvent  = errors.New("Invalid event: expected a title of at most 200 characters and a start time within the next year, as YYYY-MM-DD HH:MM in UTC")
+	errTooManyEvents = errors.New("Too many upcoming events: cancel some first")
+	errUnknownEvent  = errors.New("Event not found, or already started")
+	errInvalidRSVP   = errors.New("Invalid response: expected going, maybe or no")
+	errEventNotYours = errors.New("Only whoever scheduled an event, or a moderator, can cancel it")
+)
+
+var (
+	// Buttons of event announcements, their identifiers are the responses.
+	eventRSVPButtons  = []Component{{Type: "button", ID: "going", Label: "Going"}, {Type: "button", ID: "maybe", Label: "Maybe"}, {Type: "button", ID: "no", Label: "Can&#39;t go"}}
+	validRSVPResponse = map[string]bool{"going": true, "maybe": true, "no": true}
+)
+
+type RSVP struct {
+	Nickname string `json:"nickname"`
+	// "going", "maybe" or "no".
+	Response string    `json:"response"`
+	At       time.Time `json:"at"`
+}
+
+type CalendarEvent struct {
+	ID string `json:"id"`
+	// HTML-escaped title.
+	Title     string    `json:"title"`
+	Start     time.Time `json:"start"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Identifier of the message announcing it.
+	Message string `json:"message"`
+	// Responses, oldest first.
+	RSVPs []RSVP `json:"rsvps"`
+
+	createdBySession string
+	// Responses by session identifier.
+	rsvps    map[string]RSVP
+	reminded bool
+}
+
+// snapshot copies the event with its responses listed.
+func (event *CalendarEvent) snapshot() CalendarEvent {
+	copied := *event
+	copied.RSVPs = make([]RSVP, 0, len(event.rsvps))
+	for _, rsvp := range event.rsvps {
+		copied.RSVPs = append(copied.RSVPs, rsvp)
+	}
+	sort.Slice(copied.RSVPs, func(i, j int) bool { return copied.RSVPs[i].At.Before(copied.RSVPs[j].At) })
+	copied.rsvps = nil
+	return copied
+}
+
+// announcement is the content of the message announcing the event.
+func (event *CalendarEvent) announcement() string {
+	counts := map[string]int{}
+	for _, rsvp := range event.rsvps {
+		counts[rsvp.Response]++
+	}
+	return fmt.Sprintf("[%s] scheduled %s for %s UTC<br>%d going, %d maybe",
+		escapeText(event.CreatedBy), event.Title, event.Start.Format(eventTimeLayout), counts["going"], counts["maybe"])
+}
+
+// attendees returns the sessions going or maybe going to the event.
+func (event *CalendarEvent) attendees() []string {
+	var sessions []string
+	for sessionID, rsvp := range event.rsvps {
+		if rsvp.Response != "no" {
+			sessions = append(sessions, sessionID)
+		}
+	}
+	return sessions
+}
+
+func (s *ChatServer) upcomingEvents() []CalendarEvent {
+	s.calendarMu.Lock()
+	defer s.calendarMu.Unlock()
+	events := make([]CalendarEvent, 0, len(s.calendar))
+	for _, event := range s.calendar {
+		events = append(events, event.snapshot())
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+	return events
+}
+
+// scheduleEvent announces an event starting at start, as YYYY-MM-DD HH:MM in UTC.
+func (s *ChatServer) scheduleEvent(sessionID, title, start string) (CalendarEvent, error) {
+	if err := s.canPost(sessionID); err != nil {
+		return CalendarEvent{}, err
+	}
+	title = strings.TrimSpace(title)
+	at, err := time.ParseInLocation(eventTimeLayout, start, time.UTC)
+	now := s.clock.Now()
+	if err != nil || !at.After(now) || at.Sub(now) > maxEventHorizon ||
+		title == "" || utf8.RuneCountInString(title) > maxEventTitle || validateMessage(title) != nil {
+		return CalendarEvent{}, errInvalidEvent
+	}
+
+	event := &CalendarEvent{
+		ID:               s.newID(),
+		Title:            escapeText(title),
+		Start:            at,
+		CreatedBy:        s.getNickname(sessionID),
+		CreatedAt:        now,
+		createdBySession: sessionID,
+		rsvps:            map[string]RSVP{},
+	}
+	s.calendarMu.Lock()
+	if len(s.calendar) >= maxCalendarEvents {
+		s.calendarMu.Unlock()
+		return CalendarEvent{}, errTooManyEvents
+	}
+	s.calendar[event.ID] = event
+	s.calendarMu.Unlock()
+
+	message := s.broadcastMessage(Message{
+		FromApp:    true,
+		Kind:       "text",
+		Content:    event.announcement(),
+		Components: eventRSVPButtons,
+	})
+	id := event.ID
+	s.trackAppInteractive(message.ID, eventRSVPButtons, func(sessionID string, interaction Interaction) {
+		if _, err := s.respondToEvent(sessionID, id, interaction.Component); err != nil {
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: escapeText(err.Error())})
+		}
+	})
+
+	s.calendarMu.Lock()
+	event.Message = message.ID
+	snapshot := event.snapshot()
+	s.calendarMu.Unlock()
+	return snapshot, nil
+}
+
+// respondToEvent records whether sessionID is going to the event id, and updates its
+// announcement.
+func (s *ChatServer) respondToEvent(sessionID, id, response string) (CalendarEvent, error) {
+	if !validRSVPResponse[response] {
+		return CalendarEvent{}, errInvalidRSVP
+	}
+
+	s.calendarMu.Lock()
+	event, ok := s.calendar[id]
+	if !ok {
+		s.calendarMu.Unlock()
+		return CalendarEvent{}, errUnknownEvent
+	}
+	event.rsvps[sessionID] = RSVP{Nickname: s.getNickname(sessionID), Response: response, At: s.clock.Now()}
+	snapshot := event.snapshot()
+	content := event.announcement()
+	s.calendarMu.Unlock()
+
+	if snapshot.Message != "" {
+		s.broadcastUpdate(Message{FromApp: true, ID: snapshot.Message, Content: content, Components: eventRSVPButtons})
+	}
+	return snapshot, nil
+}
+
+// cancelEvent removes the event id. Only whoever scheduled it and moderators can.
+func (s *ChatServer) cancelEvent(sessionID, id string) error {
+	moderator := s.isModerator(sessionID)
+
+	s.calendarMu.Lock()
+	event, ok := s.calendar[id]
+	if !ok {
+		s.calendarMu.Unlock()
+		return errUnknownEvent
+	}
+	if event.createdBySession != sessionID && !moderator {
+		s.calendarMu.Unlock()
+		return errEventNotYours
+	}
+	delete(s.calendar, id)
+	attendees := event.attendees()
+	messageID := event.Message
+	s.calendarMu.Unlock()
+
+	content := fmt.Sprintf("Cancelled: %s, %s UTC", event.Title, event.Start.Format(eventTimeLayout))
+	if messageID != "" {
+		s.broadcastUpdate(Message{FromApp: true, ID: messageID, Content: content})
+	}
+	for _, attendee := range attendees {
+		s.queueNotice(attendee, Message{Kind: "text", Content: content})
+	}
+	return nil
+}
+
+// remindEvents reminds attendees of events starting soon, and lets them know when one starts.
+// Started events are forgotten.
+func (s *ChatServer) remindEvents() {
+	now := s.clock.Now()
+	notices := map[string][]string{}
+	var started []Message
+
+	s.calendarMu.Lock()
+	for id, event := range s.calendar {
+		switch {
+		case !now.Before(event.Start):
+			delete(s.calendar, id)
+			if event.Message != "" {
+				// RSVPs close, the announcement loses its buttons.
+				started = append(started, Message{FromApp: true, ID: event.Message, Content: event.announcement()})
+			}
+			for _, attendee := range event.attendees() {
+				notices[attendee] = append(notices[attendee], fmt.Sprintf("%s is starting now", event.Title))
+			}
+		case !event.reminded && event.Start.Sub(now) <= eventReminderLead:
+			event.reminded = true
+			for _, attendee := range event.attendees() {
+				notices[attendee] = append(notices[attendee], fmt.Sprintf("Reminder: %s starts in %s",
+					event.Title, event.Start.Sub(now).Round(time.Minute)))
+			}
+		}
+	}
+	s.calendarMu.Unlock()
+
+	for _, update := range started {
+		s.broadcastUpdate(update)
+	}
+	for sessionID, texts := range notices {
+		for _, text := range texts {
+			s.queueNotice(sessionID, Message{Kind: "text", Content: text})
+		}
+	}
+}
+
+func (s *ChatServer) handleEventCommand(sessionID string, text string) {
+	usage := Message{Kind: "text", Content: "Usage: ;event &quot;&lt;title&gt;&quot; YYYY-MM-DD HH:MM (UTC)|list|rsvp &lt;id&gt; going|maybe|no|cancel &lt;id&gt;"}
+	text = strings.TrimSpace(text)
+
+	if match := eventCommandPattern.FindStringSubmatch(text); match != nil {
+		if _, err := s.scheduleEvent(sessionID, match[1]+match[2], match[3]); err != nil {
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: escapeText(err.Error())})
+		}
+		return
+	}
+
+	args := strings.Fields(text)
+	if len(args) == 0 {
+		s.sendPrivateMessage(sessionID, usage)
+		return
+	}
+	var err error
+	switch strings.ToLower(args[0]) {
+	case "list":
+		messageContent := ""
+		for _, event := range s.upcomingEvents() {
+			going := 0
+			for _, rsvp := range event.RSVPs {
+				if rsvp.Response == "going" {
+					going++
+				}
+			}
+			messageContent += fmt.Sprintf("<br>(%s) %s, %s UTC, %d going", escapeText(event.ID), event.Title, event.Start.Format(eventTimeLayout), going)
+		}
+		if messageContent == "" {
+			messageContent = "<br>Nothing is scheduled"
+		}
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Upcoming events:" + messageContent})
+		return
+
+	case "rsvp":
+		if len(args) != 3 {
+			s.sendPrivateMessage(sessionID, usage)
+			return
+		}
+		if _, err = s.respondToEvent(sessionID, args[1], strings.ToLower(args[2])); err == nil {
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Response saved"})
+		}
+
+	case "cancel":
+		if len(args) != 2 {
+			s.sendPrivateMessage(sessionID, usage)
+			return
+		}
+		err = s.cancelEvent(sessionID, args[1])
+
+	default:
+		s.sendPrivateMessage(sessionID, usage)
+		return
+	}
+	if err != nil {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: escapeText(err.Error())})
+	}
+}
+
+// handleCalendar lists upcoming events, soonest first.
+func (s *ChatServer) handleCalendar(w http.ResponseWriter, r *http.Request) {
+	writePage(w, r, s.upcomingEvents(), func(e CalendarEvent) string { return timeKey(e.Start, e.ID) })
+}
+
+// handleRSVP records the "response" (going, maybe or no) of the session to the event "id".
+func (s *ChatServer) handleRSVP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+
+	r.ParseForm()
+	event, err := s.respondToEvent(sessionID, r.FormValue("id"), r.FormValue("response"))
+	switch err {
+	case nil:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(event)
+	case errUnknownEvent:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"alantern/chattest"
+)
+
+// How long the golden tests wait for the events of a conversation to come in.
+const settle = 100 * time.Millisecond
+
+// sequentialIDs returns an identifier generator counting from 1.
+func sequentialIDs() func() string {
+	var mu sync.Mutex
+	n := 0
+	return func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		n++
+		return fmt.Sprintf("id-%d", n)
+	}
+}
+
+// The session handles in golden files need the same key every run.
+func init() {
+	sessionHandleKey = []byte("alantern tests")
+}
+
+func newTestServer(t *testing.T, opts ...Option) (*ChatServer, *chattest.Server) {
+	t.Helper()
+	opts = append([]Option{WithIDGenerator(sequentialIDs())}, opts...)
+	s := NewChatServer(opts...)
+	t.Cleanup(s.hub.stop)
+	return s, chattest.NewServer(t, s.Handler())
+}
+
+func TestConversationGolden(t *testing.T) {
+	_, srv := newTestServer(t)
+	alice := srv.Connect()
+	alice.SetNickname("alice")
+	bob := srv.Connect()
+	bob.SetNickname("bob")
+
+	alice.Send("hello @bob, see https://example.com")
+	bob.Send(";whisper alice just you")
+	alice.Send(";color #ff0000")
+	alice.Send("<b>not bold</b>")
+
+	chattest.AssertGolden(t, "testdata/conversation-alice.golden", alice.Collect(settle))
+	chattest.AssertGolden(t, "testdata/conversation-bob.golden", bob.Collect(settle))
+}
+
+func TestRoomsGolden(t *testing.T) {
+	_, srv := newTestServer(t)
+	alice := srv.Connect()
+	alice.SetNickname("alice")
+	bob := srv.Connect()
+	bob.SetNickname("bob")
+	carol := srv.Connect()
+	carol.SetNickname("carol")
+
+	alice.Send(";room create games")
+	bob.Send(";join games")
+	bob.Send(";switch games")
+	bob.Send("anyone up for chess?")
+	alice.Send(";switch games")
+	alice.Send("sure")
+
+	chattest.AssertGolden(t, "testdata/rooms-bob.golden", bob.Collect(settle))
+	chattest.AssertGolden(t, "testdata/rooms-carol.golden", carol.Collect(settle))
+}
+
+func TestWhisperReachesOnlyItsRecipient(t *testing.T) {
+	_, srv := newTestServer(t)
+	alice, bob, carol := srv.Connect(), srv.Connect(), srv.Connect()
+	alice.SetNickname("alice")
+	bob.SetNickname("bob")
+	carol.SetNickname("carol")
+	bob.Collect(settle)
+	carol.Collect(settle)
+
+	alice.Send(";whisper bob psst")
+	bob.Expect(chattest.Private("psst"))
+	carol.ExpectNone(settle)
+}
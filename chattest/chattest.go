@@ -0,0 +1,441 @@
+// Package chattest runs an alantern server in memory for tests. It connects fake clients to the
+// server's event stream, sends messages on their behalf and checks the events they receive,
+// either one by one or against a golden file.
+//
+// The server itself lives in package main, so tests build the handler and pass it in:
+//
+//	srv := chattest.NewServer(t, NewChatServer(WithClock(clock)).Handler())
+//	alice, bob := srv.Connect(), srv.Connect()
+//	alice.Send("hello")
+//	bob.Expect(chattest.Text("hello"))
+package chattest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// How long Next and Expect wait for an event by default.
+const DefaultTimeout = 2 * time.Second
+
+// Events a client buffers before the stream stops being read.
+const eventBuffer = 256
+
+// Event is a decoded server event, mirroring the server's Message.
+type Event struct {
+	FromApp  bool    `json:"fromApp"`
+	Author   *Author `json:"author,omitempty"`
+	ID       string  `json:"id,omitempty"`
+	Kind     string  `json:"kind"`
+	Content  string  `json:"content"`
+	URL      string  `json:"url,omitempty"`
+	Private  bool    `json:"private"`
+	Origin   string  `json:"origin,omitempty"`
+	Messages []Event `json:"messages,omitempty"`
+	// Parts of a member's text message, unless it is all plain text.
+	Segments []Segment `json:"segments,omitempty"`
+	// Payload of kinds registered with registerKind.
+	Data json.RawMessage `json:"data,omitempty"`
+
+	// The event exactly as received.
+	Raw string `json:"-"`
+}
+
+// Segment is a part of a member's text message, see the server's segments.go.
+type Segment struct {
+	Type      string `json:"type"`
+	Text      string `json:"text"`
+	SessionID string `json:"sessionId,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+type Author struct {
+	ID       string `json:"id"`
+	Nickname string `json:"nickname"`
+	Color    string `json:"color"`
+}
+
+func (e Event) String() string {
+	who := "app"
+	if e.Author != nil {
+		who = e.Author.Nickname
+	}
+	return fmt.Sprintf("%s from %s (private: %t): %q", e.Kind, who, e.Private, e.Content)
+}
+
+// Server is a running in-memory server.
+type Server struct {
+	*httptest.Server
+	t testing.TB
+}
+
+// NewServer serves handler until the test ends.
+func NewServer(t testing.TB, handler http.Handler) *Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return &Server{Server: srv, t: t}
+}
+
+// Client is a fake browser with its own session.
+type Client struct {
+	srv    *Server
+	http   *http.Client
+	events chan Event
+	stop   func()
+}
+
+// NewClient returns a client that isn't connected to the event stream yet. Its session is created
+// by its first request.
+func (s *Server) NewClient() *Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		s.t.Fatalf("chattest: creating cookie jar: %v", err)
+	}
+	return &Client{srv: s, http: &http.Client{Jar: jar}}
+}
+
+// Connect returns a new client connected to the event stream.
+func (s *Server) Connect() *Client {
+	c := s.NewClient()
+	c.Connect()
+	return c
+}
+
+// Connect opens the client's event stream. It returns once the server has registered the client,
+// so events broadcast afterwards are guaranteed to reach it.
+func (c *Client) Connect() {
+	c.srv.t.Helper()
+	if c.stop != nil {
+		c.srv.t.Fatalf("chattest: client is already connected")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.srv.URL+"/events", nil)
+	if err != nil {
+		c.srv.t.Fatalf("chattest: %v", err)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.srv.t.Fatalf("chattest: connecting: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		c.srv.t.Fatalf("chattest: connecting: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	c.events = make(chan Event, eventBuffer)
+	c.stop = func() { resp.Body.Close() }
+	c.srv.t.Cleanup(c.Disconnect)
+
+	go func(events chan<- Event) {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			event := Event{Raw: data}
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				event.Kind = "undecodable"
+			}
+			events <- event
+		}
+	}(c.events)
+}
+
+// Disconnect closes the event stream, if open.
+func (c *Client) Disconnect() {
+	if c.stop != nil {
+		c.stop()
+		c.stop = nil
+	}
+}
+
+// Do sends a request as the client and returns the status code and body.
+func (c *Client) Do(method, path string, form url.Values) (int, string) {
+	c.srv.t.Helper()
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, c.srv.URL+path, body)
+	if err != nil {
+		c.srv.t.Fatalf("chattest: %v", err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return c.roundTrip(req)
+}
+
+// Get sends a GET request as the client and returns the response, whose body is already read
+// and closed, with the body.
+func (c *Client) Get(path string) (*http.Response, string) {
+	c.srv.t.Helper()
+	resp, err := c.http.Get(c.srv.URL + path)
+	if err != nil {
+		c.srv.t.Fatalf("chattest: GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.srv.t.Fatalf("chattest: reading %s response: %v", path, err)
+	}
+	return resp, string(data)
+}
+
+func (c *Client) roundTrip(req *http.Request) (int, string) {
+	c.srv.t.Helper()
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.srv.t.Fatalf("chattest: %s %s: %v", req.Method, req.URL.Path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.srv.t.Fatalf("chattest: reading %s response: %v", req.URL.Path, err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+// Send sends a message or command, failing the test if the server rejects it.
+func (c *Client) Send(message string) {
+	c.srv.t.Helper()
+	if status, body := c.Do(http.MethodPost, "/send", url.Values{"message": {message}}); status != http.StatusOK {
+		c.srv.t.Fatalf("chattest: sending %q: %d %s", message, status, strings.TrimSpace(body))
+	}
+}
+
+// SetNickname sets the client's nickname, failing the test if the server rejects it.
+func (c *Client) SetNickname(nickname string) {
+	c.srv.t.Helper()
+	if status, body := c.Do(http.MethodPost, "/set-nickname", url.Values{"nickname": {nickname}}); status != http.StatusOK {
+		c.srv.t.Fatalf("chattest: setting nickname %q: %d %s", nickname, status, strings.TrimSpace(body))
+	}
+}
+
+// Upload uploads an image and returns the status code and body.
+func (c *Client) Upload(data []byte, public bool) (int, string) {
+	c.srv.t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("image", "image")
+	if err == nil {
+		_, err = part.Write(data)
+	}
+	if err == nil && public {
+		err = mw.WriteField("public", "true")
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	if err != nil {
+		c.srv.t.Fatalf("chattest: building upload: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.srv.URL+"/upload-image", &body)
+	if err != nil {
+		c.srv.t.Fatalf("chattest: %v", err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return c.roundTrip(req)
+}
+
+// Next returns the next event, failing the test if none arrives within timeout.
+func (c *Client) Next(timeout time.Duration) Event {
+	c.srv.t.Helper()
+	if c.events == nil {
+		c.srv.t.Fatalf("chattest: client isn't connected")
+	}
+	select {
+	case event, ok := <-c.events:
+		if !ok {
+			c.srv.t.Fatalf("chattest: event stream closed")
+		}
+		return event
+	case <-time.After(timeout):
+		c.srv.t.Fatalf("chattest: no event within %s", timeout)
+	}
+	return Event{}
+}
+
+// Matcher checks a single event, returning a description of the mismatch or "".
+type Matcher func(Event) string
+
+// Kind matches any event of the given kind.
+func Kind(kind string) Matcher {
+	return func(e Event) string {
+		if e.Kind != kind {
+			return fmt.Sprintf("want a %s event", kind)
+		}
+		return ""
+	}
+}
+
+// Text matches a public text message with the given content.
+func Text(content string) Matcher {
+	return func(e Event) string {
+		if e.Kind != "text" || e.Private || e.Content != content {
+			return fmt.Sprintf("want public text %q", content)
+		}
+		return ""
+	}
+}
+
+// Private matches a private text message containing substr.
+func Private(substr string) Matcher {
+	return func(e Event) string {
+		if e.Kind != "text" || !e.Private || !strings.Contains(e.Content, substr) {
+			return fmt.Sprintf("want a private message containing %q", substr)
+		}
+		return ""
+	}
+}
+
+// From matches a message written by the given nickname.
+func From(nickname string) Matcher {
+	return func(e Event) string {
+		if e.Author == nil || e.Author.Nickname != nickname {
+			return fmt.Sprintf("want a message from %s", nickname)
+		}
+		return ""
+	}
+}
+
+// All matches events matched by every one of matchers.
+func All(matchers ...Matcher) Matcher {
+	return func(e Event) string {
+		for _, m := range matchers {
+			if problem := m(e); problem != "" {
+				return problem
+			}
+		}
+		return ""
+	}
+}
+
+// bookkeeping reports whether e is a presence update or resume token, which Expect, ExpectNone and
+// Collect skip: their timing depends on the scheduler and each connection gets its own token.
+func bookkeeping(e Event) bool {
+	return e.Kind == "viewers" || e.Kind == "resume"
+}
+
+// Expect reads one event per matcher and fails the test at the first one that doesn't match.
+// Presence updates and resume tokens are skipped.
+func (c *Client) Expect(matchers ...Matcher) []Event {
+	c.srv.t.Helper()
+	events := make([]Event, 0, len(matchers))
+	for i, m := range matchers {
+		event := c.Next(DefaultTimeout)
+		for bookkeeping(event) {
+			event = c.Next(DefaultTimeout)
+		}
+		if problem := m(event); problem != "" {
+			c.srv.t.Fatalf("chattest: event %d: %s, got %s", i, problem, event)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// ExpectNone fails the test if an event other than a presence update or resume token arrives
+// within d.
+func (c *Client) ExpectNone(d time.Duration) {
+	c.srv.t.Helper()
+	deadline := time.After(d)
+	for {
+		select {
+		case event, ok := <-c.events:
+			if ok && !bookkeeping(event) {
+				c.srv.t.Fatalf("chattest: unexpected event %s", event)
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// Collect returns every event received within d, presence updates and resume tokens excepted.
+func (c *Client) Collect(d time.Duration) []Event {
+	var events []Event
+	deadline := time.After(d)
+	for {
+		select {
+		case event, ok := <-c.events:
+			if !ok {
+				return events
+			}
+			if !bookkeeping(event) {
+				events = append(events, event)
+			}
+		case <-deadline:
+			return events
+		}
+	}
+}
+
+// AssertGolden compares events to the golden file at path, ignoring identifiers, colours and
+// URLs which change from run to run. Setting CHATTEST_UPDATE rewrites the file instead.
+func AssertGolden(t testing.TB, path string, events []Event) {
+	t.Helper()
+	got, err := json.MarshalIndent(normalize(events), "", "  ")
+	if err != nil {
+		t.Fatalf("chattest: %v", err)
+	}
+	got = append(got, '\n')
+
+	if os.Getenv("CHATTEST_UPDATE") != "" {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatalf("chattest: updating golden file: %v", err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("chattest: reading golden file (set CHATTEST_UPDATE to create it): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("chattest: events differ from %s\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func normalize(events []Event) []Event {
+	out := make([]Event, len(events))
+	for i, e := range events {
+		if e.ID != "" {
+			e.ID = "*"
+		}
+		if e.URL != "" {
+			e.URL = "*"
+		}
+		if e.Kind == "image" {
+			e.Content = "*"
+		}
+		if e.Author != nil {
+			author := *e.Author
+			author.ID, author.Color = "*", "*"
+			e.Author = &author
+		}
+		if e.Messages != nil {
+			e.Messages = normalize(e.Messages)
+		}
+		out[i] = e
+	}
+	return out
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// "alantern check" takes serve's flags and settings and goes through what the server would do
+// to start, without starting it or changing what it saved: the settings, the saved files and
+// room templates, whether the files can be written, the message database, the TLS certificate,
+// and whether the services it talks to (the relay upstream, federated peers, the LLM, Sentry and
+// the archive sinks) answer. It prints a line per check and exits with 1 if any failed, saying what to fix, so that
+// it can run before a deployment or restart.
+
+// How long check waits for a service to answer.
+const checkTimeout = 5 * time.Second
+
+// Certificates expiring sooner than this are reported.
+const certificateRenewal = 14 * 24 * time.Hour
+
+func check(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	options := serverFlags(flags)
+	flags.Parse(args)
+
+	failed := 0
+	report := func(name string, err error) {
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %v\n", name, err)
+			return
+		}
+		fmt.Printf("ok    %s\n", name)
+	}
+
+	report("logging", checkLogging(*options.logLevel, *options.logFormat, *options.logFile))
+	report("tls", checkTLS())
+	report("sentry", loadCrashReporter())
+	if *options.dataDir != "" {
+		setDataDir(*options.dataDir)
+		report("data directory", checkWritable(*options.dataDir))
+	}
+	report("storage", checkStorage())
+
+	server := NewChatServer()
+	for _, step := range server.startupSteps() {
+		report(step.name, step.run())
+	}
+	report("message database", checkMessageDB())
+	for _, a := range server.archivers {
+		if sink, ok := a.sink.(*fileSink); ok {
+			report("archive sink "+a.name, checkWritable(filepath.Dir(sink.path)))
+		}
+	}
+	if legalHold && archiveSpool != "" {
+		report("archive spool", checkWritable(archiveSpool))
+	}
+
+	for _, service := range server.checkedServices() {
+		report(service.name, checkReachable(service.url))
+	}
+
+	if failed > 0 {
+		fmt.Printf("\n%d of the checks failed, the server would not start or work as set up\n", failed)
+		os.Exit(1)
+	}
+}
+
+// checkLogging checks the logging settings, which setupLogging would use.
+func checkLogging(level, format, file string) error {
+	if _, ok := logLevels[level]; !ok {
+		return errInvalidLogLevel
+	}
+	if format != "text" && format != "json" {
+		return errInvalidLogFormat
+	}
+	if file != "" {
+		if info, err := os.Stat(file); err == nil && info.IsDir() {
+			return fmt.Errorf("%s is a directory", file)
+		} else if _, err := os.Stat(filepath.Dir(file)); err != nil {
+			return fmt.Errorf("%s can't be created: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// checkTLS checks that the certificate, if any, loads with its key and is valid for a while yet.
+func checkTLS() error {
+	if err := validateTLS(); err != nil {
+		return err
+	}
+	if tlsCertFile == "" {
+		return nil
+	}
+	pair, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return fmt.Errorf("%s and %s: %w", tlsCertFile, tlsKeyFile, err)
+	}
+	certificate, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("%s: %w", tlsCertFile, err)
+	}
+	now := time.Now()
+	switch {
+	case now.Before(certificate.NotBefore):
+		return fmt.Errorf("%s is not valid before %s", tlsCertFile, certificate.NotBefore.Format(time.RFC3339))
+	case now.After(certificate.NotAfter):
+		return fmt.Errorf("%s expired on %s, renew it", tlsCertFile, certificate.NotAfter.Format(time.RFC3339))
+	case now.Add(certificateRenewal).After(certificate.NotAfter):
+		return fmt.Errorf("%s expires on %s, renew it", tlsCertFile, certificate.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkStorage checks that the server can write where it saves files.
+func checkStorage() error {
+	for _, file := range savedFiles() {
+		if *file.path == "" || (file.path == &autocertCache && autocertHosts == "") {
+			continue
+		}
+		dir := filepath.Dir(*file.path)
+		if file.path == &autocertCache {
+			dir = *file.path
+		}
+		if err := checkWritable(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWritable checks that files can be created in dir, or in the closest of its parents that
+// exists if the server has to create it, leaving nothing behind.
+func checkWritable(dir string) error {
+	existing := dir
+	for {
+		info, err := os.Stat(existing)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%s is not a directory", existing)
+			}
+			break
+		}
+		parent := filepath.Dir(existing)
+		if !os.IsNotExist(err) || parent == existing {
+			return fmt.Errorf("%s can't be created: %w", dir, err)
+		}
+		existing = parent
+	}
+	probe, err := os.CreateTemp(existing, ".check-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", existing, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return nil
+}
+
+// checkMessageDB checks that MESSAGE_DB, if set and already there, can be read. It is opened read
+// only, so that check neither creates it nor changes its tables.
+func checkMessageDB() error {
+	if messageDB == "" || relayUpstream != "" {
+		return nil
+	}
+	if _, err := os.Stat(messageDB); os.IsNotExist(err) {
+		return nil
+	}
+	path, err := filepath.Abs(messageDB)
+	if err != nil {
+		return err
+	}
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	db, err := sql.Open("sqlite", (&url.URL{Scheme: "file", Path: path, RawQuery: "mode=ro"}).String())
+	if err != nil {
+		return fmt.Errorf("%s: %w", messageDB, err)
+	}
+	store := &sqliteStore{db: db}
+	defer store.Close()
+	if _, err := store.Recent(1); err != nil {
+		return fmt.Errorf("%s: %w", messageDB, err)
+	}
+	return nil
+}
+
+type checkedService struct {
+	name, url string
+}
+
+// checkedServices returns the services the server is set up to talk to over HTTP.
+func (s *ChatServer) checkedServices() []checkedService {
+	var services []checkedService
+	if relayUpstream != "" {
+		services = append(services, checkedService{"relay upstream", relayUpstream})
+	}
+	if federation := loadFederationConfig(); federation != nil {
+		for _, peer := range federation.peers {
+			services = append(services, checkedService{"federation peer " + peer, peer})
+		}
+	}
+	if dailySummary == "llm" {
+		services = append(services, checkedService{"summary llm", os.Getenv("SUMMARY_LLM_URL")})
+	}
+	if crashes != nil {
+		services = append(services, checkedService{"sentry endpoint", crashes.endpoint})
+	}
+	for _, a := range s.archivers {
+		switch sink := a.sink.(type) {
+		case *s3Sink:
+			services = append(services, checkedService{"archive sink " + a.name, sink.base})
+		case *kafkaSink:
+			services = append(services, checkedService{"archive sink " + a.name, sink.url})
+		}
+	}
+	return services
+}
+
+// checkReachable checks that the server at target answers, whatever it answers.
+func checkReachable(target string) error {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("expected an http or https URL")
+	}
+	client := &http.Client{Timeout: checkTimeout}
+	resp, err := client.Head(target)
+	if err != nil {
+		return fmt.Errorf("%s does not answer, check the URL and that it is up: %w", u.Host, err)
+	}
+	resp.Body.Close()
+	return nil
+}
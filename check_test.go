@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckChangesNothing(t *testing.T) {
+	dir := t.TempDir()
+	saved := messageDB
+	t.Cleanup(func() { messageDB = saved })
+	messageDB = filepath.Join(dir, "data", "messages.db")
+
+	if err := checkWritable(filepath.Dir(messageDB)); err != nil {
+		t.Fatalf("checkWritable: %v", err)
+	}
+	if err := checkMessageDB(); err != nil {
+		t.Fatalf("checkMessageDB without a database: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(messageDB)); !os.IsNotExist(err) {
+		t.Fatalf("check created %s", filepath.Dir(messageDB))
+	}
+
+	os.Mkdir(filepath.Dir(messageDB), 0o755)
+	store, err := openSQLiteStore(messageDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(Message{ID: "id-1", Kind: "text", Content: "hello"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	before, _ := os.ReadFile(messageDB)
+	if err := checkMessageDB(); err != nil {
+		t.Fatalf("checkMessageDB: %v", err)
+	}
+	if after, _ := os.ReadFile(messageDB); string(after) != string(before) {
+		t.Fatal("check changed the message database")
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// The alantern command runs the server with "serve", the default when no command is given, so that
+// "alantern -selftest" still works. "check" takes the same flags and settings, and reports what
+// would keep the server from starting or working, see check.go. "backup" and "restore" archive and
+// bring back what it saved, see backup.go, and "user" and "room" manage it while it runs, see
+// ops.go, as "ctl" does through the control socket, see ctl.go. "snapshot" saves the history of a
+// room as a static site, see snapshot.go, "verify" checks it or the archive, see legalhold.go, and
+// "service" runs it as a service of the system, see service.go. "version" prints the build, and
+// "gen-config" an environment file listing every setting with its default, to start a deployment
+// from. The settings of serve's flags can still be given in the environment, which they default to.
+
+// Set at build time with -ldflags "-X main.version=v1.2.3".
+var version = "dev"
+
+// Where the server listens, from serve's -bind and -port.
+var (
+	bindAddress = envOr("BIND_ADDRESS", "0.0.0.0")
+	port        = envOr("PORT", "8080")
+)
+
+const cliUsage = `Usage: alantern [command] [flags]
+
+Commands:
+  serve       run the server (the default)
+  check       check the settings, files and services the server needs, and exit
+  backup      archive what the server saved
+  restore     bring back what the server saved from an archive, with it stopped
+  user        list, rename, kick, ban or unban sessions of the running server
+  room        list the rooms of the running server, or post in them
+  ctl         make a request to the control socket of the running server
+  snapshot    save the history of a room of the running server as a static site
+  verify      check the hashes of a snapshot or of archive files taken under legal hold
+  service     install the server as a Windows, launchd or systemd service, or manage it
+  version     print the version
+  gen-config  print an environment file with every setting and its default
+
+Run alantern <command> -h for the flags of a command.
+`
+
+func main() {
+	args := os.Args[1:]
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "serve":
+		serve(args)
+	case "check":
+		check(args)
+	case "backup":
+		backup(args)
+	case "restore":
+		restore(args)
+	case "user":
+		user(args)
+	case "room":
+		room(args)
+	case "ctl":
+		ctl(args)
+	case "service":
+		service(args)
+	case "snapshot":
+		snapshot(args)
+	case "verify":
+		verify(args)
+	case "version":
+		printVersion(os.Stdout)
+	case "gen-config":
+		genConfig(args)
+	case "help":
+		fmt.Print(cliUsage)
+	default:
+		fmt.Printf("Unknown command %q\n\n%s", command, cliUsage)
+		os.Exit(2)
+	}
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func printVersion(w io.Writer) {
+	revision := ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+				revision = " " + setting.Value[:12]
+			}
+		}
+	}
+	fmt.Fprintf(w, "alantern %s%s (%s, %s/%s)\n", version, revision, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// useDataDir keeps everything the server saves in dir, unless a file of its own was given.
+func useDataDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	setDataDir(dir)
+	return nil
+}
+
+// setDataDir points the settings of the saved files at dir, without creating it.
+func setDataDir(dir string) {
+	for _, file := range savedFiles() {
+		if *file.path == "" {
+			*file.path = filepath.Join(dir, file.name)
+		}
+	}
+	if controlSocket == "" {
+		controlSocket = dataDirControlSocket(dir)
+	}
+	if archiveSpool == "" {
+		archiveSpool = filepath.Join(dir, "archive-spool")
+	}
+}
+
+// dataDirControlSocket returns the control socket in the data directory dir, see ctl.go.
+func dataDirControlSocket(dir string) string {
+	return filepath.Join(dir, "control.sock")
+}
+
+type savedFile struct {
+	// Setting of the file, and its name in the data directory.
+	path *string
+	name string
+}
+
+// savedFiles returns the files the server saves to.
+func savedFiles() []savedFile {
+	return []savedFile{
+		{&automationFile, "automation.json"},
+		{&preferencesFile, "preferences.json"},
+		{&snippetFile, "snippets.json"},
+		{&todoFile, "todos.json"},
+		{&welcomeFile, "welcome.json"},
+		{&bansFile, "bans.json"},
+		{&uiBundleFile, "ui.zip"},
+		{&messageDB, "messages.db"},
+		{&autocertCache, "autocert"},
+	}
+}
+
+type serverOptions struct {
+	dataDir, logLevel, logFormat, logFile *string
+}
+
+// serverFlags adds the flags setting up the server to flags, for serve and check.
+func serverFlags(flags *flag.FlagSet) serverOptions {
+	flags.StringVar(&port, "port", port, "port to listen on ($PORT)")
+	flags.StringVar(&bindAddress, "bind", bindAddress, "address to listen on ($BIND_ADDRESS)")
+	flags.StringVar(&tlsCertFile, "tls-cert", tlsCertFile, "certificate file to serve HTTPS with, with -tls-key ($TLS_CERT_FILE)")
+	flags.StringVar(&tlsKeyFile, "tls-key", tlsKeyFile, "key file of -tls-cert ($TLS_KEY_FILE)")
+	flags.StringVar(&autocertHosts, "autocert", autocertHosts, "comma-separated hosts to serve HTTPS for with Let's Encrypt certificates ($AUTOCERT_HOSTS)")
+	return serverOptions{
+		dataDir:   flags.String("data-dir", os.Getenv("DATA_DIR"), "directory to keep saved files and the message database in, unless set one by one ($DATA_DIR)"),
+		logLevel:  flags.String("log-level", envOr("LOG_LEVEL", "info"), "debug, info, warn or error ($LOG_LEVEL)"),
+		logFormat: flags.String("log-format", envOr("LOG_FORMAT", "text"), "text, or json for log aggregation ($LOG_FORMAT)"),
+		logFile:   flags.String("log-file", os.Getenv("LOG_FILE"), "file to append the log to, instead of standard output ($LOG_FILE)"),
+	}
+}
+
+type configVar struct {
+	name, value, help string
+}
+
+// configVars returns the settings read from the environment, with their defaults.
+func configVars() []configVar {
+	return []configVar{
+		{"PORT", "8080", "Port to listen on, or -port."},
+		{"BIND_ADDRESS", "0.0.0.0", "Address to listen on, or -bind."},
+		{"DATA_DIR", "", "Directory the files below default to, or -data-dir."},
+		{"LOG_LEVEL", "info", "debug, info, warn or error, or -log-level."},
+		{"LOG_FORMAT", "text", "text, or json for log aggregation, or -log-format."},
+		{"LOG_FILE", "", "File to append the log to instead of standard output, or -log-file."},
+		{"TLS_CERT_FILE", "", "Certificate to serve HTTPS with, or -tls-cert."},
+		{"TLS_KEY_FILE", "", "Key of TLS_CERT_FILE, or -tls-key."},
+		{"AUTOCERT_HOSTS", "", "Comma-separated hosts to get Let's Encrypt certificates for, or -autocert."},
+		{"AUTOCERT_EMAIL", "", "Address Let's Encrypt writes to about the certificates."},
+		{"AUTOCERT_CACHE", "autocert", "Directory keeping the certificates."},
+		{"AUTOCERT_HTTP_PORT", "80", "Port answering Let's Encrypt's checks, or off."},
+		{"MODERATOR_KEY", "", "Key moderators log in with, with ;mod."},
+		{"OWNER_KEY", "", "Key the owner claims the server with, with ;claim."},
+		{"ADMIN_TOKEN", "", "Bearer token for /api/admin and /metrics."},
+		{"CONTROL_SOCKET", "control.sock", "Unix socket alantern ctl manages the server through, or off."},
+		{"CONTENT_SECURITY_POLICY", "", "Content Security Policy of the chat page, instead of the default."},
+		{"FRAME_ANCESTORS", "'self'", "Sites that may embed the chat page, as in a CSP, e.g. 'self' https://example.com."},
+		{"REFERRER_POLICY", "same-origin", "Referrer-Policy of every response."},
+		{"IMAGE_URL_SECRET", "", "Key signing image URLs, random on each start unless set."},
+		{"HISTORY_SIZE", fmt.Sprint(defaultHistorySize), "Events new streams start with."},
+		{"CLIENT_BUFFER", fmt.Sprint(defaultClientBuffer), "Events queued per stream before it misses some."},
+		{"SLOW_CLIENT_POLICY", "", `"disconnect" to close streams whose queue is full.`},
+		{"SLOW_REQUEST_THRESHOLD", defaultSlowRequest.String(), "Requests and commands taking longer are logged and counted as slow."},
+		{"SSE_HEARTBEAT", defaultHeartbeatInterval.String(), "How often idle streams get a ping."},
+		{"MESSAGE_RATE", fmt.Sprint(defaultMessageRate), "Messages each member may send a second, after MESSAGE_BURST."},
+		{"MESSAGE_BURST", fmt.Sprint(defaultMessageBurst), "Messages each member may send at once."},
+		{"SPAM_WINDOW", defaultSpamWindow.String(), "Window SPAM_STRIKES messages over the rate limits must come in to be an offence."},
+		{"SPAM_STRIKES", fmt.Sprint(defaultSpamStrikes), "Messages over the rate limits making an offence."},
+		{"SPAM_PENALTY", defaultSpamPenalty.String(), "How long spam mutes and bans last, unless their step says."},
+		{"SPAM_ESCALATION", defaultSpamEscalation, "Comma-separated warn, mute and ban steps for offences in turn, e.g. warn,mute:10m,ban:24h."},
+		{"IP_MESSAGE_RATE", fmt.Sprint(defaultAddressMessageRate), "Messages each address may send a second, after IP_MESSAGE_BURST."},
+		{"IP_MESSAGE_BURST", fmt.Sprint(defaultAddressMessageBurst), "Messages each address may send at once."},
+		{"IP_UPLOADS_PER_MINUTE", fmt.Sprint(defaultAddressUploads), "Images each address may upload a minute."},
+		{"IP_MAX_STREAMS", fmt.Sprint(defaultAddressStreams), "Event streams each address may have open at once."},
+		{"TRUSTED_PROXIES", "", "Comma-separated addresses or CIDRs of reverse proxies whose X-Forwarded-For is believed."},
+		{"JOIN_RATE", fmt.Sprint(defaultJoinRate), "Streams let in per second when many connect at once."},
+		{"JOIN_BURST", fmt.Sprint(defaultJoinBurst), "Streams let in at once before JOIN_RATE applies."},
+		{"LIVESTREAM_MODE", "", "Set to start with livestream mode on."},
+		{"LIVESTREAM_MAX_RATE", fmt.Sprint(defaultLivestreamMaxRate), "Messages per second shown in livestream mode."},
+		{"MAX_PINS", fmt.Sprint(defaultMaxPins), "Pins per room."},
+		{"ANIMATION_MAX_MB", fmt.Sprint(defaultAnimationMaxMB), "Largest animated image."},
+		{"ANIMATION_MAX_FRAMES", fmt.Sprint(defaultAnimationMaxFrames), "Most frames of an animated image."},
+		{"ANIMATIONS_PER_MINUTE", fmt.Sprint(defaultAnimationsPerMin), "Animated images each member may post a minute."},
+		{"STORAGE_QUOTA_MB", fmt.Sprint(defaultStorageQuotaMB), "Room for uploaded images."},
+		{"PROXY_DOMAINS", "", "Comma-separated sites the media proxy fetches from."},
+		{"PROXY_MAX_MB", fmt.Sprint(defaultProxyMaxMB), "Largest image the media proxy fetches."},
+		{"PROXY_CACHE_MB", fmt.Sprint(defaultProxyCacheMB), "Media proxy cache size."},
+		{"MAP_TILE_URL", "", "Map tile URL template, with {z}, {x} and {y}, shown with shared locations."},
+		{"PREVIEW_CACHE_MB", fmt.Sprint(defaultPreviewCacheMB), "Link preview cache size."},
+		{"MESSAGE_DB", "", "SQLite database keeping logged events across restarts."},
+		{"MESSAGE_RETENTION", defaultMessageRetention.String(), "How long stored events are kept."},
+		{"LEGAL_HOLD", "", "Set to keep everything deleted in the archive sinks, suspend retention and hash exports."},
+		{"ARCHIVE_SINKS", "", "Comma-separated file://, s3:// and kafka+http(s):// sinks logged messages are archived to."},
+		{"ARCHIVE_FLUSH", defaultArchiveFlush.String(), "How often messages are sent to the archive sinks."},
+		{"ARCHIVE_FILE_MB", fmt.Sprint(defaultArchiveFileMB), "Size file sinks are rotated at."},
+		{"AWS_REGION", "us-east-1", "Region of s3:// archive sinks, unless they say."},
+		{"AWS_ACCESS_KEY_ID", "", "Access key of s3:// archive sinks."},
+		{"AWS_SECRET_ACCESS_KEY", "", "Secret key of s3:// archive sinks."},
+		{"AWS_SESSION_TOKEN", "", "Session token of s3:// archive sinks, for temporary credentials."},
+		{"AUTOMATION_FILE", "", "File saving automation rules."},
+		{"PREFERENCES_FILE", "", "File saving members' mutes and thread settings."},
+		{"BANS_FILE", "", "File saving banned sessions and networks."},
+		{"UI_BUNDLE", "", "File saving the UI bundle uploaded to /api/admin/ui, served instead of the default page."},
+		{"SNIPPET_FILE", "", "File saving snippets."},
+		{"TODO_FILE", "", "File saving todos."},
+		{"WELCOME_FILE", "", "File saving the welcome message."},
+		{"WELCOME_MESSAGE", "", "Welcome message, unless WELCOME_FILE has one."},
+		{"RULES_URL", "", "Link to the rules, for the welcome message."},
+		{"ROOM_TEMPLATES_FILE", "", "JSON list of room templates."},
+		{"ROOMS_DIRECTORY", "public", "public, members or off."},
+		{"DAILY_SUMMARY", "", "local or llm, to post a daily recap."},
+		{"DAILY_SUMMARY_AT", "00:00", "When the recap is posted, UTC."},
+		{"SUMMARY_LLM_URL", "", "OpenAI-compatible chat completions endpoint, for llm recaps."},
+		{"SUMMARY_LLM_MODEL", "", "Model of the llm recaps."},
+		{"SUMMARY_LLM_KEY", "", "Bearer token for SUMMARY_LLM_URL."},
+		{"GEOIP_DB", "", "MaxMind country database."},
+		{"GEOIP_ASN_DB", "", "MaxMind ASN database."},
+		{"STATSD_ADDR", "", "host:port of a StatsD or DogStatsD agent to push metrics to."},
+		{"STATSD_FORMAT", "statsd", "statsd, or datadog for tagged DogStatsD metrics."},
+		{"STATSD_PREFIX", "alantern.", "Prefix of the StatsD metric names."},
+		{"STATSD_TAGS", "", "Comma-separated tags added to DogStatsD metrics, e.g. env:prod."},
+		{"STATSD_INTERVAL", defaultStatsDInterval.String(), "How often metrics are pushed to StatsD."},
+		{"MOD_LOG", "", "Set to stream moderation events to /modlog/events."},
+		{"ONCALL", "", "Who is paged about incidents."},
+		{"SENTRY_DSN", "", "Sentry DSN to report crashes and errors to."},
+		{"SENTRY_ENVIRONMENT", "production", "Environment crash reports are tagged with."},
+		{"TRACE_SAMPLE_RATE", "", "Share of broadcasts traced, from 0 to 1."},
+		{"FEDERATION_NAME", "", "Name of this instance to federated peers."},
+		{"FEDERATION_SECRET", "", "Secret shared with federated peers."},
+		{"FEDERATION_PEERS", "", "Comma-separated base URLs of federated peers."},
+		{"RELAY_TOKEN", "", "Token edges present to /relay/stream."},
+		{"RELAY_UPSTREAM", "", "Primary this instance is a relay edge of."},
+		{"MIGRATE_TARGET", "", "Where a draining edge sends its clients."},
+	}
+}
+
+func genConfig(args []string) {
+	flags := flag.NewFlagSet("gen-config", flag.ExitOnError)
+	output := flags.String("o", "", "file to write, standard output by default")
+	flags.Parse(args)
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			fmt.Printf("Could not write the config: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		w = file
+	}
+	fmt.Fprintln(w, "# Alantern settings, as environment variables. Uncomment and change what you need.")
+	for _, v := range configVars() {
+		fmt.Fprintf(w, "\n# %s\n#%s=%s\n", v.help, v.name, v.value)
+	}
+}
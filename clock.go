@@ -0,0 +1,39 @@
+package main
+
+import "time"
+
+// Clock is where the server gets the time from. Tests can swap it out with WithClock to drive rate
+// limits, expiries and scheduled jobs deterministically.
+type Clock interface {
+	Now() time.Time
+	// After sends the current time on the returned channel once d has elapsed.
+	After(d time.Duration) <-chan time.Time
+	// AfterFunc calls f in its own goroutine once d has elapsed. Calling stop before then prevents
+	// the call and reports true.
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// Option configures a ChatServer built by NewChatServer.
+type Option func(*ChatServer)
+
+// WithClock makes the server use c instead of the system clock.
+func WithClock(c Clock) Option {
+	return func(s *ChatServer) {
+		s.clock = c
+	}
+}
+
+// WithIDGenerator makes the server use gen to generate session, image, pin and other identifiers.
+func WithIDGenerator(gen func() string) Option {
+	return func(s *ChatServer) {
+		s.newID = gen
+	}
+}
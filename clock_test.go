@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"sync"
+	"testing"
+	"time"
+
+	"alantern/chattest"
+)
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	at time.Time
+	f  func(now time.Time)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.add(d, func(now time.Time) { ch <- now })
+	return ch
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) func() bool {
+	timer := c.add(d, func(time.Time) { go f() })
+	return func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, t := range c.timers {
+			if t == timer {
+				c.timers = append(c.timers[:i], c.timers[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (c *fakeClock) add(d time.Duration, f func(time.Time)) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := &fakeTimer{at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, timer)
+	return timer
+}
+
+// Advance moves the clock forward by d, firing the timers due by then.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var due []*fakeTimer
+	kept := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(now) {
+			kept = append(kept, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	c.timers = kept
+	c.mu.Unlock()
+	for _, t := range due {
+		t.f(now)
+	}
+}
+
+// waitTimers waits until n timers are pending, so that Advance reaches goroutines that are about
+// to wait on the clock.
+func (c *fakeClock) waitTimers(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(chattest.DefaultTimeout)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		pending := len(c.timers)
+		c.mu.Unlock()
+		if pending >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("no %d timers pending on the clock", n)
+}
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 2, 2))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMessageRateLimitFollowsClock(t *testing.T) {
+	clock := newFakeClock()
+	s := NewChatServer(WithClock(clock), WithMessageLimiter(newTokenBucketLimiter(1, 2)))
+	alice := chattest.NewServer(t, s.Handler()).Connect()
+
+	alice.Send("one")
+	alice.Send("two")
+	alice.Send("three")
+	alice.Expect(chattest.Text("one"), chattest.Text("two"), chattest.Private("wait 1s"))
+
+	clock.Advance(time.Second)
+	alice.Send("four")
+	alice.Expect(chattest.Text("four"))
+}
+
+func TestImagesExpireWithClock(t *testing.T) {
+	clock := newFakeClock()
+	s := NewChatServer(WithClock(clock), WithIDGenerator(sequentialIDs()))
+	alice := chattest.NewServer(t, s.Handler()).Connect()
+	if status, body := alice.Upload(testPNG(t), false); status != 200 {
+		t.Fatalf("upload: %d %s", status, body)
+	}
+	stored := func() int {
+		s.imageStoreMu.Lock()
+		defer s.imageStoreMu.Unlock()
+		return len(s.imageStore)
+	}
+
+	clock.Advance(imageLifetime)
+	s.expireImages()
+	if stored() != 1 {
+		t.Fatalf("image expired at its lifetime, want it kept until after")
+	}
+	clock.Advance(time.Nanosecond)
+	s.expireImages()
+	if stored() != 0 {
+		t.Fatalf("image kept after its lifetime")
+	}
+}
+
+func TestScheduledJobsRunOnClock(t *testing.T) {
+	clock := newFakeClock()
+	s := NewChatServer(WithClock(clock))
+	t.Cleanup(func() { close(s.stopping) })
+	runs := make(chan time.Time, 1)
+	s.schedule("test", time.Minute, 0, func() { runs <- s.clock.Now() })
+
+	clock.waitTimers(t, 1)
+	clock.Advance(time.Minute - time.Second)
+	select {
+	case <-runs:
+		t.Fatal("job ran before its interval")
+	default:
+	}
+	clock.Advance(time.Second)
+	select {
+	case at := <-runs:
+		if want := clock.Now(); !at.Equal(want) {
+			t.Fatalf("job ran at %s, want %s", at, want)
+		}
+	case <-time.After(chattest.DefaultTimeout):
+		t.Fatal("job didn't run after its interval")
+	}
+}
+
+func TestMessagesStampedFromClockAndIDGenerator(t *testing.T) {
+	clock := newFakeClock()
+	s := NewChatServer(WithClock(clock), WithIDGenerator(sequentialIDs()))
+	alice := chattest.NewServer(t, s.Handler()).Connect()
+	alice.Send("hello")
+	alice.Expect(chattest.Text("hello"))
+
+	events, _ := s.eventsSince("")
+	last := events[len(events)-1]
+	if last.ID == "" || last.ID[:3] != "id-" {
+		t.Errorf("message ID %q, want one from the generator", last.ID)
+	}
+	if !last.Timestamp.Equal(clock.Now()) {
+		t.Errorf("message timestamp %s, want %s", last.Timestamp, clock.Now())
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"unicode/utf8"
+)
+
+// Messages can carry interactive components, buttons and selects, each with a callback
+// identifier chosen by the sender. When someone uses one with /api/v1/interactions, the sender
+// receives a private "interaction" event on its stream, and can then replace the message, for
+// example to close an approval request, with /api/v1/messages/update.
+
+const (
+	maxComponents       = 5
+	maxComponentOptions = 25
+	maxComponentLabel   = 80
+	// Interactive messages are forgotten after this many newer ones.
+	maxInteractiveMessages = 1000
+)
+
+var (
+	errInvalidComponents  = errors.New("Invalid components: expected a JSON array of at most 5 buttons or selects with unique ids, labels and, for selects, 1 to 25 options")
+	errUnknownInteraction = errors.New("Unknown message or component")
+	errInvalidOption      = errors.New("Invalid option for this select")
+	errNotMessageAuthor   = errors.New("Only the author of a message can update it")
+)
+
+type Component struct {
+	// "button" or "select".
+	Type string `json:"type"`
+	// Callback identifier, sent back in interactions.
+	ID string `json:"id"`
+	// HTML-escaped label.
+	Label string `json:"label"`
+	// Choices of a select.
+	Options []ComponentOption `json:"options,omitempty"`
+}
+
+type ComponentOption struct {
+	Value string `json:"value"`
+	// HTML-escaped label.
+	Label string `json:"label"`
+}
+
+type Interaction struct {
+	// Identifier of the message the component belongs to.
+	Message string `json:"message"`
+	// Callback identifier of the component.
+	Component string `json:"component"`
+	// Option chosen in a select.
+	Value string `json:"value,omitempty"`
+}
+
+type interactiveMessage struct {
+	Author     string
+	Components []Component
+	// Handles interactions instead of sending them to the author, for messages posted by the
+	// server itself.
+	handle func(sessionID string, interaction Interaction)
+}
+
+// parseComponents decodes and validates components sent as JSON, escaping their labels.
+func parseComponents(data string) ([]Component, error) {
+	if data == "" {
+		return nil, nil
+	}
+	var components []Component
+	if err := json.Unmarshal([]byte(data), &components); err != nil || len(components) > maxComponents {
+		return nil, errInvalidComponents
+	}
+
+	ids := map[string]bool{}
+	for i := range components {
+		component := &components[i]
+		component.Label = normalizeMessage(component.Label)
+		if !validComponentText(component.ID) || !validComponentText(component.Label) || ids[component.ID] {
+			return nil, errInvalidComponents
+		}
+		ids[component.ID] = true
+		component.Label = escapeText(component.Label)
+
+		switch component.Type {
+		case "button":
+			if len(component.Options) > 0 {
+				return nil, errInvalidComponents
+			}
+		case "select":
+			if len(component.Options) == 0 || len(component.Options) > maxComponentOptions {
+				return nil, errInvalidComponents
+			}
+			for j := range component.Options {
+				option := &component.Options[j]
+				option.Label = normalizeMessage(option.Label)
+				if !validComponentText(option.Value) || !validComponentText(option.Label) {
+					return nil, errInvalidComponents
+				}
+				option.Label = escapeText(option.Label)
+			}
+		default:
+			return nil, errInvalidComponents
+		}
+	}
+	return components, nil
+}
+
+func validComponentText(text string) bool {
+	return text != "" && utf8.RuneCountInString(text) <= maxComponentLabel && validateMessage(text) == nil
+}
+
+// trackInteractive remembers the components of a message sent by author.
+func (s *ChatServer) trackInteractive(id, author string, components []Component) {
+	s.trackInteractiveMessage(id, &interactiveMessage{Author: author, Components: components})
+}
+
+// trackAppInteractive remembers the components of a message posted by the server, whose
+// interactions go to handle.
+func (s *ChatServer) trackAppInteractive(id string, components []Component, handle func(sessionID string, interaction Interaction)) {
+	s.trackInteractiveMessage(id, &interactiveMessage{Components: components, handle: handle})
+}
+
+func (s *ChatServer) trackInteractiveMessage(id string, message *interactiveMessage) {
+	s.interactiveMu.Lock()
+	defer s.interactiveMu.Unlock()
+	if _, ok := s.interactive[id]; !ok {
+		s.interactiveOrder = append(s.interactiveOrder, id)
+	}
+	s.interactive[id] = message
+	for len(s.interactiveOrder) > maxInteractiveMessages {
+		delete(s.interactive, s.interactiveOrder[0])
+		s.interactiveOrder = s.interactiveOrder[1:]
+	}
+}
+
+// interact delivers the use of a component by sessionID to the author of the message.
+func (s *ChatServer) interact(sessionID string, interaction Interaction) error {
+	s.interactiveMu.Lock()
+	message, ok := s.interactive[interaction.Message]
+	s.interactiveMu.Unlock()
+	if !ok {
+		return errUnknownInteraction
+	}
+
+	var component *Component
+	for i := range message.Components {
+		if message.Components[i].ID == interaction.Component {
+			component = &message.Components[i]
+		}
+	}
+	if component == nil {
+		return errUnknownInteraction
+	}
+	if component.Type == "select" {
+		valid := false
+		for _, option := range component.Options {
+			valid = valid || option.Value == interaction.Value
+		}
+		if !valid {
+			return errInvalidOption
+		}
+	} else {
+		interaction.Value = ""
+	}
+
+	if message.handle != nil {
+		message.handle(sessionID, interaction)
+		return nil
+	}
+	s.sendTo(message.Author, Message{
+		FromApp:     true,
+		Author:      s.authorOf(sessionID),
+		Kind:        "interaction",
+		Private:     true,
+		Interaction: &interaction,
+	})
+	return nil
+}
+
+// checkEditable returns why sessionID may not edit the interactive message id, or nil.
+func (s *ChatServer) checkEditable(sessionID, id string) error {
+	s.interactiveMu.Lock()
+	message, ok := s.interactive[id]
+	s.interactiveMu.Unlock()
+	if !ok {
+		return errUnknownInteraction
+	}
+	if message.Author != sessionID {
+		return errNotMessageAuthor
+	}
+	return nil
+}
+
+// updateMessage replaces the content and components of a message sent by sessionID, and lets
+// every client know with an "update" event carrying the message identifier. The edits of shadow
+// muted sessions are only echoed back to them, as their messages are.
+func (s *ChatServer) updateMessage(sessionID, id, text string, components []Component) error {
+	if err := s.checkEditable(sessionID, id); err != nil {
+		return err
+	}
+	update := Message{
+		Author:     s.authorOf(sessionID),
+		ID:         id,
+		Content:    escapeText(text),
+		Segments:   s.segments(text),
+		Components: components,
+	}
+	if s.shadowMuted(sessionID) {
+		update.Kind = "update"
+		s.sendTo(sessionID, update)
+		return nil
+	}
+
+	s.trackInteractive(id, sessionID, components)
+	return s.broadcastUpdate(update)
+}
+
+// broadcastUpdate replaces the content, segments and components of the message update.ID, in the
+// event log and on every client.
+func (s *ChatServer) broadcastUpdate(update Message) error {
+	update.Kind = "update"
+	update = s.stamp(update.sanitized())
+	var updated []Message
+	s.eventLogMu.Lock()
+	for i := range s.eventLog {
+		if s.eventLog[i].ID == update.ID {
+			s.eventLog[i].Content = update.Content
+			s.eventLog[i].Segments = update.Segments
+			s.eventLog[i].Components = update.Components
+			updated = append(updated, s.eventLog[i])
+		}
+	}
+	s.eventLogMu.Unlock()
+	for _, message := range updated {
+		s.storeMessage(message)
+	}
+
+	s.archive(update)
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	s.broadcastRaw(string(data))
+	s.publishToRelays(string(data))
+	return nil
+}
+
+func (s *ChatServer) authorOf(sessionID string) *MessageAuthor {
+	s.nicknameColorsMu.Lock()
+	color := s.nicknameColors[sessionID]
+	s.nicknameColorsMu.Unlock()
+	if color == "" {
+		color = "black"
+	}
+	return &MessageAuthor{ID: sessionHandle(sessionID), Nickname: s.getNickname(sessionID), Color: color}
+}
+
+// handleInteractions records the use of "component" (with the chosen "value" for a select) of
+// "message".
+func (s *ChatServer) handleInteractions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+
+	r.ParseForm()
+	interaction := Interaction{Message: r.FormValue("message"), Component: r.FormValue("component"), Value: r.FormValue("value")}
+	switch err := s.interact(sessionID, interaction); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errUnknownInteraction:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// handleMessageUpdate replaces the "content" and "components" of the interactive message "id".
+func (s *ChatServer) handleMessageUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+
+	r.ParseForm()
+	text := normalizeMessage(r.FormValue("content"))
+	if err := validateMessage(text); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	components, err := parseComponents(r.FormValue("components"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Edits are posts too, held to the same restrictions and limits as messages.
+	id := r.FormValue("id")
+	if err := s.checkEditable(sessionID, id); err == nil {
+		if s.inLobby(sessionID) {
+			http.Error(w, errInLobby.Error(), http.StatusForbidden)
+			return
+		}
+		message, _ := s.findMessage(id)
+		if restriction := s.postRestriction(sessionID, message.Room); restriction != "" {
+			http.Error(w, restriction, http.StatusForbidden)
+			return
+		}
+		now := s.clock.Now()
+		if s.overRateLimit(r, sessionID, now) {
+			http.Error(w, "Too many messages, wait before editing", http.StatusTooManyRequests)
+			return
+		}
+		s.slowmodePosted(sessionID, message.Room, now)
+	}
+
+	switch err := s.updateMessage(sessionID, id, text, components); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errUnknownInteraction:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errNotMessageAuthor:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
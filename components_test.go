@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"alantern/chattest"
+)
+
+// postInteractive has client post a message with a button, and returns it as the others see it.
+func postInteractive(t *testing.T, client, other *chattest.Client) chattest.Event {
+	t.Helper()
+	status, body := client.Do(http.MethodPost, "/send", url.Values{
+		"message":    {"vote"},
+		"components": {`[{"type": "button", "id": "yes", "label": "Yes"}]`},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("sending: %d %s", status, body)
+	}
+	return other.Expect(chattest.Text("vote"))[0]
+}
+
+func TestEditsAreHeldToPostRestrictions(t *testing.T) {
+	s, srv := newTestServer(t)
+	alice, bob := srv.Connect(), srv.Connect()
+	alice.SetNickname("alice")
+	bob.SetNickname("bob")
+	bob.Collect(settle)
+	message := postInteractive(t, alice, bob)
+	edit := url.Values{"id": {message.ID}, "content": {"rewritten"}}
+	author := s.sessionOfHandle(message.Author.ID)
+
+	s.modMutesMu.Lock()
+	s.modMutes[author] = s.clock.Now().Add(time.Hour)
+	s.modMutesMu.Unlock()
+	if status, body := alice.Do(http.MethodPost, "/api/v1/messages/update", edit); status != http.StatusForbidden {
+		t.Fatalf("muted edit: %d %s, want 403", status, body)
+	}
+	bob.ExpectNone(settle)
+
+	s.modMutesMu.Lock()
+	delete(s.modMutes, author)
+	s.shadowMutes[author] = time.Time{}
+	s.modMutesMu.Unlock()
+	if status, body := alice.Do(http.MethodPost, "/api/v1/messages/update", edit); status != http.StatusNoContent {
+		t.Fatalf("shadow muted edit: %d %s, want 204", status, body)
+	}
+	bob.ExpectNone(settle)
+	alice.Collect(settle)
+
+	s.modMutesMu.Lock()
+	delete(s.shadowMutes, author)
+	s.modMutesMu.Unlock()
+	if status, body := alice.Do(http.MethodPost, "/api/v1/messages/update", edit); status != http.StatusNoContent {
+		t.Fatalf("edit: %d %s, want 204", status, body)
+	}
+	bob.Expect(chattest.All(chattest.Kind("update"), func(e chattest.Event) string {
+		if e.Content != "rewritten" {
+			return "want the new content"
+		}
+		return ""
+	}))
+}
+
+func TestEditsRecomputeSegments(t *testing.T) {
+	s, srv := newTestServer(t)
+	alice, bob := srv.Connect(), srv.Connect()
+	alice.SetNickname("alice")
+	bob.SetNickname("bob")
+	bob.Collect(settle)
+	message := postInteractive(t, alice, bob)
+
+	edit := url.Values{"id": {message.ID}, "content": {"see https://example.com @bob"}}
+	if status, body := alice.Do(http.MethodPost, "/api/v1/messages/update", edit); status != http.StatusNoContent {
+		t.Fatalf("edit: %d %s, want 204", status, body)
+	}
+	bob.Expect(chattest.All(chattest.Kind("update"), func(e chattest.Event) string {
+		if len(e.Segments) != 4 || e.Segments[1].URL != "https://example.com" || e.Segments[3].Type != "mention" {
+			return "want the segments of the new content"
+		}
+		return ""
+	}))
+
+	events, _ := s.eventsSince("")
+	for _, event := range events {
+		if event.ID == message.ID && (len(event.Segments) != 4 || event.Segments[1].URL != "https://example.com") {
+			t.Errorf("logged segments %+v, want those of the edit", event.Segments)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Crashes are reported to Sentry, or anything taking its store API (GlitchTip, Bugsink...), when
+// SENTRY_DSN is set: panics in requests and jobs, with their stack, and whatever is logged at the
+// error level, like failing to save a file. SENTRY_ENVIRONMENT tags them, "production" by default.
+// Reports leave out anything members wrote: requests are described by their method and path only,
+// never their query, form or cookies, and quoted text, email addresses and session identifiers
+// are filtered out of messages. They are sent in the background, and dropped rather than queued
+// when Sentry can't keep up.
+
+const (
+	crashQueueSize = 64
+	crashTimeout   = 10 * time.Second
+)
+
+var errInvalidSentryDSN = errors.New("SENTRY_DSN must look like https://<key>@<host>/<project>")
+
+type crashReporter struct {
+	// Store API endpoint, and the X-Sentry-Auth header sent to it.
+	endpoint, auth string
+	environment    string
+	events         chan map[string]interface{}
+}
+
+// crashes reports to SENTRY_DSN, nil until loadCrashReporter sets it up.
+var crashes *crashReporter
+
+// loadCrashReporter starts reporting crashes, if SENTRY_DSN is set.
+func loadCrashReporter() error {
+	dsn := os.Getenv("SENTRY_DSN")
+	if dsn == "" {
+		return nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.User.Username() == "" || u.Host == "" || !strings.HasPrefix(u.Path, "/") {
+		return errInvalidSentryDSN
+	}
+	// The project is the last part of the path, after any the server is mounted on.
+	i := strings.LastIndex(u.Path, "/")
+	prefix, project := u.Path[:i], u.Path[i+1:]
+	if project == "" {
+		return errInvalidSentryDSN
+	}
+	crashes = &crashReporter{
+		endpoint:    fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, prefix, project),
+		auth:        fmt.Sprintf("Sentry sentry_version=7, sentry_client=alantern/%s, sentry_key=%s", version, u.User.Username()),
+		environment: envOr("SENTRY_ENVIRONMENT", "production"),
+		events:      make(chan map[string]interface{}, crashQueueSize),
+	}
+	go crashes.send()
+	return nil
+}
+
+func (c *crashReporter) send() {
+	client := &http.Client{Timeout: crashTimeout}
+	for event := range c.events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		req, err := http.NewRequest(http.MethodPost, c.endpoint, bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Sentry-Auth", c.auth)
+		resp, err := client.Do(req)
+		if err != nil {
+			slog.Warn("Could not report a crash", "err", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			slog.Warn("Could not report a crash", "status", resp.Status)
+		}
+	}
+}
+
+func (c *crashReporter) capture(event map[string]interface{}) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	event["event_id"] = hex.EncodeToString(id)
+	event["timestamp"] = time.Now().UTC().Format(time.RFC3339)
+	event["platform"] = "go"
+	event["logger"] = "alantern"
+	event["release"] = "alantern@" + version
+	event["environment"] = c.environment
+	if host, err := os.Hostname(); err == nil {
+		event["server_name"] = host
+	}
+	select {
+	case c.events <- event:
+	default:
+	}
+}
+
+// reportError reports a record logged at the error level, with its attributes as extra data.
+func reportError(record slog.Record) {
+	if crashes == nil {
+		return
+	}
+	extra := make(map[string]string)
+	record.Attrs(func(attr slog.Attr) bool {
+		extra[attr.Key] = scrubPII(attr.Value.String())
+		return true
+	})
+	crashes.capture(map[string]interface{}{
+		"level":   "error",
+		"message": map[string]string{"formatted": scrubPII(record.Message)},
+		"extra":   extra,
+	})
+}
+
+// reportPanic logs and reports p, recovered in where, with the stack of the goroutine that
+// panicked, and the request it was serving with its trace identifier, if any. It must be called
+// from the deferred function that recovered p.
+func reportPanic(where string, p interface{}, r *http.Request, traceID string) {
+	pcs := make([]uintptr, 64)
+	// Leave out runtime.Callers, reportPanic and the deferred function calling it.
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	var stack []map[string]interface{}
+	var trace strings.Builder
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&trace, "%s\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		// Sentry lists frames oldest first.
+		stack = append([]map[string]interface{}{{
+			"function": frame.Function,
+			"filename": frame.File,
+			"lineno":   frame.Line,
+			"in_app":   strings.HasPrefix(frame.Function, "main."),
+		}}, stack...)
+		if !more {
+			break
+		}
+	}
+	logger := slog.Default()
+	if r != nil {
+		logger = logger.With("trace", traceID)
+	}
+	logger.ErrorContext(alreadyReported(context.Background()), where+" panicked", "panic", p, "stack", trace.String())
+	if crashes == nil {
+		return
+	}
+
+	event := map[string]interface{}{
+		"level": "fatal",
+		"exception": map[string]interface{}{"values": []map[string]interface{}{{
+			"type":       fmt.Sprintf("%T", p),
+			"value":      scrubPII(fmt.Sprint(p)),
+			"stacktrace": map[string]interface{}{"frames": stack},
+			"mechanism":  map[string]interface{}{"type": "panic", "handled": true},
+		}}},
+		"tags": map[string]string{"where": where},
+	}
+	if r != nil {
+		event["request"] = map[string]string{"method": r.Method, "url": r.URL.Path}
+		event["tags"].(map[string]string)["trace_id"] = traceID
+	}
+	crashes.capture(event)
+}
+
+var (
+	quotedText = regexp.MustCompile(`"(?:[^"\\]|\\.)*"|'[^']*'`)
+	emails     = regexp.MustCompile(`[^\s@<>"']+@[^\s@<>"']+\.[A-Za-z]{2,}`)
+	// Session identifiers, as generateRandomId makes them, and resume tokens, from generateSessionID.
+	sessionIDs   = regexp.MustCompile(`\b\d+-[0-9a-f]{8}\b`)
+	resumeTokens = regexp.MustCompile(`[A-Za-z0-9_-]{43}=`)
+)
+
+// scrubPII filters what could be members' messages or identities out of text.
+func scrubPII(text string) string {
+	text = quotedText.ReplaceAllString(text, `"[Filtered]"`)
+	text = emails.ReplaceAllString(text, "[Filtered]")
+	text = resumeTokens.ReplaceAllString(text, "[Filtered]")
+	return sessionIDs.ReplaceAllString(text, "[Filtered]")
+}
+
+// recoverPanics answers requests to next that panic with a 500, reporting the panic.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			// Set by timeRequests, further in.
+			reportPanic(r.Method+" "+r.URL.Path, p, r, w.Header().Get("X-Request-Id"))
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
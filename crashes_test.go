@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScrubPIIFiltersSessions(t *testing.T) {
+	session, token := generateRandomId(), generateSessionID()
+	for _, text := range []string{
+		"no stream for session " + session,
+		"session=" + session + ": gone",
+		"bad resume token " + token,
+	} {
+		got := scrubPII(text)
+		if strings.Contains(got, session) || strings.Contains(got, token) {
+			t.Errorf("scrubPII(%q) = %q, want the session filtered", text, got)
+		}
+		if !strings.Contains(got, "[Filtered]") {
+			t.Errorf("scrubPII(%q) = %q, want [Filtered] in its place", text, got)
+		}
+	}
+	if text := "runtime error: index out of range [3] with length 2"; scrubPII(text) != text {
+		t.Errorf("scrubPII(%q) = %q, want it unchanged", text, scrubPII(text))
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Operators on the server's host manage it through the control socket, CONTROL_SOCKET, which
+// is control.sock in the data directory unless set, and off without either or if set to "off".
+// It is a Unix socket only its owner can connect to, so it needs no token and leaves the admin
+// API alone, unreachable from outside if so wished. Clients send it JSON-RPC 2.0 requests, one
+// per line, and get one response per line: "stats", "load", "sessions" and "rooms" return what
+// their /api/admin endpoint does, "rename" takes a "session" and a "nickname", "kick" a
+// "session" and a "reason", "ban" a "session", a "duration" and a "reason", "unban" a "session"
+// and "announce" a "message" and a "room". What is done through it is audited as done by
+// "admin". "alantern ctl <method> [name=value ...]" makes the requests from a shell, as do
+// "alantern user" and "alantern room" (see ops.go); relay edges have no control socket.
+
+var controlSocket = os.Getenv("CONTROL_SOCKET")
+
+const (
+	// Longest request read from the control socket, in bytes.
+	maxControlRequest = 64 << 10
+	// How long a control connection may stay idle.
+	controlIdleTimeout = 5 * time.Minute
+)
+
+// JSON-RPC error codes.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcServerError    = -32000
+)
+
+var (
+	errControlRunning = errors.New("another server is listening on the control socket")
+	errNoControl      = errors.New("No control socket: give it with -socket, or the server's -data-dir")
+)
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  ctlParams       `json:"params"`
+}
+
+// ctlParams holds the parameters of every control method, by name.
+type ctlParams struct {
+	Session  string `json:"session,omitempty"`
+	Nickname string `json:"nickname,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Duration string `json:"duration,omitempty"`
+	Message  string `json:"message,omitempty"`
+	Room     string `json:"room,omitempty"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// ctlMethods are what the control socket does, by method name.
+var ctlMethods = map[string]func(s *ChatServer, params ctlParams) (interface{}, error){
+	"stats":    func(s *ChatServer, _ ctlParams) (interface{}, error) { return s.currentStats(), nil },
+	"load":     func(s *ChatServer, _ ctlParams) (interface{}, error) { return s.currentLoad(), nil },
+	"sessions": func(s *ChatServer, _ ctlParams) (interface{}, error) { return s.sessions(), nil },
+	"rooms":    func(s *ChatServer, _ ctlParams) (interface{}, error) { return s.roomList(), nil },
+	"rename": func(s *ChatServer, params ctlParams) (interface{}, error) {
+		target := s.findSession(params.Session)
+		if target == "" {
+			return nil, errUnknownSession
+		}
+		return true, s.adminRename("admin", target, params.Nickname)
+	},
+	"kick": func(s *ChatServer, params ctlParams) (interface{}, error) {
+		target := s.findSession(params.Session)
+		if target == "" {
+			return nil, errUnknownSession
+		}
+		s.adminKick("admin", target, params.Reason)
+		return true, nil
+	},
+	"ban": func(s *ChatServer, params ctlParams) (interface{}, error) {
+		target := s.findSession(params.Session)
+		if target == "" {
+			return nil, errUnknownSession
+		}
+		var d time.Duration
+		if params.Duration != "" {
+			var err error
+			if d, err = time.ParseDuration(params.Duration); err != nil || d <= 0 {
+				return nil, errInvalidBan
+			}
+		}
+		return true, s.adminBan("admin", target, params.Reason, d)
+	},
+	"unban": func(s *ChatServer, params ctlParams) (interface{}, error) {
+		return true, s.adminUnban("admin", params.Session)
+	},
+	"announce": func(s *ChatServer, params ctlParams) (interface{}, error) {
+		return s.announce("admin", params.Message, params.Room)
+	},
+}
+
+// startControl listens on the control socket, if there is one, until the server stops.
+func (s *ChatServer) startControl() error {
+	if controlSocket == "" || controlSocket == "off" {
+		return nil
+	}
+	if conn, err := net.Dial("unix", controlSocket); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s: %w", controlSocket, errControlRunning)
+	}
+	// Left behind by a server that didn't stop cleanly.
+	os.Remove(controlSocket)
+	// The socket is made in a directory only the owner can enter, and moved in place once only
+	// the owner can connect to it, so that nobody else gets to connect in between.
+	dir, err := os.MkdirTemp(filepath.Dir(controlSocket), ".ctl-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "s")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(path, 0o600); err == nil {
+		err = os.Rename(path, controlSocket)
+	}
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	socket := controlSocket
+	go func() {
+		<-s.stopping
+		listener.Close()
+		os.Remove(socket)
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveControl(conn)
+		}
+	}()
+	slog.Info("Control socket listening", "path", controlSocket)
+	return nil
+}
+
+// serveControl answers the requests of a control connection until it closes or idles.
+func (s *ChatServer) serveControl(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxControlRequest)
+	encoder := json.NewEncoder(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(controlIdleTimeout))
+		if !scanner.Scan() {
+			return
+		}
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			encoder.Encode(s.callControl([]byte(line)))
+		}
+	}
+}
+
+// callControl answers the JSON-RPC request line.
+func (s *ChatServer) callControl(line []byte) rpcResponse {
+	response := rpcResponse{JSONRPC: "2.0", ID: json.RawMessage("null")}
+	var request rpcRequest
+	if err := json.Unmarshal(line, &request); err != nil {
+		response.Error = &rpcError{rpcParseError, "Invalid request: expected a JSON-RPC 2.0 request with params by name"}
+		return response
+	}
+	if len(request.ID) > 0 {
+		response.ID = request.ID
+	}
+	if request.JSONRPC != "2.0" {
+		response.Error = &rpcError{rpcInvalidRequest, `Invalid request: jsonrpc must be "2.0"`}
+		return response
+	}
+	method, ok := ctlMethods[request.Method]
+	if !ok {
+		response.Error = &rpcError{rpcMethodNotFound, "Unknown method " + request.Method}
+		return response
+	}
+	result, err := method(s, request.Params)
+	switch err {
+	case nil:
+		response.Result = result
+	case errUnknownSession, errInvalidBan, errMessageRequired, errNotBanned, errUnknownRoom,
+		errNicknameTaken, errNicknameEmpty, errNicknameLength, errNicknameChars:
+		response.Error = &rpcError{rpcInvalidParams, err.Error()}
+	default:
+		response.Error = &rpcError{rpcServerError, err.Error()}
+	}
+	slog.Info("Control request", "method", request.Method, "err", err)
+	return response
+}
+
+const ctlUsage = `Usage: alantern ctl [flags] <method> [name=value ...]
+
+Methods:
+  stats                                   statistics of the chat
+  load                                    load signals of the server
+  sessions                                every session known
+  rooms                                   every room, unlisted ones too
+  rename session=<session> nickname=...   change the nickname of a session
+  kick session=<session> [reason=...]     disconnect a session for a while
+  ban session=<session> [duration=...] [reason=...]
+  unban session=<session>
+  announce message=... [room=<room>]      post a message as the app
+
+Sessions can be given by nickname, or by handle as sessions lists them.
+`
+
+// controlFlags adds the flags finding the control socket of the server on this host to flags,
+// and returns what sets controlSocket from them once they are parsed.
+func controlFlags(flags *flag.FlagSet) func() {
+	dataDir := flags.String("data-dir", os.Getenv("DATA_DIR"), "data directory of the server ($DATA_DIR)")
+	flags.StringVar(&controlSocket, "socket", controlSocket, "control socket of the server ($CONTROL_SOCKET)")
+	return func() {
+		if *dataDir != "" && controlSocket == "" {
+			controlSocket = dataDirControlSocket(*dataDir)
+		}
+	}
+}
+
+// callControlSocket makes the request method with params to the control socket, and decodes its
+// result into v unless it is nil.
+func callControlSocket(method string, params map[string]string, v interface{}) error {
+	if controlSocket == "" || controlSocket == "off" {
+		return errNoControl
+	}
+	request, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+	conn, err := net.DialTimeout("unix", controlSocket, opsTimeout)
+	if err != nil {
+		return fmt.Errorf("Could not connect to the server: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(opsTimeout))
+	if _, err := conn.Write(append(request, '\n')); err != nil {
+		return fmt.Errorf("Could not send the request: %w", err)
+	}
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return fmt.Errorf("Could not read the response: %w", err)
+	}
+	if response.Error != nil {
+		return errors.New(response.Error.Message)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(response.Result, v)
+}
+
+// ctl makes a request to the control socket of the server running on this host.
+func ctl(args []string) {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	useFlags := controlFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), ctlUsage+"\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	useFlags()
+	if controlSocket == "" || controlSocket == "off" {
+		fmt.Println(errNoControl)
+		os.Exit(2)
+	}
+
+	params := map[string]string{}
+	for _, arg := range flags.Args()[1:] {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			flags.Usage()
+			os.Exit(2)
+		}
+		params[name] = value
+	}
+	var result interface{}
+	if err := callControlSocket(flags.Arg(0), params, &result); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	out, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(out))
+}
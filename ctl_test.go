@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestControlSocketIsOwnerOnly(t *testing.T) {
+	dir := t.TempDir()
+	saved := controlSocket
+	t.Cleanup(func() { controlSocket = saved })
+	controlSocket = filepath.Join(dir, "control.sock")
+	s, _ := newTestServer(t)
+	if err := s.startControl(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { close(s.stopping) })
+
+	info, err := os.Stat(controlSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode(); mode&os.ModeSocket == 0 || mode.Perm() != 0o600 {
+		t.Fatalf("control socket mode %s, want a socket only its owner can use", mode)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("%d entries next to the control socket, want it alone", len(entries))
+	}
+
+	var stats Stats
+	if err := callControlSocket("stats", nil, &stats); err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+}
+
+func TestOpsGoThroughTheControlSocket(t *testing.T) {
+	saved := controlSocket
+	t.Cleanup(func() { controlSocket = saved })
+	controlSocket = filepath.Join(t.TempDir(), "control.sock")
+	s, srv := newTestServer(t)
+	if err := s.startControl(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { close(s.stopping) })
+	alice := srv.Connect()
+	alice.SetNickname("alice")
+	alice.Send(";room create games")
+	alice.Collect(settle)
+
+	if err := callControlSocket("rename", map[string]string{"session": "alice", "nickname": "carol"}, nil); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if s.findSession("carol") == "" {
+		t.Error("rename didn't rename alice")
+	}
+	if err := callControlSocket("rename", map[string]string{"session": "nobody", "nickname": "x"}, nil); err == nil || err.Error() != errUnknownSession.Error() {
+		t.Errorf("renaming nobody: %v, want %v", err, errUnknownSession)
+	}
+	var rooms []Room
+	if err := callControlSocket("rooms", nil, &rooms); err != nil || len(rooms) != 1 || rooms[0].Name != "games" {
+		t.Errorf("rooms: %v %+v, want games", err, rooms)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// /debug/events is a moderator-only page rendering the live broadcast stream, with filters by kind,
+// author and origin, for developing bots and debugging delivery. It reads the same feed as relay
+// edges, so it shows every public broadcast, including full livestream batches before sampling,
+// but no private messages.
+
+const debugEventsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>alantern events</title>
+  <style>
+    body { font-family: monospace; margin: 1em; }
+    form { margin-bottom: 1em; }
+    table { border-collapse: collapse; width: 100%; }
+    td, th { border-bottom: 1px solid #ddd; padding: 2px 6px; text-align: left; vertical-align: top; }
+    td.raw { white-space: pre-wrap; word-break: break-all; color: #555; }
+    #status { margin-left: 1em; }
+  </style>
+</head>
+<body>
+  <form onsubmit="return false">
+    kind <input id="kind" placeholder="text,image">
+    author <input id="author" placeholder="nickname">
+    origin <input id="origin" placeholder="instance, or - for local">
+    <label><input id="raw" type="checkbox"> raw</label>
+    <button id="pause" type="button">pause</button>
+    <button id="clear" type="button">clear</button>
+    <span id="status">connecting</span>
+  </form>
+  <table>
+    <thead><tr><th>time</th><th>kind</th><th>author</th><th>origin</th><th>content</th></tr></thead>
+    <tbody id="events"></tbody>
+  </table>
+  <script>
+    const rows = document.getElementById("events");
+    const status = document.getElementById("status");
+    const field = id => document.getElementById(id);
+    let paused = false;
+    let received = 0;
+
+    field("pause").onclick = () => {
+      paused = !paused;
+      field("pause").textContent = paused ? "resume" : "pause";
+    };
+    field("clear").onclick = () => { rows.textContent = ""; };
+
+    function matches(event) {
+      const kinds = field("kind").value.split(",").map(k => k.trim()).filter(k => k);
+      if (kinds.length && !kinds.includes(event.kind)) return false;
+      const author = field("author").value.trim();
+      if (author && (!event.author || event.author.nickname !== author)) return false;
+      const origin = field("origin").value.trim();
+      if (origin && (event.origin || "-") !== origin) return false;
+      return true;
+    }
+
+    function cell(row, text, className) {
+      const td = row.insertCell();
+      td.textContent = text;
+      if (className) td.className = className;
+    }
+
+    function show(event, data) {
+      if (!matches(event)) return;
+      const row = rows.insertRow(0);
+      cell(row, new Date().toISOString().substring(11, 23));
+      cell(row, event.kind);
+      cell(row, event.author ? event.author.nickname : (event.fromApp ? "(app)" : ""));
+      cell(row, event.origin || "");
+      if (field("raw").checked) {
+        cell(row, JSON.stringify(JSON.parse(data), null, 2), "raw");
+      } else if (event.kind === "batch") {
+        cell(row, event.messages.length + " messages");
+        event.messages.forEach(m => show(m, JSON.stringify(m)));
+      } else {
+        cell(row, event.content);
+      }
+      while (rows.rows.length > 1000) rows.deleteRow(-1);
+    }
+
+    const source = new EventSource("/debug/events/stream");
+    source.onopen = () => { status.textContent = "connected"; };
+    source.onerror = () => { status.textContent = "disconnected, retrying"; };
+    source.onmessage = e => {
+      received++;
+      status.textContent = "connected, " + received + " events";
+      if (!paused) show(JSON.parse(e.data), e.data);
+    };
+  </script>
+</body>
+</html>
+`
+
+func (s *ChatServer) handleDebugEvents(w http.ResponseWriter, r *http.Request) {
+	if !s.isModerator(s.getOrCreateSession(w, r)) {
+		http.Error(w, "Moderators only", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setPageHeaders(w)
+	w.Write([]byte(debugEventsPage))
+}
+
+// handleDebugEventsStream streams every public broadcast to a moderator.
+func (s *ChatServer) handleDebugEventsStream(w http.ResponseWriter, r *http.Request) {
+	if !s.isModerator(s.getOrCreateSession(w, r)) {
+		http.Error(w, "Moderators only", http.StatusForbidden)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	id := s.newID()
+	ch := make(chan string, relaySubscriberBuffer)
+	s.relaySubscribersMu.Lock()
+	s.relaySubscribers[id] = ch
+	s.relaySubscribersMu.Unlock()
+
+	defer func() {
+		s.relaySubscribersMu.Lock()
+		delete(s.relaySubscribers, id)
+		s.relaySubscribersMu.Unlock()
+	}()
+
+	for {
+		select {
+		case data := <-ch:
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// ;delete <message id> deletes a message: members delete their own, and moderators any in the
+// rooms they moderate. The message is removed from the event log, the room's log and the message
+// store, so that it is no longer replayed, and a "delete" event with its identifier as ID is
+// logged in its place and sent where it was posted, and to relay edges, for clients to remove it,
+// those resuming with since= too. What else was kept of it goes as well: its text waiting for the
+// daily recap, pins of the same text in its room, the followers of its thread, and the image of
+// an image message, unless under legal hold. Deletions are archived (see archive.go), with the
+// message deleted, so that under legal hold it is kept there. Moderators deleting the messages of
+// others are audited and listed in the moderation log.
+
+var (
+	errNoSuchMessage  = errors.New("No message with that id")
+	errNotYourMessage = errors.New("You can only delete your own messages")
+	errDeleteFailed   = errors.New("Could not delete the message")
+)
+
+// deletable reports whether message is one ;delete deletes, rather than an event.
+func deletable(message Message) bool {
+	return contentKinds[message.Kind].Message && message.Kind != "update"
+}
+
+// deletableMessage returns the message id ;delete would delete, from the logs (see findMessage)
+// or the message store.
+func (s *ChatServer) deletableMessage(id string) (Message, bool) {
+	message, ok := s.findMessage(id)
+	if !ok && s.messages != nil {
+		var err error
+		if message, ok, err = s.messages.Get(id); err != nil {
+			slog.Error("Could not read stored message", "id", id, "err", err)
+		}
+	}
+	return message, ok && deletable(message)
+}
+
+// forgetEventLocked removes the message id from the event log. eventLogMu must be held.
+func (s *ChatServer) forgetEventLocked(id string) {
+	kept := s.eventLog[:0]
+	for _, message := range s.eventLog {
+		if message.ID != id {
+			kept = append(kept, message)
+		}
+	}
+	s.eventLog = kept
+}
+
+// deleteMessage deletes the message id for actor, and returns it.
+func (s *ChatServer) deleteMessage(actor, id string) (Message, error) {
+	message, ok := s.deletableMessage(id)
+	if !ok {
+		return message, errNoSuchMessage
+	}
+	own := !message.FromApp && message.Author != nil && message.Author.ID == sessionHandle(actor)
+	if !own && !s.moderatesRoom(actor, message.Room) {
+		return message, errNotYourMessage
+	}
+
+	if s.messages != nil && message.Room == "" {
+		if err := s.unstoreMessage(id); err != nil {
+			slog.Error("Could not delete stored message", "id", id, "err", err)
+			return message, errDeleteFailed
+		}
+	}
+	event := Message{FromApp: true, Kind: "delete", ID: id, Room: message.Room}
+	s.broadcastMu.Lock()
+	if message.Room == "" {
+		s.eventLogMu.Lock()
+		s.forgetEventLocked(id)
+		s.eventLogMu.Unlock()
+		event = s.logEvent(event)
+		data, _ := json.Marshal(event)
+		s.broadcastRaw(string(data))
+		s.publishToRelays(string(data))
+	} else {
+		event = s.stamp(event)
+		s.roomsMu.Lock()
+		var members []string
+		if room, ok := s.rooms[message.Room]; ok {
+			kept := room.log[:0]
+			for _, logged := range room.log {
+				if logged.ID != id {
+					kept = append(kept, logged)
+				}
+			}
+			if len(kept) >= roomLogSize {
+				kept = append(kept[:0], kept[1:]...)
+			}
+			room.seq++
+			event.Seq = room.seq
+			room.log = append(kept, event)
+			for member := range room.members {
+				members = append(members, member)
+			}
+		}
+		s.roomsMu.Unlock()
+		data, _ := json.Marshal(event)
+		s.hub.broadcastTo(members, func(_ string, ch chan string) {
+			s.deliver(ch, string(data))
+		})
+	}
+	s.broadcastMu.Unlock()
+	s.forgetCopies(actor, message)
+
+	s.archiveEvent("delete", actor, message, nil)
+	if !own {
+		author := ""
+		if message.Author != nil {
+			author = message.Author.Nickname
+		}
+		s.audit(actor, "message.delete", id, "from "+author)
+		s.logModAction(fmt.Sprintf("A message from [%s] was deleted", escapeText(author)))
+	}
+	return message, nil
+}
+
+// forgetCopies drops what is kept of the message actor deleted elsewhere than in the logs.
+func (s *ChatServer) forgetCopies(actor string, message Message) {
+	s.summaryMu.Lock()
+	kept := s.summaryMessages[:0]
+	for _, collected := range s.summaryMessages {
+		if collected.ID != message.ID {
+			kept = append(kept, collected)
+		}
+	}
+	s.summaryMessages = kept
+	s.summaryMu.Unlock()
+
+	var pins []string
+	s.pinsMu.Lock()
+	for _, pin := range s.pins {
+		if pin.Room == message.Room && pin.Content == message.Content {
+			pins = append(pins, pin.ID)
+		}
+	}
+	s.pinsMu.Unlock()
+	for _, id := range pins {
+		s.removePin(actor, id)
+	}
+
+	s.threadsMu.Lock()
+	delete(s.threadFollowers, message.ID)
+	for sessionID, digests := range s.pendingDigests {
+		kept := digests[:0]
+		for _, activity := range digests {
+			if activity.ThreadID != message.ID {
+				kept = append(kept, activity)
+			}
+		}
+		s.pendingDigests[sessionID] = kept
+	}
+	s.threadsMu.Unlock()
+
+	if message.Kind == "image" && !legalHold {
+		s.imageStoreMu.Lock()
+		if _, ok := s.imageStore[message.Content]; ok {
+			s.deleteImageLocked(message.Content)
+		}
+		s.imageStoreMu.Unlock()
+	}
+}
+
+func (s *ChatServer) handleDeleteCommand(sessionID string, args []string) {
+	if len(args) != 1 {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Usage: ;delete &lt;message id&gt;",
+		})
+		return
+	}
+	if _, err := s.deleteMessage(sessionID, args[0]); err != nil {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: escapeText(err.Error())})
+		return
+	}
+	s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Message deleted"})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"alantern/chattest"
+)
+
+func TestDeletionForgetsEveryCopy(t *testing.T) {
+	s, srv := newTestServer(t)
+	alice, bob := srv.Connect(), srv.Connect()
+	alice.SetNickname("alice")
+	bob.SetNickname("bob")
+	bob.Collect(settle)
+
+	alice.Send("regrettable")
+	message := bob.Expect(chattest.Text("regrettable"))[0]
+	s.summaryMu.Lock()
+	s.summaryMessages = append(s.summaryMessages, SummaryMessage{ID: message.ID, Nickname: "alice", Text: "regrettable"})
+	s.summaryMu.Unlock()
+	if _, err := s.follow(s.sessionOfHandle(message.Author.ID), message.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if status, body := alice.Upload(testPNG(t), false); status != 200 {
+		t.Fatalf("upload: %d %s", status, body)
+	}
+	image := bob.Expect(chattest.Kind("image"))[0]
+
+	alice.Send(";delete " + message.ID)
+	alice.Send(";delete " + image.ID)
+	bob.Expect(chattest.Kind("delete"), chattest.Kind("delete"))
+
+	events, _ := s.eventsSince("")
+	deleted := make(map[string]bool)
+	for _, event := range events {
+		if event.Kind == "delete" && event.Seq != 0 {
+			deleted[event.ID] = true
+		} else if event.ID == message.ID || event.ID == image.ID {
+			t.Errorf("%s still logged as %q", event.ID, event.Kind)
+		}
+	}
+	if !deleted[message.ID] || !deleted[image.ID] {
+		t.Errorf("deletions logged %v, want both", deleted)
+	}
+
+	s.summaryMu.Lock()
+	if len(s.summaryMessages) != 0 {
+		t.Errorf("summary keeps %+v", s.summaryMessages)
+	}
+	s.summaryMu.Unlock()
+	s.threadsMu.Lock()
+	if _, ok := s.threadFollowers[message.ID]; ok {
+		t.Error("thread of the deleted message still followed")
+	}
+	s.threadsMu.Unlock()
+	s.imageStoreMu.Lock()
+	if _, ok := s.imageStore[image.Content]; ok {
+		t.Error("deleted image still stored")
+	}
+	s.imageStoreMu.Unlock()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// /rooms is a directory of the rooms besides the main room, by category, with their description,
+// how many members they have and a button to join them. It is public unless ROOMS_DIRECTORY is
+// "members", for sessions with a nickname only, or "off". Rooms are listed unless a moderator of
+// the room unlists it with ;room unlist, in which case it only shows to its members and the
+// server's moderators; ;room category and ;room describe set what the directory shows. Rooms
+// opened from a template start with its category and description.
+
+var roomsDirectory = loadRoomsDirectory()
+
+var errNotRoomModerator = errors.New("Only moderators of the room can change it")
+
+const (
+	maxRoomCategory    = 32
+	maxRoomDescription = 200
+)
+
+func loadRoomsDirectory() string {
+	switch value := os.Getenv("ROOMS_DIRECTORY"); value {
+	case "members", "off":
+		return value
+	}
+	return "public"
+}
+
+// directory returns the rooms sessionID may see listed, by category and then name.
+func (s *ChatServer) directory(sessionID string) []Room {
+	moderator := s.isModerator(sessionID)
+	var rooms []Room
+	for _, room := range s.roomList() {
+		if !room.Unlisted || moderator || s.inRoom(sessionID, room.Name) {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+// directoryKey sorts rooms by category, those without one last, and then by name.
+func directoryKey(room Room) string {
+	if room.Category == "" {
+		return "1\x00" + room.Name
+	}
+	return "0" + room.Category + "\x00" + room.Name
+}
+
+// directoryAllowed reports whether sessionID may see the directory, or writes why not.
+func (s *ChatServer) directoryAllowed(w http.ResponseWriter, sessionID string) bool {
+	switch {
+	case roomsDirectory == "off":
+		http.Error(w, "The room directory is off", http.StatusNotFound)
+	case s.isBanned(sessionID):
+		http.Error(w, "You are banned", http.StatusForbidden)
+	case roomsDirectory == "members" && !s.hasNickname(sessionID):
+		http.Error(w, "Set a nickname to see the rooms", http.StatusForbidden)
+	default:
+		return true
+	}
+	return false
+}
+
+func (s *ChatServer) hasNickname(sessionID string) bool {
+	s.nicknamesMu.Lock()
+	defer s.nicknamesMu.Unlock()
+	_, ok := s.nicknames[sessionID]
+	return ok
+}
+
+// updateRoom applies change to the room name, which sessionID must moderate.
+func (s *ChatServer) updateRoom(sessionID, name string, change func(room *Room)) error {
+	if name == "" {
+		return errNotInRoom
+	}
+	if !s.moderatesRoom(sessionID, name) {
+		return errNotRoomModerator
+	}
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	room, ok := s.rooms[name]
+	if !ok {
+		return errUnknownRoom
+	}
+	change(room)
+	return nil
+}
+
+// handleRoomDirectoryCommand lists or unlists the current room, or sets its category or
+// description.
+func (s *ChatServer) handleRoomDirectoryCommand(sessionID string, args []string) {
+	reply := func(content string) {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: content})
+	}
+	name := s.currentRoom(sessionID)
+	text := strings.Join(args[1:], " ")
+
+	var err error
+	var done string
+	switch args[0] {
+	case "list", "unlist":
+		unlisted := args[0] == "unlist"
+		err = s.updateRoom(sessionID, name, func(room *Room) { room.Unlisted = unlisted })
+		done = fmt.Sprintf("#%s is now %sed in the room directory", name, args[0])
+	case "category":
+		if utf8.RuneCountInString(text) > maxRoomCategory || validateMessage(text) != nil {
+			reply(fmt.Sprintf("Usage: ;room category &lt;category&gt; (up to %d characters, none to clear it)", maxRoomCategory))
+			return
+		}
+		err = s.updateRoom(sessionID, name, func(room *Room) { room.Category = text })
+		done = fmt.Sprintf("#%s is now listed under %s", name, escapeText(text))
+	case "describe":
+		if utf8.RuneCountInString(text) > maxRoomDescription || validateMessage(text) != nil {
+			reply(fmt.Sprintf("Usage: ;room describe &lt;description&gt; (up to %d characters, none to clear it)", maxRoomDescription))
+			return
+		}
+		err = s.updateRoom(sessionID, name, func(room *Room) { room.Description = text })
+		done = fmt.Sprintf("Description of #%s updated", name)
+	}
+	if err != nil {
+		reply(escapeText(err.Error()))
+		return
+	}
+	s.audit(sessionID, "room."+args[0], name, text)
+	reply(done)
+}
+
+// handleRooms serves the room directory page.
+func (s *ChatServer) handleRooms(w http.ResponseWriter, r *http.Request) {
+	if !s.directoryAllowed(w, s.getOrCreateSession(w, r)) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	setPageHeaders(w)
+	fmt.Fprint(w, roomsPage)
+}
+
+// handleRoomDirectory lists the rooms of the directory (GET), or joins the session to "room"
+// (POST), making it where its messages go.
+func (s *ChatServer) handleRoomDirectory(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	if !s.directoryAllowed(w, sessionID) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writePage(w, r, s.directory(sessionID), directoryKey)
+
+	case http.MethodPost:
+		r.ParseForm()
+		// The directory joins existing rooms only, ;join opens new ones.
+		if !s.roomExists(r.FormValue("room")) {
+			http.Error(w, errUnknownRoom.Error(), http.StatusNotFound)
+			return
+		}
+		name, err := s.joinRoom(sessionID, r.FormValue("room"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"room": name})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+const roomsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width,initial-scale=1.0">
+  <title>Alantern rooms</title>
+  <style>
+    body { font-family: sans-serif; margin: 1em auto; max-width: 40em; padding: 0 1em; }
+    h2 { border-bottom: 1px solid #ddd; font-size: 1.1em; margin-top: 1.5em; }
+    .room { align-items: center; display: flex; gap: 1em; margin: 0.8em 0; }
+    .room div { flex: 1; }
+    .members, .unlisted { color: #777; font-size: 0.9em; }
+  </style>
+</head>
+<body>
+  <h1>Rooms</h1>
+  <p><a href="/">Back to the chat</a></p>
+  <div id="rooms">Loading…</div>
+  <script>
+    const list = document.getElementById("rooms");
+
+    function element(tag, text, className) {
+      const node = document.createElement(tag);
+      if (text) node.textContent = text;
+      if (className) node.className = className;
+      return node;
+    }
+
+    async function join(name) {
+      const body = new URLSearchParams({room: name});
+      const response = await fetch("/api/v1/rooms", {method: "POST", body});
+      if (response.ok) {
+        location.href = "/";
+      } else {
+        alert(await response.text());
+      }
+    }
+
+    async function load() {
+      let rooms = [];
+      for (let cursor = ""; ; ) {
+        const response = await fetch("/api/v1/rooms?limit=500" + (cursor ? "&cursor=" + cursor : ""));
+        if (!response.ok) {
+          list.textContent = await response.text();
+          return;
+        }
+        const page = await response.json();
+        rooms = rooms.concat(page.items);
+        if (!page.next) break;
+        cursor = page.next;
+      }
+      list.textContent = rooms.length ? "" : "No rooms yet. Open one in the chat with ;join <room>";
+
+      let category = null;
+      for (const room of rooms) {
+        if (room.category !== category) {
+          category = room.category;
+          list.appendChild(element("h2", category || "Other rooms"));
+        }
+        const row = element("div", "", "room");
+        const info = element("div");
+        info.appendChild(element("strong", "#" + room.name));
+        info.appendChild(element("span", " " + room.members + (room.members === 1 ? " member" : " members"), "members"));
+        if (room.unlisted) info.appendChild(element("span", " (unlisted)", "unlisted"));
+        if (room.description) info.appendChild(element("p", room.description));
+        const button = element("button", "Join");
+        button.onclick = () => join(room.name);
+        row.appendChild(info);
+        row.appendChild(button);
+        list.appendChild(row);
+      }
+    }
+
+    load();
+  </script>
+</body>
+</html>
+`
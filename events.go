@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Every public broadcast but viewer counts gets an identifier and is kept in a log of the last
+// eventLogSize events, so that bots which were offline can catch up with /api/v1/events before
+// switching to /events. Messages coalesced by livestream mode are logged one by one, unsampled.
+
+const eventLogSize = 1000
+
+// kindFilter selects events by kind, from the "kinds" and "exclude" comma-separated query
+// parameters. Batches are filtered message by message and dropped once empty.
+type kindFilter struct {
+	include map[string]bool
+	exclude map[string]bool
+}
+
+func parseKindFilter(r *http.Request) kindFilter {
+	return kindFilter{include: kindSet(r.URL.Query().Get("kinds")), exclude: kindSet(r.URL.Query().Get("exclude"))}
+}
+
+func kindSet(list string) map[string]bool {
+	kinds := map[string]bool{}
+	for _, kind := range strings.Split(list, ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			kinds[kind] = true
+		}
+	}
+	return kinds
+}
+
+func (f kindFilter) empty() bool {
+	return len(f.include) == 0 && len(f.exclude) == 0
+}
+
+func (f kindFilter) allows(kind string) bool {
+	return (len(f.include) == 0 || f.include[kind]) && !f.exclude[kind]
+}
+
+// apply returns message as it should be delivered through the filter, or false if it shouldn't be.
+func (f kindFilter) apply(message Message) (Message, bool) {
+	if message.Kind != "batch" || f.include["batch"] || f.exclude["batch"] {
+		return message, f.allows(message.Kind)
+	}
+	var messages []Message
+	for _, inner := range message.Messages {
+		if f.allows(inner.Kind) {
+			messages = append(messages, inner)
+		}
+	}
+	message.Messages = messages
+	return message, len(messages) > 0
+}
+
+// filterEncoded is apply for an already encoded message.
+func (f kindFilter) filterEncoded(data string) (string, bool) {
+	if f.empty() {
+		return data, true
+	}
+	var message Message
+	if err := json.Unmarshal([]byte(data), &message); err != nil {
+		return data, true
+	}
+	message, ok := f.apply(message)
+	if !ok || message.Kind != "batch" {
+		return data, ok
+	}
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return data, true
+	}
+	return string(encoded), true
+}
+
+// stamp returns message with an identifier, unless it already has one, and the current time.
+func (s *ChatServer) stamp(message Message) Message {
+	if message.ID == "" {
+		message.ID = s.newID()
+	}
+	message.Timestamp = s.clock.Now().UTC()
+	return message
+}
+
+// logEvent stamps message and assigns it its Seq, and appends it to the log, and to the message
+// store if there is one.
+func (s *ChatServer) logEvent(message Message) Message {
+	message = s.stamp(message)
+	if message.Kind == "viewers" {
+		return message
+	}
+
+	s.recordIncident(message)
+
+	s.eventLogMu.Lock()
+	s.eventSeq++
+	message.Seq = s.eventSeq
+	s.appendEventLocked(message)
+	s.eventLogMu.Unlock()
+	s.storeMessage(message)
+	s.archive(message)
+	return message
+}
+
+func (s *ChatServer) appendEventLocked(message Message) {
+	if len(s.eventLog) >= eventLogSize {
+		copy(s.eventLog, s.eventLog[1:])
+		s.eventLog = s.eventLog[:len(s.eventLog)-1]
+	}
+	s.eventLog = append(s.eventLog, message)
+}
+
+// eventsSince returns the logged events after the one with identifier since, or all of them if
+// since is empty. ok is false if since is no longer, or never was, in the log.
+func (s *ChatServer) eventsSince(since string) (events []Message, ok bool) {
+	s.eventLogMu.Lock()
+	defer s.eventLogMu.Unlock()
+	if since == "" {
+		return append([]Message{}, s.eventLog...), true
+	}
+	for i := len(s.eventLog) - 1; i >= 0; i-- {
+		if s.eventLog[i].ID == since {
+			return append([]Message{}, s.eventLog[i+1:]...), true
+		}
+	}
+	return nil, false
+}
+
+// handleEventsReplay returns the logged events after "since", oldest first, filtered like /events,
+// from the log of "room" when given, which the session must have joined unless it moderates.
+// next is set when more events remain: pass it as since.
+func (s *ChatServer) handleEventsReplay(w http.ResponseWriter, r *http.Request) {
+	page, ok := s.replayPage(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// replayPage returns the page of logged events r asks for, answering it if it can't be read.
+func (s *ChatServer) replayPage(w http.ResponseWriter, r *http.Request) (Page[Message], bool) {
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return Page[Message]{}, false
+	}
+
+	limit := defaultPageLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPageLimit {
+			http.Error(w, errInvalidPage.Error(), http.StatusBadRequest)
+			return Page[Message]{}, false
+		}
+		limit = n
+	}
+	filter := parseKindFilter(r)
+
+	var events []Message
+	var ok bool
+	if room := r.URL.Query().Get("room"); room != "" {
+		if !s.roomExists(room) {
+			http.Error(w, errUnknownRoom.Error(), http.StatusNotFound)
+			return Page[Message]{}, false
+		}
+		if !s.canReadRoom(sessionID, room) {
+			http.Error(w, errNotInRoom.Error(), http.StatusForbidden)
+			return Page[Message]{}, false
+		}
+		events, ok = s.roomEventsSince(room, r.URL.Query().Get("since"))
+	} else {
+		events, ok = s.eventsSince(r.URL.Query().Get("since"))
+	}
+	if !ok {
+		http.Error(w, "Event no longer in the log, fetch without since to start over", http.StatusGone)
+		return Page[Message]{}, false
+	}
+
+	page := Page[Message]{Items: []Message{}}
+	for _, event := range events {
+		if !filter.allows(event.Kind) {
+			continue
+		}
+		if len(page.Items) == limit {
+			page.Next = page.Items[limit-1].ID
+			break
+		}
+		page.Items = append(page.Items, event)
+	}
+	return page, true
+}
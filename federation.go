@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Federation links this instance's room with the room of other alantern instances. Every public
+// text message sent here is POSTed to each peer's /federation/inbox, signed with the shared
+// secret, and peers broadcast it locally with Origin set to this instance's name. Inbound
+// messages are never relayed onwards, so every instance has to list every other one as a peer.
+//
+// Configured with:
+//   - FEDERATION_NAME: name of this instance shown next to relayed messages
+//   - FEDERATION_SECRET: secret shared by all instances, used to sign requests
+//   - FEDERATION_PEERS: comma separated base URLs of the other instances
+//
+// Images aren't relayed since their identifiers only resolve on the instance they were uploaded to,
+// and neither are the session handles of authors and mentions, for the same reason: peers get the
+// nicknames alone.
+
+const (
+	// Oldest signed timestamp accepted from a peer.
+	federationMaxSkew = 5 * time.Minute
+	// Outgoing events buffered per peer before new ones are dropped.
+	federationQueueSize = 256
+	// How long event identifiers are remembered to drop duplicates.
+	federationDedupWindow = 10 * time.Minute
+)
+
+type federationConfig struct {
+	name   string
+	secret []byte
+	peers  []string
+}
+
+func loadFederationConfig() *federationConfig {
+	name, secret := os.Getenv("FEDERATION_NAME"), os.Getenv("FEDERATION_SECRET")
+	if name == "" || secret == "" {
+		return nil
+	}
+
+	cfg := &federationConfig{name: name, secret: []byte(secret)}
+	for _, peer := range strings.Split(os.Getenv("FEDERATION_PEERS"), ",") {
+		if peer = strings.TrimRight(strings.TrimSpace(peer), "/"); peer != "" {
+			cfg.peers = append(cfg.peers, peer)
+		}
+	}
+	return cfg
+}
+
+type FederatedEvent struct {
+	// Unique identifier of the event, used by peers to drop duplicates.
+	ID string `json:"id"`
+	// Name of the instance the message was sent on.
+	Origin string `json:"origin"`
+	// The message as broadcast on the origin instance.
+	Message Message `json:"message"`
+}
+
+func signFederationRequest(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// startFederation starts one delivery worker per peer. It does nothing if federation isn't configured.
+func (s *ChatServer) startFederation() {
+	if s.federation == nil {
+		return
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, peer := range s.federation.peers {
+		queue := make(chan []byte, federationQueueSize)
+		s.federationQueues = append(s.federationQueues, queue)
+		go func(peer string, queue chan []byte) {
+			for body := range queue {
+				if err := s.deliverFederated(client, peer, body); err != nil {
+					slog.Warn("Federation delivery failed", "peer", peer, "err", err)
+				}
+			}
+		}(peer, queue)
+	}
+}
+
+func (s *ChatServer) deliverFederated(client *http.Client, peer string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, peer+"/federation/inbox", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(s.clock.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Alantern-Origin", s.federation.name)
+	req.Header.Set("X-Alantern-Timestamp", timestamp)
+	req.Header.Set("X-Alantern-Signature", signFederationRequest(s.federation.secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer answered %s", resp.Status)
+	}
+	return nil
+}
+
+// federate queues a locally sent public message for delivery to every peer.
+func (s *ChatServer) federate(message Message) {
+	if s.federation == nil || message.Private || message.Kind != "text" {
+		return
+	}
+	// Interactions are handled by the instance the author is on, peers couldn't route them.
+	message.Components = nil
+	message = withoutSessions(message)
+
+	body, err := json.Marshal(FederatedEvent{
+		ID:      s.newID(),
+		Origin:  s.federation.name,
+		Message: message,
+	})
+	if err != nil {
+		return
+	}
+
+	for _, queue := range s.federationQueues {
+		select {
+		case queue <- body:
+		default:
+			slog.Warn("Federation queue full, dropping event")
+		}
+	}
+}
+
+// withoutSessions returns message without the sessions of its author and mentions.
+func withoutSessions(message Message) Message {
+	if message.Author != nil {
+		author := *message.Author
+		author.ID = ""
+		message.Author = &author
+	}
+	if message.Segments != nil {
+		segments := make([]Segment, len(message.Segments))
+		for i, segment := range message.Segments {
+			segment.SessionID = ""
+			segments[i] = segment
+		}
+		message.Segments = segments
+	}
+	return message
+}
+
+// seenFederatedEvent reports whether the event was already received, remembering it if not.
+func (s *ChatServer) seenFederatedEvent(id string) bool {
+	s.federationSeenMu.Lock()
+	defer s.federationSeenMu.Unlock()
+
+	now := s.clock.Now()
+	if _, ok := s.federationSeen[id]; ok {
+		return true
+	}
+	for seenID, at := range s.federationSeen {
+		if now.Sub(at) > federationDedupWindow {
+			delete(s.federationSeen, seenID)
+		}
+	}
+	s.federationSeen[id] = now
+	return false
+}
+
+// handleFederationInbox receives signed events from peer instances.
+func (s *ChatServer) handleFederationInbox(w http.ResponseWriter, r *http.Request) {
+	if s.federation == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, "Could not read body", http.StatusBadRequest)
+		return
+	}
+
+	timestamp := r.Header.Get("X-Alantern-Timestamp")
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || s.clock.Now().Sub(time.Unix(unix, 0)).Abs() > federationMaxSkew {
+		http.Error(w, "Stale or missing timestamp", http.StatusUnauthorized)
+		return
+	}
+	expected := signFederationRequest(s.federation.secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Alantern-Signature"))) {
+		http.Error(w, "Bad signature", http.StatusUnauthorized)
+		return
+	}
+
+	var event FederatedEvent
+	if err := json.Unmarshal(body, &event); err != nil || event.ID == "" || event.Message.Kind != "text" {
+		http.Error(w, "Invalid event", http.StatusBadRequest)
+		return
+	}
+	if event.Origin == "" || event.Origin == s.federation.name || event.Origin != r.Header.Get("X-Alantern-Origin") {
+		http.Error(w, "Invalid origin", http.StatusBadRequest)
+		return
+	}
+
+	if !s.seenFederatedEvent(event.ID) {
+		message := event.Message
+		message.ID = ""
+		message.FromApp = false
+		message.Private = false
+		message.Origin = event.Origin
+		s.broadcastMessage(withoutSessions(message))
+	}
+	w.WriteHeader(http.StatusOK)
+}
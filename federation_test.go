@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"alantern/chattest"
+)
+
+func TestFederatedMessagesCarryNoSessions(t *testing.T) {
+	s, srv := newTestServer(t)
+	queue := make(chan []byte, 1)
+	s.federation = &federationConfig{name: "here", secret: []byte("test-secret")}
+	s.federationQueues = []chan []byte{queue}
+	alice, bob := srv.Connect(), srv.Connect()
+	alice.SetNickname("alice")
+	bob.SetNickname("bob")
+
+	alice.Send("hi @bob")
+	var event FederatedEvent
+	select {
+	case body := <-queue:
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(chattest.DefaultTimeout):
+		t.Fatal("message not federated")
+	}
+	if event.Message.Author == nil || event.Message.Author.ID != "" || event.Message.Author.Nickname != "alice" {
+		t.Errorf("federated author %+v, want alice without a session", event.Message.Author)
+	}
+	for _, segment := range event.Message.Segments {
+		if segment.SessionID != "" {
+			t.Errorf("federated mention of %s", segment.SessionID)
+		}
+	}
+	if len(event.Message.Segments) != 2 {
+		t.Errorf("federated segments %+v, want the mention kept", event.Message.Segments)
+	}
+}
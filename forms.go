@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// Bots can ask a single user to fill in a form, for onboarding surveys or ticket intake. The
+// user gets a private "form" event describing its fields, submits it once with
+// /api/v1/forms/submit, and once every value is valid the bot gets a private "response" event
+// with them.
+
+const (
+	formLifetime    = time.Hour
+	maxFormFields   = 10
+	maxFormTitle    = 200
+	maxFormFieldLen = 2000
+)
+
+var formFieldNamePattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+var (
+	errInvalidForm  = errors.New("Invalid form: expected a title and a JSON array of 1 to 10 fields with unique names, labels and a type of text, number or select")
+	errUnknownForm  = errors.New("Unknown or expired form")
+	errFormNotYours = errors.New("This form was sent to someone else")
+)
+
+type FormField struct {
+	// Key of the value in the response, lowercase letters, digits and _.
+	Name string `json:"name"`
+	// HTML-escaped label.
+	Label string `json:"label"`
+	// "text", "number" or "select".
+	Type     string `json:"type"`
+	Required bool   `json:"required,omitempty"`
+	// Longest text accepted, maxFormFieldLen if unset.
+	MaxLength int `json:"maxLength,omitempty"`
+	// Choices of a select.
+	Options []ComponentOption `json:"options,omitempty"`
+}
+
+type Form struct {
+	ID string `json:"id"`
+	// HTML-escaped title.
+	Title  string      `json:"title"`
+	Fields []FormField `json:"fields"`
+	// When the form can no longer be submitted.
+	Expires time.Time `json:"expires"`
+}
+
+type FormResponse struct {
+	// Identifier of the form.
+	Form string `json:"form"`
+	// Values by field name. Fields left empty are absent.
+	Values map[string]string `json:"values"`
+}
+
+type pendingForm struct {
+	Form
+	Bot       string
+	Recipient string
+}
+
+// parseForm validates a form schema sent by a bot, escaping its labels.
+func parseForm(title, fields string) (Form, error) {
+	form := Form{Title: escapeText(title)}
+	if title == "" || utf8.RuneCountInString(title) > maxFormTitle || validateMessage(title) != nil {
+		return form, errInvalidForm
+	}
+	if err := json.Unmarshal([]byte(fields), &form.Fields); err != nil || len(form.Fields) == 0 || len(form.Fields) > maxFormFields {
+		return form, errInvalidForm
+	}
+
+	names := map[string]bool{}
+	for i := range form.Fields {
+		field := &form.Fields[i]
+		field.Label = normalizeMessage(field.Label)
+		if !formFieldNamePattern.MatchString(field.Name) || field.Name == "id" || names[field.Name] || !validComponentText(field.Label) {
+			return form, errInvalidForm
+		}
+		names[field.Name] = true
+		field.Label = escapeText(field.Label)
+		if field.MaxLength <= 0 || field.MaxLength > maxFormFieldLen {
+			field.MaxLength = maxFormFieldLen
+		}
+
+		switch field.Type {
+		case "text", "number":
+			if len(field.Options) > 0 {
+				return form, errInvalidForm
+			}
+		case "select":
+			if len(field.Options) == 0 || len(field.Options) > maxComponentOptions {
+				return form, errInvalidForm
+			}
+			for j := range field.Options {
+				option := &field.Options[j]
+				option.Label = normalizeMessage(option.Label)
+				if !validComponentText(option.Value) || !validComponentText(option.Label) {
+					return form, errInvalidForm
+				}
+				option.Label = escapeText(option.Label)
+			}
+		default:
+			return form, errInvalidForm
+		}
+	}
+	return form, nil
+}
+
+// validate checks a submitted value against the field.
+func (field FormField) validate(value string) error {
+	if value == "" {
+		if field.Required {
+			return fmt.Errorf("%s is required", field.Name)
+		}
+		return nil
+	}
+	if utf8.RuneCountInString(value) > field.MaxLength {
+		return fmt.Errorf("%s is longer than %d characters", field.Name, field.MaxLength)
+	}
+	if err := validateMessage(value); err != nil {
+		return fmt.Errorf("%s: %s", field.Name, err)
+	}
+
+	switch field.Type {
+	case "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("%s must be a number", field.Name)
+		}
+	case "select":
+		for _, option := range field.Options {
+			if option.Value == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s must be one of the options", field.Name)
+	}
+	return nil
+}
+
+// sendForm sends form from bot to recipient privately.
+func (s *ChatServer) sendForm(bot, recipient string, form Form) Form {
+	form.ID = s.newID()
+	form.Expires = s.clock.Now().Add(formLifetime)
+
+	s.formsMu.Lock()
+	s.forms[form.ID] = &pendingForm{Form: form, Bot: bot, Recipient: recipient}
+	s.formsMu.Unlock()
+
+	s.sendTo(recipient, Message{
+		FromApp: true,
+		Author:  s.authorOf(bot),
+		Kind:    "form",
+		Private: true,
+		Form:    &form,
+	})
+	return form
+}
+
+// submitForm validates the values sessionID entered in a form and delivers them to its bot.
+func (s *ChatServer) submitForm(sessionID, id string, value func(name string) string) error {
+	s.formsMu.Lock()
+	pending, ok := s.forms[id]
+	if ok && !s.clock.Now().Before(pending.Expires) {
+		delete(s.forms, id)
+		ok = false
+	}
+	s.formsMu.Unlock()
+	if !ok {
+		return errUnknownForm
+	}
+	if pending.Recipient != sessionID {
+		return errFormNotYours
+	}
+
+	response := FormResponse{Form: id, Values: map[string]string{}}
+	for _, field := range pending.Fields {
+		v := value(field.Name)
+		if err := field.validate(v); err != nil {
+			return err
+		}
+		if v != "" {
+			response.Values[field.Name] = v
+		}
+	}
+
+	// Submitted forms are gone, so that each one is answered once.
+	s.formsMu.Lock()
+	_, ok = s.forms[id]
+	delete(s.forms, id)
+	s.formsMu.Unlock()
+	if !ok {
+		return errUnknownForm
+	}
+
+	s.sendTo(pending.Bot, Message{
+		FromApp:  true,
+		Author:   s.authorOf(sessionID),
+		Kind:     "response",
+		Private:  true,
+		Response: &response,
+	})
+	return nil
+}
+
+// expireForms forgets forms that can no longer be submitted.
+func (s *ChatServer) expireForms() {
+	s.formsMu.Lock()
+	defer s.formsMu.Unlock()
+	for id, pending := range s.forms {
+		if !s.clock.Now().Before(pending.Expires) {
+			delete(s.forms, id)
+		}
+	}
+}
+
+// handleForms sends the form made of "title" and the JSON array of FormField "fields" to the
+// session or nickname "to".
+func (s *ChatServer) handleForms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+
+	r.ParseForm()
+	form, err := parseForm(normalizeMessage(r.FormValue("title")), r.FormValue("fields"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	recipient := s.findSession(r.FormValue("to"))
+	if recipient == "" {
+		http.Error(w, "Recipient not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.sendForm(sessionID, recipient, form))
+}
+
+// handleFormSubmit submits the form "id", with one form value per field.
+func (s *ChatServer) handleFormSubmit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := s.getOrCreateSession(w, r)
+
+	r.ParseForm()
+	value := func(name string) string { return normalizeMessage(r.FormValue(name)) }
+	switch err := s.submitForm(sessionID, r.FormValue("id"), value); err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errUnknownForm:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errFormNotYours:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
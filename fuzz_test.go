@@ -0,0 +1,94 @@
+package main
+
+// Fuzz targets for what members send, run with go test -fuzz, e.g.:
+//
+//	go test -fuzz FuzzSend
+//
+// Without -fuzz, go test runs them on their seed inputs only. Each input runs against a fresh
+// server so runs don't influence each other through rate limits.
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func newFuzzServer() *ChatServer {
+	return NewChatServer(WithIDGenerator(func() string { return "fuzz" }))
+}
+
+// FuzzSend posts a message, so it goes through normalization, validation and, for commands,
+// handleCommand. Anything other than a success or a clean rejection is a bug.
+func FuzzSend(f *testing.F) {
+	for _, seed := range []string{"hello", "", " ", ";help", ";whisper", ";whisper bob", ";color #zzz",
+		"<script>alert(1)</script>", "@nobody https://example.com 🎉", "a\u202eb\u200bc", "z\u0301\u0302\u0303\u0304\u0305\u0306",
+		strings.Repeat("x", 5000), "\xff\xfe"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, message string) {
+		s := newFuzzServer()
+		form := url.Values{"message": {message}}
+		req := httptest.NewRequest(http.MethodPost, "/send", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+
+		s.handleSendMessage(w, req)
+		if w.Code != http.StatusOK && w.Code != http.StatusBadRequest {
+			t.Fatalf("sending %q: status %d", message, w.Code)
+		}
+	})
+}
+
+// FuzzCommand runs a command as the owner, so that the privileged commands get exercised too.
+func FuzzCommand(f *testing.F) {
+	for _, seed := range []string{"help", "mute", "mute x 1h", "ban x -1s", "raidmode on 99999999h", "slowmode 0s",
+		"pin for 1ns x", "todo done -1", "timer 1ns", `event "" 2024-13-40 25:61`, "room create ../x", "delete",
+		"snippet save a", "incident note", "kick"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, command string) {
+		if validateMessage(command) != nil {
+			t.Skip()
+		}
+		s := newFuzzServer()
+		s.roles["fuzz"] = RoleOwner
+		s.handleCommand("fuzz", ";"+command)
+	})
+}
+
+// FuzzNickname checks that accepted nicknames are safe to show.
+func FuzzNickname(f *testing.F) {
+	for _, seed := range []string{"alice", "", "a b", "\u202eevil", "zero\u200bwidth", "e\u0301", "<b>", "\xff"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, nickname string) {
+		nickname = normalizeNickname(nickname)
+		if validateNickname(nickname) != nil {
+			return
+		}
+		if !utf8.ValidString(nickname) || strings.ContainsAny(nickname, " \n\r\t\u202e\u200b") {
+			t.Fatalf("accepted nickname %q", nickname)
+		}
+	})
+}
+
+// FuzzSegments checks that the segments of a text message put together are the message.
+func FuzzSegments(f *testing.F) {
+	for _, seed := range []string{"plain", "hi @bob!", "see https://example.com/a?b=(c).", "👍🏽 and 👨\u200d👩\u200d👧", "🇫🇷@", "http://", "@"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, text string) {
+		s := newFuzzServer()
+		var b strings.Builder
+		segments := s.segments(text)
+		for _, segment := range segments {
+			b.WriteString(segment.Text)
+		}
+		if segments != nil && b.String() != text {
+			t.Fatalf("segments of %q put together are %q", text, b.String())
+		}
+	})
+}
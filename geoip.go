@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type GeoInfo struct {
+	// ISO 3166-1 country code, if the country database knows the address.
+	Country string `json:"country,omitempty"`
+	// Autonomous system number, if the ASN database knows the address.
+	ASN uint `json:"asn,omitempty"`
+	// Organisation owning the autonomous system (usually the ISP or hosting/VPN provider).
+	ASOrg string `json:"asOrg,omitempty"`
+}
+
+type SessionInfo struct {
+	// Handle of the session, see sessionHandle.
+	ID string `json:"id"`
+	// Nickname of the session.
+	Nickname string `json:"nickname"`
+	// Address the session was last seen from.
+	IP string `json:"ip"`
+	// When the session was first seen.
+	FirstSeen time.Time `json:"firstSeen"`
+	// Coarse location of IP. Only present when a GeoIP database is configured.
+	Geo *GeoInfo `json:"geo,omitempty"`
+	// Handle of the banned session this one likely belongs to, according to the ban evasion
+	// heuristics.
+	LikelySameAs string `json:"likelySameAs,omitempty"`
+}
+
+// geoResolver looks up addresses in operator supplied MaxMind DB files. Either database may be nil.
+type geoResolver struct {
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+// openGeoResolver opens the country (GeoLite2-Country or -City) and ASN databases at the given
+// paths. Empty paths are skipped; if both are empty, it returns nil.
+func openGeoResolver(countryPath, asnPath string) (*geoResolver, error) {
+	if countryPath == "" && asnPath == "" {
+		return nil, nil
+	}
+
+	g := &geoResolver{}
+	var err error
+	if countryPath != "" {
+		if g.country, err = maxminddb.Open(countryPath); err != nil {
+			return nil, err
+		}
+	}
+	if asnPath != "" {
+		if g.asn, err = maxminddb.Open(asnPath); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+func (g *geoResolver) lookup(ip net.IP) *GeoInfo {
+	if g == nil || ip == nil {
+		return nil
+	}
+
+	info := &GeoInfo{}
+	if g.country != nil {
+		var record struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if err := g.country.Lookup(ip, &record); err == nil {
+			info.Country = record.Country.ISOCode
+		}
+	}
+	if g.asn != nil {
+		var record struct {
+			Number       uint   `maxminddb:"autonomous_system_number"`
+			Organization string `maxminddb:"autonomous_system_organization"`
+		}
+		if err := g.asn.Lookup(ip, &record); err == nil {
+			info.ASN = record.Number
+			info.ASOrg = record.Organization
+		}
+	}
+	return info
+}
+
+func (s *ChatServer) sessionInfos() []SessionInfo {
+	s.sessionFirstSeenMu.Lock()
+	infos := make([]SessionInfo, 0, len(s.sessionFirstSeen))
+	for id, firstSeen := range s.sessionFirstSeen {
+		infos = append(infos, SessionInfo{
+			ID:           id,
+			FirstSeen:    firstSeen,
+			IP:           s.sessionTraits[id].ip,
+			LikelySameAs: s.evasionSuspects[id],
+		})
+	}
+	s.sessionFirstSeenMu.Unlock()
+
+	for i := range infos {
+		infos[i].Nickname = s.getNickname(infos[i].ID)
+		infos[i].Geo = s.geo.lookup(net.ParseIP(infos[i].IP))
+		infos[i].ID = sessionHandle(infos[i].ID)
+		if infos[i].LikelySameAs != "" {
+			infos[i].LikelySameAs = sessionHandle(infos[i].LikelySameAs)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].FirstSeen.Before(infos[j].FirstSeen)
+	})
+	return infos
+}
+
+// handleModSessions lists known sessions with their address and GeoIP annotations, a page at a time.
+func (s *ChatServer) handleModSessions(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	if !s.isModerator(sessionID) {
+		http.Error(w, "Moderators only", http.StatusForbidden)
+		return
+	}
+
+	writePage(w, r, s.sessionInfos(), func(info SessionInfo) string { return timeKey(info.FirstSeen, info.ID) })
+}
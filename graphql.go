@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// /graphql offers the room's state through a single GraphQL endpoint. Queries are POSTed as
+// {"query", "operationName", "variables"} or passed as GET parameters. Subscriptions are served
+// over server-sent events: send Accept: text/event-stream and every result arrives as one event.
+// The history query returns the last events of the room's event log, oldest first, as new /events
+// streams start with (see history.go). Other rooms are only for their members, so stay off it.
+
+const graphQLSchema = `
+	schema {
+		query: Query
+		subscription: Subscription
+	}
+
+	scalar Time
+
+	type Query {
+		# The room, the only one this server hosts.
+		room: Room!
+		# Every room, for clients written against multi-room servers.
+		rooms: [Room!]!
+		# Sessions that have set a nickname.
+		members: [Member!]!
+		# Pinned messages, oldest first.
+		pins: [Pin!]!
+		# The last logged events, oldest first: HISTORY_SIZE of them unless last is given.
+		history(last: Int): [Message!]!
+	}
+
+	type Subscription {
+		# Public broadcasts, optionally only of the given kinds.
+		messages(kinds: [String!]): Message!
+	}
+
+	type Room {
+		name: String!
+		presence: Presence!
+		members: [Member!]!
+		pins: [Pin!]!
+		history(last: Int): [Message!]!
+	}
+
+	type Presence {
+		connected: Int!
+		members: Int!
+		lurkers: Int!
+	}
+
+	type Member {
+		id: String!
+		nickname: String!
+		color: String!
+		role: String!
+	}
+
+	type Pin {
+		id: String!
+		content: String!
+		pinnedBy: String!
+		pinnedAt: Time!
+	}
+
+	type Message {
+		id: String
+		fromApp: Boolean!
+		author: Author
+		kind: String!
+		content: String!
+		url: String
+		private: Boolean!
+		origin: String
+		messages: [Message!]
+	}
+
+	type Author {
+		id: String!
+		nickname: String!
+		color: String!
+	}
+`
+
+type graphQLResolver struct {
+	s *ChatServer
+}
+
+type graphQLRoom struct {
+	s *ChatServer
+}
+
+type graphQLPresence struct {
+	Connected int32
+	Members   int32
+	Lurkers   int32
+}
+
+type graphQLMember struct {
+	ID       string
+	Nickname string
+	Color    string
+	Role     string
+}
+
+type graphQLPin struct {
+	ID       string
+	Content  string
+	PinnedBy string
+	PinnedAt graphql.Time
+}
+
+type graphQLMessage struct {
+	m Message
+}
+
+func (r *graphQLResolver) Room() *graphQLRoom {
+	return &graphQLRoom{r.s}
+}
+
+func (r *graphQLResolver) Rooms() []*graphQLRoom {
+	return []*graphQLRoom{{r.s}}
+}
+
+func (r *graphQLResolver) Members() []*graphQLMember {
+	return graphQLMembers(r.s)
+}
+
+func (r *graphQLResolver) Pins() []*graphQLPin {
+	return graphQLPins(r.s)
+}
+
+func (r *graphQLResolver) History(args struct{ Last *int32 }) []*graphQLMessage {
+	return graphQLHistory(r.s, args.Last)
+}
+
+func (r *graphQLResolver) Messages(ctx context.Context, args struct{ Kinds *[]string }) <-chan *graphQLMessage {
+	kinds := map[string]bool{}
+	if args.Kinds != nil {
+		for _, kind := range *args.Kinds {
+			kinds[kind] = true
+		}
+	}
+
+	id := r.s.newID()
+	feed := make(chan string, relaySubscriberBuffer)
+	r.s.relaySubscribersMu.Lock()
+	r.s.relaySubscribers[id] = feed
+	r.s.relaySubscribersMu.Unlock()
+
+	out := make(chan *graphQLMessage)
+	go func() {
+		defer close(out)
+		defer func() {
+			r.s.relaySubscribersMu.Lock()
+			delete(r.s.relaySubscribers, id)
+			r.s.relaySubscribersMu.Unlock()
+		}()
+		for {
+			select {
+			case data := <-feed:
+				var message Message
+				if err := json.Unmarshal([]byte(data), &message); err != nil {
+					continue
+				}
+				if len(kinds) > 0 && !kinds[message.Kind] {
+					continue
+				}
+				select {
+				case out <- &graphQLMessage{message}:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (r *graphQLRoom) Name() string {
+	if r.s.federation != nil {
+		return r.s.federation.name
+	}
+	return "alantern"
+}
+
+func (r *graphQLRoom) Presence() *graphQLPresence {
+	p := r.s.presence()
+	return &graphQLPresence{Connected: int32(p.Connected), Members: int32(p.Members), Lurkers: int32(p.Lurkers)}
+}
+
+func (r *graphQLRoom) Members() []*graphQLMember {
+	return graphQLMembers(r.s)
+}
+
+func (r *graphQLRoom) Pins() []*graphQLPin {
+	return graphQLPins(r.s)
+}
+
+func (r *graphQLRoom) History(args struct{ Last *int32 }) []*graphQLMessage {
+	return graphQLHistory(r.s, args.Last)
+}
+
+func graphQLMembers(s *ChatServer) []*graphQLMember {
+	members := []*graphQLMember{}
+	for _, member := range s.members() {
+		members = append(members, &graphQLMember{ID: member.ID, Nickname: member.Nickname, Color: member.Color, Role: member.Role.String()})
+	}
+	return members
+}
+
+func graphQLPins(s *ChatServer) []*graphQLPin {
+	mainPins := s.pinsIn("")
+	pins := make([]*graphQLPin, 0, len(mainPins))
+	for _, pin := range mainPins {
+		pins = append(pins, &graphQLPin{ID: pin.ID, Content: pin.Content, PinnedBy: pin.PinnedBy, PinnedAt: graphql.Time{Time: pin.PinnedAt}})
+	}
+	return pins
+}
+
+// graphQLHistory returns the last events of the event log, historySize of them unless last is
+// given, and at most eventLogSize.
+func graphQLHistory(s *ChatServer, last *int32) []*graphQLMessage {
+	n := historySize
+	if last != nil {
+		n = max(0, min(int(*last), eventLogSize))
+	}
+	events := s.history(n)
+	messages := make([]*graphQLMessage, len(events))
+	for i, event := range events {
+		messages[i] = &graphQLMessage{event}
+	}
+	return messages
+}
+
+func (m *graphQLMessage) ID() *string            { return optional(m.m.ID) }
+func (m *graphQLMessage) FromApp() bool          { return m.m.FromApp }
+func (m *graphQLMessage) Kind() string           { return m.m.Kind }
+func (m *graphQLMessage) Content() string        { return m.m.Content }
+func (m *graphQLMessage) URL() *string           { return optional(m.m.URL) }
+func (m *graphQLMessage) Private() bool          { return m.m.Private }
+func (m *graphQLMessage) Origin() *string        { return optional(m.m.Origin) }
+func (m *graphQLMessage) Author() *MessageAuthor { return m.m.Author }
+
+func (m *graphQLMessage) Messages() *[]*graphQLMessage {
+	if m.m.Messages == nil {
+		return nil
+	}
+	messages := make([]*graphQLMessage, len(m.m.Messages))
+	for i, message := range m.m.Messages {
+		messages[i] = &graphQLMessage{message}
+	}
+	return &messages
+}
+
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func (s *ChatServer) newGraphQLSchema() *graphql.Schema {
+	return graphql.MustParseSchema(graphQLSchema, &graphQLResolver{s}, graphql.UseFieldResolvers(), graphql.MaxDepth(8))
+}
+
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+func (s *ChatServer) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	if s.isBanned(s.getOrCreateSession(w, r)) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+
+	var req graphQLRequest
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if variables := r.URL.Query().Get("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				http.Error(w, "Invalid variables", http.StatusBadRequest)
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "Invalid GraphQL request", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.graphQL.Exec(r.Context(), req.Query, req.OperationName, req.Variables))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	results, err := s.graphQL.Subscribe(r.Context(), req.Query, req.OperationName, req.Variables)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for result := range results {
+		data, err := json.Marshal(result)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Every response tells browsers not to sniff its type, and how much of its URL to send as the
+// referrer of links followed from it: REFERRER_POLICY, "same-origin" unless set. Every HTML page
+// also gets a Content Security Policy, CONTENT_SECURITY_POLICY unless the default below suits,
+// that only lets it load what this origin serves, plus the frame-ancestors of FRAME_ANCESTORS
+// ("'self'" unless set) to choose which sites may embed it. /api/docs, whose Swagger UI comes
+// from unpkg.com, has a fixed policy allowing that instead. Uploaded images get a policy of their
+// own that sandboxes them, so that an HTML or SVG file passed off as an image can't run scripts
+// in the chat's origin when opened directly.
+
+const (
+	defaultContentSecurityPolicy = "default-src 'self'; script-src 'self' 'unsafe-inline'; style-src 'self' 'unsafe-inline'; " +
+		"img-src 'self' data: blob:; media-src 'self' blob:; connect-src 'self'; object-src 'none'; base-uri 'self'; form-action 'self'"
+	imageContentSecurityPolicy = "default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'; sandbox"
+	docsContentSecurityPolicy  = "default-src 'self'; script-src 'self' 'unsafe-inline' https://unpkg.com; style-src 'self' 'unsafe-inline' https://unpkg.com; " +
+		"img-src 'self' data:; connect-src 'self'; object-src 'none'; base-uri 'self'; form-action 'self'"
+)
+
+var (
+	contentSecurityPolicy = envOr("CONTENT_SECURITY_POLICY", defaultContentSecurityPolicy)
+	referrerPolicy        = envOr("REFERRER_POLICY", "same-origin")
+	frameAncestors        = envOr("FRAME_ANCESTORS", "'self'")
+)
+
+// securityHeaders adds the headers every response gets to those of next.
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", referrerPolicy)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setPageHeaders sets the Content Security Policy of the chat page and the other HTML pages.
+func setPageHeaders(w http.ResponseWriter) {
+	setPolicyHeaders(w, contentSecurityPolicy)
+}
+
+// setPolicyHeaders sets policy as the Content Security Policy of a page, with FRAME_ANCESTORS.
+func setPolicyHeaders(w http.ResponseWriter, policy string) {
+	w.Header().Set("Content-Security-Policy", strings.TrimSuffix(policy, ";")+"; frame-ancestors "+frameAncestors)
+	// For browsers predating frame-ancestors.
+	switch frameAncestors {
+	case "'none'":
+		w.Header().Set("X-Frame-Options", "DENY")
+	case "'self'":
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+	}
+}
+
+// setImageHeaders sets the Content Security Policy of uploaded images.
+func setImageHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Security-Policy", imageContentSecurityPolicy)
+}
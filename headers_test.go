@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHTMLPagesHaveAPolicy(t *testing.T) {
+	key := moderatorKey
+	moderatorKey = "test-key"
+	t.Cleanup(func() { moderatorKey = key })
+
+	_, srv := newTestServer(t)
+	mod := srv.Connect()
+	mod.Send(";mod test-key")
+	mod.Collect(settle)
+
+	for _, path := range []string{"/", "/rooms", "/debug/events", "/api/docs"} {
+		resp, _ := mod.Get(path)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s: %s", path, resp.Status)
+			continue
+		}
+		policy := resp.Header.Get("Content-Security-Policy")
+		if !strings.Contains(policy, "default-src 'self'") || !strings.Contains(policy, "frame-ancestors "+frameAncestors) {
+			t.Errorf("GET %s: Content-Security-Policy %q, want the page policy", path, policy)
+		}
+		if path == "/api/docs" && !strings.Contains(policy, "script-src 'self' 'unsafe-inline' https://unpkg.com") {
+			t.Errorf("GET /api/docs: Content-Security-Policy %q, want it to allow Swagger UI from unpkg.com", policy)
+		}
+	}
+}
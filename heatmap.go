@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// /api/v1/activity returns how many messages and images were sent in a room each hour of the last
+// days, from the counts kept for the statistics (see stats.go), for the interface to draw an
+// activity heatmap with: a row per day, UTC, oldest first, and a column per hour. Other rooms'
+// heatmaps are only shown to their members, like their messages.
+
+const (
+	defaultHeatmapDays = 30
+	maxHeatmapDays     = 90
+)
+
+type HeatmapDay struct {
+	// Day, as YYYY-MM-DD.
+	Date  string  `json:"date"`
+	Hours [24]int `json:"hours"`
+	Total int     `json:"total"`
+}
+
+type Heatmap struct {
+	// Room, empty for the main room.
+	Room string       `json:"room,omitempty"`
+	Days []HeatmapDay `json:"days"`
+	// Most messages sent in any one hour, to scale the colors by.
+	Max int `json:"max"`
+}
+
+// heatmap returns the hourly message counts of room over the last days, today included.
+func (s *ChatServer) heatmap(room string, days int) Heatmap {
+	today := s.clock.Now().UTC().Truncate(24 * time.Hour)
+	heatmap := Heatmap{Room: room, Days: make([]HeatmapDay, days)}
+	for i := range heatmap.Days {
+		heatmap.Days[i].Date = today.AddDate(0, 0, i-days+1).Format(time.DateOnly)
+	}
+
+	first := today.AddDate(0, 0, 1-days)
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	for hour, activity := range s.activity {
+		start := time.Unix(hour, 0).UTC()
+		count := activity.rooms[room]
+		if start.Before(first) || count == 0 {
+			continue
+		}
+		day := int(start.Sub(first) / (24 * time.Hour))
+		if day >= days {
+			continue
+		}
+		heatmap.Days[day].Hours[start.Hour()] += count
+		heatmap.Days[day].Total += count
+		heatmap.Max = max(heatmap.Max, heatmap.Days[day].Hours[start.Hour()])
+	}
+	return heatmap
+}
+
+// handleActivity returns the heatmap of "room", the main room by default, over the last "days".
+func (s *ChatServer) handleActivity(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+
+	days := defaultHeatmapDays
+	if value := r.URL.Query().Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxHeatmapDays {
+			http.Error(w, "Invalid days: expected 1 to 90", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	room := normalizeRoom(r.URL.Query().Get("room"))
+	if room != "" && (!s.roomExists(room) || !s.inRoom(sessionID, room)) {
+		http.Error(w, errUnknownRoom.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.heatmap(room, days))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// So that people opening the page don't find an empty room, new /events streams start with the
+// last HISTORY_SIZE events of the event log, 50 unless set and at most eventLogSize, before live
+// events, on relay edges too, and with the last as many messages of each room the session is in.
+// Clients that don't want them, like bots, pass history=0, and /graphql has them as the history
+// query. Resumed
+// streams get what they missed instead, see resume.go, as do those reconnecting with a
+// Last-Event-ID, see sse.go.
+
+const defaultHistorySize = 50
+
+var historySize = loadHistorySize()
+
+func loadHistorySize() int {
+	n, err := strconv.Atoi(os.Getenv("HISTORY_SIZE"))
+	if err != nil || n < 0 {
+		return defaultHistorySize
+	}
+	return min(n, eventLogSize)
+}
+
+// historyLength returns how many events the stream requested by r starts with.
+func historyLength(r *http.Request) int {
+	if n, err := strconv.Atoi(r.URL.Query().Get("history")); err == nil && n >= 0 && n < historySize {
+		return n
+	}
+	return historySize
+}
+
+// subscribe connects ch as the stream of sessionID, requested by r, and returns the logged events
+// it starts with, oldest first. No broadcast comes in between, so none is missed or sent twice.
+func (s *ChatServer) subscribe(sessionID string, ch chan string, r *http.Request) []Message {
+	s.broadcastMu.Lock()
+	defer s.broadcastMu.Unlock()
+	backlog := s.backlog(sessionID, r)
+	s.hub.connect(sessionID, ch)
+	return backlog
+}
+
+// backlog returns the logged events the stream of sessionID requested by r starts with: those
+// after its Last-Event-ID, or else its history and that of its rooms, oldest first. Called with
+// broadcastMu held.
+func (s *ChatServer) backlog(sessionID string, r *http.Request) []Message {
+	if seq, ok := lastEventID(r); ok {
+		if events, ok := s.catchUp(seq); ok {
+			return events
+		}
+	}
+	n := historyLength(r)
+	if n == 0 {
+		return nil
+	}
+	events := s.historyLocked(n)
+	rooms := s.roomHistory(sessionID, n)
+	if len(rooms) == 0 {
+		return events
+	}
+	events = append(events, rooms...)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Timestamp.Before(events[j].Timestamp) })
+	return events
+}
+
+// history returns the last n events of the event log, oldest first.
+func (s *ChatServer) history(n int) []Message {
+	s.broadcastMu.Lock()
+	defer s.broadcastMu.Unlock()
+	return s.historyLocked(n)
+}
+
+// historyLocked is history with broadcastMu held.
+func (s *ChatServer) historyLocked(n int) []Message {
+	events, _ := s.eventsSince("")
+	return lastEvents(s.unbatched(events), n)
+}
+
+// roomHistory returns the last n messages of each room sessionID is in.
+func (s *ChatServer) roomHistory(sessionID string, n int) []Message {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	var events []Message
+	for _, room := range s.rooms {
+		if room.members[sessionID] {
+			events = append(events, lastEvents(room.log, n)...)
+		}
+	}
+	return events
+}
+
+func lastEvents(events []Message, n int) []Message {
+	if len(events) > n {
+		return events[len(events)-n:]
+	}
+	return events
+}
+
+// unbatched returns events without the messages waiting for the next livestream batch, which
+// subscribers get with it. Called with broadcastMu held.
+func (s *ChatServer) unbatched(events []Message) []Message {
+	s.livestreamMu.Lock()
+	pending := make(map[string]bool, len(s.livestream.pending))
+	for _, message := range s.livestream.pending {
+		pending[message.ID] = true
+	}
+	s.livestreamMu.Unlock()
+	if len(pending) == 0 {
+		return events
+	}
+	var kept []Message
+	for _, event := range events {
+		if !pending[event.ID] {
+			kept = append(kept, event)
+		}
+	}
+	return kept
+}
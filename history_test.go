@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+
+	"alantern/chattest"
+)
+
+// said returns what members said among events.
+func said(events []chattest.Event) []string {
+	var texts []string
+	for _, e := range events {
+		if e.Kind == "text" && !e.Private && !e.FromApp {
+			texts = append(texts, e.Content)
+		}
+	}
+	return texts
+}
+
+func TestHistoryIncludesJoinedRooms(t *testing.T) {
+	_, srv := newTestServer(t)
+	alice, bob := srv.Connect(), srv.Connect()
+	alice.SetNickname("alice")
+	bob.SetNickname("bob")
+	bob.Send("before")
+	alice.Send(";room create games")
+	alice.Send(";switch games")
+	alice.Send("in the room")
+	bob.Send("after")
+	alice.Collect(settle)
+	bob.Collect(settle)
+
+	alice.Disconnect()
+	alice.Connect()
+	if got, want := said(alice.Collect(settle)), []string{"before", "in the room", "after"}; !slices.Equal(got, want) {
+		t.Errorf("a member's history: %q, want %q", got, want)
+	}
+	bob.Disconnect()
+	bob.Connect()
+	if got, want := said(bob.Collect(settle)), []string{"before", "after"}; !slices.Equal(got, want) {
+		t.Errorf("a stranger's history: %q, want %q", got, want)
+	}
+}
+
+func TestGraphQLHistory(t *testing.T) {
+	_, srv := newTestServer(t)
+	alice := srv.Connect()
+	alice.SetNickname("alice")
+	alice.Send("one")
+	alice.Send("two")
+	alice.Send("three")
+	alice.Collect(settle)
+
+	status, body := alice.Do(http.MethodGet, "/graphql?query="+url.QueryEscape("{ history(last: 2) { kind content } }"), nil)
+	if status != http.StatusOK {
+		t.Fatalf("/graphql: %d %s", status, body)
+	}
+	var result struct {
+		Data struct {
+			History []struct{ Kind, Content string }
+		}
+	}
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, message := range result.Data.History {
+		got = append(got, message.Content)
+	}
+	if want := []string{"two", "three"}; !slices.Equal(got, want) {
+		t.Errorf("history(last: 2): %q, want %q", got, want)
+	}
+}
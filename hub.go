@@ -0,0 +1,168 @@
+package main
+
+import "sync"
+
+// The streams connected to /events are registered with a hub: one goroutine that owns the
+// registry and serves the requests to change or read it one after another, in the order they
+// come. Broadcasts are requests too, fanned out by the hub itself with non-blocking sends, so no
+// goroutine is spawned per client or message and a stream registered after a broadcast returned
+// never gets it, while one registered before always does (see ordering.go). Callers wait for
+// their request to be served.
+//
+// Functions run by the hub (deliveries and reads) must not make requests of it in turn. They may
+// take other locks, which are never held waiting on the hub by anything those functions call.
+//
+// The hub runs until stop, at the end of shutdown. Requests made after that do nothing: there is
+// nobody connected, nothing is delivered and registering is refused.
+type hub struct {
+	register   chan hubRegistration
+	unregister chan hubRegistration
+	broadcast  chan hubBroadcast
+	query      chan hubQuery
+
+	stopOnce sync.Once
+	stopping chan struct{}
+	// Closed once the hub goroutine has returned.
+	stopped chan struct{}
+}
+
+type hubRegistration struct {
+	sessionID string
+	ch        chan string
+	// Reports, for unregistrations, whether the stream was removed.
+	done chan bool
+}
+
+type hubBroadcast struct {
+	// Whether to deliver to every connected session, or only to those of sessionIDs.
+	all        bool
+	sessionIDs []string
+	deliver    func(sessionID string, ch chan string)
+	done       chan struct{}
+}
+
+type hubQuery struct {
+	read func(clients map[string]chan string)
+	done chan struct{}
+}
+
+func newHub() *hub {
+	h := &hub{
+		register:   make(chan hubRegistration),
+		unregister: make(chan hubRegistration),
+		broadcast:  make(chan hubBroadcast),
+		query:      make(chan hubQuery),
+		stopping:   make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	go h.run()
+	return h
+}
+
+func (h *hub) run() {
+	defer close(h.stopped)
+	clients := make(map[string]chan string)
+	for {
+		select {
+		case <-h.stopping:
+			return
+		case r := <-h.register:
+			clients[r.sessionID] = r.ch
+			r.done <- true
+		case r := <-h.unregister:
+			current, ok := clients[r.sessionID]
+			removed := ok && (r.ch == nil || current == r.ch)
+			if removed {
+				delete(clients, r.sessionID)
+			}
+			r.done <- removed
+		case b := <-h.broadcast:
+			if b.all {
+				for id, ch := range clients {
+					b.deliver(id, ch)
+				}
+			} else {
+				for _, id := range b.sessionIDs {
+					if ch, ok := clients[id]; ok {
+						b.deliver(id, ch)
+					}
+				}
+			}
+			close(b.done)
+		case q := <-h.query:
+			q.read(clients)
+			close(q.done)
+		}
+	}
+}
+
+// stop stops the hub once the requests it is serving are done.
+func (h *hub) stop() {
+	h.stopOnce.Do(func() { close(h.stopping) })
+	<-h.stopped
+}
+
+// connect registers ch as the stream of sessionID, replacing any other.
+func (h *hub) connect(sessionID string, ch chan string) {
+	done := make(chan bool, 1)
+	select {
+	case h.register <- hubRegistration{sessionID: sessionID, ch: ch, done: done}:
+		<-done
+	case <-h.stopped:
+	}
+}
+
+// disconnect unregisters the stream of sessionID, if it is still ch, or whatever it is if ch is
+// nil, and reports whether it did.
+func (h *hub) disconnect(sessionID string, ch chan string) bool {
+	done := make(chan bool, 1)
+	select {
+	case h.unregister <- hubRegistration{sessionID: sessionID, ch: ch, done: done}:
+		return <-done
+	case <-h.stopped:
+		return false
+	}
+}
+
+// broadcastAll calls deliver with the stream of every connected session.
+func (h *hub) broadcastAll(deliver func(sessionID string, ch chan string)) {
+	done := make(chan struct{})
+	select {
+	case h.broadcast <- hubBroadcast{all: true, deliver: deliver, done: done}:
+		<-done
+	case <-h.stopped:
+	}
+}
+
+// broadcastTo calls deliver with the stream of each of sessionIDs that is connected.
+func (h *hub) broadcastTo(sessionIDs []string, deliver func(sessionID string, ch chan string)) {
+	done := make(chan struct{})
+	select {
+	case h.broadcast <- hubBroadcast{sessionIDs: sessionIDs, deliver: deliver, done: done}:
+		<-done
+	case <-h.stopped:
+	}
+}
+
+// read calls fn with the registry, which it must not keep or change.
+func (h *hub) read(fn func(clients map[string]chan string)) {
+	done := make(chan struct{})
+	select {
+	case h.query <- hubQuery{read: fn, done: done}:
+		<-done
+	case <-h.stopped:
+		fn(nil)
+	}
+}
+
+// lookup returns the stream of sessionID, if it is connected.
+func (h *hub) lookup(sessionID string) (ch chan string, ok bool) {
+	h.read(func(clients map[string]chan string) { ch, ok = clients[sessionID] })
+	return ch, ok
+}
+
+// connected returns how many sessions are connected.
+func (h *hub) connected() (n int) {
+	h.read(func(clients map[string]chan string) { n = len(clients) })
+	return n
+}
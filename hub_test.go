@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"alantern/chattest"
+)
+
+func TestHubStops(t *testing.T) {
+	h := newHub()
+	ch := make(chan string, 1)
+	h.connect("alice", ch)
+	h.broadcastAll(func(_ string, ch chan string) { ch <- "before" })
+	if got := <-ch; got != "before" {
+		t.Fatalf("delivered %q, want %q", got, "before")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		h.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(chattest.DefaultTimeout):
+		t.Fatal("the hub didn't stop")
+	}
+	h.stop()
+
+	// Requests made after stop return without being served.
+	h.broadcastAll(func(_ string, ch chan string) { ch <- "after" })
+	h.connect("bob", make(chan string))
+	if h.disconnect("alice", nil) {
+		t.Error("disconnected a stream after stop")
+	}
+	if n := h.connected(); n != 0 {
+		t.Errorf("%d connected after stop, want 0", n)
+	}
+	if len(ch) != 0 {
+		t.Errorf("delivered %q after stop", <-ch)
+	}
+}
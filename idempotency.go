@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+)
+
+// Mutating endpoints accept an Idempotency-Key header, so that clients on flaky networks can
+// safely retry a request whose response they never got: a retry with the same key from the same
+// session within idempotencyWindow gets the original response back instead of running again.
+
+const (
+	idempotencyWindow = 24 * time.Hour
+	// Longest key accepted, keys are usually UUIDs.
+	maxIdempotencyKeyLength = 255
+)
+
+type idempotentResponse struct {
+	// Method and path the key was first used with.
+	Request string
+	At      time.Time
+	// Unset while the original request is still being handled.
+	Done   bool
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// idempotencyRecorder passes a response through while keeping a copy of it.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(data)
+	return rec.ResponseWriter.Write(data)
+}
+
+// idempotent wraps a mutating handler to honour Idempotency-Key. Requests without the header, or
+// without a session yet, are handled as usual.
+func (s *ChatServer) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		cookie, err := r.Cookie("session_id")
+		if key == "" || err != nil || r.Method == http.MethodGet {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		id := cookie.Value + " " + key
+		request := r.Method + " " + r.URL.Path
+		s.idempotencyMu.Lock()
+		if previous, ok := s.idempotency[id]; ok && s.clock.Now().Sub(previous.At) < idempotencyWindow {
+			s.idempotencyMu.Unlock()
+			switch {
+			case previous.Request != request:
+				http.Error(w, "Idempotency-Key was already used for another request", http.StatusUnprocessableEntity)
+			case !previous.Done:
+				http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+			default:
+				for name, values := range previous.Header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(previous.Status)
+				w.Write(previous.Body)
+			}
+			return
+		}
+		response := &idempotentResponse{Request: request, At: s.clock.Now()}
+		s.idempotency[id] = response
+		s.idempotencyMu.Unlock()
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		s.idempotencyMu.Lock()
+		defer s.idempotencyMu.Unlock()
+		if rec.status >= 500 {
+			// Let the client retry failures for real.
+			delete(s.idempotency, id)
+			return
+		}
+		response.Done = true
+		response.Status = rec.status
+		if response.Status == 0 {
+			response.Status = http.StatusOK
+		}
+		response.Header = w.Header().Clone()
+		response.Header.Del("Set-Cookie")
+		response.Body = rec.body.Bytes()
+	}
+}
+
+// expireIdempotencyKeys forgets responses older than idempotencyWindow.
+func (s *ChatServer) expireIdempotencyKeys() {
+	s.idempotencyMu.Lock()
+	defer s.idempotencyMu.Unlock()
+	for id, response := range s.idempotency {
+		if response.Done && s.clock.Now().Sub(response.At) >= idempotencyWindow {
+			delete(s.idempotency, id)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Image URLs handed out to clients are signed and expire, so uploaded images can't be hotlinked
+// from outside the chat: /image/{id}?exp={unix seconds}&sig={hmac}. Fetching one additionally
+// requires the session cookie of someone who was connected when it was posted.
+//
+// Uploaders can instead mark an image public. Public images are stored under the SHA-256 of their
+// contents and served at a stable /image/{hash} to anyone, so the link can be shared outside the room.
+//
+// Whatever was uploaded, only what sniffs as an image is shown in the browser. Anything else, such
+// as HTML or SVG, which could run scripts in the chat's origin, is served as a download of opaque
+// bytes instead (see also setImageHeaders).
+
+const (
+	// How long a signed image URL stays valid.
+	imageURLTTL = 10 * time.Minute
+	// How long images are kept.
+	imageLifetime       = 1 * time.Minute
+	publicImageLifetime = 24 * time.Hour
+)
+
+// Secret image URLs are signed with. Random per process unless IMAGE_URL_SECRET is set, which
+// keeps URLs valid across restarts.
+var imageURLSecret = loadImageURLSecret()
+
+func loadImageURLSecret() []byte {
+	if secret := os.Getenv("IMAGE_URL_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	secret := make([]byte, 32)
+	if _, err := crand.Read(secret); err != nil {
+		panic(fmt.Sprintf("could not generate image URL secret: %v", err))
+	}
+	return secret
+}
+
+func imageSignature(id string, exp string) string {
+	mac := hmac.New(sha256.New, imageURLSecret)
+	mac.Write([]byte(id))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(exp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedImageURL returns the URL the image can be fetched from until it expires.
+func (s *ChatServer) signedImageURL(id string) string {
+	exp := strconv.FormatInt(s.clock.Now().Add(imageURLTTL).Unix(), 10)
+	query := url.Values{"exp": {exp}, "sig": {imageSignature(id, exp)}}
+	return "/image/" + url.PathEscape(id) + "?" + query.Encode()
+}
+
+// imageURLValid reports whether exp and sig form an unexpired signature for the image.
+func (s *ChatServer) imageURLValid(id string, exp string, sig string) bool {
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || s.clock.Now().Unix() > unix {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(imageSignature(id, exp)))
+}
+
+// storeImage keeps an uploaded image, evicting older ones if the storage quota requires it, and
+// returns its identifier and the URL to view it at.
+func (s *ChatServer) storeImage(data []byte, uploader string, public bool) (string, string, error) {
+	defer s.checkStorageWarning()
+
+	if public {
+		sum := sha256.Sum256(data)
+		id := hex.EncodeToString(sum[:])
+		s.imageStoreMu.Lock()
+		defer s.imageStoreMu.Unlock()
+		// Uploading the same public image again just refreshes it.
+		s.deleteImageLocked(id)
+		if err := s.makeRoomLocked(int64(len(data))); err != nil {
+			return "", "", err
+		}
+		s.imageStore[id] = data
+		s.imageExpiry[id] = s.clock.Now().Add(publicImageLifetime)
+		s.imageStoredAt[id] = s.clock.Now()
+		s.imageBytes += int64(len(data))
+		return id, "/image/" + id, nil
+	}
+
+	viewers := map[string]bool{uploader: true}
+	s.hub.read(func(clients map[string]chan string) {
+		for id := range clients {
+			viewers[id] = true
+		}
+	})
+
+	id := s.newID()
+	s.imageStoreMu.Lock()
+	defer s.imageStoreMu.Unlock()
+	if err := s.makeRoomLocked(int64(len(data))); err != nil {
+		return "", "", err
+	}
+	s.imageStore[id] = data
+	s.imageExpiry[id] = s.clock.Now().Add(imageLifetime)
+	s.imageViewers[id] = viewers
+	s.imageStoredAt[id] = s.clock.Now()
+	s.imageBytes += int64(len(data))
+	return id, s.signedImageURL(id), nil
+}
+
+// uploadContentType returns the type to serve an upload as, and whether browsers may show it
+// rather than download it.
+func uploadContentType(data []byte) (string, bool) {
+	contentType := http.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image/") {
+		return "application/octet-stream", false
+	}
+	return contentType, true
+}
+
+// viewImage returns the image if the request may see it, and whether it is public. data is nil if
+// there is no such image.
+func (s *ChatServer) viewImage(id string, r *http.Request) (data []byte, public bool, err error) {
+	s.imageStoreMu.Lock()
+	data, ok := s.imageStore[id]
+	viewers, restricted := s.imageViewers[id]
+	s.imageStoreMu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+	if !restricted {
+		return data, true, nil
+	}
+
+	query := r.URL.Query()
+	if !s.imageURLValid(id, query.Get("exp"), query.Get("sig")) {
+		return nil, false, errors.New("Image link is invalid or expired")
+	}
+	cookie, err := r.Cookie("session_id")
+	if err != nil || !viewers[cookie.Value] || s.isBanned(cookie.Value) {
+		return nil, false, errors.New("Images can only be viewed by those in the room when they were posted")
+	}
+	return data, false, nil
+}
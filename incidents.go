@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Incident mode turns the room into a lightweight incident channel. ;incident start pins a
+// status message, invites the on-call group and starts a timeline of everything said; ;incident
+// resolve closes it and produces a postmortem in Markdown at /mod/incidents/postmortem. The
+// server hosts a single room, so the incident takes place in it rather than in a dedicated one.
+
+// onCall lists the nicknames invited to incidents, comma-separated. Moderators when unset.
+var onCall = os.Getenv("ONCALL")
+
+const (
+	// Entries beyond this are dropped from the timeline, oldest kept.
+	maxIncidentTimeline = 5000
+	// Resolved incidents kept for their postmortem.
+	maxResolvedIncidents = 20
+)
+
+type IncidentEntry struct {
+	At time.Time `json:"at"`
+	// Nickname of the author, empty for server messages.
+	Author string `json:"author,omitempty"`
+	// "message", "note" or "status".
+	Kind string `json:"kind"`
+	// Text as sent, not escaped.
+	Text string `json:"text"`
+}
+
+type Incident struct {
+	ID         string          `json:"id"`
+	Title      string          `json:"title"`
+	StartedBy  string          `json:"startedBy"`
+	StartedAt  time.Time       `json:"startedAt"`
+	ResolvedBy string          `json:"resolvedBy,omitempty"`
+	ResolvedAt time.Time       `json:"resolvedAt"`
+	Summary    string          `json:"summary,omitempty"`
+	Timeline   []IncidentEntry `json:"-"`
+
+	// Pin of the current status message.
+	pinID string
+}
+
+// recordIncident adds a public broadcast to the timeline of the current incident, if any.
+func (s *ChatServer) recordIncident(message Message) {
+	if message.Private || (message.Kind != "text" && message.Kind != "image") {
+		return
+	}
+	entry := IncidentEntry{At: s.clock.Now(), Kind: "message", Text: messageText(message)}
+	if message.Author != nil {
+		entry.Author = message.Author.Nickname
+	}
+	s.addIncidentEntry(entry)
+}
+
+func (s *ChatServer) addIncidentEntry(entry IncidentEntry) bool {
+	s.incidentMu.Lock()
+	defer s.incidentMu.Unlock()
+	if s.incident == nil {
+		return false
+	}
+	if len(s.incident.Timeline) < maxIncidentTimeline {
+		s.incident.Timeline = append(s.incident.Timeline, entry)
+	}
+	return true
+}
+
+// onCallSessions returns the sessions invited to incidents.
+func (s *ChatServer) onCallSessions() []string {
+	var ids []string
+	if onCall == "" {
+		s.rolesMu.Lock()
+		for id, role := range s.roles {
+			if role >= RoleModerator {
+				ids = append(ids, id)
+			}
+		}
+		s.rolesMu.Unlock()
+		return ids
+	}
+	for _, nickname := range strings.Split(onCall, ",") {
+		if id := s.findSession(strings.TrimSpace(nickname)); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (s *ChatServer) startIncident(sessionID, title string) error {
+	incident := &Incident{
+		ID:        s.newID(),
+		Title:     title,
+		StartedBy: s.getNickname(sessionID),
+		StartedAt: s.clock.Now(),
+	}
+	s.incidentMu.Lock()
+	if s.incident != nil {
+		s.incidentMu.Unlock()
+		return fmt.Errorf("incident %q is still open, resolve it first", s.incident.Title)
+	}
+	s.incident = incident
+	s.incidentMu.Unlock()
+
+	s.audit(sessionID, "incident.start", incident.ID, title)
+	s.broadcastMessage(Message{
+		FromApp: true,
+		Kind:    "text",
+		Content: fmt.Sprintf("Incident started by [%s]: %s", escapeText(incident.StartedBy), escapeText(title)),
+	})
+	s.setIncidentStatus(sessionID, "investigating")
+
+	invite := Message{
+		Kind:    "text",
+		Content: fmt.Sprintf("You are on call for the incident %s, started by [%s]", escapeText(title), escapeText(incident.StartedBy)),
+	}
+	for _, id := range s.onCallSessions() {
+		if id != sessionID {
+			s.queueNotice(id, invite)
+		}
+	}
+	return nil
+}
+
+// setIncidentStatus replaces the pinned status message of the current incident.
+func (s *ChatServer) setIncidentStatus(sessionID, status string) bool {
+	s.incidentMu.Lock()
+	incident := s.incident
+	var title, oldPin string
+	if incident != nil {
+		title, oldPin = incident.Title, incident.pinID
+	}
+	s.incidentMu.Unlock()
+	if incident == nil {
+		return false
+	}
+
+	if oldPin != "" {
+		s.removePin(sessionID, oldPin)
+	}
+	pin := s.addPin(sessionID, "", fmt.Sprintf("Incident: %s. Status: %s", title, status), 0)
+
+	s.incidentMu.Lock()
+	incident.pinID = pin.ID
+	s.incidentMu.Unlock()
+	s.addIncidentEntry(IncidentEntry{At: s.clock.Now(), Author: s.getNickname(sessionID), Kind: "status", Text: status})
+	return true
+}
+
+func (s *ChatServer) resolveIncident(sessionID, summary string) (*Incident, error) {
+	s.incidentMu.Lock()
+	incident := s.incident
+	if incident == nil {
+		s.incidentMu.Unlock()
+		return nil, fmt.Errorf("no incident is open")
+	}
+	s.incident = nil
+	incident.ResolvedBy = s.getNickname(sessionID)
+	incident.ResolvedAt = s.clock.Now()
+	incident.Summary = summary
+	s.resolvedIncidents = append(s.resolvedIncidents, incident)
+	if len(s.resolvedIncidents) > maxResolvedIncidents {
+		s.resolvedIncidents = s.resolvedIncidents[len(s.resolvedIncidents)-maxResolvedIncidents:]
+	}
+	pinID := incident.pinID
+	s.incidentMu.Unlock()
+
+	if pinID != "" {
+		s.removePin(sessionID, pinID)
+	}
+	s.audit(sessionID, "incident.resolve", incident.ID, summary)
+	s.broadcastMessage(Message{
+		FromApp: true,
+		Kind:    "text",
+		Content: fmt.Sprintf("Incident resolved by [%s] after %s: %s", escapeText(incident.ResolvedBy), incident.ResolvedAt.Sub(incident.StartedAt).Round(time.Second), escapeText(incident.Title)),
+	})
+	return incident, nil
+}
+
+// postmortem renders an incident as a Markdown document.
+func (incident *Incident) postmortem() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Postmortem: %s\n\n", incident.Title)
+	fmt.Fprintf(&b, "- Started: %s by %s\n", incident.StartedAt.UTC().Format(time.RFC3339), incident.StartedBy)
+	if !incident.ResolvedAt.IsZero() {
+		fmt.Fprintf(&b, "- Resolved: %s by %s\n", incident.ResolvedAt.UTC().Format(time.RFC3339), incident.ResolvedBy)
+		fmt.Fprintf(&b, "- Duration: %s\n", incident.ResolvedAt.Sub(incident.StartedAt).Round(time.Second))
+	}
+	if incident.Summary != "" {
+		fmt.Fprintf(&b, "\n## Summary\n\n%s\n", incident.Summary)
+	}
+
+	b.WriteString("\n## Timeline\n\n")
+	for _, entry := range incident.Timeline {
+		author := entry.Author
+		if author == "" {
+			author = "alantern"
+		}
+		text := strings.ReplaceAll(entry.Text, "\n", " ")
+		switch entry.Kind {
+		case "status":
+			fmt.Fprintf(&b, "- %s **%s** set the status to: %s\n", entry.At.UTC().Format("15:04:05"), author, text)
+		case "note":
+			fmt.Fprintf(&b, "- %s **%s** (note): %s\n", entry.At.UTC().Format("15:04:05"), author, text)
+		default:
+			fmt.Fprintf(&b, "- %s **%s**: %s\n", entry.At.UTC().Format("15:04:05"), author, text)
+		}
+	}
+	if len(incident.Timeline) >= maxIncidentTimeline {
+		fmt.Fprintf(&b, "\nThe timeline was cut at %d entries.\n", maxIncidentTimeline)
+	}
+	return b.String()
+}
+
+// handleIncidentCommand implements ;incident start|status|note|resolve.
+func (s *ChatServer) handleIncidentCommand(sessionID string, args []string) {
+	if !s.isModerator(sessionID) {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Only moderators can use ;incident",
+		})
+		return
+	}
+
+	usage := Message{
+		Kind:    "text",
+		Content: "Usage: ;incident start &lt;title&gt;|status [status]|note &lt;text&gt;|resolve [summary]",
+	}
+	if len(args) == 0 {
+		s.sendPrivateMessage(sessionID, usage)
+		return
+	}
+	text := strings.TrimSpace(strings.Join(args[1:], " "))
+
+	switch strings.ToLower(args[0]) {
+	case "start":
+		if text == "" {
+			s.sendPrivateMessage(sessionID, usage)
+			return
+		}
+		if err := s.startIncident(sessionID, text); err != nil {
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Could not start the incident: " + escapeText(err.Error())})
+		}
+
+	case "status":
+		if text == "" {
+			s.incidentMu.Lock()
+			incident := s.incident
+			var content string
+			if incident == nil {
+				content = "No incident is open"
+			} else {
+				content = fmt.Sprintf("Incident %s, started by [%s] %s ago, %d timeline entries",
+					escapeText(incident.Title), escapeText(incident.StartedBy),
+					s.clock.Now().Sub(incident.StartedAt).Round(time.Second), len(incident.Timeline))
+			}
+			s.incidentMu.Unlock()
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: content})
+			return
+		}
+		if !s.setIncidentStatus(sessionID, text) {
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "No incident is open"})
+		}
+
+	case "note":
+		if text == "" {
+			s.sendPrivateMessage(sessionID, usage)
+			return
+		}
+		content := "Noted in the incident timeline"
+		if !s.addIncidentEntry(IncidentEntry{At: s.clock.Now(), Author: s.getNickname(sessionID), Kind: "note", Text: text}) {
+			content = "No incident is open"
+		}
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: content})
+
+	case "resolve":
+		incident, err := s.resolveIncident(sessionID, text)
+		if err != nil {
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Could not resolve the incident: " + escapeText(err.Error())})
+			return
+		}
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: fmt.Sprintf("Postmortem: /mod/incidents/postmortem?id=%s", escapeText(incident.ID)),
+		})
+
+	default:
+		s.sendPrivateMessage(sessionID, usage)
+	}
+}
+
+// handleModIncidents lists the open and resolved incidents, most recent first.
+func (s *ChatServer) handleModIncidents(w http.ResponseWriter, r *http.Request) {
+	if !s.isModerator(s.getOrCreateSession(w, r)) {
+		http.Error(w, "Moderators only", http.StatusForbidden)
+		return
+	}
+
+	s.incidentMu.Lock()
+	incidents := []Incident{}
+	if s.incident != nil {
+		incidents = append(incidents, *s.incident)
+	}
+	for i := len(s.resolvedIncidents) - 1; i >= 0; i-- {
+		incidents = append(incidents, *s.resolvedIncidents[i])
+	}
+	s.incidentMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(incidents)
+}
+
+// handleModIncidentPostmortem exports the incident "id" as Markdown. The open incident can be
+// exported too, for a report so far.
+func (s *ChatServer) handleModIncidentPostmortem(w http.ResponseWriter, r *http.Request) {
+	if !s.isModerator(s.getOrCreateSession(w, r)) {
+		http.Error(w, "Moderators only", http.StatusForbidden)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	var document string
+	s.incidentMu.Lock()
+	for _, incident := range append([]*Incident{s.incident}, s.resolvedIncidents...) {
+		if incident != nil && incident.ID == id {
+			document = incident.postmortem()
+		}
+	}
+	s.incidentMu.Unlock()
+	if document == "" {
+		http.Error(w, "Incident not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="postmortem-%s.md"`, id))
+	w.Write([]byte(document))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Clearing cookies makes a new session, so what sessions may do is also capped per address:
+// how often each may post (IP_MESSAGE_RATE and IP_MESSAGE_BURST) and upload images
+// (IP_UPLOADS_PER_MINUTE), and how many uploads and event streams it may have going at once. The
+// caps are loose enough for a classroom or office behind one address, and moderators are exempt.
+// Behind a reverse proxy every request comes from the proxy, so the address is taken from
+// X-Forwarded-For when the request comes from one of TRUSTED_PROXIES, comma-separated addresses
+// or CIDRs: the rightmost address in it that isn't a trusted proxy, as those left of it can be
+// made up by the client.
+
+var trustedProxiesConfig = os.Getenv("TRUSTED_PROXIES")
+
+// Networks X-Forwarded-For is believed from, see loadTrustedProxies.
+var trustedProxies []*net.IPNet
+
+const (
+	defaultAddressMessageRate  = 2
+	defaultAddressMessageBurst = 20
+	defaultAddressUploads      = 10
+	defaultAddressStreams      = 30
+	maxUploadsPerAddress       = 6
+)
+
+// loadTrustedProxies parses TRUSTED_PROXIES.
+func loadTrustedProxies() error {
+	trustedProxies = nil
+	for _, value := range strings.Split(trustedProxiesConfig, ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+		network, err := parseCIDR(value)
+		if err != nil {
+			return fmt.Errorf("TRUSTED_PROXIES: %s is not an address or CIDR", value)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	return nil
+}
+
+func trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address r comes from, as forwarded by trusted proxies.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(address) == nil {
+			break
+		}
+		host = address
+		if !trustedProxy(address) {
+			break
+		}
+	}
+	return host
+}
+
+// loadAddressLimiters returns the limiters of how often each address may post and upload.
+func loadAddressLimiters() (messages, uploads *tokenBucketLimiter) {
+	messages = loadTokenBucketLimiter("IP_MESSAGE_RATE", "IP_MESSAGE_BURST", defaultAddressMessageRate, defaultAddressMessageBurst)
+	perMinute := defaultAddressUploads
+	if value, err := strconv.Atoi(os.Getenv("IP_UPLOADS_PER_MINUTE")); err == nil && value > 0 {
+		perMinute = value
+	}
+	return messages, newTokenBucketLimiter(float64(perMinute)/60, float64(perMinute))
+}
+
+func loadAddressStreams() int {
+	if value, err := strconv.Atoi(os.Getenv("IP_MAX_STREAMS")); err == nil && value > 0 {
+		return value
+	}
+	return defaultAddressStreams
+}
+
+func tooManyFromAddress(w http.ResponseWriter, what string, limit int) {
+	http.Error(w, fmt.Sprintf("Too many simultaneous %s from your address (at most %d)", what, limit), http.StatusTooManyRequests)
+}
+
+// pruneAddressLimits forgets the addresses that have been quiet for long enough.
+func (s *ChatServer) pruneAddressLimits() {
+	now := s.clock.Now()
+	s.addressMessages.Prune(now)
+	s.addressUploads.Prune(now)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"time"
+)
+
+// Maintenance work runs as jobs registered with schedule. Each job runs every interval plus a
+// random jitter, so jobs sharing an interval don't all fire at once, and a panicking run is
+// recovered and counted rather than taking the server down. Moderators can inspect per-job
+// statistics at /mod/jobs. Jobs stop when the server shuts down.
+
+// Sessions unseen for this long are forgotten, unless they matter to moderation.
+const sessionIdleTTL = 24 * time.Hour
+
+type job struct {
+	every  time.Duration
+	jitter time.Duration
+	run    func()
+	stats  JobStats
+}
+
+type JobStats struct {
+	// Job name, e.g. "images.expire".
+	Name string `json:"name"`
+	// Interval between runs, not counting jitter.
+	Every string `json:"every"`
+	// Number of completed runs, including those that panicked.
+	Runs int `json:"runs"`
+	// Number of runs that panicked.
+	Panics int `json:"panics"`
+	// When the last run started.
+	LastRun *time.Time `json:"lastRun,omitempty"`
+	// How long the last run took.
+	LastDuration string `json:"lastDuration,omitempty"`
+	// Time spent in all runs.
+	TotalDuration string `json:"totalDuration"`
+	// Value the last panic was raised with.
+	LastPanic string `json:"lastPanic,omitempty"`
+
+	totalDuration time.Duration
+}
+
+// schedule starts running fn every interval, delayed by up to jitter more each time.
+func (s *ChatServer) schedule(name string, every time.Duration, jitter time.Duration, fn func()) {
+	j := &job{every: every, jitter: jitter, run: fn, stats: JobStats{Name: name, Every: every.String()}}
+	s.jobsMu.Lock()
+	s.jobs = append(s.jobs, j)
+	s.jobsMu.Unlock()
+
+	go func() {
+		for {
+			delay := j.every
+			if j.jitter > 0 {
+				delay += time.Duration(mrand.Int63n(int64(j.jitter)))
+			}
+			select {
+			case <-s.clock.After(delay):
+			case <-s.stopping:
+				return
+			}
+			s.runJob(j)
+		}
+	}()
+}
+
+func (s *ChatServer) runJob(j *job) {
+	started := s.clock.Now()
+	defer func() {
+		p := recover()
+		if p != nil {
+			reportPanic("Job "+j.stats.Name, p, nil, "")
+		}
+
+		elapsed := s.clock.Now().Sub(started)
+		s.jobsMu.Lock()
+		defer s.jobsMu.Unlock()
+		j.stats.Runs++
+		j.stats.LastRun = &started
+		j.stats.LastDuration = elapsed.String()
+		j.stats.totalDuration += elapsed
+		if p != nil {
+			j.stats.Panics++
+			j.stats.LastPanic = fmt.Sprint(p)
+		}
+	}()
+	j.run()
+}
+
+// startJobs registers the server's maintenance jobs.
+func (s *ChatServer) startJobs() {
+	s.schedule("images.expire", 30*time.Second, 5*time.Second, s.expireImages)
+	s.schedule("sessions.gc", time.Hour, 5*time.Minute, s.gcSessions)
+	s.schedule("idempotency.expire", 5*time.Minute, 30*time.Second, s.expireIdempotencyKeys)
+	s.schedule("forms.expire", 5*time.Minute, 30*time.Second, s.expireForms)
+	s.schedule("automation.schedule", 15*time.Second, 0, s.runScheduledAutomation)
+	s.schedule("calendar.remind", 30*time.Second, 0, s.remindEvents)
+	s.schedule("streams.admit", admissionTick, 0, s.admitStreams)
+	s.schedule("streams.gaps", gapNoticeInterval, 0, s.notifyGaps)
+	s.schedule("presence.broadcast", presenceInterval, time.Second, s.broadcastPresence)
+	s.schedule("messages.prune", time.Hour, 5*time.Minute, s.pruneMessages)
+	s.schedule("reactions.expire", 10*time.Minute, time.Minute, s.expireReactions)
+	s.schedule("threads.expire", 10*time.Minute, time.Minute, s.expireThreads)
+	s.schedule("stats.aggregate", statsInterval, 30*time.Second, s.aggregateStats)
+	if s.summarizer != nil {
+		s.schedule("summary.daily", time.Minute, 0, s.postDailySummary)
+	}
+	s.schedule("pins.expire", 15*time.Second, 0, s.expirePins)
+	s.schedule("bans.expire", time.Minute, 5*time.Second, s.expireBans)
+	s.schedule("limits.prune", 10*time.Minute, time.Minute, s.pruneAddressLimits)
+	// Batches go out at a steady pace, so no jitter here.
+	s.schedule("livestream.flush", livestreamFlushInterval, 0, s.flushLivestream)
+}
+
+// gcSessions forgets idle sessions that aren't connected, have no role and aren't banned.
+func (s *ChatServer) gcSessions() {
+	now := s.clock.Now()
+	s.sessionFirstSeenMu.Lock()
+	var idle []string
+	for id, lastSeen := range s.sessionLastSeen {
+		if now.Sub(lastSeen) > sessionIdleTTL {
+			idle = append(idle, id)
+		}
+	}
+	s.sessionFirstSeenMu.Unlock()
+
+	for _, id := range idle {
+		if _, connected := s.hub.lookup(id); connected || s.roleOf(id) != RoleMember || s.isBanned(id) {
+			continue
+		}
+
+		s.sessionFirstSeenMu.Lock()
+		delete(s.sessionFirstSeen, id)
+		delete(s.sessionHandles, sessionHandle(id))
+		delete(s.sessionLastSeen, id)
+		delete(s.sessionTraits, id)
+		delete(s.evasionSuspects, id)
+		s.sessionFirstSeenMu.Unlock()
+
+		s.nicknamesMu.Lock()
+		delete(s.nicknames, id)
+		s.nicknamesMu.Unlock()
+		s.nicknameColorsMu.Lock()
+		delete(s.nicknameColors, id)
+		s.nicknameColorsMu.Unlock()
+		s.lastMessageTimeMu.Lock()
+		delete(s.lastMessageTime, id)
+		s.lastMessageTimeMu.Unlock()
+		s.slowmodeMu.Lock()
+		delete(s.slowmode.posts, id)
+		s.slowmodeMu.Unlock()
+		s.messageLimiter.Forget(id)
+		s.spamMu.Lock()
+		delete(s.spam, id)
+		s.spamMu.Unlock()
+		s.lobbyMu.Lock()
+		delete(s.lobbyPending, id)
+		s.lobbyMu.Unlock()
+		s.unregisterBot(id)
+		s.noticesMu.Lock()
+		delete(s.notices, id)
+		s.noticesMu.Unlock()
+		s.appealsMu.Lock()
+		delete(s.appeals, id)
+		s.appealsMu.Unlock()
+		s.welcomeMu.Lock()
+		delete(s.welcomed, id)
+		s.welcomeMu.Unlock()
+		s.animationsMu.Lock()
+		delete(s.animationPosts, id)
+		s.animationsMu.Unlock()
+		s.notificationsMu.Lock()
+		delete(s.doNotDisturb, id)
+		delete(s.heldNotifications, id)
+		s.notificationsMu.Unlock()
+		s.leaveAllRooms(id)
+	}
+}
+
+// handleModJobs lists the statistics of every job.
+func (s *ChatServer) handleModJobs(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	if !s.isModerator(sessionID) {
+		http.Error(w, "Moderators only", http.StatusForbidden)
+		return
+	}
+
+	s.jobsMu.Lock()
+	stats := make([]JobStats, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		st := j.stats
+		st.TotalDuration = st.totalDuration.String()
+		stats = append(stats, st)
+	}
+	s.jobsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
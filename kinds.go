@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// What the server does with a message depending on its Kind is described by a ContentKind in
+// contentKinds, rather than by every handler on its own: whether clients show it as a message, how
+// it is sanitized before being sent (see sanitize.go) and how it reads as plain text, in the
+// incident timeline and /api/v1/events.txt for example (see plaintext.go). Kinds with a payload of
+// their own, like polls or stickers, are added with registerKind and keep it as JSON in
+// Message.Data, which the event log and the message store keep with the rest of the message.
+// Members send them to /send with "kind" and "data", which the kind's Validate checks, "message"
+// then being an optional caption; kinds without a Validate are only sent by the server.
+
+var (
+	errUnknownKind = errors.New("Invalid kind: not one that can be sent")
+	errInvalidData = errors.New("Invalid data: expected JSON")
+)
+
+type ContentKind struct {
+	// Whether clients show it as a message rather than as a system event, see sse.go.
+	Message bool
+	// Validate reports why data can't be sent as a message of the kind, if it can't.
+	Validate func(data json.RawMessage) error
+	// Allowed reports why the kind can't be sent in room, empty for the main room, if it can't.
+	// Allowed everywhere without it.
+	Allowed func(s *ChatServer, room string) error
+	// Prepare returns a message of the kind a member sent with what the server adds to it.
+	Prepare func(message Message) Message
+	// Sanitize returns message ready to send. Messages are sent as they are without it.
+	Sanitize func(message Message) Message
+	// Text returns message as plain text. "[kind]" without it.
+	Text func(message Message) string
+}
+
+var contentKinds = map[string]ContentKind{
+	"text":        {Message: true, Sanitize: sanitizeContent, Text: contentText},
+	"image":       {Message: true},
+	"command":     {Message: true},
+	"interaction": {Message: true},
+	"update":      {Message: true, Sanitize: sanitizeContent, Text: contentText},
+	"delete":      {},
+	"form":        {Message: true},
+	"response":    {Message: true},
+	"reaction":    {Message: true},
+}
+
+func init() {
+	// Registered here, as sanitizing the messages it coalesces refers back to contentKinds.
+	registerKind("batch", ContentKind{Message: true, Sanitize: sanitizeBatch, Text: batchText})
+}
+
+// registerKind adds kind to those messages can be of. It panics if there already is one by that
+// name, so it is meant to be called from init.
+func registerKind(name string, kind ContentKind) {
+	if _, exists := contentKinds[name]; exists {
+		panic("message kind " + name + " registered twice")
+	}
+	contentKinds[name] = kind
+}
+
+// parseContent returns the kind and data of a message sent as kind with data, both optional for
+// text.
+func parseContent(name, data string) (string, json.RawMessage, error) {
+	if name == "" || name == "text" {
+		return "text", nil, nil
+	}
+	kind, ok := contentKinds[name]
+	if !ok || kind.Validate == nil {
+		return "", nil, errUnknownKind
+	}
+	if !json.Valid([]byte(data)) {
+		return "", nil, errInvalidData
+	}
+	if err := kind.Validate(json.RawMessage(data)); err != nil {
+		return "", nil, err
+	}
+	return name, json.RawMessage(data), nil
+}
+
+// messageText returns message as plain text.
+func messageText(message Message) string {
+	if kind := contentKinds[message.Kind]; kind.Text != nil {
+		return kind.Text(message)
+	}
+	return fmt.Sprintf("[%s]", message.Kind)
+}
+
+func sanitizeContent(message Message) Message {
+	message.Content = outboundPolicy.sanitize(message.Content)
+	return message
+}
+
+func sanitizeBatch(message Message) Message {
+	messages := make([]Message, len(message.Messages))
+	for i, coalesced := range message.Messages {
+		messages[i] = coalesced.sanitized()
+	}
+	message.Messages = messages
+	return message
+}
+
+func batchText(message Message) string {
+	texts := make([]string, len(message.Messages))
+	for i, coalesced := range message.Messages {
+		texts[i] = messageText(coalesced)
+	}
+	return strings.Join(texts, "\n")
+}
+
+func contentText(message Message) string {
+	return plainText(message.Content)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How long requests take, by endpoint, and chat commands, by command, is kept for the last
+// latencySamples of each, and /metrics reports its percentiles along with how many took longer
+// than SLOW_REQUEST_THRESHOLD (1s unless set), the latency objective. Those are also logged, with
+// the trace identifier requests are logged with: that of the W3C traceparent or X-Request-Id
+// header of the request, or a random one, which is sent back as X-Request-Id so that clients can
+// quote it. A command is logged with the trace identifier of the /send that ran it. Streams aren't
+// timed, since they stay open for as long as the page does.
+
+const (
+	latencySamples = 512
+	// Endpoints and commands timed separately, beyond which the rest are timed as "other", so that
+	// unknown paths or commands can't grow the metrics without bound.
+	maxLatencyKeys     = 100
+	defaultSlowRequest = time.Second
+)
+
+var latencyQuantiles = []float64{0.5, 0.9, 0.99}
+
+var slowRequestThreshold = loadSlowRequestThreshold()
+
+func loadSlowRequestThreshold() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SLOW_REQUEST_THRESHOLD")); err == nil && d > 0 {
+		return d
+	}
+	return defaultSlowRequest
+}
+
+type latencyWindow struct {
+	// Last durations, latencySamples at most, overwritten oldest first from next.
+	samples []time.Duration
+	next    int
+	// Since start, how long they took and how many of them were slow.
+	count, slow uint64
+	total       time.Duration
+}
+
+func (l *latencyWindow) observe(d time.Duration) {
+	if len(l.samples) < latencySamples {
+		l.samples = append(l.samples, d)
+	} else {
+		l.samples[l.next] = d
+		l.next = (l.next + 1) % latencySamples
+	}
+	l.count++
+	l.total += d
+	if d > slowRequestThreshold {
+		l.slow++
+	}
+}
+
+// quantile returns the duration q of the sorted samples are at most.
+func quantile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[max(int(math.Ceil(q*float64(len(sorted))))-1, 0)]
+}
+
+type traceIDKey struct{}
+
+// traceID returns the trace identifier of r, see timeRequests.
+func traceID(r *http.Request) string {
+	id, _ := r.Context().Value(traceIDKey{}).(string)
+	return id
+}
+
+// requestTraceID returns the trace identifier r comes with, or a new one.
+func requestTraceID(r *http.Request) string {
+	// traceparent is version-traceid-parentid-flags.
+	if parts := strings.Split(r.Header.Get("traceparent"), "-"); len(parts) == 4 && len(parts[1]) == 32 {
+		return parts[1]
+	}
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= 64 {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// timeRequests gives requests to mux a trace identifier and logger, and times those that aren't
+// streams.
+func (s *ChatServer) timeRequests(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestTraceID(r)
+		w.Header().Set("X-Request-Id", id)
+		r = withRequestLogger(r.WithContext(context.WithValue(r.Context(), traceIDKey{}, id)), id)
+		if isStream(r) {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		started := s.clock.Now()
+		mux.ServeHTTP(w, r)
+		elapsed := s.clock.Now().Sub(started)
+		// The pattern the path was routed to, so that /images/<id> and the like count as one.
+		_, pattern := mux.Handler(r)
+		s.observeLatency(s.endpointLatency, pattern, elapsed)
+		if elapsed > slowRequestThreshold {
+			requestLogger(r).Warn("Slow request", "took", elapsed)
+		}
+	})
+}
+
+// timeCommand runs the command text sent with r, timing it.
+func (s *ChatServer) timeCommand(r *http.Request, sessionID, text string) {
+	started := s.clock.Now()
+	s.handleCommand(sessionID, text)
+	elapsed := s.clock.Now().Sub(started)
+	command := strings.ToLower(strings.Split(text, " ")[0])
+	s.observeLatency(s.commandLatency, command, elapsed)
+	if elapsed > slowRequestThreshold {
+		requestLogger(r).Warn("Slow command", "command", command, "took", elapsed)
+	}
+}
+
+func (s *ChatServer) observeLatency(windows map[string]*latencyWindow, key string, d time.Duration) {
+	s.latencyMu.Lock()
+	defer s.latencyMu.Unlock()
+	window, ok := windows[key]
+	if !ok {
+		if len(windows) >= maxLatencyKeys {
+			key = "other"
+			window = windows[key]
+		}
+		if window == nil {
+			window = &latencyWindow{}
+			windows[key] = window
+		}
+	}
+	window.observe(d)
+}
+
+// writeLatencyMetrics writes the latency of endpoints and commands in the Prometheus text format.
+func (s *ChatServer) writeLatencyMetrics(w io.Writer, role string) {
+	s.latencyMu.Lock()
+	defer s.latencyMu.Unlock()
+	for _, family := range []struct {
+		name, label, help string
+		windows           map[string]*latencyWindow
+	}{
+		{"alantern_http_request_duration_seconds", "endpoint", "How long requests took, by endpoint, over the last few.", s.endpointLatency},
+		{"alantern_command_duration_seconds", "command", "How long chat commands took, by command, over the last few.", s.commandLatency},
+	} {
+		keys := make([]string, 0, len(family.windows))
+		for key := range family.windows {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s summary\n", family.name, family.help, family.name)
+		for _, key := range keys {
+			window := family.windows[key]
+			sorted := append([]time.Duration(nil), window.samples...)
+			sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+			labels := fmt.Sprintf("role=%q,%s=%q", role, family.label, key)
+			for _, q := range latencyQuantiles {
+				fmt.Fprintf(w, "%s{%s,quantile=\"%v\"} %v\n", family.name, labels, q, quantile(sorted, q).Seconds())
+			}
+			fmt.Fprintf(w, "%s_sum{%s} %v\n%s_count{%s} %d\n", family.name, labels, window.total.Seconds(), family.name, labels, window.count)
+		}
+
+		slow := strings.TrimSuffix(family.name, "_duration_seconds") + "_slow_total"
+		fmt.Fprintf(w, "# HELP %s Those that took longer than SLOW_REQUEST_THRESHOLD, since start.\n# TYPE %s counter\n", slow, slow)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s{role=%q,%s=%q} %d\n", slow, role, family.label, key, family.windows[key].slow)
+		}
+	}
+}
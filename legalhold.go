@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Under legal hold, set with LEGAL_HOLD, nothing sent is lost, so that the chat can be used for
+// work communication. The archive sinks, which must be set, get every image uploaded along with
+// the messages (see archive.go), so that deleting an image or a message only hides it from
+// members, with a "delete" record archived saying who did. MESSAGE_RETENTION no longer prunes the
+// message store.
+//
+// Records aren't queued in memory for the sinks but appended to a spool per sink, in the
+// directory ARCHIVE_SPOOL (archive-spool in the data directory unless set), and sent from there
+// in order: a sink that is slow or down makes the spool grow instead of records being dropped,
+// and what is left at shutdown is sent at the next start.
+//
+// Exports are tamper-evident: each archive record has as prev the SHA-256 of the line of the
+// record before it for its sink, a chain going on from one run to the next, whose head is in the
+// audit log ("archive.head") at start and every archiveHeadInterval, and snapshots (see
+// snapshot.go) a SHA256SUMS of their files, whose hash is in the audit log with the hash of the
+// archive downloaded. "alantern verify" checks both.
+
+var (
+	legalHold    = os.Getenv("LEGAL_HOLD") != ""
+	archiveSpool = os.Getenv("ARCHIVE_SPOOL")
+)
+
+// How often the head of the chain of each sink is put in the audit log, as records are sent.
+const archiveHeadInterval = 15 * time.Minute
+
+var (
+	errLegalHoldNoSinks = errors.New("LEGAL_HOLD needs ARCHIVE_SINKS, where what is deleted is kept")
+	errLegalHoldNoSpool = errors.New("LEGAL_HOLD needs ARCHIVE_SPOOL, or -data-dir, to keep what the archive sinks don't have yet")
+)
+
+// snapshotSums is the file of a snapshot listing the hashes of the others, as sha256sum does.
+const snapshotSums = "SHA256SUMS"
+
+// checkLegalHold makes sure that what is deleted under legal hold is kept somewhere.
+func (s *ChatServer) checkLegalHold() error {
+	if !legalHold || relayUpstream != "" {
+		return nil
+	}
+	if len(s.archivers) == 0 {
+		return errLegalHoldNoSinks
+	}
+	if archiveSpool == "" {
+		return errLegalHoldNoSpool
+	}
+	slog.Info("Legal hold is on: deletions are soft and retention is suspended")
+	return nil
+}
+
+// archiveUpload archives the image data uploaded by uploader as id, under legal hold.
+func (s *ChatServer) archiveUpload(id, uploader string, data []byte) {
+	if !legalHold {
+		return
+	}
+	message := Message{Kind: "image", Content: id, Author: &MessageAuthor{ID: uploader, Nickname: s.getNickname(uploader)}}
+	s.archiveEvent("upload", uploader, message, data)
+}
+
+// spool keeps the records for a sink, as lines of JSON, until the sink has them.
+type spool struct {
+	path, statePath string
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// SHA-256 of the line of the last record added, "" if there was none yet.
+	head string
+	sent spoolState
+}
+
+// spoolState is what of a spool was sent, saved next to it.
+type spoolState struct {
+	// Where the records not sent yet start in the spool.
+	Offset int64 `json:"offset"`
+	// SHA-256 of the line of the last record sent.
+	Head string `json:"head"`
+}
+
+// openSpool opens the spool of the sink name in dir, going on from what the last run left.
+func openSpool(dir, name string) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(name))
+	base := filepath.Join(dir, hex.EncodeToString(sum[:8]))
+	sp := &spool{path: base + ".jsonl", statePath: base + ".json"}
+	if data, err := os.ReadFile(sp.statePath); err == nil {
+		if err := json.Unmarshal(data, &sp.sent); err != nil {
+			return nil, fmt.Errorf("%s: %w", sp.statePath, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	file, err := os.OpenFile(sp.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	sp.file, sp.size = file, info.Size()
+	if sp.sent.Offset > sp.size {
+		file.Close()
+		return nil, fmt.Errorf("%s is shorter than what was sent from it", sp.path)
+	}
+	// The chain goes on from the last record spooled, sent or not.
+	sp.head = sp.sent.Head
+	offset := sp.sent.Offset
+	for {
+		lines, end, err := sp.next(offset, archiveBatchSize)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if len(lines) == 0 {
+			break
+		}
+		sp.head, offset = lineHash(lines[len(lines)-1].data), end
+	}
+	// What is left is a record whose write was cut short.
+	if offset < sp.size {
+		if err := file.Truncate(offset); err != nil {
+			file.Close()
+			return nil, err
+		}
+		sp.size = offset
+	}
+	return sp, nil
+}
+
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// add appends record to the spool, chained to the one before it.
+func (sp *spool) add(record archiveRecord) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	prev := sp.head
+	record.Prev = &prev
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := sp.file.Write(append(data, '\n')); err != nil {
+		// Not to leave half a line for the next record to follow.
+		sp.file.Truncate(sp.size)
+		return err
+	}
+	sp.size += int64(len(data)) + 1
+	sp.head = lineHash(data)
+	return nil
+}
+
+// next returns at most max of the records spooled from offset on, and where the records after
+// them start.
+func (sp *spool) next(offset int64, max int) ([]archiveLine, int64, error) {
+	sp.mu.Lock()
+	size := sp.size
+	sp.mu.Unlock()
+	reader := bufio.NewReader(io.NewSectionReader(sp.file, offset, size-offset))
+	var lines []archiveLine
+	for len(lines) < max {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, offset, err
+		}
+		offset += int64(len(line))
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		var record struct {
+			Message struct {
+				ID string `json:"id"`
+			} `json:"message"`
+		}
+		json.Unmarshal(line, &record)
+		lines = append(lines, archiveLine{key: record.Message.ID, data: line})
+	}
+	return lines, offset, nil
+}
+
+// markSent notes that the records up to offset were sent, the last of them hashing to head, and
+// empties the spool once all were.
+func (sp *spool) markSent(offset int64, head string) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.sent = spoolState{Offset: offset, Head: head}
+	if offset == sp.size {
+		if err := sp.file.Truncate(0); err != nil {
+			return err
+		}
+		sp.size, sp.sent.Offset = 0, 0
+	}
+	data, _ := json.Marshal(sp.sent)
+	temp := sp.statePath + ".tmp"
+	if err := os.WriteFile(temp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(temp, sp.statePath)
+}
+
+// runSpooledArchiver sends the spool of a to its sink every ARCHIVE_FLUSH, until a is stopped.
+func (s *ChatServer) runSpooledArchiver(a *archiver) {
+	defer close(a.done)
+	defer a.spool.file.Close()
+	ticker := time.NewTicker(s.archiveFlush)
+	defer ticker.Stop()
+
+	var retryAt, headAudited time.Time
+	failures := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-a.stop:
+			if err := s.sendSpool(a); err != nil {
+				slog.Error("Could not archive messages at shutdown, they stay spooled for the next start", "sink", a.name, "err", err)
+			}
+			s.audit("archive", "archive.head", a.name, a.spool.sentHead())
+			return
+		}
+		now := s.clock.Now()
+		if now.Before(retryAt) {
+			continue
+		}
+		if err := s.sendSpool(a); err != nil {
+			failures++
+			backoff := min(archiveMaxBackoff, s.archiveFlush<<min(failures, 10))
+			retryAt = now.Add(backoff)
+			slog.Warn("Could not archive messages, they stay spooled", "sink", a.name, "retry", backoff, "err", err)
+			continue
+		}
+		retryAt, failures = time.Time{}, 0
+		if now.Sub(headAudited) >= archiveHeadInterval {
+			s.audit("archive", "archive.head", a.name, a.spool.sentHead())
+			headAudited = now
+		}
+	}
+}
+
+// sendSpool sends what the spool of a holds to its sink, in batches.
+func (s *ChatServer) sendSpool(a *archiver) error {
+	for {
+		lines, offset, err := a.spool.next(a.spool.sentOffset(), archiveBatchSize)
+		if err != nil || len(lines) == 0 {
+			return err
+		}
+		if err := a.sink.write(lines, s.clock.Now()); err != nil {
+			return err
+		}
+		if err := a.spool.markSent(offset, lineHash(lines[len(lines)-1].data)); err != nil {
+			return err
+		}
+	}
+}
+
+func (sp *spool) sentOffset() int64 {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.sent.Offset
+}
+
+func (sp *spool) sentHead() string {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.sent.Head
+}
+
+// writeSums writes the SHA256SUMS of a snapshot of files, by name, and returns its own hash.
+func writeSums(w io.Writer, sums map[string][sha256.Size]byte) (string, error) {
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		sum := sums[name]
+		fmt.Fprintf(&b, "%s  %s\n", hex.EncodeToString(sum[:]), name)
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	_, err := io.WriteString(w, b.String())
+	return hex.EncodeToString(sum[:]), err
+}
+
+func verify(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: alantern verify <snapshot directory> | <archive file>...")
+		fmt.Fprintln(os.Stderr, "Checks the SHA256SUMS of a snapshot, or the hash chain of archive files given in order.")
+		os.Exit(2)
+	}
+	var err error
+	if info, statErr := os.Stat(args[0]); statErr == nil && info.IsDir() && len(args) == 1 {
+		err = verifySnapshot(args[0])
+	} else {
+		err = verifyArchive(args)
+	}
+	if err != nil {
+		fmt.Printf("FAIL  %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// verifySnapshot checks the files of the snapshot in dir against its SHA256SUMS.
+func verifySnapshot(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, snapshotSums))
+	if err != nil {
+		return fmt.Errorf("%v: it was not taken under legal hold", err)
+	}
+	sum := sha256.Sum256(data)
+	listed := make(map[string]bool)
+	failed := 0
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		want, name, ok := strings.Cut(line, "  ")
+		if !ok {
+			return fmt.Errorf("%s: malformed line %q", snapshotSums, line)
+		}
+		listed[name] = true
+		content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			fmt.Printf("FAIL  %s: %v\n", name, err)
+			failed++
+			continue
+		}
+		if got := sha256.Sum256(content); hex.EncodeToString(got[:]) != want {
+			fmt.Printf("FAIL  %s: changed\n", name)
+			failed++
+		}
+	}
+	filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		name, _ := filepath.Rel(dir, path)
+		if name = filepath.ToSlash(name); name != snapshotSums && !listed[name] {
+			fmt.Printf("FAIL  %s: added\n", name)
+			failed++
+		}
+		return nil
+	})
+	if failed > 0 {
+		return errors.New("the snapshot was changed since it was taken")
+	}
+	fmt.Printf("ok    %d files, %s hash %s, to compare with the audit log\n", len(listed), snapshotSums, hex.EncodeToString(sum[:]))
+	return nil
+}
+
+// verifyArchive checks that each record of the archive files, read in order, follows the one
+// before it. The first may go on from records not given.
+func verifyArchive(files []string) error {
+	head := ""
+	records := 0
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		reader := bufio.NewReader(file)
+		for n := 1; ; n++ {
+			line, err := reader.ReadBytes('\n')
+			if len(line) == 0 && err == io.EOF {
+				break
+			} else if err != nil && err != io.EOF {
+				file.Close()
+				return err
+			}
+			line = bytes.TrimSuffix(line, []byte("\n"))
+			var record struct {
+				Prev *string `json:"prev"`
+			}
+			if err := json.Unmarshal(line, &record); err != nil {
+				file.Close()
+				return fmt.Errorf("%s:%d: not a record: %v", name, n, err)
+			}
+			switch {
+			case record.Prev == nil:
+				file.Close()
+				return fmt.Errorf("%s:%d: no hash, the record was not archived under legal hold", name, n)
+			case records == 0:
+			case *record.Prev == "":
+				file.Close()
+				return fmt.Errorf("%s:%d: a new chain starts, the records before it were cut or the spool was lost", name, n)
+			case *record.Prev != head:
+				file.Close()
+				return fmt.Errorf("%s:%d: the record before it was changed or removed", name, n)
+			}
+			sum := sha256.Sum256(line)
+			head = hex.EncodeToString(sum[:])
+			records++
+		}
+		file.Close()
+	}
+	fmt.Printf("ok    %d records, last hash %s, to compare with the archive.head entries of the audit log\n", records, head)
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakySink is an archive sink that fails until told otherwise.
+type flakySink struct {
+	mu    sync.Mutex
+	down  bool
+	lines [][]byte
+}
+
+func (f *flakySink) write(lines []archiveLine, now time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return errors.New("down")
+	}
+	for _, line := range lines {
+		f.lines = append(f.lines, line.data)
+	}
+	return nil
+}
+
+func (f *flakySink) close() error { return nil }
+
+func (f *flakySink) sent() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.lines)
+}
+
+// startHeld starts archiving to sink, under legal hold.
+func startHeld(t *testing.T, sink archiveSink) *ChatServer {
+	t.Helper()
+	s, _ := newTestServer(t)
+	s.archiveFlush = time.Millisecond
+	s.archivers = []*archiver{{name: "test", sink: sink, stop: make(chan struct{}), done: make(chan struct{})}}
+	if err := s.startArchive(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestLegalHoldKeepsWhatSinksDontTake(t *testing.T) {
+	held, spool := legalHold, archiveSpool
+	legalHold, archiveSpool = true, filepath.Join(t.TempDir(), "spool")
+	t.Cleanup(func() { legalHold, archiveSpool = held, spool })
+
+	sink := &flakySink{down: true}
+	s := startHeld(t, sink)
+	// More than a queue holds, with the sink down.
+	for i := 0; i < archiveQueueSize+10; i++ {
+		s.archive(Message{ID: "id", Kind: "text", Content: "hello"})
+	}
+	s.stopArchive()
+	if sink.sent() != 0 || s.archiveDropped() != 0 {
+		t.Fatalf("%d records sent to a sink that is down, %d dropped", sink.sent(), s.archiveDropped())
+	}
+
+	sink.mu.Lock()
+	sink.down = false
+	sink.mu.Unlock()
+	s = startHeld(t, sink)
+	s.auditMu.Lock()
+	started := s.auditLog[len(s.auditLog)-1]
+	s.auditMu.Unlock()
+	if started.Action != "archive.head" || !strings.HasPrefix(started.Detail, "going on from ") {
+		t.Errorf("audited %s %q at start, want the head the chain goes on from", started.Action, started.Detail)
+	}
+	s.archive(Message{ID: "id", Kind: "text", Content: "after the restart"})
+	deadline := time.Now().Add(5 * time.Second)
+	for sink.sent() < archiveQueueSize+11 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	s.stopArchive()
+	if n := sink.sent(); n != archiveQueueSize+11 {
+		t.Fatalf("%d records sent once the sink is back, want %d", n, archiveQueueSize+11)
+	}
+
+	file := filepath.Join(t.TempDir(), "archive.jsonl")
+	var data []byte
+	for _, line := range sink.lines {
+		data = append(append(data, line...), '\n')
+	}
+	os.WriteFile(file, data, 0o600)
+	if err := verifyArchive([]string{file}); err != nil {
+		t.Fatalf("the chain doesn't go on across the restart: %v", err)
+	}
+}
+
+func TestVerifyArchiveFindsNewChains(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "archive.jsonl")
+	first := `{"message": {"id": "a"}, "prev": ""}`
+	os.WriteFile(file, []byte(first+"\n"+`{"message": {"id": "b"}, "prev": "`+lineHash([]byte(first))+`"}`+"\n"), 0o600)
+	if err := verifyArchive([]string{file}); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	// As if the records after a were cut, and the next run started over.
+	os.WriteFile(file, []byte(first+"\n"+`{"message": {"id": "c"}, "prev": ""}`+"\n"), 0o600)
+	if err := verifyArchive([]string{file}); err == nil || !strings.Contains(err.Error(), "new chain") {
+		t.Fatalf("verify of a chain starting over: %v, want it found", err)
+	}
+}
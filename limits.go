@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Per-session concurrency caps.
+const (
+	maxUploadsPerSession = 2
+	maxStreamsPerSession = 3
+	// Applies to every other request, so a session can't pile up slow requests either.
+	maxInFlightPerSession = 10
+)
+
+// acquireSlot reserves one of limit concurrent slots of the given kind for sessionID. The returned
+// release function must be called once the slot is no longer used; it is nil if no slot was free.
+func (s *ChatServer) acquireSlot(sessionID, kind string, limit int) func() {
+	key := kind + " " + sessionID
+
+	s.inFlightMu.Lock()
+	defer s.inFlightMu.Unlock()
+	if s.inFlight[key] >= limit {
+		return nil
+	}
+	s.inFlight[key]++
+
+	return func() {
+		s.inFlightMu.Lock()
+		defer s.inFlightMu.Unlock()
+		if s.inFlight[key]--; s.inFlight[key] <= 0 {
+			delete(s.inFlight, key)
+		}
+	}
+}
+
+func isStream(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/events") || strings.HasSuffix(r.URL.Path, "/stream") ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+func tooManyConcurrent(w http.ResponseWriter, what string, limit int) {
+	http.Error(w, fmt.Sprintf("Too many simultaneous %s from this session (at most %d)", what, limit), http.StatusTooManyRequests)
+}
+
+// limitInFlight caps the number of concurrent requests per session cookie. Streams are left to
+// their own, separate cap since they stay open for as long as the page does.
+func (s *ChatServer) limitInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie("session_id")
+		if err != nil || isStream(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		release := s.acquireSlot(cookie.Value, "request", maxInFlightPerSession)
+		if release == nil {
+			tooManyConcurrent(w, "requests", maxInFlightPerSession)
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Livestream mode tunes the room for one-to-many streams. Public user messages are coalesced
+// and delivered as a single "batch" event every livestreamFlushInterval. When more than maxRate
+// messages per second come in, every viewer gets its own random sample of the batch, always
+// including its own messages and those of moderators. Pinned messages stay at the top for late
+// joiners.
+//
+// Each room, the main room included, keeps up to MAX_PINS pins, 5 by default: pinning another
+// unpins the oldest. Pins can also be given a lifetime, ;pin for 2h <message>, and are unpinned
+// once it is over.
+
+const (
+	livestreamFlushInterval  = 250 * time.Millisecond
+	defaultLivestreamMaxRate = 20
+	defaultMaxPins           = 5
+)
+
+// Most pins kept at once in each room.
+var maxPins = loadPositiveInt("MAX_PINS", defaultMaxPins)
+
+type livestreamState struct {
+	// Whether or not livestream mode is on.
+	enabled bool
+	// Messages per second above which viewers get sampled batches.
+	maxRate int
+	// Messages waiting for the next flush.
+	pending []Message
+}
+
+type Pin struct {
+	// Pin identifier.
+	ID string `json:"id"`
+	// Pinned text, already escaped.
+	Content string `json:"content"`
+	// Nickname of the moderator who pinned it.
+	PinnedBy string `json:"pinnedBy"`
+	// When it was pinned.
+	PinnedAt time.Time `json:"pinnedAt"`
+	// When it gets unpinned, if it was pinned for a while only.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// Room it was pinned in, empty for the main room.
+	Room string `json:"room,omitempty"`
+}
+
+func (p Pin) message() Message {
+	return Message{ID: p.ID, FromApp: true, Kind: "pin", Content: p.Content, Room: p.Room}
+}
+
+func (s *ChatServer) initLivestream() {
+	s.livestream.maxRate = defaultLivestreamMaxRate
+	if os.Getenv("LIVESTREAM_MODE") != "" {
+		s.livestream.enabled = true
+	}
+	if rate, err := strconv.Atoi(os.Getenv("LIVESTREAM_MAX_RATE")); err == nil && rate > 0 {
+		s.livestream.maxRate = rate
+	}
+}
+
+// coalesce queues a public user message for the next livestream batch. It reports false if
+// livestream mode is off, in which case the message should be broadcast right away.
+func (s *ChatServer) coalesce(message Message) bool {
+	if message.FromApp || message.Private || message.Kind == "batch" {
+		return false
+	}
+
+	s.livestreamMu.Lock()
+	defer s.livestreamMu.Unlock()
+	if !s.livestream.enabled {
+		return false
+	}
+	s.livestream.pending = append(s.livestream.pending, message)
+	return true
+}
+
+func (s *ChatServer) flushLivestream() {
+	// Relay edges catching up skip pending messages, see handleRelayStream.
+	s.broadcastMu.Lock()
+	defer s.broadcastMu.Unlock()
+	s.livestreamMu.Lock()
+	pending := s.livestream.pending
+	s.livestream.pending = nil
+	limit := s.livestream.maxRate * int(livestreamFlushInterval) / int(time.Second)
+	s.livestreamMu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	if limit < 1 {
+		limit = 1
+	}
+
+	full, err := json.Marshal(s.stamp(Message{FromApp: true, Kind: "batch", Messages: pending}))
+	if err != nil {
+		return
+	}
+	s.publishToRelays(string(full))
+
+	// Viewers who muted someone get the batch without their messages, see mutes.go.
+	mutes := s.mutePreferences()
+	if len(pending) <= limit && len(mutes) == 0 {
+		s.broadcastRaw(string(full))
+		return
+	}
+
+	// Messages every viewer gets no matter the sampling.
+	keep := make([]bool, len(pending))
+	for i, message := range pending {
+		keep[i] = message.Author == nil || s.isModerator(s.sessionOfHandle(message.Author.ID))
+	}
+
+	s.countBroadcast()
+	s.hub.broadcastAll(func(id string, ch chan string) {
+		preferences, muting := mutes[id]
+		if len(pending) <= limit && !muting {
+			s.deliver(ch, string(full))
+			return
+		}
+		batch, batchKeep := pending, keep
+		if muting {
+			batch, batchKeep = s.withoutMuted(pending, keep, preferences)
+		}
+		if len(batch) > limit {
+			batch = sampleBatch(batch, batchKeep, sessionHandle(id), limit)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		data, err := json.Marshal(s.stamp(Message{FromApp: true, Kind: "batch", Messages: batch}))
+		if err != nil {
+			return
+		}
+		s.deliver(ch, string(data))
+	})
+}
+
+// sampleBatch picks up to limit messages from pending at random, plus every message marked in
+// keep or written by viewer, a session handle, preserving their order.
+func sampleBatch(pending []Message, keep []bool, viewer string, limit int) []Message {
+	var forced, optional []int
+	for i, message := range pending {
+		if keep[i] || (message.Author != nil && message.Author.ID == viewer) {
+			forced = append(forced, i)
+		} else {
+			optional = append(optional, i)
+		}
+	}
+
+	chosen := forced
+	if room := limit - len(forced); room > 0 {
+		mrand.Shuffle(len(optional), func(i, j int) { optional[i], optional[j] = optional[j], optional[i] })
+		if room > len(optional) {
+			room = len(optional)
+		}
+		chosen = append(chosen, optional[:room]...)
+	}
+	sort.Ints(chosen)
+
+	batch := make([]Message, 0, len(chosen))
+	for _, i := range chosen {
+		batch = append(batch, pending[i])
+	}
+	return batch
+}
+
+// sendPins delivers the current pins to a freshly connected client.
+// pinsIn returns the pins of the room name, oldest first.
+func (s *ChatServer) pinsIn(name string) []Pin {
+	s.pinsMu.Lock()
+	defer s.pinsMu.Unlock()
+	return s.pinsInLocked(name)
+}
+
+// sendPins sends sessionID the pins of the room name.
+func (s *ChatServer) sendPins(sessionID, name string) {
+	for _, pin := range s.pinsIn(name) {
+		s.sendTo(sessionID, pin.message())
+	}
+}
+
+// handlePins lists the pins of "room", the main room by default, oldest first, a page at a time.
+// Only the members of a room and the moderators see its pins.
+func (s *ChatServer) handlePins(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	room := normalizeRoom(r.URL.Query().Get("room"))
+	if room != "" && !s.roomExists(room) {
+		http.Error(w, errUnknownRoom.Error(), http.StatusNotFound)
+		return
+	}
+	if !s.canReadRoom(sessionID, room) {
+		http.Error(w, errNotInRoom.Error(), http.StatusForbidden)
+		return
+	}
+	pins := s.pinsIn(room)
+	if pins == nil {
+		pins = []Pin{}
+	}
+
+	writePage(w, r, pins, func(p Pin) string { return timeKey(p.PinnedAt, p.ID) })
+}
+
+func (s *ChatServer) handleLivestreamCommand(sessionID string, args []string) {
+	if !s.isModerator(sessionID) {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Only moderators can use ;livestream",
+		})
+		return
+	}
+
+	usage := Message{Kind: "text", Content: "Usage: ;livestream on [max messages per second]|off"}
+	if len(args) == 0 || (args[0] != "on" && args[0] != "off") {
+		s.sendPrivateMessage(sessionID, usage)
+		return
+	}
+
+	s.livestreamMu.Lock()
+	if len(args) > 1 {
+		rate, err := strconv.Atoi(args[1])
+		if err != nil || rate < 1 {
+			s.livestreamMu.Unlock()
+			s.sendPrivateMessage(sessionID, usage)
+			return
+		}
+		s.livestream.maxRate = rate
+	}
+	s.livestream.enabled = args[0] == "on"
+	maxRate := s.livestream.maxRate
+	s.livestreamMu.Unlock()
+
+	// Anything still queued goes out right away rather than waiting for the next tick.
+	s.flushLivestream()
+
+	s.audit(sessionID, "livestream."+args[0], "", strconv.Itoa(maxRate))
+	s.notifyModerators(Message{
+		Kind:    "text",
+		Content: fmt.Sprintf("Livestream mode turned %s by [%s] (sampling above %d messages per second)", args[0], escapeText(s.getNickname(sessionID)), maxRate),
+	})
+}
+
+func (s *ChatServer) handlePinCommand(sessionID string, text string) {
+	room := s.currentRoom(sessionID)
+	if !s.moderatesRoom(sessionID, room) {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Only moderators can use ;pin",
+		})
+		return
+	}
+	// "for <duration>" in front pins the message for that long only.
+	var lifetime time.Duration
+	if words := strings.SplitN(strings.TrimSpace(text), " ", 3); len(words) == 3 && words[0] == "for" {
+		if d, err := time.ParseDuration(words[1]); err == nil && d > 0 {
+			lifetime, text = d, words[2]
+		}
+	}
+	if strings.TrimSpace(text) == "" {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Usage: ;pin [for &lt;duration&gt;] &lt;message&gt;",
+		})
+		return
+	}
+
+	s.addPin(sessionID, room, text, lifetime)
+}
+
+// addPin pins text in the room name on behalf of sessionID, for lifetime or until unpinned if 0,
+// dropping the oldest pins of the room beyond maxPins.
+func (s *ChatServer) addPin(sessionID, name, text string, lifetime time.Duration) Pin {
+	pin := Pin{
+		ID:       s.newID(),
+		Content:  escapeText(text),
+		PinnedBy: s.getNickname(sessionID),
+		PinnedAt: s.clock.Now(),
+		Room:     name,
+	}
+	if lifetime > 0 {
+		expiresAt := pin.PinnedAt.Add(lifetime)
+		pin.ExpiresAt = &expiresAt
+	}
+
+	s.pinsMu.Lock()
+	s.pins = append(s.pins, pin)
+	var dropped []Pin
+	for inRoom := len(s.pinsInLocked(name)); inRoom > maxPins; inRoom-- {
+		for i, old := range s.pins {
+			if old.Room == name {
+				dropped = append(dropped, old)
+				s.pins = append(s.pins[:i], s.pins[i+1:]...)
+				break
+			}
+		}
+	}
+	s.pinsMu.Unlock()
+
+	for _, old := range dropped {
+		s.broadcastUnpin(old)
+	}
+	s.audit(sessionID, "pin", pin.ID, text)
+	s.broadcastPin(pin.message())
+	return pin
+}
+
+func (s *ChatServer) pinsInLocked(name string) []Pin {
+	var pins []Pin
+	for _, pin := range s.pins {
+		if pin.Room == name {
+			pins = append(pins, pin)
+		}
+	}
+	return pins
+}
+
+// broadcastPin sends a pin or unpin event to the room it is about.
+func (s *ChatServer) broadcastPin(message Message) {
+	if message.Room == "" {
+		s.broadcastMessage(message)
+	} else {
+		s.broadcastToRoom(message.Room, message)
+	}
+}
+
+func (s *ChatServer) broadcastUnpin(pin Pin) {
+	s.broadcastPin(Message{FromApp: true, Kind: "unpin", Content: pin.ID, Room: pin.Room})
+}
+
+// expirePins unpins the pins whose lifetime is over, and forgets those of rooms that are gone.
+func (s *ChatServer) expirePins() {
+	now := s.clock.Now()
+	s.pinsMu.Lock()
+	var expired []Pin
+	kept := s.pins[:0]
+	for _, pin := range s.pins {
+		switch {
+		case pin.Room != "" && !s.roomExists(pin.Room):
+		case pin.ExpiresAt != nil && !now.Before(*pin.ExpiresAt):
+			expired = append(expired, pin)
+		default:
+			kept = append(kept, pin)
+		}
+	}
+	s.pins = kept
+	s.pinsMu.Unlock()
+
+	for _, pin := range expired {
+		s.broadcastUnpin(pin)
+	}
+}
+
+func (s *ChatServer) handleUnpinCommand(sessionID string, args []string) {
+	room := s.currentRoom(sessionID)
+	if !s.moderatesRoom(sessionID, room) {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Only moderators can use ;unpin",
+		})
+		return
+	}
+	if len(args) != 1 {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Usage: ;unpin &lt;pin id&gt;",
+		})
+		return
+	}
+
+	// Those who only moderate their room can only unpin there.
+	if !s.isModerator(sessionID) && !containsPin(s.pinsIn(room), args[0]) || !s.removePin(sessionID, args[0]) {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "No pin with that id, see ;pins",
+		})
+	}
+}
+
+func containsPin(pins []Pin, id string) bool {
+	for _, pin := range pins {
+		if pin.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// removePin unpins the pin id on behalf of sessionID. It reports false if there is no such pin.
+func (s *ChatServer) removePin(sessionID, id string) bool {
+	s.pinsMu.Lock()
+	var removed *Pin
+	for i, pin := range s.pins {
+		if pin.ID == id {
+			s.pins = append(s.pins[:i], s.pins[i+1:]...)
+			removed = &pin
+			break
+		}
+	}
+	s.pinsMu.Unlock()
+
+	if removed == nil {
+		return false
+	}
+	s.audit(sessionID, "unpin", id, "")
+	s.broadcastUnpin(*removed)
+	return true
+}
+
+func (s *ChatServer) handlePinsCommand(sessionID string) {
+	pins := s.pinsIn(s.currentRoom(sessionID))
+
+	if len(pins) == 0 {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Nothing is pinned"})
+		return
+	}
+	messageContent := "Pinned messages:"
+	for _, pin := range pins {
+		messageContent += fmt.Sprintf("<br>(%s) %s", escapeText(pin.ID), pin.Content)
+		if pin.ExpiresAt != nil {
+			messageContent += fmt.Sprintf(" (until %s UTC)", pin.ExpiresAt.UTC().Format("2006-01-02 15:04"))
+		}
+	}
+	s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: messageContent})
+}
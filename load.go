@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Load signals for autoscalers. /api/admin/load returns them as flat JSON, for the KEDA
+// metrics-api scaler or an HPA external metrics adapter, and /metrics in the Prometheus text
+// format, along with request latencies (see latency.go), while statsd.go pushes them to StatsD where nothing scrapes. Both are served by the primary and by relay edges, each about itself, to whoever
+// presents ADMIN_TOKEN as a bearer token, or for /metrics a moderator on the primary too.
+//
+// Edges can come and go freely: a new or reconnecting edge catches up from the primary's event
+// log, and an edge is drained before going away, moving its clients to another, see migrate.go.
+
+var adminToken = os.Getenv("ADMIN_TOKEN")
+
+// Seconds over which the broadcast rate is averaged.
+const loadWindow = 60
+
+type loadState struct {
+	// Broadcasts during each of the last loadWindow seconds, by Unix time modulo loadWindow.
+	broadcasts [loadWindow]int
+	seconds    [loadWindow]int64
+}
+
+type Load struct {
+	// "primary" or "edge".
+	Role string `json:"role"`
+	// Connected /events streams.
+	Subscribers int `json:"subscribers"`
+	// Edges, debug viewers and GraphQL subscriptions reading the relay feed. Always 0 on edges.
+	Relays int `json:"relays"`
+	// Broadcasts per second over the last minute.
+	MessagesPerSecond float64 `json:"messagesPerSecond"`
+	// How full the fullest client queue is, from 0 to 1.
+	QueueSaturation float64 `json:"queueSaturation"`
+	// Events dropped for clients whose queue was full since start.
+	Dropped uint64 `json:"dropped"`
+	// Streams closed since start because their queue was full, with SLOW_CLIENT_POLICY=disconnect.
+	Evicted uint64 `json:"evicted"`
+	// Messages dropped for archive sinks whose queue was full since start, see archive.go.
+	ArchiveDropped uint64 `json:"archiveDropped"`
+}
+
+// countBroadcast adds a broadcast to the rate of the current second.
+func (s *ChatServer) countBroadcast() {
+	now := s.clock.Now().Unix()
+	s.loadMu.Lock()
+	defer s.loadMu.Unlock()
+	slot := now % loadWindow
+	if s.load.seconds[slot] != now {
+		s.load.seconds[slot] = now
+		s.load.broadcasts[slot] = 0
+	}
+	s.load.broadcasts[slot]++
+}
+
+func (s *ChatServer) currentLoad() Load {
+	load := Load{Role: "primary"}
+	if relayUpstream != "" {
+		load.Role = "edge"
+	}
+
+	s.hub.read(func(clients map[string]chan string) {
+		load.Subscribers = len(clients)
+		for _, ch := range clients {
+			if saturation := float64(len(ch)) / float64(cap(ch)); cap(ch) > 0 && saturation > load.QueueSaturation {
+				load.QueueSaturation = saturation
+			}
+		}
+	})
+
+	s.relaySubscribersMu.Lock()
+	load.Relays = len(s.relaySubscribers)
+	s.relaySubscribersMu.Unlock()
+
+	now := s.clock.Now().Unix()
+	s.loadMu.Lock()
+	total := 0
+	for slot, second := range s.load.seconds {
+		if second > now-loadWindow && second <= now {
+			total += s.load.broadcasts[slot]
+		}
+	}
+	s.loadMu.Unlock()
+	load.MessagesPerSecond = float64(total) / loadWindow
+
+	s.gapsMu.Lock()
+	load.Dropped = s.dropped
+	load.Evicted = s.evicted
+	s.gapsMu.Unlock()
+	load.ArchiveDropped = s.archiveDropped()
+	return load
+}
+
+// validAdminToken reports whether token is ADMIN_TOKEN, if set.
+func validAdminToken(token string) bool {
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// adminAuthorized reports whether r presents ADMIN_TOKEN, or else comes from a moderator. It is for
+// /metrics, the admin API taking the token alone, see adminTokenAuthorized.
+func (s *ChatServer) adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return validAdminToken(token)
+	}
+	return relayUpstream == "" && s.isModerator(s.getOrCreateSession(w, r))
+}
+
+// adminTokenAuthorized reports whether r presents ADMIN_TOKEN, moderators not being enough.
+func adminTokenAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && validAdminToken(token)
+}
+
+func (s *ChatServer) handleAdminLoad(w http.ResponseWriter, r *http.Request) {
+	if !adminTokenAuthorized(r) {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.currentLoad())
+}
+
+func (s *ChatServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !s.adminAuthorized(w, r) {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+	load := s.currentLoad()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, metric := range load.metrics() {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s{role=%q} %v\n", metric.name, metric.help, metric.name, metric.kind, metric.name, load.Role, metric.value)
+	}
+	s.writeLatencyMetrics(w, load.Role)
+}
+
+type metric struct {
+	// Prometheus name, e.g. "alantern_subscribers".
+	name string
+	// "gauge" or "counter".
+	kind, help string
+	value      float64
+}
+
+// metrics returns load as the metrics /metrics and StatsD report.
+func (load Load) metrics() []metric {
+	return []metric{
+		{"alantern_subscribers", "gauge", "Connected /events streams.", float64(load.Subscribers)},
+		{"alantern_relay_subscribers", "gauge", "Readers of the relay feed.", float64(load.Relays)},
+		{"alantern_messages_per_second", "gauge", "Broadcasts per second over the last minute.", load.MessagesPerSecond},
+		{"alantern_queue_saturation", "gauge", "How full the fullest client queue is, from 0 to 1.", load.QueueSaturation},
+		{"alantern_dropped_events_total", "counter", "Events dropped for clients whose queue was full.", float64(load.Dropped)},
+		{"alantern_evicted_clients_total", "counter", "Streams closed because their queue was full.", float64(load.Evicted)},
+		{"alantern_archive_dropped_total", "counter", "Messages dropped for archive sinks whose queue was full.", float64(load.ArchiveDropped)},
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lobbyNoticeDelay is how long the moderators' notice of new joiners waits for more of them.
+const lobbyNoticeDelay = 10 * time.Second
+
+var (
+	errInLobby       = errors.New("You can't post in the room until a moderator approves you")
+	errRaidNewMember = errors.New("Raid mode is on: new members can't send messages right now")
+	errMuted         = errors.New("You are muted by the moderators")
+)
+
+type PendingJoiner struct {
+	// Handle of the joiner's session, see sessionHandle.
+	ID string `json:"id"`
+	// Nickname of the joiner, "anonymous" if none is set yet.
+	Nickname string `json:"nickname"`
+	// When the joiner landed in the lobby.
+	WaitingSince time.Time `json:"waitingSince"`
+}
+
+func (s *ChatServer) inLobby(sessionID string) bool {
+	s.lobbyMu.Lock()
+	defer s.lobbyMu.Unlock()
+	_, ok := s.lobbyPending[sessionID]
+	return ok
+}
+
+// canPost returns why sessionID can't have something posted in the room on its behalf, by a
+// command or an API, or nil. These skip the lobby, mute and raid mode checks made on plain
+// messages.
+func (s *ChatServer) canPost(sessionID string) error {
+	if s.inLobby(sessionID) {
+		return errInLobby
+	}
+	if s.muteRestriction(sessionID) != "" {
+		return errMuted
+	}
+	if s.raidBlocksNewMember(sessionID) {
+		return errRaidNewMember
+	}
+	return nil
+}
+
+// holdInLobby keeps a newly seen session from posting if lobby mode is on. It isn't listed in
+// the queue, nor are the moderators told, until it connects a stream: sessions are minted for
+// every request without a cookie.
+func (s *ChatServer) holdInLobby(sessionID string) {
+	s.lobbyMu.Lock()
+	if s.lobbyOn {
+		s.lobbyPending[sessionID] = time.Time{}
+	}
+	s.lobbyMu.Unlock()
+}
+
+// enqueueLobby lists a held session in the queue once its stream connects, and tells the
+// moderators about it along with whoever else arrives within lobbyNoticeDelay.
+func (s *ChatServer) enqueueLobby(sessionID string) {
+	s.lobbyMu.Lock()
+	defer s.lobbyMu.Unlock()
+	if since, ok := s.lobbyPending[sessionID]; !ok || !since.IsZero() {
+		return
+	}
+	s.lobbyPending[sessionID] = s.clock.Now()
+	s.lobbyArrivals = append(s.lobbyArrivals, sessionID)
+	if len(s.lobbyArrivals) == 1 {
+		s.clock.AfterFunc(lobbyNoticeDelay, s.sendLobbyNotice)
+	}
+}
+
+// sendLobbyNotice tells the moderators who joined the lobby since the last notice.
+func (s *ChatServer) sendLobbyNotice() {
+	s.lobbyMu.Lock()
+	var waiting []string
+	for _, id := range s.lobbyArrivals {
+		if _, ok := s.lobbyPending[id]; ok {
+			waiting = append(waiting, id)
+		}
+	}
+	s.lobbyArrivals = nil
+	s.lobbyMu.Unlock()
+
+	switch len(waiting) {
+	case 0:
+		return
+	case 1:
+		s.notifyModerators(Message{
+			Kind:    "text",
+			Content: fmt.Sprintf("New joiner %s is waiting in the lobby, use ;approve %s to let them in", sessionHandle(waiting[0]), sessionHandle(waiting[0])),
+		})
+	default:
+		s.notifyModerators(Message{
+			Kind:    "text",
+			Content: fmt.Sprintf("%d new joiners are waiting in the lobby, see /mod/queue or use ;approve &lt;nickname|session&gt; to let them in", len(waiting)),
+		})
+	}
+}
+
+func (s *ChatServer) approveJoiner(sessionID string) bool {
+	s.lobbyMu.Lock()
+	_, ok := s.lobbyPending[sessionID]
+	delete(s.lobbyPending, sessionID)
+	s.lobbyMu.Unlock()
+
+	if ok {
+		s.logModAction(fmt.Sprintf("[%s] was let in from the lobby", escapeText(s.getNickname(sessionID))))
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "A moderator approved you, welcome in!",
+		})
+	}
+	return ok
+}
+
+func (s *ChatServer) pendingJoiners() []PendingJoiner {
+	s.lobbyMu.Lock()
+	pending := make([]PendingJoiner, 0, len(s.lobbyPending))
+	for id, since := range s.lobbyPending {
+		if since.IsZero() {
+			continue
+		}
+		pending = append(pending, PendingJoiner{ID: id, WaitingSince: since})
+	}
+	s.lobbyMu.Unlock()
+
+	for i := range pending {
+		pending[i].Nickname = s.getNickname(pending[i].ID)
+		pending[i].ID = sessionHandle(pending[i].ID)
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].WaitingSince.Before(pending[j].WaitingSince)
+	})
+	return pending
+}
+
+// relayLobbyMessage delivers a message from a lobby member to the moderators and back to its
+// author. Held sessions that never connected a stream are dropped, like their place in the queue.
+func (s *ChatServer) relayLobbyMessage(sessionID, messageText string) {
+	s.lobbyMu.Lock()
+	since := s.lobbyPending[sessionID]
+	s.lobbyMu.Unlock()
+	if since.IsZero() {
+		return
+	}
+	msg := Message{
+		Kind:    "text",
+		Content: fmt.Sprintf("(lobby) [%s] (%s): %s", escapeText(s.getNickname(sessionID)), sessionHandle(sessionID), escapeText(messageText)),
+	}
+	s.notifyModerators(msg)
+	s.sendPrivateMessage(sessionID, msg)
+}
+
+func (s *ChatServer) handleLobbyCommand(sessionID string, args []string) {
+	if !s.isModerator(sessionID) {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Only moderators can use ;lobby",
+		})
+		return
+	}
+
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Usage: ;lobby on|off",
+		})
+		return
+	}
+
+	s.lobbyMu.Lock()
+	s.lobbyOn = args[0] == "on"
+	var released []string
+	if !s.lobbyOn {
+		for id, since := range s.lobbyPending {
+			if !since.IsZero() {
+				released = append(released, id)
+			}
+		}
+		s.lobbyPending = make(map[string]time.Time)
+	}
+	s.lobbyMu.Unlock()
+
+	for _, id := range released {
+		s.sendPrivateMessage(id, Message{
+			Kind:    "text",
+			Content: "Lobby mode was turned off, welcome in!",
+		})
+	}
+	s.audit(sessionID, "lobby."+args[0], "", "")
+	s.logModAction("Lobby mode was turned " + args[0])
+	s.notifyModerators(Message{
+		Kind:    "text",
+		Content: fmt.Sprintf("Lobby mode turned %s by [%s]", args[0], escapeText(s.getNickname(sessionID))),
+	})
+}
+
+func (s *ChatServer) handleApproveCommand(sessionID string, args []string) {
+	if !s.isModerator(sessionID) {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Only moderators can use ;approve",
+		})
+		return
+	}
+
+	if len(args) != 1 {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Usage: ;approve &lt;nickname|session&gt;",
+		})
+		return
+	}
+
+	target := s.findSession(args[0])
+	if target == "" || !s.approveJoiner(target) {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: fmt.Sprintf("%s is not waiting in the lobby", escapeText(args[0])),
+		})
+		return
+	}
+
+	s.audit(sessionID, "lobby.approve", target, "")
+	s.notifyModerators(Message{
+		Kind:    "text",
+		Content: fmt.Sprintf("[%s] approved %s", escapeText(s.getNickname(sessionID)), sessionHandle(target)),
+	})
+}
+
+// handleModQueue lists the lobby (GET) or approves a joiner given by the "id" form value (POST).
+func (s *ChatServer) handleModQueue(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	if !s.isModerator(sessionID) {
+		http.Error(w, "Moderators only", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.pendingJoiners())
+
+	case http.MethodPost:
+		r.ParseForm()
+		id := strings.TrimSpace(r.FormValue("id"))
+		target := s.findSession(id)
+		if target == "" || !s.approveJoiner(target) {
+			http.Error(w, "Not waiting in the lobby", http.StatusNotFound)
+			return
+		}
+		s.audit(sessionID, "lobby.approve", target, "")
+		fmt.Fprintf(w, "Approved %s", sessionHandle(target))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
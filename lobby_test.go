@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"alantern/chattest"
+)
+
+func TestLobbyQueuesStreamsAndCoalescesNotices(t *testing.T) {
+	clock := newFakeClock()
+	_, srv := newTestServer(t, WithClock(clock))
+	key := moderatorKey
+	moderatorKey = "test-key"
+	t.Cleanup(func() { moderatorKey = key })
+	mod := srv.Connect()
+	mod.Send(";mod test-key")
+	mod.Expect(chattest.Private("You are now a moderator"))
+	mod.Send(";lobby on")
+	mod.Collect(settle)
+
+	for i := 0; i < 3; i++ {
+		srv.NewClient().Do(http.MethodGet, "/mod/queue", nil)
+	}
+	unstreamed := srv.NewClient()
+	unstreamed.Send("no stream")
+	mod.ExpectNone(settle)
+	srv.Connect()
+	srv.Connect()
+	clock.Advance(lobbyNoticeDelay)
+	mod.Expect(chattest.Private("2 new joiners are waiting in the lobby"))
+	mod.ExpectNone(settle)
+
+	var pending []PendingJoiner
+	_, body := mod.Do(http.MethodGet, "/mod/queue", nil)
+	if err := json.Unmarshal([]byte(body), &pending); err != nil || len(pending) != 2 {
+		t.Fatalf("/mod/queue lists %s, want the 2 streams", body)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Members can share where they are as a "location" message, sent to /send with data such as
+// {"lat": 46.55, "lon": 7.98, "accuracy": 50}: coordinates in degrees and how far off they may
+// be, in meters. The message text is an optional caption. Locations are off until a room's
+// moderators turn them on with ;locations on, in the room they are in. When MAP_TILE_URL is set,
+// a tile URL template such as "https://tile.openstreetmap.org/{z}/{x}/{y}.png", each location
+// gets the map tile around it, zoomed in as far as its accuracy allows, as URL through the media
+// proxy (see proxy.go), so its host must be in PROXY_DOMAINS.
+
+const (
+	// Most a location may be off by, in meters.
+	maxLocationAccuracy = 100_000
+	// Zoom levels map tiles are picked from.
+	minTileZoom = 3
+	maxTileZoom = 17
+	// Size of a map tile, in pixels.
+	tileSize = 256
+)
+
+var mapTileURL = os.Getenv("MAP_TILE_URL")
+
+var (
+	errInvalidLocation = fmt.Errorf("Invalid location: expected lat and lon in degrees and an accuracy of at most %d meters", maxLocationAccuracy)
+	errLocationsOff    = errors.New("Locations are off in this room")
+)
+
+type Location struct {
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lon"`
+	// Radius around the coordinates the location is within, in meters.
+	Accuracy float64 `json:"accuracy"`
+}
+
+func init() {
+	registerKind("location", ContentKind{
+		Message:  true,
+		Validate: validateLocation,
+		Allowed: func(s *ChatServer, room string) error {
+			if !s.locationsAllowed(room) {
+				return errLocationsOff
+			}
+			return nil
+		},
+		Prepare:  withMapTile,
+		Sanitize: sanitizeContent,
+		Text:     locationText,
+	})
+}
+
+func decodeLocation(data json.RawMessage) (Location, error) {
+	var location Location
+	if err := json.Unmarshal(data, &location); err != nil {
+		return location, errInvalidLocation
+	}
+	if math.IsNaN(location.Latitude) || math.Abs(location.Latitude) > 90 ||
+		math.IsNaN(location.Longitude) || math.Abs(location.Longitude) > 180 ||
+		!(location.Accuracy >= 0 && location.Accuracy <= maxLocationAccuracy) {
+		return location, errInvalidLocation
+	}
+	return location, nil
+}
+
+func validateLocation(data json.RawMessage) error {
+	_, err := decodeLocation(data)
+	return err
+}
+
+// tile returns the zoom and coordinates of the map tile around the location, zoomed in as far
+// as still shows its accuracy radius.
+func (location Location) tile() (zoom, x, y int) {
+	latitude := location.Latitude * math.Pi / 180
+	// Web Mercator tiles don't reach the poles.
+	latitude = max(min(latitude, 1.4844), -1.4844)
+	zoom = maxTileZoom
+	for zoom > minTileZoom {
+		metersPerPixel := 156543.03 * math.Cos(latitude) / math.Exp2(float64(zoom))
+		if metersPerPixel*tileSize >= 2*location.Accuracy {
+			break
+		}
+		zoom--
+	}
+	n := math.Exp2(float64(zoom))
+	x = int((location.Longitude + 180) / 360 * n)
+	y = int((1 - math.Log(math.Tan(latitude)+1/math.Cos(latitude))/math.Pi) / 2 * n)
+	return zoom, min(x, int(n)-1), min(y, int(n)-1)
+}
+
+// withMapTile sets the URL of a location message to its map tile, if MAP_TILE_URL is set.
+func withMapTile(message Message) Message {
+	location, err := decodeLocation(message.Data)
+	if err != nil || mapTileURL == "" {
+		return message
+	}
+	zoom, x, y := location.tile()
+	tile := strings.NewReplacer("{z}", strconv.Itoa(zoom), "{x}", strconv.Itoa(x), "{y}", strconv.Itoa(y)).Replace(mapTileURL)
+	message.URL = "/proxy?url=" + url.QueryEscape(tile)
+	return message
+}
+
+func locationText(message Message) string {
+	location, _ := decodeLocation(message.Data)
+	text := fmt.Sprintf("[location %.5f, %.5f, within %gm]", location.Latitude, location.Longitude, location.Accuracy)
+	if caption := contentText(message); caption != "" {
+		text += " " + caption
+	}
+	return text
+}
+
+// locationsAllowed reports whether locations may be shared in the room name.
+func (s *ChatServer) locationsAllowed(name string) bool {
+	if name == "" {
+		s.locationsMu.Lock()
+		defer s.locationsMu.Unlock()
+		return s.locationsOn
+	}
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	room, ok := s.rooms[name]
+	return ok && room.locationsOn
+}
+
+// setLocations turns locations on, or back off, in the room name.
+func (s *ChatServer) setLocations(name string, on bool) error {
+	if name == "" {
+		s.locationsMu.Lock()
+		s.locationsOn = on
+		s.locationsMu.Unlock()
+		return nil
+	}
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	room, ok := s.rooms[name]
+	if !ok {
+		return errUnknownRoom
+	}
+	room.locationsOn = on
+	return nil
+}
+
+// handleLocationsCommand turns locations on or off in the room the moderator is in.
+func (s *ChatServer) handleLocationsCommand(sessionID string, args []string) {
+	room := s.currentRoom(sessionID)
+	if !s.moderatesRoom(sessionID, room) {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Only moderators can use ;locations",
+		})
+		return
+	}
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Usage: ;locations on|off"})
+		return
+	}
+
+	if err := s.setLocations(room, args[0] == "on"); err != nil {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: escapeText(err.Error())})
+		return
+	}
+
+	where := "the main room"
+	if room != "" {
+		where = "#" + room
+	}
+	s.audit(sessionID, "locations."+args[0], room, "")
+	notice := Message{
+		FromApp: true,
+		Kind:    "text",
+		Content: fmt.Sprintf("Location sharing turned %s in %s by [%s]", args[0], where, escapeText(s.getNickname(sessionID))),
+	}
+	if room == "" {
+		s.broadcastMessage(notice)
+	} else {
+		s.broadcastToRoom(room, notice)
+	}
+}
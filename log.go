@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// What the server does is logged with log/slog, as text, or as JSON for log aggregation with
+// serve's -log-format or LOG_FORMAT=json. Records below the level of -log-level, LOG_LEVEL or
+// "info" by default, are left out. Those logged while serving a request should go through
+// requestLogger, which adds its trace identifier, method, path and session. They go to standard
+// output, or are appended to -log-file or LOG_FILE if set, for services. Errors are also reported
+// as crashes, see crashes.go.
+
+var errInvalidLogLevel = errors.New(`log level must be "debug", "info", "warn" or "error"`)
+
+var errInvalidLogFormat = errors.New(`log format must be "text" or "json"`)
+
+var logLevels = map[string]slog.Level{"debug": slog.LevelDebug, "info": slog.LevelInfo, "warn": slog.LevelWarn, "error": slog.LevelError}
+
+// setupLogging makes the default logger write records at level and above, in format, to file
+// unless it is "".
+func setupLogging(level, format, file string) error {
+	minLevel, ok := logLevels[level]
+	if !ok {
+		return errInvalidLogLevel
+	}
+	if format != "text" && format != "json" {
+		return errInvalidLogFormat
+	}
+	out := io.Writer(os.Stdout)
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+	options := &slog.HandlerOptions{Level: minLevel}
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(out, options)
+	} else {
+		handler = slog.NewTextHandler(out, options)
+	}
+	slog.SetDefault(slog.New(reportingHandler{handler}))
+	return nil
+}
+
+// fatal logs err, what the server could not do to start, and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+type loggerKey struct{}
+
+// withRequestLogger returns r with a logger adding its fields, see requestLogger.
+func withRequestLogger(r *http.Request, traceID string) *http.Request {
+	logger := slog.Default().With("trace", traceID, "method", r.Method, "path", r.URL.Path)
+	if cookie, err := r.Cookie("session_id"); err == nil {
+		logger = logger.With("session", cookie.Value)
+	}
+	return r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger))
+}
+
+// requestLogger returns the logger for what happens serving r.
+func requestLogger(r *http.Request) *slog.Logger {
+	if logger, ok := r.Context().Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+type reportedKey struct{}
+
+// reportingHandler reports the errors it handles as crashes, unless logged with a context from
+// alreadyReported.
+type reportingHandler struct {
+	slog.Handler
+}
+
+// alreadyReported returns ctx for logging what was reported as a crash some other way.
+func alreadyReported(ctx context.Context) context.Context {
+	return context.WithValue(ctx, reportedKey{}, true)
+}
+
+func (h reportingHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level >= slog.LevelError && ctx.Value(reportedKey{}) == nil {
+		reportError(record)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h reportingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return reportingHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h reportingHandler) WithGroup(name string) slog.Handler {
+	return reportingHandler{h.Handler.WithGroup(name)}
+}
@@ -7,274 +7,858 @@ import (
 	"embed"
 	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"html"
 	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
 	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
 )
 
 //go:embed index.html
 var embeddedFiles embed.FS
 
 type MessageAuthor struct {
-	// Session identifier of author.
-	ID       string `json:"id"`
+	// Handle of the author's session, see sessionHandle.
+	ID string `json:"id"`
 	// Nickname of author.
 	Nickname string `json:"nickname"`
 	// Nickname colour of author.
-	Color    string `json:"color`
+	Color string `json:"color"`
 }
 
 type Message struct {
 	// Whether or not this message is a server message.
-	FromApp bool           `json:"fromApp"`
+	FromApp bool `json:"fromApp"`
 	// Message author information.
-	Author  *MessageAuthor `json:"author,omitempty"`
-	// Kind (type without keyword connotations) of message. Currently, either "text" or "image".
-	Kind    string         `json:"kind"`
+	Author *MessageAuthor `json:"author,omitempty"`
+	// Message identifier, set by the server on every message, see stamp. For pins, the pin
+	// identifier, and for "update", the identifier of the message whose Content and Components
+	// were replaced.
+	ID string `json:"id,omitempty"`
+	// When the server sent the message, or logged it for logged events, set along with ID. For
+	// "update", when the message was edited.
+	Timestamp time.Time `json:"timestamp"`
+	// Position of the event in the log, one more than the previous logged event. Set on every
+	// logged event, see ordering.go. For messages of a room, the position in the room's log.
+	Seq uint64 `json:"seq,omitempty"`
+	// Room the message was posted in, empty for the main room. See rooms.go.
+	Room string `json:"room,omitempty"`
+	// Kind (type without keyword connotations) of message. One of "text", "image", "batch" (see
+	// Messages), "pin", "unpin" (Content is the pin identifier), "viewers" (Content is the count),
+	// "command" (see Command), "interaction" (see Interaction), "update" (see ID), "delete" (ID is the
+	// message deleted, see deletion.go), "form" (see Form), "response" (see Response), "resume"
+	// (Content is the token to resume the stream with, see detachStream), "gap" (see Gap), "migrate"
+	// (Content is the URL to reconnect to, see drain), "reaction" (see Reaction), "notification" (see
+	// Notification), "thread" (see Thread) or one registered with registerKind, like "location" (see
+	// location.go).
+	Kind string `json:"kind"`
 	// Content of message. If Kind is "text", the text contents. If Kind is "image", the image identifier.
-	Content string         `json:"content"`
+	Content string `json:"content"`
+	// Signed, expiring URL of the image. Only set if Kind is "image", or "location" for its map
+	// tile through the media proxy.
+	URL string `json:"url,omitempty"`
 	// Whether or not this message is private. If this is the case, FromApp is true.
-	Private bool           `json:"private"`
+	Private bool `json:"private"`
+	// Name of the federated instance this message was relayed from. Empty for local messages.
+	Origin string `json:"origin,omitempty"`
+	// Messages coalesced into this one. Only set if Kind is "batch".
+	Messages []Message `json:"messages,omitempty"`
+	// Content split into mentions, links, emoji and plain text. Only set on text messages from
+	// members, unless they are all plain text, see segments.go.
+	Segments []Segment `json:"segments,omitempty"`
+	// Payload of a kind registered with registerKind, as the kind defines it. See kinds.go.
+	Data json.RawMessage `json:"data,omitempty"`
+	// Connection counts. Only set if Kind is "viewers".
+	Presence *Presence `json:"presence,omitempty"`
+	// Buttons and selects, see Component. For "update", the new components.
+	Components []Component `json:"components,omitempty"`
+	// Use of a component of one of the recipient's messages. Only set if Kind is "interaction".
+	Interaction *Interaction `json:"interaction,omitempty"`
+	// Form the Author asks the recipient to fill in. Only set if Kind is "form".
+	Form *Form `json:"form,omitempty"`
+	// Values the Author submitted in one of the recipient's forms. Only set if Kind is "response".
+	Response *FormResponse `json:"response,omitempty"`
+	// Bot command the Author sent, with the identifier of their message. Only set if Kind is
+	// "command", which is only sent to the bot that registered the prefix.
+	Command *BotCommand `json:"command,omitempty"`
+	// Events the recipient missed because its queue was full. Only set if Kind is "gap".
+	Gap *Gap `json:"gap,omitempty"`
+	// Whether this is synthetic traffic from -selftest.
+	Test bool `json:"test,omitempty"`
+	// Identifier of the message this one replies to, see notifications.go.
+	ReplyTo string `json:"replyTo,omitempty"`
+	// Reaction to a message, with its new count. Only set if Kind is "reaction".
+	Reaction *Reaction `json:"reaction,omitempty"`
+	// Replies or reactions to one of the recipient's messages. Only set if Kind is "notification".
+	Notification *Notification `json:"notification,omitempty"`
+	// Replies in a thread the recipient follows. Only set if Kind is "thread".
+	Thread *ThreadActivity `json:"thread,omitempty"`
+	// What an app message announces, "join", "leave" or "nick", if any. Used as the SSE event
+	// type, see sse.go.
+	Activity string `json:"activity,omitempty"`
 }
 
 type ChatServer struct {
-	clients    map[string]chan string
-	clientsMu  sync.Mutex
+	clock Clock
+	// Generates identifiers, generateRandomId unless set with WithIDGenerator.
+	newID func() string
+
+	// Streams connected to /events, see hub.go.
+	hub *hub
+
+	nicknames   map[string]string
+	nicknamesMu sync.Mutex
+
+	nicknameColors   map[string]string
+	nicknameColorsMu sync.Mutex
+
+	imageStore  map[string][]byte
+	imageExpiry map[string]time.Time
+	// Sessions allowed to view each non-public image. Public images have no entry.
+	imageViewers map[string]map[string]bool
+	// When each image was stored, for oldest-first eviction.
+	imageStoredAt map[string]time.Time
+	// Total size of imageStore, see storageQuota.
+	imageBytes int64
+	// Whether moderators were warned that storage is nearly full.
+	storageWarned bool
+	imageStoreMu  sync.Mutex
 
-	nicknames    map[string]string
-	nicknamesMu  sync.Mutex
+	lastMessageTime   map[string]time.Time
+	lastMessageTimeMu sync.Mutex
+
+	// How often members may post, see ratelimit.go.
+	messageLimiter RateLimiter
+	// How often each address may post and upload, and how many streams it may have, see
+	// iplimits.go.
+	addressMessages RateLimiter
+	addressUploads  RateLimiter
+	addressStreams  int
 
-	nicknameColors    map[string]string
-	nicknameColorsMu  sync.Mutex
+	// UI bundle served instead of the default page, see ui.go.
+	ui   *UIBundle
+	uiMu sync.RWMutex
 
-	imageStore    map[string][]byte
-	imageExpiry   map[string]time.Time
-	imageStoreMu  sync.Mutex
+	// Strikes and offences of those going over them, see spam.go.
+	spamPolicy spamPolicy
+	spam       map[string]*spamRecord
+	spamMu     sync.Mutex
+
+	roles   map[string]Role
+	rolesMu sync.Mutex
+	// Incremented on every role change, for the /mod/roles ETag.
+	rolesVersion uint64
+
+	sessionFirstSeen map[string]time.Time
+	sessionLastSeen  map[string]time.Time
+	// Sessions by handle, see sessionHandle.
+	sessionHandles     map[string]string
+	sessionTraits      map[string]sessionTraits
+	evasionSuspects    map[string]string
+	sessionFirstSeenMu sync.Mutex
 
-	lastMessageTime    map[string]time.Time
-	lastMessageTimeMu  sync.Mutex
+	geo *geoResolver
 
-	spamCount    map[string]int
-	spamCountMu  sync.Mutex
+	raid   raidState
+	raidMu sync.Mutex
+
+	// Lobby mode, see lobby.go. Held sessions map to the zero time until their stream connects.
+	lobbyOn       bool
+	lobbyPending  map[string]time.Time
+	lobbyArrivals []string
+	lobbyMu       sync.Mutex
+
+	// Banned sessions and networks, see bans.go and banlist.go.
+	bans        map[string]*BanRecord
+	addressBans map[string]*AddressBan
+	bansMu      sync.Mutex
+
+	modLog        []string
+	modLogClients map[string]chan string
+	modLogMu      sync.Mutex
+
+	appeals   map[string]*Appeal
+	appealsMu sync.Mutex
+
+	// Reports of members by members, oldest first, see reports.go.
+	reports   []*Report
+	reportsMu sync.Mutex
+
+	notices   map[string][]Message
+	noticesMu sync.Mutex
+
+	auditLog []AuditEntry
+	auditSeq uint64
+	auditMu  sync.Mutex
+
+	federation       *federationConfig
+	federationQueues []chan []byte
+	federationSeen   map[string]time.Time
+	federationSeenMu sync.Mutex
+
+	relaySubscribers   map[string]chan string
+	relaySubscribersMu sync.Mutex
+	// Which relay subscribers are edges, see publishToRelays.
+	relayEdges map[string]bool
+
+	livestream   livestreamState
+	livestreamMu sync.Mutex
+
+	pins   []Pin
+	pinsMu sync.Mutex
+
+	lastPresence   Presence
+	lastPresenceMu sync.Mutex
+
+	jobs   []*job
+	jobsMu sync.Mutex
+
+	graphQL *graphql.Schema
+
+	// In-flight uploads, streams and requests per session, see acquireSlot.
+	inFlight   map[string]int
+	inFlightMu sync.Mutex
+
+	// Responses by session and Idempotency-Key, see idempotent.
+	idempotency   map[string]*idempotentResponse
+	idempotencyMu sync.Mutex
+
+	// Components of recent messages by message identifier, oldest first in interactiveOrder.
+	interactive      map[string]*interactiveMessage
+	interactiveOrder []string
+	interactiveMu    sync.Mutex
+
+	// Forms sent and not yet submitted, by identifier.
+	forms   map[string]*pendingForm
+	formsMu sync.Mutex
+
+	slowmode   slowmodeState
+	slowmodeMu sync.Mutex
+
+	automation   map[string]*AutomationRule
+	automationMu sync.Mutex
+
+	// The room's todos, oldest first, and the last identifier given to one.
+	todos   []Todo
+	todoSeq int
+	todosMu sync.Mutex
+
+	// Upcoming events by identifier.
+	calendar   map[string]*CalendarEvent
+	calendarMu sync.Mutex
+
+	// Running timers by identifier.
+	timers   map[string]*Timer
+	timersMu sync.Mutex
+
+	// Snippets by name.
+	snippets   map[string]*Snippet
+	snippetsMu sync.Mutex
+
+	admission   admissionState
+	admissionMu sync.Mutex
+
+	// Dropped streams that can be resumed, by resume token.
+	resumable map[string]*detachedStream
+	// Sessions whose client said it is leaving, disconnected as soon as their stream ends.
+	leaving     map[string]bool
+	resumableMu sync.Mutex
+
+	// Welcome message, and the sessions that got it already.
+	welcome   WelcomeConfig
+	welcomed  map[string]bool
+	welcomeMu sync.Mutex
+
+	// Open incident, nil if none, and the last resolved ones, oldest first.
+	incident          *Incident
+	resolvedIncidents []*Incident
+	incidentMu        sync.Mutex
+
+	// Bot registrations by command prefix.
+	botCommands   map[string]*BotRegistration
+	botCommandsMu sync.Mutex
+
+	// Last public broadcasts, oldest first, and the Seq of the last one, see logEvent.
+	eventLog   []Message
+	eventSeq   uint64
+	eventLogMu sync.Mutex
+	// Where logged events are kept across restarts, nil unless MESSAGE_DB is set.
+	messages MessageStore
+	// Writes queued for messages and its writer, see messagestore.go. messagesClosed, under
+	// messageWritesMu, is set once messageWrites takes no more.
+	messageWrites   chan storeWrite
+	messageWritesMu sync.RWMutex
+	messagesClosed  bool
+	messagesDone    chan struct{}
+
+	// Whether animated images are off in the main room, and when each session last posted them,
+	// see animations.go.
+	animationsOff  bool
+	animationPosts map[string][]time.Time
+	animationsMu   sync.Mutex
+
+	// Whether locations can be shared in the main room, see location.go.
+	locationsOn bool
+	locationsMu sync.Mutex
+
+	// Reactions by message identifier, emoji and session identifier, notifications waiting to be
+	// batched, and those held for sessions with do not disturb on, see notifications.go.
+	reactions            map[string]map[string]map[string]bool
+	pendingNotifications map[string]*Notification
+	doNotDisturb         map[string]bool
+	heldNotifications    map[string][]Notification
+	notificationsMu      sync.Mutex
+
+	// Held while a broadcast is logged and queued, see ordering.go.
+	broadcastMu sync.Mutex
+	// Delivery tracing, see traces.go.
+	tracing   tracingState
+	tracingMu sync.Mutex
+
+	// Events missed by clients whose queue was full, by their channel, and how many were in all.
+	gaps    map[chan string]*Gap
+	dropped uint64
+	// Streams closed when their queue is full, by channel, and how many were, see ordering.go.
+	evictions map[chan string]chan struct{}
+	evicted   uint64
+	gapsMu    sync.Mutex
+
+	// Where streams are sent once the edge drains, and closed drainGrace after it does, see
+	// migrate.go.
+	migrateTo string
+	drained   chan struct{}
+	drainMu   sync.Mutex
+	// Closed once the server shuts down, which stops the jobs, see shutdown.go.
+	stopping chan struct{}
+
+	// Rooms besides the main room, by name, and the room each session's messages go to.
+	rooms        map[string]*Room
+	currentRooms map[string]string
+	roomsMu      sync.Mutex
+	// Room templates by name, read on start and not changed after, see templates.go.
+	roomTemplates map[string]RoomTemplate
+
+	// What each session muted, see mutes.go.
+	preferences   map[string]*Preferences
+	preferencesMu sync.Mutex
+
+	// Followers of each thread, by the identifier of its first message, and the digests waiting
+	// for each session, see threads.go.
+	threadFollowers map[string]map[string]bool
+	pendingDigests  map[string][]*ThreadActivity
+	threadsMu       sync.Mutex
+
+	// Writes the daily recap, nil unless DAILY_SUMMARY is set, the messages sent since the last
+	// one, and the day it was posted, see summary.go.
+	summarizer      Summarizer
+	summaryMessages []SummaryMessage
+	summaryDay      string
+	summaryMu       sync.Mutex
+
+	// What was sent each hour of the last maxHeatmapDays, by Unix time, and the statistics last
+	// computed from it, see stats.go.
+	activity map[int64]*hourActivity
+	stats    Stats
+	statsMu  sync.Mutex
+
+	// Images fetched by the media proxy and link previews, by URL, see fetchCache.
+	proxyCache   *fetchCache[*proxiedMedia]
+	previewCache *fetchCache[LinkPreview]
+
+	// Recent broadcast rate, see load.go.
+	load   loadState
+	loadMu sync.Mutex
+
+	// Latency of requests, by the pattern they were routed to, and of chat commands, see
+	// latency.go.
+	endpointLatency map[string]*latencyWindow
+	commandLatency  map[string]*latencyWindow
+	latencyMu       sync.Mutex
+
+	// When each kicked session may connect again, and the stream of each connected session to
+	// send its last event on should it be kicked, see admin.go.
+	kicked  map[string]time.Time
+	kicks   map[chan string]chan string
+	kicksMu sync.Mutex
+
+	// Until when each session muted, or shadow muted, by a moderator is, see sanctions.go. Shadow
+	// mutes lifted by hand only are until the zero time.
+	modMutes    map[string]time.Time
+	shadowMutes map[string]time.Time
+	modMutesMu  sync.Mutex
+
+	// Pushes the load metrics to StatsD, nil unless STATSD_ADDR is set, see statsd.go.
+	statsd *statsdEmitter
+
+	// Sinks of ARCHIVE_SINKS logged messages are streamed to, and how often, see archive.go.
+	archivers    []*archiver
+	archiveFlush time.Duration
 }
 
 var predefinedColors = map[string]string{
-	"red": "#ff0000",
-	"lightred": "#ff6666",
-	"darkred": "#8b0000",
-	"blue": "#0000ff",
-	"lightblue": "#add8e6",
-	"darkblue": "#00008b",
-	"green": "#008000",
-	"lightgreen": "#90ee90",
-	"darkgreen": "#006400",
-	"yellow": "#ffff00",
-	"lightyellow": "#ffffe0",
-	"darkyellow": "#9b870c",
-	"purple": "#800080",
-	"lightpurple": "#dda0dd",
-	"darkpurple": "#4b0082",
-	"orange": "#ffa500",
-	"lightorange": "#ffcc99",
-	"darkorange": "#ff8c00",
-	"pink": "#ffc0cb",
-	"lightpink": "#ffb6c1",
-	"darkpink": "#c71585",
-	"cyan": "#00ffff",
-	"lightcyan": "#e0ffff",
-	"darkcyan": "#008b8b",
-	"brown": "#a52a2a",
-	"lightbrown": "#deb887",
-	"darkbrown": "#654321",
-	"black": "#000000",
-	"lightblack": "#696969",
-	"darkblack": "#0a0a0a",
-	"white": "#ffffff",
-	"lightwhite": "#f5f5f5",
-	"darkwhite": "#dcdcdc",
-	"gray": "#808080",
-	"lightgray": "#d3d3d3",
-	"darkgray": "#505050",
-	"gold": "#ffd700",
-	"lightgold": "#ffec8b",
-	"darkgold": "#b8860b",
-	"silver": "#c0c0c0",
-	"lightsilver": "#e6e6e6",
-	"darksilver": "#a9a9a9",
-	"navy": "#000080",
-	"lightnavy": "#4682b4",
-	"darknavy": "#00004d",
-	"lime": "#00ff00",
-	"lightlime": "#bfff00",
-	"darklime": "#32cd32",
-	"magenta": "#ff00ff",
-	"lightmagenta": "#ff77ff",
-	"darkmagenta": "#8b008b",
-	"beige": "#f5f5dc",
-	"lightbeige": "#faf0e6",
-	"darkbeige": "#d2b48c",
-	"olive": "#808000",
-	"lightolive": "#b5b35c",
-	"darkolive": "#556b2f",
-	"maroon": "#800000",
-	"lightmaroon": "#b03060",
-	"darkmaroon": "#5c0000",
-	"violet": "#ee82ee",
-	"lightviolet": "#f3e5ab",
-	"darkviolet": "#9400d3",
-	"indigo": "#4b0082",
-	"lightindigo": "#7a5c99",
-	"darkindigo": "#310062",
-	"turquoise": "#40e0d0",
-	"lightturquoise": "#afeeee",
-	"darkturquoise": "#00ced1",
-	"chocolate": "#d2691e",
-	"lightchocolate": "#e6b8a2",
-	"darkchocolate": "#8b4513",
-	"coral": "#ff7f50",
-	"lightcoral": "#f08080",
-	"darkcoral": "#cd5b45",
-	"salmon": "#fa8072",
-	"lightsalmon": "#ffa07a",
-	"darksalmon": "#e9967a",
-	"khaki": "#f0e68c",
-	"lightkhaki": "#fffacd",
-	"darkkhaki": "#bdb76b",
-	"orchid": "#da70d6",
-	"lightorchid": "#e6a8d7",
-	"darkorchid": "#9932cc",
-	"plum": "#dda0dd",
-	"lightplum": "#e6b8e6",
-	"darkplum": "#8e4585",
-	"tan": "#d2b48c",
-	"lighttan": "#f5deb3",
-	"darktan": "#a0522d",
-	"lavender": "#e6e6fa",
-	"lightlavender": "#f3e5f5",
-	"darklavender": "#7c7c99",
-	"peach": "#ffdab9",
-	"lightpeach": "#ffefd5",
-	"darkpeach": "#cd853f",
-	"mint": "#98ff98",
-	"lightmint": "#bdfcc9",
-	"darkmint": "#3cb371",
-	"aqua": "#00ffff",
-	"lightaqua": "#e0ffff",
-	"darkaqua": "#008b8b",
-	"skyblue": "#87ceeb",
-	"lightskyblue": "#b0e2ff",
-	"darkskyblue": "#4682b4",
-	"crimson": "#dc143c",
-	"lightcrimson": "#ff6f61",
-	"darkcrimson": "#8b0000",
-	"goldenrod": "#daa520",
-	"lightgoldenrod": "#ffec8b",
-	"darkgoldenrod": "#b8860b",
-	"seagreen": "#2e8b57",
-	"lightseagreen": "#54ff9f",
-	"darkseagreen": "#8fbc8f",
-	"slateblue": "#6a5acd",
-	"lightslateblue": "#8470ff",
-	"darkslateblue": "#483d8b",
-	"steelblue": "#4682b4",
-	"lightsteelblue": "#b0c4de",
-	"darksteelblue": "#2a4f7c",
-	"tomato": "#ff6347",
-	"lighttomato": "#ff7f50",
-	"darktomato": "#cd5b45",
-	"wheat": "#f5deb3",
-	"lightwheat": "#ffe4b5",
-	"darkwheat": "#d2b48c",
-	"azure": "#f0ffff",
-	"lightazure": "#e0ffff",
-	"darkazure": "#b0e0e6",
-	"ivory": "#fffff0",
-	"lightivory": "#f5f5dc",
-	"darkivory": "#dcdcdc",
-	"lavenderblush": "#fff0f5",
+	"red":                "#ff0000",
+	"lightred":           "#ff6666",
+	"darkred":            "#8b0000",
+	"blue":               "#0000ff",
+	"lightblue":          "#add8e6",
+	"darkblue":           "#00008b",
+	"green":              "#008000",
+	"lightgreen":         "#90ee90",
+	"darkgreen":          "#006400",
+	"yellow":             "#ffff00",
+	"lightyellow":        "#ffffe0",
+	"darkyellow":         "#9b870c",
+	"purple":             "#800080",
+	"lightpurple":        "#dda0dd",
+	"darkpurple":         "#4b0082",
+	"orange":             "#ffa500",
+	"lightorange":        "#ffcc99",
+	"darkorange":         "#ff8c00",
+	"pink":               "#ffc0cb",
+	"lightpink":          "#ffb6c1",
+	"darkpink":           "#c71585",
+	"cyan":               "#00ffff",
+	"lightcyan":          "#e0ffff",
+	"darkcyan":           "#008b8b",
+	"brown":              "#a52a2a",
+	"lightbrown":         "#deb887",
+	"darkbrown":          "#654321",
+	"black":              "#000000",
+	"lightblack":         "#696969",
+	"darkblack":          "#0a0a0a",
+	"white":              "#ffffff",
+	"lightwhite":         "#f5f5f5",
+	"darkwhite":          "#dcdcdc",
+	"gray":               "#808080",
+	"lightgray":          "#d3d3d3",
+	"darkgray":           "#505050",
+	"gold":               "#ffd700",
+	"lightgold":          "#ffec8b",
+	"darkgold":           "#b8860b",
+	"silver":             "#c0c0c0",
+	"lightsilver":        "#e6e6e6",
+	"darksilver":         "#a9a9a9",
+	"navy":               "#000080",
+	"lightnavy":          "#4682b4",
+	"darknavy":           "#00004d",
+	"lime":               "#00ff00",
+	"lightlime":          "#bfff00",
+	"darklime":           "#32cd32",
+	"magenta":            "#ff00ff",
+	"lightmagenta":       "#ff77ff",
+	"darkmagenta":        "#8b008b",
+	"beige":              "#f5f5dc",
+	"lightbeige":         "#faf0e6",
+	"darkbeige":          "#d2b48c",
+	"olive":              "#808000",
+	"lightolive":         "#b5b35c",
+	"darkolive":          "#556b2f",
+	"maroon":             "#800000",
+	"lightmaroon":        "#b03060",
+	"darkmaroon":         "#5c0000",
+	"violet":             "#ee82ee",
+	"lightviolet":        "#f3e5ab",
+	"darkviolet":         "#9400d3",
+	"indigo":             "#4b0082",
+	"lightindigo":        "#7a5c99",
+	"darkindigo":         "#310062",
+	"turquoise":          "#40e0d0",
+	"lightturquoise":     "#afeeee",
+	"darkturquoise":      "#00ced1",
+	"chocolate":          "#d2691e",
+	"lightchocolate":     "#e6b8a2",
+	"darkchocolate":      "#8b4513",
+	"coral":              "#ff7f50",
+	"lightcoral":         "#f08080",
+	"darkcoral":          "#cd5b45",
+	"salmon":             "#fa8072",
+	"lightsalmon":        "#ffa07a",
+	"darksalmon":         "#e9967a",
+	"khaki":              "#f0e68c",
+	"lightkhaki":         "#fffacd",
+	"darkkhaki":          "#bdb76b",
+	"orchid":             "#da70d6",
+	"lightorchid":        "#e6a8d7",
+	"darkorchid":         "#9932cc",
+	"plum":               "#dda0dd",
+	"lightplum":          "#e6b8e6",
+	"darkplum":           "#8e4585",
+	"tan":                "#d2b48c",
+	"lighttan":           "#f5deb3",
+	"darktan":            "#a0522d",
+	"lavender":           "#e6e6fa",
+	"lightlavender":      "#f3e5f5",
+	"darklavender":       "#7c7c99",
+	"peach":              "#ffdab9",
+	"lightpeach":         "#ffefd5",
+	"darkpeach":          "#cd853f",
+	"mint":               "#98ff98",
+	"lightmint":          "#bdfcc9",
+	"darkmint":           "#3cb371",
+	"aqua":               "#00ffff",
+	"lightaqua":          "#e0ffff",
+	"darkaqua":           "#008b8b",
+	"skyblue":            "#87ceeb",
+	"lightskyblue":       "#b0e2ff",
+	"darkskyblue":        "#4682b4",
+	"crimson":            "#dc143c",
+	"lightcrimson":       "#ff6f61",
+	"darkcrimson":        "#8b0000",
+	"goldenrod":          "#daa520",
+	"lightgoldenrod":     "#ffec8b",
+	"darkgoldenrod":      "#b8860b",
+	"seagreen":           "#2e8b57",
+	"lightseagreen":      "#54ff9f",
+	"darkseagreen":       "#8fbc8f",
+	"slateblue":          "#6a5acd",
+	"lightslateblue":     "#8470ff",
+	"darkslateblue":      "#483d8b",
+	"steelblue":          "#4682b4",
+	"lightsteelblue":     "#b0c4de",
+	"darksteelblue":      "#2a4f7c",
+	"tomato":             "#ff6347",
+	"lighttomato":        "#ff7f50",
+	"darktomato":         "#cd5b45",
+	"wheat":              "#f5deb3",
+	"lightwheat":         "#ffe4b5",
+	"darkwheat":          "#d2b48c",
+	"azure":              "#f0ffff",
+	"lightazure":         "#e0ffff",
+	"darkazure":          "#b0e0e6",
+	"ivory":              "#fffff0",
+	"lightivory":         "#f5f5dc",
+	"darkivory":          "#dcdcdc",
+	"lavenderblush":      "#fff0f5",
 	"lightlavenderblush": "#ffe4e1",
-	"darklavenderblush": "#d8bfd8",
-	"mistyrose": "#ffe4e1",
-	"lightmistyrose": "#ffebcd",
-	"darkmistyrose": "#cd5b45",
-	"powderblue": "#b0e0e6",
-	"lightpowderblue": "#add8e6",
-	"darkpowderblue": "#4682b4",
-	"rosybrown": "#bc8f8f",
-	"lightrosybrown": "#deb887",
-	"darkrosybrown": "#8b4513",
-	"sandybrown": "#f4a460",
-	"lightsandybrown": "#ffcc99",
-	"darksandybrown": "#cd853f",
-	"snow": "#fffafa",
-	"lightsnow": "#f5f5f5",
-	"darksnow": "#dcdcdc",
-	"thistle": "#d8bfd8",
-	"lightthistle": "#e6e6fa",
-	"darkthistle": "#7c7c99",
-	"yellowgreen": "#9acd32",
-	"lightyellowgreen": "#adff2f",
-	"darkyellowgreen": "#556b2f",
+	"darklavenderblush":  "#d8bfd8",
+	"mistyrose":          "#ffe4e1",
+	"lightmistyrose":     "#ffebcd",
+	"darkmistyrose":      "#cd5b45",
+	"powderblue":         "#b0e0e6",
+	"lightpowderblue":    "#add8e6",
+	"darkpowderblue":     "#4682b4",
+	"rosybrown":          "#bc8f8f",
+	"lightrosybrown":     "#deb887",
+	"darkrosybrown":      "#8b4513",
+	"sandybrown":         "#f4a460",
+	"lightsandybrown":    "#ffcc99",
+	"darksandybrown":     "#cd853f",
+	"snow":               "#fffafa",
+	"lightsnow":          "#f5f5f5",
+	"darksnow":           "#dcdcdc",
+	"thistle":            "#d8bfd8",
+	"lightthistle":       "#e6e6fa",
+	"darkthistle":        "#7c7c99",
+	"yellowgreen":        "#9acd32",
+	"lightyellowgreen":   "#adff2f",
+	"darkyellowgreen":    "#556b2f",
 }
 
 var colorSlice []string
 
-func main() {
-	mrand.Seed(time.Now().UnixNano())
-
+func init() {
 	for _, color := range predefinedColors {
 		colorSlice = append(colorSlice, color)
 	}
+}
+
+// serve runs the server, see cli.go.
+func serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	options := serverFlags(flags)
+	selftest := flags.Bool("selftest", false, "soak the server with synthetic users and messages, see selftest.go")
+	var config selftestConfig
+	flags.IntVar(&config.users, "selftest-users", 100, "synthetic users connected by -selftest")
+	flags.Float64Var(&config.rate, "selftest-rate", 10, "messages per second sent by -selftest")
+	flags.DurationVar(&config.duration, "selftest-duration", 5*time.Minute, "how long -selftest runs, 0 for as long as the server")
+	flags.Parse(args)
+	if err := setupLogging(*options.logLevel, *options.logFormat, *options.logFile); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if err := validateTLS(); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if err := loadCrashReporter(); err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	if *options.dataDir != "" {
+		if err := useDataDir(*options.dataDir); err != nil {
+			fatal("Could not use the data directory", err)
+		}
+	}
+	if *selftest && (config.users < 1 || config.rate <= 0 || config.duration < 0) {
+		fmt.Println("-selftest needs at least 1 user, a positive rate and a duration of 0 or more")
+		os.Exit(2)
+	}
+	if *selftest && relayUpstream != "" {
+		fmt.Println("-selftest runs on the primary, not on relay edges")
+		os.Exit(2)
+	}
+
+	mrand.Seed(time.Now().UnixNano())
 
 	server := NewChatServer()
+	server.federation = loadFederationConfig()
+	for _, step := range server.startupSteps() {
+		if err := step.run(); err != nil {
+			fatal(step.failure, err)
+		}
+	}
+	if err := server.loadMessages(); err != nil {
+		fatal("Could not open the message database", err)
+	}
+
+	if *selftest {
+		go server.runSelftest(config)
+	}
 	if err := server.Start(); err != nil {
-		fmt.Printf("Server error: %v\n", err)
-		os.Exit(1)
+		fatal("Server error", err)
 	}
 }
 
-func NewChatServer() *ChatServer {
-	return &ChatServer{
-		clients:         make(map[string]chan string),
-		nicknames:       make(map[string]string),
-		nicknameColors:  make(map[string]string),
-		imageStore:      make(map[string][]byte),
-		imageExpiry:     make(map[string]time.Time),
-		lastMessageTime: make(map[string]time.Time),
-		spamCount:       make(map[string]int),
-	}
+// startupStep is something serve does before starting, which check does too.
+type startupStep struct {
+	// What it is about, and what serve logs if it fails.
+	name, failure string
+	run           func() error
 }
 
-func (s *ChatServer) Start() error {
-	http.HandleFunc("/", s.serveChatPage)
-	http.HandleFunc("/send", s.handleSendMessage)
-	http.HandleFunc("/events", s.handleEvents)
-	http.HandleFunc("/set-nickname", s.handleSetNickname)
+// startupSteps returns what serve sets up and loads before starting, in order.
+func (s *ChatServer) startupSteps() []startupStep {
+	return []startupStep{
+		{"trusted proxies", "Could not parse TRUSTED_PROXIES", loadTrustedProxies},
+		{"spam policy", "Could not parse the spam settings", s.loadSpamPolicy},
+		{"geoip", "Could not open GeoIP database", func() (err error) {
+			s.geo, err = openGeoResolver(os.Getenv("GEOIP_DB"), os.Getenv("GEOIP_ASN_DB"))
+			return err
+		}},
+		{"daily summary", "Could not set up the daily summary", func() (err error) {
+			s.summarizer, err = loadSummarizer()
+			return err
+		}},
+		{"statsd", "Could not set up StatsD", func() (err error) {
+			s.statsd, err = loadStatsD()
+			return err
+		}},
+		{"archive", "Could not set up the archive sinks", s.loadArchive},
+		{"legal hold", "Could not set up legal hold", s.checkLegalHold},
+		{"automation", "Could not load automation rules", s.loadAutomation},
+		{"todos", "Could not load todos", s.loadTodos},
+		{"preferences", "Could not load preferences", s.loadPreferences},
+		{"snippets", "Could not load snippets", s.loadSnippets},
+		{"room templates", "Could not load room templates", s.loadRoomTemplates},
+		{"bans", "Could not load bans", s.loadBans},
+		{"welcome message", "Could not load the welcome message", s.loadWelcome},
+		{"ui bundle", "Could not load the UI bundle", s.loadUIBundle},
+	}
+}
 
-	http.HandleFunc("/upload-image", s.handleImageUpload)
-	http.HandleFunc("/image/", s.handleImage)
+func NewChatServer(opts ...Option) *ChatServer {
+	addressMessages, addressUploads := loadAddressLimiters()
+	s := &ChatServer{
+		clock:            realClock{},
+		newID:            generateRandomId,
+		hub:              newHub(),
+		nicknames:        make(map[string]string),
+		nicknameColors:   make(map[string]string),
+		imageStore:       make(map[string][]byte),
+		imageExpiry:      make(map[string]time.Time),
+		imageViewers:     make(map[string]map[string]bool),
+		imageStoredAt:    make(map[string]time.Time),
+		lastMessageTime:  make(map[string]time.Time),
+		messageLimiter:   loadMessageLimiter(),
+		addressMessages:  addressMessages,
+		addressUploads:   addressUploads,
+		addressStreams:   loadAddressStreams(),
+		spamPolicy:       defaultSpamPolicy(),
+		spam:             make(map[string]*spamRecord),
+		roles:            make(map[string]Role),
+		sessionFirstSeen: make(map[string]time.Time),
+		sessionLastSeen:  make(map[string]time.Time),
+		sessionHandles:   make(map[string]string),
+		sessionTraits:    make(map[string]sessionTraits),
+		evasionSuspects:  make(map[string]string),
+		lobbyPending:     make(map[string]time.Time),
+		bans:             make(map[string]*BanRecord),
+		addressBans:      make(map[string]*AddressBan),
+		modLogClients:    make(map[string]chan string),
+		appeals:          make(map[string]*Appeal),
+		notices:          make(map[string][]Message),
+		federationSeen:   make(map[string]time.Time),
+		relaySubscribers: make(map[string]chan string),
+		relayEdges:       make(map[string]bool),
+		inFlight:         make(map[string]int),
+		idempotency:      make(map[string]*idempotentResponse),
+		botCommands:      make(map[string]*BotRegistration),
+		interactive:      make(map[string]*interactiveMessage),
+		forms:            make(map[string]*pendingForm),
+		automation:       make(map[string]*AutomationRule),
+		calendar:         make(map[string]*CalendarEvent),
+		timers:           make(map[string]*Timer),
+		snippets:         make(map[string]*Snippet),
+		welcomed:         make(map[string]bool),
+		resumable:        make(map[string]*detachedStream),
+		leaving:          make(map[string]bool),
+		gaps:             make(map[chan string]*Gap),
+		evictions:        make(map[chan string]chan struct{}),
+		drained:          make(chan struct{}),
+		stopping:         make(chan struct{}),
+		animationPosts:   make(map[string][]time.Time),
+		proxyCache:       newFetchCache[*proxiedMedia](proxyCacheBytes),
+		previewCache:     newFetchCache[LinkPreview](previewCacheBytes),
+		rooms:            make(map[string]*Room),
+		currentRooms:     make(map[string]string),
+		preferences:      make(map[string]*Preferences),
+		activity:         make(map[int64]*hourActivity),
+		kicked:           make(map[string]time.Time),
+		kicks:            make(map[chan string]chan string),
+		modMutes:         make(map[string]time.Time),
+		shadowMutes:      make(map[string]time.Time),
+		endpointLatency:  make(map[string]*latencyWindow),
+		commandLatency:   make(map[string]*latencyWindow),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.graphQL = s.newGraphQLSchema()
+	s.initLivestream()
+	s.initAdmission()
+	s.initTracing()
+	s.initNotifications()
+	s.initThreads()
+	return s
+}
 
-	http.HandleFunc("/join", s.handleJoin)
-	http.HandleFunc("/leave", s.handleLeave)
+// Start serves the chat on bindAddress and port until the server shuts down.
+func (s *ChatServer) Start() error {
+	addr := net.JoinHostPort(bindAddress, port)
+	s.startStatsD()
+	if relayUpstream != "" {
+		handler, err := s.relayEdgeHandler(relayUpstream)
+		if err != nil {
+			return err
+		}
+		slog.Info("Relay edge started", "upstream", relayUpstream, "url", scheme()+"://"+addr)
+		s.startRelayEdge(relayUpstream)
+		return s.serve(addr, handler)
+	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	slog.Info("Server started", "url", scheme()+"://"+addr)
+	if err := s.startControl(); err != nil {
+		return err
+	}
+	if err := s.startArchive(); err != nil {
+		return err
 	}
+	s.startJobs()
+	s.startFederation()
+	return s.serve(addr, s.Handler())
+}
 
-	fmt.Printf("Server started on http://0.0.0.0:%s\n", port)
-	s.startImageCleanup()
-	return http.ListenAndServe(fmt.Sprintf("0.0.0.0:%s", port), nil)
+// Handler returns the HTTP handler serving the chat, without starting any background work.
+func (s *ChatServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveChatPage)
+	mux.HandleFunc("/send", s.idempotent(s.handleSendMessage))
+	mux.HandleFunc("/events", s.handleEvents)
+	mux.HandleFunc("/set-nickname", s.idempotent(s.handleSetNickname))
+
+	mux.HandleFunc("/upload-image", s.idempotent(s.handleImageUpload))
+	mux.HandleFunc("/image/", s.handleImage)
+	mux.HandleFunc("/proxy", s.handleProxy)
+	mux.HandleFunc("/api/v1/unfurl", s.handleUnfurl)
+
+	mux.HandleFunc("/join", s.idempotent(s.handleJoin))
+	mux.HandleFunc("/leave", s.idempotent(s.handleLeave))
+	mux.HandleFunc("/appeal", s.idempotent(s.handleAppeal))
+	mux.HandleFunc("/presence", s.handlePresence)
+	mux.HandleFunc("/members", s.handleMembers)
+	mux.HandleFunc("/pins", s.handlePins)
+
+	mux.HandleFunc("/mod/queue", s.idempotent(s.handleModQueue))
+	mux.HandleFunc("/mod/sessions", s.handleModSessions)
+	mux.HandleFunc("/modlog/events", s.handleModLogEvents)
+	mux.HandleFunc("/mod/appeals", s.idempotent(s.handleModAppeals))
+	mux.HandleFunc("/mod/roles", s.idempotent(s.handleModRoles))
+	mux.HandleFunc("/mod/audit", s.handleModAudit)
+	mux.HandleFunc("/mod/storage", s.handleModStorage)
+	mux.HandleFunc("/mod/jobs", s.handleModJobs)
+	mux.HandleFunc("/mod/automation", s.idempotent(s.handleModAutomation))
+	mux.HandleFunc("/mod/incidents", s.handleModIncidents)
+	mux.HandleFunc("/mod/incidents/postmortem", s.handleModIncidentPostmortem)
+	mux.HandleFunc("/api/v1/todos", s.idempotent(s.handleTodos))
+	mux.HandleFunc("/api/v1/todos/done", s.idempotent(s.handleTodoDone))
+	mux.HandleFunc("/rooms", s.handleRooms)
+	mux.HandleFunc("/api/v1/rooms", s.idempotent(s.handleRoomDirectory))
+	mux.HandleFunc("/api/v1/activity", s.handleActivity)
+	mux.HandleFunc("/calendar", s.handleCalendar)
+	mux.HandleFunc("/rsvp", s.idempotent(s.handleRSVP))
+	mux.HandleFunc("/timers", s.idempotent(s.handleTimers))
+	mux.HandleFunc("/api/v1/snippets", s.idempotent(s.handleSnippets))
+	mux.HandleFunc("/mod/welcome", s.idempotent(s.handleModWelcome))
+	mux.HandleFunc("/mod/traces", s.idempotent(s.handleModTraces))
+
+	mux.HandleFunc("/federation/inbox", s.handleFederationInbox)
+	mux.HandleFunc("/relay/stream", s.handleRelayStream)
+	mux.HandleFunc("/api/admin/load", s.handleAdminLoad)
+	mux.HandleFunc("/api/admin/stats", s.handleAdminStats)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/api/admin/drain", s.handleAdminDrain)
+	mux.HandleFunc("/api/admin/sessions", s.handleAdminSessions)
+	mux.HandleFunc("/api/admin/sessions/rename", s.idempotent(s.handleAdminRename))
+	mux.HandleFunc("/api/admin/sessions/kick", s.idempotent(s.handleAdminKick))
+	mux.HandleFunc("/api/admin/images/delete", s.idempotent(s.handleAdminDeleteImage))
+	mux.HandleFunc("/api/admin/broadcast", s.idempotent(s.handleAdminBroadcast))
+	mux.HandleFunc("/api/admin/rooms", s.handleAdminRooms)
+	mux.HandleFunc("/api/admin/bans", s.idempotent(s.handleAdminBans))
+	mux.HandleFunc("/api/admin/bans/delete", s.idempotent(s.handleAdminUnban))
+	mux.HandleFunc("/api/admin/reports", s.handleAdminReports)
+	mux.HandleFunc("/api/admin/reports/resolve", s.idempotent(s.handleAdminResolveReport))
+	mux.HandleFunc("/api/admin/snapshot", s.handleAdminSnapshot)
+	mux.HandleFunc("/api/admin/ui", s.idempotent(s.handleAdminUI))
+	mux.HandleFunc("/api/admin/ui/rollback", s.idempotent(s.handleAdminUIRollback))
+
+	mux.HandleFunc("/debug/events", s.handleDebugEvents)
+	mux.HandleFunc("/debug/events/stream", s.handleDebugEventsStream)
+
+	mux.HandleFunc("/graphql", s.handleGraphQL)
+
+	mux.HandleFunc("/api/v1/events", s.handleEventsReplay)
+	mux.HandleFunc("/api/v1/events.txt", s.handleEventsText)
+	mux.HandleFunc("/sync", s.handleSync)
+	mux.HandleFunc("/api/v1/bot/commands", s.idempotent(s.handleBotCommands))
+	mux.HandleFunc("/api/v1/interactions", s.idempotent(s.handleInteractions))
+	mux.HandleFunc("/api/v1/messages/update", s.idempotent(s.handleMessageUpdate))
+	mux.HandleFunc("/api/v1/reactions", s.idempotent(s.handleReactions))
+	mux.HandleFunc("/api/v1/forms", s.idempotent(s.handleForms))
+	mux.HandleFunc("/api/v1/forms/submit", s.idempotent(s.handleFormSubmit))
+
+	mux.HandleFunc("/api/spec", s.handleAPISpec)
+	mux.HandleFunc("/api/docs", s.handleAPIDocs)
+	return s.blockBannedAddresses(s.limitInFlight(s.timeRequests(mux)))
 }
 
 func (s *ChatServer) serveChatPage(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/html")
+	if bundle := s.uiBundle(); bundle != nil {
+		if !serveUIBundleFile(w, r, bundle) {
+			r.URL.Path = "/"
+			serveUIBundleFile(w, r, bundle)
+		}
+		return
+	}
 
+	w.Header().Set("Content-Type", "text/html")
+	setPageHeaders(w)
 	if _, err := os.Stat("index.html"); err == nil {
 		http.ServeFile(w, r, "index.html")
 		return
@@ -297,72 +881,136 @@ func generateSessionID() string {
 	return base64.URLEncoding.EncodeToString(b)
 }
 
-func getOrCreateSession(w http.ResponseWriter, r *http.Request) string {
+func (s *ChatServer) getOrCreateSession(w http.ResponseWriter, r *http.Request) string {
+	traits := requestTraits(r, s.getOrCreateDevice(w, r))
+
 	cookie, err := r.Cookie("session_id")
 	if err == nil {
+		s.markSessionSeen(cookie.Value, traits)
 		return cookie.Value
 	}
 
-	sessionID := generateRandomId()
+	sessionID := s.newID()
 	http.SetCookie(w, &http.Cookie{
 		Name:  "session_id",
 		Value: sessionID,
 		Path:  "/",
 	})
+	s.markSessionSeen(sessionID, traits)
 	return sessionID
 }
 
+func (s *ChatServer) markSessionSeen(sessionID string, traits sessionTraits) {
+	s.sessionFirstSeenMu.Lock()
+	_, seen := s.sessionFirstSeen[sessionID]
+	if !seen {
+		s.sessionFirstSeen[sessionID] = s.clock.Now()
+		s.sessionHandles[sessionHandle(sessionID)] = sessionID
+	}
+	s.sessionLastSeen[sessionID] = s.clock.Now()
+	s.sessionTraits[sessionID] = traits
+	s.sessionFirstSeenMu.Unlock()
+
+	if !seen {
+		s.holdInLobby(sessionID)
+		s.checkBanEvasion(sessionID, traits)
+	}
+}
+
 func (s *ChatServer) handleSendMessage(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
-	messageText := r.FormValue("message")
-	if messageText == "" {
+	kind, data, err := parseContent(r.FormValue("kind"), r.FormValue("data"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messageText := normalizeMessage(r.FormValue("message"))
+	if messageText == "" && kind == "text" {
 		http.Error(w, "Message is required", http.StatusBadRequest)
 		return
 	}
+	if err := validateMessage(messageText); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	sessionID := getOrCreateSession(w, r)
+	components, err := parseComponents(r.FormValue("components"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	s.lastMessageTimeMu.Lock()
-	lastTime, exists := s.lastMessageTime[sessionID]
-	if exists && time.Since(lastTime) < 2*time.Second {
-		s.spamCountMu.Lock()
-		s.spamCount[sessionID]++
-		if s.spamCount[sessionID] >= 5 {
-			s.spamCountMu.Unlock()
-			s.lastMessageTimeMu.Unlock()
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+	room := normalizeRoom(r.FormValue("room"))
+	if room == "" {
+		room = s.currentRoom(sessionID)
+	}
+	if !s.inRoom(sessionID, room) {
+		http.Error(w, errNotInRoom.Error(), http.StatusForbidden)
+		return
+	}
+	if allowed := contentKinds[kind].Allowed; allowed != nil {
+		if err := allowed(s, room); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	var repliedTo Message
+	if replyTo := r.FormValue("replyTo"); replyTo != "" {
+		var ok bool
+		if repliedTo, ok = s.findMessage(replyTo); !ok || repliedTo.Room != room {
+			http.Error(w, "Invalid replyTo: "+errUnknownMessage.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	command := kind == "text" && strings.HasPrefix(messageText, ";")
+	if !command {
+		if restriction := s.postRestriction(sessionID, room); restriction != "" {
 			s.sendPrivateMessage(sessionID, Message{
-				Kind: "text",
-				Content: "You are sending messages quicker than Omar eating"
+				Kind:    "text",
+				Content: restriction,
 			})
 			return
 		}
-		s.spamCountMu.Unlock()
-	} else {
-		s.spamCountMu.Lock()
-		s.spamCount[sessionID] = 0
-		s.spamCountMu.Unlock()
 	}
-	s.lastMessageTime[sessionID] = time.Now()
-	s.lastMessageTimeMu.Unlock()
 
-	if strings.HasPrefix(messageText, ";") {
-		s.handleCommand(sessionID, messageText)
+	now := s.clock.Now()
+	if s.overRateLimit(r, sessionID, now) {
 		return
 	}
 
+	if command {
+		s.timeCommand(r, sessionID, messageText)
+		return
+	}
+
+	if s.inLobby(sessionID) {
+		s.relayLobbyMessage(sessionID, messageText)
+		return
+	}
+	s.slowmodePosted(sessionID, room, now)
+
 	s.nicknameColorsMu.Lock()
 	color := s.nicknameColors[sessionID]
 	s.nicknameColorsMu.Unlock()
 
 	formattedMessage := Message{
-		FromApp: false,
-		Private: false,
-		Kind: "text",
-		Content: html.EscapeString(messageText),
+		FromApp:    false,
+		Private:    false,
+		Kind:       kind,
+		Content:    escapeText(messageText),
+		Data:       data,
+		Components: components,
+		ReplyTo:    repliedTo.ID,
 		Author: &MessageAuthor{
-			ID: sessionID,
-			Nickname: s.getNickname(sessionID)
-		}
+			ID:       sessionHandle(sessionID),
+			Nickname: s.getNickname(sessionID),
+		},
 	}
 
 	if color == "" {
@@ -370,37 +1018,208 @@ func (s *ChatServer) handleSendMessage(w http.ResponseWriter, r *http.Request) {
 	} else {
 		formattedMessage.Author.Color = color
 	}
+	if kind == "text" {
+		formattedMessage.Segments = s.segments(messageText)
+	}
+	if prepare := contentKinds[kind].Prepare; prepare != nil {
+		formattedMessage = prepare(formattedMessage)
+	}
+	if s.shadowMuted(sessionID) {
+		s.echoShadowMuted(room, formattedMessage)
+		fmt.Fprintf(w, "Message sent")
+		return
+	}
 
-	s.broadcastMessage(formattedMessage)
+	if room != "" {
+		formattedMessage, err = s.broadcastToRoom(room, formattedMessage)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if len(components) > 0 {
+			s.trackInteractive(formattedMessage.ID, sessionID, components)
+		}
+		s.notify("reply", repliedTo, sessionID, "")
+		s.threadReply(repliedTo, formattedMessage)
+		s.recordMessage(sessionID, room, messageText)
+		s.runRoomAutomation(room, "message", sessionID, messageText)
+		fmt.Fprintf(w, "Message sent")
+		return
+	}
+
+	formattedMessage = s.broadcastMessage(formattedMessage)
+	if len(components) > 0 {
+		s.trackInteractive(formattedMessage.ID, sessionID, components)
+	}
+	s.notify("reply", repliedTo, sessionID, "")
+	s.threadReply(repliedTo, formattedMessage)
+	s.recordMessage(sessionID, "", messageText)
+	s.collectForSummary(formattedMessage, messageText)
+	s.federate(formattedMessage)
+	s.routeBotCommand(formattedMessage, messageText)
+	s.runAutomation("message", sessionID, messageText)
 	fmt.Fprintf(w, "Message sent")
 }
 
+// postRestriction returns why sessionID can't post in the room now, or "": a moderator mute, raid
+// mode or slow mode. Whatever members post, messages, edits, images and reactions, goes through it.
+func (s *ChatServer) postRestriction(sessionID, room string) string {
+	restriction := s.muteRestriction(sessionID)
+	if restriction == "" {
+		restriction = s.raidRestriction(sessionID)
+	}
+	if restriction == "" {
+		restriction = s.slowmodeRestriction(sessionID, room)
+	}
+	return restriction
+}
+
+// overRateLimit reports whether sessionID, posting with r at now, is over the rate limits, in
+// which case it was told how long to wait, or dealt with as a spammer. Otherwise the post counts
+// towards them. Only the limit of the session itself makes strikes: the limit of the address is
+// shared by everyone behind it, who shouldn't be punished for the others.
+func (s *ChatServer) overRateLimit(r *http.Request, sessionID string, now time.Time) bool {
+	ok, wait := s.messageLimiter.Allow(sessionID, now)
+	strike := !ok
+	if ok && !s.isModerator(sessionID) {
+		ok, wait = s.addressMessages.Allow(clientIP(r), now)
+	}
+	if !ok {
+		if !strike || !s.spamStrike(sessionID, now) {
+			s.sendPrivateMessage(sessionID, Message{
+				Kind:    "text",
+				Content: fmt.Sprintf("You are sending messages quicker than Omar eating, wait %s", wait.Round(100*time.Millisecond)),
+			})
+		}
+		return true
+	}
+	s.lastMessageTimeMu.Lock()
+	s.lastMessageTime[sessionID] = now
+	s.lastMessageTimeMu.Unlock()
+	return false
+}
+
 func (s *ChatServer) handleCommand(sessionID, message string) {
 	switch strings.ToLower(strings.Split(message, " ")[0]) {
 	case ";help":
 		s.sendPrivateMessage(sessionID, Message{
-			Kind: "text",
-			Content: "Available commands:<br>;whisper &lt;username&gt; &lt;message&gt;<br>;color &lt;hexcode|colorname&;gt",
+			Kind:    "text",
+			Content: "Available commands:<br>;whisper &lt;username&gt; &lt;message&gt;<br>;color &lt;hexcode|colorname&gt;<br>;mod &lt;key&gt;<br>;claim &lt;owner key&gt;<br>;pins<br>;delete &lt;message id&gt;<br>;todo add &lt;text&gt;|done &lt;id&gt;|remove &lt;id&gt;|list [all]<br>;event &quot;&lt;title&gt;&quot; YYYY-MM-DD HH:MM (UTC)|list|rsvp &lt;id&gt; going|maybe|no|cancel &lt;id&gt;<br>;timer &lt;duration&gt; [halfway] [label]|list|cancel &lt;id&gt;<br>;snippet save &lt;name&gt; &lt;content&gt;|get &lt;name&gt;|delete &lt;name&gt;|list<br>;join|;leave &lt;room&gt;<br>;switch [room]<br>;rooms<br>;room create &lt;name&gt; [--template=&lt;template&gt;]|templates<br>;room list|unlist|category [category]|describe [description] (room moderators, in your current room)<br>;dnd on|off<br>;follow|;unfollow &lt;message id&gt;<br>;threads instant|digest|never<br>;mute|;unmute #&lt;room&gt;|&lt;nickname&gt;<br>;mutes<br>;report &lt;nickname&gt; &lt;reason&gt;<br><br>Moderator commands:<br>;raidmode on [duration]|off|status<br>;slowmode &lt;interval&gt; [duration]|off (in your current room)<br>;lobby on|off<br>;approve &lt;nickname|session&gt;<br>;kick &lt;nickname|session&gt; [reason]<br>;mute &lt;nickname|session&gt; &lt;duration&gt; [reason]<br>;unmute &lt;nickname|session&gt;<br>;shadowmute &lt;nickname|session&gt; [duration]<br>;unshadowmute &lt;nickname|session&gt;<br>;ban &lt;nickname|session&gt; [duration] (and their address)<br>;unban &lt;session&gt;<br>;roles<br>;livestream on [max messages per second]|off<br>;animations on|off (in your current room)<br>;locations on|off (in your current room)<br>;pin [for &lt;duration&gt;] &lt;message&gt; (in your current room)<br>;unpin &lt;pin id&gt;<br>;stats<br>;incident start &lt;title&gt;|status [status]|note &lt;text&gt;|resolve [summary]<br><br>Owner commands:<br>;owner transfer &lt;nickname&gt;<br>;coowner add|remove &lt;nickname&gt;<br>;promote|;demote &lt;nickname&gt; (co-owners too)",
 		})
 
+	case ";mod":
+		s.handleModLogin(sessionID, strings.Split(message, " ")[1:])
+
+	case ";claim":
+		s.handleClaimCommand(sessionID, strings.Split(message, " ")[1:])
+
+	case ";owner", ";coowner", ";promote", ";demote", ";roles":
+		splitted := strings.Split(message, " ")
+		s.handleRoleCommand(sessionID, strings.ToLower(splitted[0][1:]), splitted[1:])
+
+	case ";join", ";leave", ";switch", ";rooms", ";room":
+		splitted := strings.Split(message, " ")
+		s.handleRoomCommand(sessionID, strings.ToLower(splitted[0][1:]), splitted[1:])
+
+	case ";livestream":
+		s.handleLivestreamCommand(sessionID, strings.Split(message, " ")[1:])
+
+	case ";mute", ";unmute", ";mutes":
+		splitted := strings.Split(message, " ")
+		s.handleMuteCommand(sessionID, strings.ToLower(splitted[0][1:]), splitted[1:])
+
+	case ";follow", ";unfollow", ";threads":
+		splitted := strings.Split(message, " ")
+		s.handleThreadCommand(sessionID, strings.ToLower(splitted[0][1:]), splitted[1:])
+
+	case ";locations":
+		s.handleLocationsCommand(sessionID, strings.Split(message, " ")[1:])
+
+	case ";stats":
+		s.handleStatsCommand(sessionID)
+
+	case ";dnd":
+		s.handleDNDCommand(sessionID, strings.Split(message, " ")[1:])
+
+	case ";animations":
+		s.handleAnimationsCommand(sessionID, strings.Split(message, " ")[1:])
+
+	case ";pin":
+		s.handlePinCommand(sessionID, strings.TrimSpace(strings.TrimPrefix(message, strings.Split(message, " ")[0])))
+
+	case ";unpin":
+		s.handleUnpinCommand(sessionID, strings.Split(message, " ")[1:])
+
+	case ";delete":
+		s.handleDeleteCommand(sessionID, strings.Fields(message)[1:])
+
+	case ";pins":
+		s.handlePinsCommand(sessionID)
+
+	case ";raidmode":
+		s.handleRaidCommand(sessionID, strings.Split(message, " ")[1:])
+
+	case ";slowmode":
+		s.handleSlowmodeCommand(sessionID, strings.Fields(message)[1:])
+
+	case ";event":
+		s.handleEventCommand(sessionID, strings.TrimSpace(strings.TrimPrefix(message, strings.Split(message, " ")[0])))
+
+	case ";timer":
+		s.handleTimerCommand(sessionID, strings.Split(message, " ")[1:])
+
+	case ";snippet":
+		s.handleSnippetCommand(sessionID, strings.TrimSpace(strings.TrimPrefix(message, strings.Split(message, " ")[0])))
+
+	case ";todo":
+		s.handleTodoCommand(sessionID, strings.Split(message, " ")[1:])
+
+	case ";incident":
+		s.handleIncidentCommand(sessionID, strings.Split(message, " ")[1:])
+
+	case ";shadowmute", ";unshadowmute":
+		splitted := strings.Split(message, " ")
+		s.handleShadowMuteCommand(sessionID, strings.ToLower(splitted[0][1:]), splitted[1:])
+
+	case ";report":
+		s.handleReportCommand(sessionID, strings.Split(message, " ")[1:])
+
+	case ";kick":
+		s.handleKickCommand(sessionID, strings.Split(message, " ")[1:])
+
+	case ";ban":
+		s.handleBanCommand(sessionID, strings.Split(message, " ")[1:])
+
+	case ";unban":
+		s.handleUnbanCommand(sessionID, strings.Split(message, " ")[1:])
+
+	case ";lobby":
+		s.handleLobbyCommand(sessionID, strings.Split(message, " ")[1:])
+
+	case ";approve":
+		s.handleApproveCommand(sessionID, strings.Split(message, " ")[1:])
+
 	case ";members":
 		s.nicknamesMu.Lock()
 		members := ""
 		for memberSessionID, nickname := range s.nicknames {
-			members = fmt.Sprintf("%s [%s] (%s)", members, html.EscapeString(nickname), html.EscapeString(memberSessionID))
+			members = fmt.Sprintf("%s [%s] (%s)", members, escapeText(nickname), sessionHandle(memberSessionID))
 		}
 		s.nicknamesMu.Unlock()
 		// s.sendPrivateMessage(sessionID, "{app}: Online members" + members)
 		messageContent := "Online members:" + members
 		s.sendPrivateMessage(sessionID, Message{
-			Kind: "text",
-			Content: messageContent
+			Kind:    "text",
+			Content: messageContent,
 		})
 
 	case ";whisper":
 		splitted := strings.Split(message, " ")
 		if len(splitted) < 3 {
-			s.sendPrivateMessage(sessionID, "{app}: Usage: ;whisper <username> <message>")
+			s.sendPrivateMessage(sessionID, Message{
+				Kind:    "text",
+				Content: "Usage: ;whisper &lt;username&gt; &lt;message&gt;",
+			})
 			return
 		}
 		toNickname := splitted[1]
@@ -417,39 +1236,46 @@ func (s *ChatServer) handleCommand(sessionID, message string) {
 		s.nicknamesMu.Unlock()
 
 		if toSessionID == "" {
-			// s.sendPrivateMessage(sessionID, fmt.Sprintf("{app}: User %s not found", html.EscapeString(toNickname)))
-			messageContent := fmt.Sprintf("User %s not found", html.EscapeString(toNickname))
-			s.sendPrivateMessage(sessionID, Message{ Kind: "text", Content: messageContent })
+			// s.sendPrivateMessage(sessionID, fmt.Sprintf("{app}: User %s not found", escapeText(toNickname)))
+			messageContent := fmt.Sprintf("User %s not found", escapeText(toNickname))
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: messageContent})
 			return
 		}
-		escapedMsg := html.EscapeString(msg)
-		msgToSend := fmt.Sprintf("(whisper to @%s) [%s]: %s", 
-			html.EscapeString(toNickname), 
-			html.EscapeString(s.getNickname(sessionID)), 
+		if s.inLobby(sessionID) && !s.isModerator(toSessionID) {
+			s.sendPrivateMessage(sessionID, Message{
+				Kind:    "text",
+				Content: "You can only message moderators until a moderator approves you",
+			})
+			return
+		}
+		escapedMsg := escapeText(msg)
+		msgToSend := fmt.Sprintf("(whisper to @%s) [%s]: %s",
+			escapeText(toNickname),
+			escapeText(s.getNickname(sessionID)),
 			escapedMsg)
 
-		s.sendPrivateMessage(toSessionID, Message{ Kind: "text", Content: msgToSend })
-		s.sendPrivateMessage(sessionID, Message{ Kind: "text", Content: msgToSend })
+		// Whispers from someone muted are left out, without telling them.
+		if !s.mutes(toSessionID, sessionID, "") {
+			s.sendPrivateMessage(toSessionID, Message{Kind: "text", Content: msgToSend})
+		}
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: msgToSend})
 
 	case ";color":
 		splitted := strings.Split(message, " ")
 		if len(splitted) != 2 {
 			// s.sendPrivateMessage(sessionID, "{app}: Usage: ;color <hexcode|colorname> (e.g., ;color #ff0000 or ;color red)")
 			s.sendPrivateMessage(sessionID, Message{
-				Kind: "text",
-				Content: "Usage: ;color &lt;hexcode|colorname&gt;"
+				Kind:    "text",
+				Content: "Usage: ;color &lt;hexcode|colorname&gt;",
 			})
 			return
 		}
-		color := splitted[1]
-
-		if hex, ok := predefinedColors[strings.ToLower(color)]; ok {
-			color = hex
-		} else if !strings.HasPrefix(color, "#") || len(color) != 7 {
+		color, err := parseColor(splitted[1])
+		if err != nil {
 			// s.sendPrivateMessage(sessionID, "{app}: Invalid color format. Use hexadecimal format like #ff0000 or predefined names like red")
-			s.sendPrivateMessge(sessionID, Message{
-				Kind: "text",
-				Content: "Invalid color format. Use hexadecimal format like #ff0000 or predefined names like red"
+			s.sendPrivateMessage(sessionID, Message{
+				Kind:    "text",
+				Content: err.Error(),
 			})
 			return
 		}
@@ -460,16 +1286,16 @@ func (s *ChatServer) handleCommand(sessionID, message string) {
 		// s.sendPrivateMessage(sessionID, fmt.Sprintf("{app}: Your nickname color has been changed to %s", color))
 		messageContent := fmt.Sprintf("Your nickname color has been changed to %s", color)
 		s.sendPrivateMessage(sessionID, Message{
-			Kind: "text",
-			Content: messageContent
+			Kind:    "text",
+			Content: messageContent,
 		})
 
 	default:
-		// s.sendPrivateMessage(sessionID, "{app}: Unknown command: " + html.EscapeString(message))
-		messageContent := "Unknown command: " + html.EscapeString(message)
+		// s.sendPrivateMessage(sessionID, "{app}: Unknown command: " + escapeText(message))
+		messageContent := "Unknown command: " + escapeText(message)
 		s.sendPrivateMessage(sessionID, Message{
-			Kind: "text",
-			Content: messageContent
+			Kind:    "text",
+			Content: messageContent,
 		})
 	}
 }
@@ -479,29 +1305,107 @@ func (s *ChatServer) handleEvents(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	sessionID := getOrCreateSession(w, r)
-	msgCh := make(chan string)
-
-	s.clientsMu.Lock()
-	s.clients[sessionID] = msgCh
-	s.clientsMu.Unlock()
-
-	defer func() {
-		s.clientsMu.Lock()
-		delete(s.clients, sessionID)
-		s.clientsMu.Unlock()
-		close(msgCh)
-	}()
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+	if s.isKicked(sessionID) {
+		http.Error(w, errKicked.Error(), http.StatusForbidden)
+		return
+	}
+	release := s.acquireSlot(sessionID, "stream", maxStreamsPerSession)
+	if release == nil {
+		tooManyConcurrent(w, "event streams", maxStreamsPerSession)
+		return
+	}
+	defer release()
+	if !s.isModerator(sessionID) {
+		releaseAddress := s.acquireSlot(clientIP(r), "address stream", s.addressStreams)
+		if releaseAddress == nil {
+			tooManyFromAddress(w, "event streams", s.addressStreams)
+			return
+		}
+		defer releaseAddress()
+	}
+	filter := parseKindFilter(r)
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
 		return
 	}
+	// Let the client know it is connected before the first event comes in, or while it waits in
+	// line.
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
 
-	for msg := range msgCh {
-		fmt.Fprintf(w, "data: %s\n\n", msg)
+	// Where the stream's SSE ids are at, see sse.go.
+	lastID, _ := lastEventID(r)
+	msgCh := s.resumeStream(sessionID, r.URL.Query().Get("resume"))
+	if msgCh == nil {
+		if !s.admitStream(r.Context(), w, flusher) {
+			return
+		}
+		msgCh = make(chan string, clientBuffer)
+		for _, event := range s.subscribe(sessionID, msgCh, r) {
+			if event, ok := filter.apply(event); ok {
+				writeMessage(w, event, &lastID)
+			}
+		}
 		flusher.Flush()
+		s.sendPins(sessionID, "")
+		s.deliverNotices(sessionID)
+		s.sendWelcome(sessionID)
+		s.enqueueLobby(sessionID)
+	}
+
+	token := generateSessionID()
+	writeMessage(w, s.stamp(Message{FromApp: true, Kind: "resume", Private: true, Content: token}), nil)
+	flusher.Flush()
+
+	// A newer stream of the same session may have replaced this one already, or it was evicted.
+	// Otherwise it stays connected for a while in case the client resumes the stream, see
+	// endStream. The channel is left open since broadcasts may still be trying to send on it.
+	evicted := s.watchEviction(msgCh)
+	kicked := s.watchKick(msgCh)
+	defer func() {
+		s.forgetEviction(msgCh)
+		s.forgetKick(msgCh)
+		if ch, _ := s.hub.lookup(sessionID); ch == msgCh {
+			s.endStream(token, sessionID, msgCh)
+		}
+	}()
+
+	heartbeat := s.clock.After(heartbeatInterval)
+	for {
+		select {
+		case msg := <-msgCh:
+			filtered, ok := filter.filterEncoded(msg)
+			if ok {
+				if writeEvent(w, filtered, &lastID) != nil {
+					return
+				}
+				flusher.Flush()
+			}
+			s.traceFlushed(msg, sessionID, !ok)
+		case <-heartbeat:
+			if writeHeartbeat(w) != nil {
+				return
+			}
+			heartbeat = s.clock.After(heartbeatInterval)
+		case <-evicted:
+			s.hub.disconnect(sessionID, msgCh)
+			writeEvent(w, s.evictedMessage(), nil)
+			flusher.Flush()
+			return
+		case last := <-kicked:
+			writeEvent(w, last, nil)
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
 	}
 }
 
@@ -520,84 +1424,92 @@ func (s *ChatServer) generateRandomColor() string {
 
 func (s *ChatServer) handleSetNickname(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
-	nickname := r.FormValue("nickname")
+	nickname := normalizeNickname(r.FormValue("nickname"))
 
-	if nickname == "" || strings.Contains(nickname, " ") {
-		http.Error(w, "Invalid nickname: either empty or contains spaces", http.StatusBadRequest)
+	if err := validateNickname(nickname); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	sessionID := getOrCreateSession(w, r)
-	
-	s.nicknamesMu.Lock()
-	for _, nick := range s.nicknames {
-		if nickname == nick {
-			http.Error(w, "Invalid nickname: already taken", http.StatusBadRequest)
-			return
-		}
-	}
-	old := s.nicknames[sessionID]
-	s.nicknames[sessionID] = nickname
-	s.nicknamesMu.Unlock()
-
-	s.nicknameColorsMu.Lock()
-	if _, exists := s.nicknameColors[sessionID]; !exists {
-		s.nicknameColors[sessionID] = s.generateRandomColor()
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
 	}
-	s.nicknameColorsMu.Unlock()
 
-	if old == "" {
-		old = "no previous nicknames"
-	} else {
-		old = fmt.Sprintf("previously [%s]", old)
+	if err := s.setNickname(sessionID, nickname); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-
-	messageContent := fmt.Sprintf("client %s ([%s]) changed nickname to [%s]", sessionID, old, nickname)
-	s.broadcastMessage(Message{
-		Private: false,
-		FromApp: true,
-		Kind: "text",
-		Content: messageContent
-	})
 	fmt.Fprintf(w, "Nickname set to %s for session %s", nickname, sessionID)
 }
 
-func (s *ChatServer) broadcastMessage(message Message) {
-	s.clientsMu.Lock()
-	defer s.clientsMu.Unlock()
+// broadcastMessage sends message to every client and returns it as sent, with its identifier.
+func (s *ChatServer) broadcastMessage(message Message) Message {
+	message = message.sanitized()
+	s.broadcastMu.Lock()
+	defer s.broadcastMu.Unlock()
+	message = s.logEvent(message)
+	if s.coalesce(message) {
+		return message
+	}
 
 	jsonData, err := json.Marshal(message)
 	if err != nil {
-		log.Fatal(err) // TODO: see if this affects the app negatively
+		slog.Error("Could not encode message", "kind", message.Kind, "err", err)
+		return message
 	}
 
 	jsonD := string(jsonData)
-
-	for _, ch := range s.clients {
-		go func(c chan string, d string) {
-			c <- d
-		}(ch, jsonD)
+	var muted map[string]bool
+	if message.Author != nil && !message.FromApp {
+		muted = s.mutedBy(s.sessionOfHandle(message.Author.ID), "")
 	}
+	s.broadcastRawExcept(jsonD, muted)
+	s.publishToRelays(jsonD)
+	return message
 }
 
-func (s *ChatServer) sendPrivateMessage(sessionID string, message Message) {
-	s.clientsMu.Lock()
-	ch, ok := s.clients[sessionID]
-	s.clientsMu.Unlock()
+// broadcastRaw delivers an already encoded message to every connected client.
+func (s *ChatServer) broadcastRaw(jsonD string) {
+	s.broadcastRawExcept(jsonD, nil)
+}
 
-	if ok {
-		message.Author = nil
-		message.FromApp = true
-		message.Private = true
+// broadcastRawExcept is broadcastRaw leaving out the sessions in skip, who muted the message.
+func (s *ChatServer) broadcastRawExcept(jsonD string, skip map[string]bool) {
+	s.countBroadcast()
+	trace := s.sampleTrace(jsonD)
+	s.hub.broadcastAll(func(id string, ch chan string) {
+		if skip[id] {
+			return
+		}
+		queued := s.deliver(ch, jsonD)
+		if trace != nil {
+			s.traceQueued(trace, id, queued)
+		}
+	})
+}
 
-		jsonData, err := json.Marshal(message)
+func (s *ChatServer) sendPrivateMessage(sessionID string, message Message) {
+	message.Author = nil
+	message.FromApp = true
+	message.Private = true
+	s.sendTo(sessionID, message)
+}
+
+// sendTo delivers message to a single client, sanitized and stamped unless it was already.
+func (s *ChatServer) sendTo(sessionID string, message Message) {
+	if message.Timestamp.IsZero() {
+		message = s.stamp(message)
+	}
+	if ch, ok := s.hub.lookup(sessionID); ok {
+		jsonData, err := json.Marshal(message.sanitized())
 		if err != nil {
-			log.Fatal(err) // TODO: see if this affects the app negatively
+			slog.Error("Could not encode message", "kind", message.Kind, "err", err)
+			return
 		}
 
-		go func(d string) {
-			ch <- d
-		}(string(jsonData))
+		s.deliver(ch, string(jsonData))
 	}
 }
 
@@ -613,6 +1525,39 @@ func generateRandomId() string {
 }
 
 func (s *ChatServer) handleImageUpload(w http.ResponseWriter, r *http.Request) {
+	if s.raidActive() {
+		http.Error(w, "Uploads are disabled while raid mode is on", http.StatusForbidden)
+		return
+	}
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+	if s.inLobby(sessionID) {
+		http.Error(w, "Uploads are disabled until a moderator approves you", http.StatusForbidden)
+		return
+	}
+	release := s.acquireSlot(sessionID, "upload", maxUploadsPerSession)
+	if release == nil {
+		tooManyConcurrent(w, "uploads", maxUploadsPerSession)
+		return
+	}
+	defer release()
+	if !s.isModerator(sessionID) {
+		address := clientIP(r)
+		releaseAddress := s.acquireSlot(address, "address upload", maxUploadsPerAddress)
+		if releaseAddress == nil {
+			tooManyFromAddress(w, "uploads", maxUploadsPerAddress)
+			return
+		}
+		defer releaseAddress()
+		if ok, wait := s.addressUploads.Allow(address, s.clock.Now()); !ok {
+			http.Error(w, fmt.Sprintf("Too many uploads from your address, wait %s", wait.Round(time.Second)), http.StatusTooManyRequests)
+			return
+		}
+	}
+
 	err := r.ParseMultipartForm(10 << 20)
 	if err != nil {
 		http.Error(w, "Could not parse multipart form", http.StatusBadRequest)
@@ -632,80 +1577,125 @@ func (s *ChatServer) handleImageUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id := generateRandomId()
-	s.imageStoreMu.Lock()
-	s.imageStore[id] = imageBytes
-	s.imageExpiry[id] = time.Now().Add(1 * time.Minute)
-	s.imageStoreMu.Unlock()
+	room := normalizeRoom(r.FormValue("room"))
+	if room == "" {
+		room = s.currentRoom(sessionID)
+	}
+	if !s.inRoom(sessionID, room) {
+		http.Error(w, errNotInRoom.Error(), http.StatusForbidden)
+		return
+	}
+	// Images are posts too, held to the restrictions of messages.
+	if restriction := s.postRestriction(sessionID, room); restriction != "" {
+		http.Error(w, restriction, http.StatusForbidden)
+		return
+	}
+	switch err := s.checkAnimation(sessionID, room, imageBytes); err {
+	case nil:
+	case errAnimationsOff:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case errTooManyAnimations:
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	public := r.FormValue("public") == "true"
+	id, url, err := s.storeImage(imageBytes, sessionID, public)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	s.archiveUpload(id, sessionID, imageBytes)
 
-	sessionID := getOrCreateSession(w, r)
 	// s.broadcastMessage(fmt.Sprintf("@image [%s] %s", s.getNickname(sessionID), id))
 	sessionNickname := s.getNickname(sessionID)
-	s.broadcastMessage(Message{
+	message := Message{
 		FromApp: false,
 		Private: false,
-		Kind: "image",
- 		Content: id,
+		Kind:    "image",
+		Content: id,
+		URL:     url,
 		Author: &MessageAuthor{
-			ID: sessionID,
-			Nickname: sessionNickname
+			ID:       sessionHandle(sessionID),
+			Nickname: sessionNickname,
+		},
+	}
+	if s.shadowMuted(sessionID) {
+		s.echoShadowMuted(room, message)
+	} else if room != "" {
+		if _, err := s.broadcastToRoom(room, message); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
 		}
-	})
+	} else {
+		s.broadcastMessage(message)
+	}
+	s.slowmodePosted(sessionID, room, s.clock.Now())
+	s.recordMessage(sessionID, room, "")
 	w.Write([]byte("Image uploaded"))
 }
 
 func (s *ChatServer) handleImage(w http.ResponseWriter, r *http.Request) {
 	id := strings.TrimPrefix(r.URL.Path, "/image/")
-	s.imageStoreMu.Lock()
-	data, ok := s.imageStore[id]
-	s.imageStoreMu.Unlock()
-	if !ok {
+	data, public, err := s.viewImage(id, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if data == nil {
 		http.NotFound(w, r)
 		return
 	}
-	w.Header().Set("Content-Type", http.DetectContentType(data))
+	contentType, inline := uploadContentType(data)
+	w.Header().Set("Content-Type", contentType)
+	if !inline {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id))
+	}
+	setImageHeaders(w)
+	if public {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(imageURLTTL.Seconds())))
+	}
 	w.Write(data)
 }
 
-func (s *ChatServer) startImageCleanup() {
-	ticker := time.NewTicker(30 * time.Second)
-	go func() {
-		for range ticker.C {
-			now := time.Now()
-			s.imageStoreMu.Lock()
-			for id, expiry := range s.imageExpiry {
-				if now.After(expiry) {
-					delete(s.imageStore, id)
-					delete(s.imageExpiry, id)
-				}
-			}
-			s.imageStoreMu.Unlock()
+func (s *ChatServer) expireImages() {
+	now := s.clock.Now()
+	s.imageStoreMu.Lock()
+	for id, expiry := range s.imageExpiry {
+		if now.After(expiry) {
+			s.deleteImageLocked(id)
 		}
-	}()
+	}
+	s.imageStoreMu.Unlock()
+	s.checkStorageWarning()
 }
 
 func (s *ChatServer) handleJoin(w http.ResponseWriter, r *http.Request) {
-	sessionID := getOrCreateSession(w, r)
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
 	// s.broadcastMessage(fmt.Sprintf(`<span class="highlight-admin-app">Alantern</span>: %s ([%s]) has joined the room`, sessionID, s.getNickname(sessionID)))
-	messageContent := fmt.Sprintf("%s ([%s]) has joined the room", sessionID, s.getNickname(sessionID))
+	messageContent := fmt.Sprintf("%s ([%s]) has joined the room", sessionHandle(sessionID), escapeText(s.getNickname(sessionID)))
 	s.broadcastMessage(Message{
-		Private: false,
-		FromApp: true,
-		Kind: "text",
-		Content: messageContent
+		Private:  false,
+		FromApp:  true,
+		Kind:     "text",
+		Content:  messageContent,
+		Activity: "join",
 	})
+	s.runAutomation("join", sessionID, "")
 	w.WriteHeader(http.StatusOK)
 }
 
 func (s *ChatServer) handleLeave(w http.ResponseWriter, r *http.Request) {
-	sessionID := getOrCreateSession(w, r)
-	// s.broadcastMessage(fmt.Sprintf(`<span class="highlight-admin-app">Alantern</span>: [%s] (%s) has left the room`, s.getNickname(sessionID), sessionID))
-	messageContent := fmt.Sprintf("[%s] (%s) has left the room", s.getNickname(sessionID), sessionID)
-	s.broadcastMessage(Message{
-		Private: false,
-		FromApp: true,
-		Kind: "text",
-		Content: messageContent
-	})
+	s.leave(s.getOrCreateSession(w, r))
 	w.WriteHeader(http.StatusOK)
 }
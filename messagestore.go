@@ -0,0 +1,291 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Logged events live in memory only, unless MESSAGE_DB names an SQLite database to keep them in
+// too. Then they survive restarts: the server starts with the last eventLogSize of them in its
+// event log, numbered on from the last Seq, so /api/v1/events and resuming clients pick up where
+// they were. Events older than MESSAGE_RETENTION, a duration such as "168h", are deleted every
+// hour, unless under legal hold (see legalhold.go). Room messages and -selftest traffic are never
+// stored, and relay edges, which catch up from the primary, store nothing. Rooms live in memory
+// and close when their last member leaves, so none survives a restart: their messages would be
+// kept for a room nobody can join again, and readable by whoever next opens one of that name.
+//
+// Writes go through a queue to a single writer, so that broadcasts, which log events with
+// broadcastMu held, don't wait on the disk. When the disk falls messageQueueSize writes behind
+// they do wait rather than lose messages. Deletes go through the queue too, after the writes
+// queued before them, and wait for the outcome.
+
+const (
+	defaultMessageRetention = 30 * 24 * time.Hour
+	messageQueueSize        = 1024
+)
+
+var errStoreClosed = errors.New("the message store is closed")
+
+var (
+	messageDB        = os.Getenv("MESSAGE_DB")
+	messageRetention = loadMessageRetention()
+)
+
+func loadMessageRetention() time.Duration {
+	if retention, err := time.ParseDuration(os.Getenv("MESSAGE_RETENTION")); err == nil && retention > 0 {
+		return retention
+	}
+	return defaultMessageRetention
+}
+
+// MessageStore keeps logged events across restarts.
+type MessageStore interface {
+	// Save stores message, replacing the one with the same identifier, stored at at.
+	Save(message Message, at time.Time) error
+	// Recent returns the last limit messages stored, oldest first.
+	Recent(limit int) ([]Message, error)
+	// Get returns the message stored with identifier id, if there is one.
+	Get(id string) (Message, bool, error)
+	// Delete deletes the message stored with identifier id, if there is one.
+	Delete(id string) error
+	// Prune deletes the messages stored before cutoff and returns how many there were.
+	Prune(cutoff time.Time) (int64, error)
+	Close() error
+}
+
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer at a time, so one connection avoids "database is locked".
+	db.SetMaxOpenConns(1)
+	for _, statement := range []string{
+		`PRAGMA journal_mode = WAL`,
+		`CREATE TABLE IF NOT EXISTS messages (
+			id TEXT PRIMARY KEY,
+			seq INTEGER NOT NULL,
+			stored_at INTEGER NOT NULL,
+			data TEXT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS messages_seq ON messages (seq)`,
+		`CREATE INDEX IF NOT EXISTS messages_stored_at ON messages (stored_at)`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (store *sqliteStore) Save(message Message, at time.Time) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	// Updates keep the time the message was first stored, so they don't extend its retention.
+	_, err = store.db.Exec(`INSERT INTO messages (id, seq, stored_at, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET data = excluded.data`, message.ID, message.Seq, at.UnixNano(), string(data))
+	return err
+}
+
+func (store *sqliteStore) Recent(limit int) ([]Message, error) {
+	rows, err := store.db.Query(`SELECT stored_at, data FROM (SELECT seq, stored_at, data FROM messages ORDER BY seq DESC LIMIT ?) ORDER BY seq`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var messages []Message
+	for rows.Next() {
+		var storedAt int64
+		var data string
+		if err := rows.Scan(&storedAt, &data); err != nil {
+			return nil, err
+		}
+		message, err := decodeStored(storedAt, data)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// decodeStored returns the message stored at storedAt as data. Messages stored before they had
+// a Timestamp get the time they were stored, which is when they were sent give or take.
+func decodeStored(storedAt int64, data string) (Message, error) {
+	var message Message
+	if err := json.Unmarshal([]byte(data), &message); err != nil {
+		return message, err
+	}
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Unix(0, storedAt).UTC()
+	}
+	return message, nil
+}
+
+func (store *sqliteStore) Get(id string) (Message, bool, error) {
+	var storedAt int64
+	var data string
+	err := store.db.QueryRow(`SELECT stored_at, data FROM messages WHERE id = ?`, id).Scan(&storedAt, &data)
+	if err == sql.ErrNoRows {
+		return Message{}, false, nil
+	} else if err != nil {
+		return Message{}, false, err
+	}
+	message, err := decodeStored(storedAt, data)
+	return message, err == nil, err
+}
+
+func (store *sqliteStore) Delete(id string) error {
+	_, err := store.db.Exec(`DELETE FROM messages WHERE id = ?`, id)
+	return err
+}
+
+func (store *sqliteStore) Prune(cutoff time.Time) (int64, error) {
+	result, err := store.db.Exec(`DELETE FROM messages WHERE stored_at < ?`, cutoff.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// backup writes a consistent copy of the database to path, even while it is written to.
+func (store *sqliteStore) backup(path string) error {
+	_, err := store.db.Exec(`VACUUM INTO ?`, path)
+	return err
+}
+
+func (store *sqliteStore) Close() error {
+	return store.db.Close()
+}
+
+// loadMessages opens MESSAGE_DB, if set, and fills the event log from it.
+func (s *ChatServer) loadMessages() error {
+	if messageDB == "" || relayUpstream != "" {
+		return nil
+	}
+	store, err := openSQLiteStore(messageDB)
+	if err != nil {
+		return err
+	}
+	if !legalHold {
+		if _, err := store.Prune(s.clock.Now().Add(-messageRetention)); err != nil {
+			store.Close()
+			return err
+		}
+	}
+	messages, err := store.Recent(eventLogSize)
+	if err != nil {
+		store.Close()
+		return err
+	}
+
+	s.eventLogMu.Lock()
+	for _, message := range messages {
+		s.appendEventLocked(message)
+		if message.Seq > s.eventSeq {
+			s.eventSeq = message.Seq
+		}
+	}
+	s.eventLogMu.Unlock()
+	s.messages = store
+	s.messageWrites = make(chan storeWrite, messageQueueSize)
+	s.messagesDone = make(chan struct{})
+	go s.runMessageWriter()
+	slog.Info("Loaded stored messages", "count", len(messages), "db", messageDB)
+	return nil
+}
+
+// storeWrite is a write queued for the message store: message to save, or the message with
+// identifier deleteID to delete, whose outcome is sent on result.
+type storeWrite struct {
+	message  Message
+	at       time.Time
+	deleteID string
+	result   chan error
+}
+
+// runMessageWriter applies the queued writes to the store, until stopMessages closes the queue
+// and the writes still in it are done.
+func (s *ChatServer) runMessageWriter() {
+	defer close(s.messagesDone)
+	for write := range s.messageWrites {
+		s.applyStoreWrite(write)
+	}
+}
+
+func (s *ChatServer) applyStoreWrite(write storeWrite) {
+	if write.deleteID != "" {
+		write.result <- s.messages.Delete(write.deleteID)
+		return
+	}
+	if err := s.messages.Save(write.message, write.at); err != nil {
+		slog.Error("Could not store message", "id", write.message.ID, "err", err)
+	}
+}
+
+// queueStoreWrite queues write, waiting while the queue is full, and reports whether the store
+// still takes writes. A write queued is applied, stopMessages waiting for it.
+func (s *ChatServer) queueStoreWrite(write storeWrite) bool {
+	s.messageWritesMu.RLock()
+	defer s.messageWritesMu.RUnlock()
+	if s.messagesClosed {
+		return false
+	}
+	s.messageWrites <- write
+	return true
+}
+
+// stopMessages stops taking writes, writes what is queued and closes the store.
+func (s *ChatServer) stopMessages() {
+	if s.messages == nil {
+		return
+	}
+	s.messageWritesMu.Lock()
+	s.messagesClosed = true
+	close(s.messageWrites)
+	s.messageWritesMu.Unlock()
+	<-s.messagesDone
+	s.messages.Close()
+}
+
+// storeMessage queues the logged message to be saved, if messages are stored.
+func (s *ChatServer) storeMessage(message Message) {
+	if s.messages == nil || message.Room != "" || message.Test {
+		return
+	}
+	if !s.queueStoreWrite(storeWrite{message: message, at: s.clock.Now()}) {
+		slog.Error("Could not store message", "id", message.ID, "err", errStoreClosed)
+	}
+}
+
+// unstoreMessage deletes the stored message id, once the writes queued before are done.
+func (s *ChatServer) unstoreMessage(id string) error {
+	result := make(chan error, 1)
+	if !s.queueStoreWrite(storeWrite{deleteID: id, result: result}) {
+		return errStoreClosed
+	}
+	return <-result
+}
+
+// pruneMessages deletes the stored messages older than MESSAGE_RETENTION, unless under legal hold.
+func (s *ChatServer) pruneMessages() {
+	if s.messages == nil || legalHold {
+		return
+	}
+	if _, err := s.messages.Prune(s.clock.Now().Add(-messageRetention)); err != nil {
+		slog.Error("Could not prune stored messages", "err", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStoredMessagesOutliveTheServer(t *testing.T) {
+	db := messageDB
+	messageDB = filepath.Join(t.TempDir(), "messages.db")
+	t.Cleanup(func() { messageDB = db })
+
+	s := NewChatServer(WithIDGenerator(sequentialIDs()))
+	if err := s.loadMessages(); err != nil {
+		t.Fatal(err)
+	}
+	kept := s.logEvent(Message{Kind: "text", Content: "kept"})
+	deleted := s.logEvent(Message{Kind: "text", Content: "deleted"})
+	s.logEvent(Message{Kind: "text", Content: "in a room", Room: "games"})
+	// The delete is queued behind the save of the message, so it can't come back.
+	if err := s.unstoreMessage(deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+	s.stopMessages()
+
+	restarted := NewChatServer()
+	if err := restarted.loadMessages(); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.stopMessages()
+	events, _ := restarted.eventsSince("")
+	if len(events) != 1 || events[0].ID != kept.ID || events[0].Content != "kept" {
+		t.Fatalf("after a restart the log holds %+v, want only %q", events, kept.Content)
+	}
+	next := restarted.logEvent(Message{Kind: "text", Content: "next"})
+	if next.Seq <= kept.Seq {
+		t.Errorf("next Seq %d, want it after the stored %d", next.Seq, kept.Seq)
+	}
+}
+
+func TestStoredMessagesWithoutTimestampGetOne(t *testing.T) {
+	store, err := openSQLiteStore(filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	storedAt := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	// As stored before messages had a Timestamp.
+	if _, err := store.db.Exec(`INSERT INTO messages (id, seq, stored_at, data) VALUES (?, ?, ?, ?)`,
+		"old", 1, storedAt.UnixNano(), `{"kind": "text", "content": "old", "id": "old", "seq": 1}`); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := store.Recent(1)
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("Recent: %v %+v", err, messages)
+	}
+	if !messages[0].Timestamp.Equal(storedAt) {
+		t.Errorf("Recent: timestamp %s, want when it was stored, %s", messages[0].Timestamp, storedAt)
+	}
+	message, ok, err := store.Get("old")
+	if err != nil || !ok || !message.Timestamp.Equal(storedAt) {
+		t.Errorf("Get: %v %t, timestamp %s, want %s", err, ok, message.Timestamp, storedAt)
+	}
+}
+
+func TestWritesQueuedWhileStoppingAreKept(t *testing.T) {
+	db := messageDB
+	messageDB = filepath.Join(t.TempDir(), "messages.db")
+	t.Cleanup(func() { messageDB = db })
+
+	s := NewChatServer()
+	if err := s.loadMessages(); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	queued := make([]int, 8)
+	for w := range queued {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				id := fmt.Sprintf("w%d-%d", w, i)
+				if !s.queueStoreWrite(storeWrite{message: Message{Kind: "text", ID: id, Seq: uint64(w*100000 + i + 1)}, at: s.clock.Now()}) {
+					return
+				}
+				queued[w]++
+			}
+		}(w)
+	}
+	time.Sleep(10 * time.Millisecond)
+	s.stopMessages()
+	wg.Wait()
+
+	total := 0
+	for _, n := range queued {
+		total += n
+	}
+	store, err := openSQLiteStore(messageDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	var stored int
+	if err := store.db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != total {
+		t.Errorf("%d writes stored, want the %d queued", stored, total)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// A relay edge about to go away, when scaling down say, can first move its clients elsewhere
+// without them noticing. /api/admin/drain sends every stream a private "migrate" event whose
+// Content is the /events URL to reconnect to, with the last logged event relayed before it as
+// since: edges keep the events they relay in their own log, so the edge reconnected to sends
+// those after it first. Streams connecting meanwhile are sent there right away, and every stream
+// is closed drainGrace later. The target is "target", or MIGRATE_TARGET, typically the load
+// balancer in front of the other edges. The primary can't be drained, since sessions only live
+// there.
+
+var migrateTarget = os.Getenv("MIGRATE_TARGET")
+
+// How long streams stay open after the migrate event, for clients that don't act on it.
+const drainGrace = 10 * time.Second
+
+var (
+	errInvalidMigrateTarget = errors.New("Invalid target: expected an http or https URL")
+	errNotEdge              = errors.New("Only relay edges can be drained, sessions live on the primary")
+)
+
+// migration returns where streams are sent, empty unless draining, and a channel closed once
+// they should be closed.
+func (s *ChatServer) migration() (string, chan struct{}) {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	return s.migrateTo, s.drained
+}
+
+// migrateURL returns the /events URL of target, resuming after since if set.
+func migrateURL(target, since string) string {
+	events := strings.TrimSuffix(target, "/") + "/events"
+	if since != "" {
+		events += "?since=" + url.QueryEscape(since)
+	}
+	return events
+}
+
+// drain sends every stream of the edge to target. Draining again only changes the target.
+func (s *ChatServer) drain(target string) error {
+	if relayUpstream == "" {
+		return errNotEdge
+	}
+	parsed, err := url.Parse(target)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errInvalidMigrateTarget
+	}
+
+	// No relayed event comes in between taking since and the migrate event.
+	s.broadcastMu.Lock()
+	defer s.broadcastMu.Unlock()
+	s.drainMu.Lock()
+	draining := s.migrateTo != ""
+	s.migrateTo = target
+	s.drainMu.Unlock()
+	if draining {
+		return nil
+	}
+
+	since := ""
+	s.eventLogMu.Lock()
+	if len(s.eventLog) > 0 {
+		since = s.eventLog[len(s.eventLog)-1].ID
+	}
+	s.eventLogMu.Unlock()
+	data, err := json.Marshal(s.stamp(Message{FromApp: true, Kind: "migrate", Private: true, Content: migrateURL(target, since)}))
+	if err != nil {
+		return err
+	}
+	s.broadcastRaw(string(data))
+	s.clock.AfterFunc(drainGrace, func() { close(s.drained) })
+	slog.Info("Draining streams", "target", target)
+	return nil
+}
+
+// handleAdminDrain drains the edge to "target", or MIGRATE_TARGET.
+func (s *ChatServer) handleAdminDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !adminTokenAuthorized(r) {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+
+	r.ParseForm()
+	target := r.FormValue("target")
+	if target == "" {
+		target = migrateTarget
+	}
+	switch err := s.drain(target); err {
+	case nil:
+		w.WriteHeader(http.StatusAccepted)
+	case errNotEdge:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
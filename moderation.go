@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// moderatorKey is the shared secret sessions present with ;mod to become moderators.
+// Moderator login is disabled when MODERATOR_KEY is not set.
+var moderatorKey = os.Getenv("MODERATOR_KEY")
+
+func (s *ChatServer) isModerator(sessionID string) bool {
+	return s.roleOf(sessionID) >= RoleModerator
+}
+
+func (s *ChatServer) handleModLogin(sessionID string, args []string) {
+	if len(args) != 1 {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Usage: ;mod &lt;key&gt;",
+		})
+		return
+	}
+
+	if moderatorKey == "" || subtle.ConstantTimeCompare([]byte(args[0]), []byte(moderatorKey)) != 1 {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Invalid moderator key",
+		})
+		return
+	}
+
+	s.rolesMu.Lock()
+	if s.roles[sessionID] < RoleModerator {
+		s.roles[sessionID] = RoleModerator
+		s.rolesVersion++
+	}
+	s.rolesMu.Unlock()
+
+	s.lobbyMu.Lock()
+	delete(s.lobbyPending, sessionID)
+	s.lobbyMu.Unlock()
+
+	s.audit(sessionID, "moderator.login", sessionID, "")
+	s.sendPrivateMessage(sessionID, Message{
+		Kind:    "text",
+		Content: "You are now a moderator",
+	})
+}
+
+// notifyModerators privately delivers message to every moderator currently connected.
+func (s *ChatServer) notifyModerators(message Message) {
+	s.rolesMu.Lock()
+	ids := make([]string, 0, len(s.roles))
+	for id, role := range s.roles {
+		if role >= RoleModerator {
+			ids = append(ids, id)
+		}
+	}
+	s.rolesMu.Unlock()
+
+	for _, id := range ids {
+		s.sendPrivateMessage(id, message)
+	}
+}
+
+// A session identifier is also the secret of the session's cookie, so whatever others see of a
+// session, the authors of messages, members, notices and the admin API, names it by a handle
+// instead: an HMAC of the identifier, with a key random per process. Commands and endpoints
+// taking a session accept handles, see findSession.
+var sessionHandleKey = newSessionHandleKey()
+
+func newSessionHandleKey() []byte {
+	key := make([]byte, 32)
+	if _, err := crand.Read(key); err != nil {
+		panic(fmt.Sprintf("could not generate the session handle key: %v", err))
+	}
+	return key
+}
+
+// sessionHandle returns the handle of sessionID.
+func sessionHandle(sessionID string) string {
+	mac := hmac.New(sha256.New, sessionHandleKey)
+	mac.Write([]byte(sessionID))
+	return "s-" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// findSession resolves a nickname, a session handle or a session identifier to a known session
+// identifier. It returns "" if none matches.
+func (s *ChatServer) findSession(nameOrID string) string {
+	s.nicknamesMu.Lock()
+	for id, nickname := range s.nicknames {
+		if nickname == nameOrID {
+			s.nicknamesMu.Unlock()
+			return id
+		}
+	}
+	s.nicknamesMu.Unlock()
+
+	s.sessionFirstSeenMu.Lock()
+	defer s.sessionFirstSeenMu.Unlock()
+	if _, ok := s.sessionFirstSeen[nameOrID]; ok {
+		return nameOrID
+	}
+	return s.sessionHandles[nameOrID]
+}
+
+// sessionOfHandle returns the session whose handle is handle, such as the Author.ID of a message,
+// or "" if it isn't known.
+func (s *ChatServer) sessionOfHandle(handle string) string {
+	s.sessionFirstSeenMu.Lock()
+	defer s.sessionFirstSeenMu.Unlock()
+	return s.sessionHandles[handle]
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// modLogEnabled turns on the public moderation log at /modlog/events (MOD_LOG=1).
+var modLogEnabled = os.Getenv("MOD_LOG") != ""
+
+// Number of moderation log entries replayed to a viewer when it connects.
+const modLogHistory = 100
+
+// logModAction records a moderation action in the public moderation log. text must already be
+// redacted: it is shown to anyone watching the log, so it should name the affected nickname at
+// most, never session identifiers, addresses or who the acting moderator was.
+func (s *ChatServer) logModAction(text string) {
+	if !modLogEnabled {
+		return
+	}
+
+	jsonData, err := json.Marshal(s.stamp(Message{
+		FromApp: true,
+		Kind:    "text",
+		Content: fmt.Sprintf("%s: %s", s.clock.Now().UTC().Format("2006-01-02 15:04"), text),
+	}))
+	if err != nil {
+		return
+	}
+	entry := string(jsonData)
+
+	s.modLogMu.Lock()
+	defer s.modLogMu.Unlock()
+	s.modLog = append(s.modLog, entry)
+	if len(s.modLog) > modLogHistory {
+		s.modLog = s.modLog[len(s.modLog)-modLogHistory:]
+	}
+	for _, ch := range s.modLogClients {
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+}
+
+// handleModLogEvents streams the moderation log, starting with the most recent entries.
+func (s *ChatServer) handleModLogEvents(w http.ResponseWriter, r *http.Request) {
+	if !modLogEnabled {
+		http.NotFound(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	id := s.newID()
+	ch := make(chan string, modLogHistory)
+
+	s.modLogMu.Lock()
+	for _, entry := range s.modLog {
+		ch <- entry
+	}
+	s.modLogClients[id] = ch
+	s.modLogMu.Unlock()
+
+	defer func() {
+		s.modLogMu.Lock()
+		delete(s.modLogClients, id)
+		s.modLogMu.Unlock()
+	}()
+
+	for {
+		select {
+		case entry := <-ch:
+			fmt.Fprintf(w, "data: %s\n\n", entry)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Members can mute a whole room with ;mute #room, or a person everywhere with ;mute <nickname>,
+// from whichever room they are in. A muted room stays joined, but nothing posted in it reaches
+// them, nor notifications about replies and reactions to their messages there. A muted person's
+// messages, reactions, whispers, replies and reactions to their messages are left out in every
+// room. Mutes are applied as events are routed to each stream, so muted events are still logged,
+// and read from /api/v1/events, where Seq jumps over them as it does for filtered kinds. They are
+// kept in the member's preferences, saved to PREFERENCES_FILE when set and loaded from it on start.
+
+var preferencesFile = os.Getenv("PREFERENCES_FILE")
+
+// Most rooms and people one member can mute.
+const maxMutes = 100
+
+var (
+	errUnknownMember = errors.New("No one goes by that nickname or session")
+	errMuteSelf      = errors.New("You can't mute yourself")
+	errTooManyMutes  = errors.New("Too many mutes: unmute some first")
+)
+
+type Preferences struct {
+	// Rooms muted, by name.
+	MutedRooms []string `json:"mutedRooms,omitempty"`
+	// People muted, by session identifier.
+	MutedSessions []string `json:"mutedSessions,omitempty"`
+	// How replies in followed threads come, "digest" or "never", empty for "instant". See
+	// threads.go.
+	Threads string `json:"threads,omitempty"`
+}
+
+func (p *Preferences) empty() bool {
+	return len(p.MutedRooms) == 0 && len(p.MutedSessions) == 0 && p.Threads == ""
+}
+
+// mutes reports whether the preferences leave out an event of authorID, empty for app messages,
+// posted in room, empty for the main room.
+func (p *Preferences) mutes(authorID, room string) bool {
+	return (authorID != "" && containsString(p.MutedSessions, authorID)) || (room != "" && containsString(p.MutedRooms, room))
+}
+
+// setMute mutes target, a #room or a nickname, for sessionID, or unmutes it, and returns what it
+// names.
+func (s *ChatServer) setMute(sessionID, target string, on bool) (string, error) {
+	var room, muted string
+	if strings.HasPrefix(target, "#") {
+		room = normalizeRoom(target)
+		if !roomNamePattern.MatchString(room) {
+			return "", errInvalidRoom
+		}
+		target = "#" + room
+	} else {
+		muted = s.findSession(target)
+		if muted == "" && on {
+			return "", errUnknownMember
+		}
+		// Someone who has lost their nickname since is unmuted by session identifier.
+		if muted == "" {
+			muted = target
+		}
+		if muted == sessionID {
+			return "", errMuteSelf
+		}
+	}
+
+	s.preferencesMu.Lock()
+	defer s.preferencesMu.Unlock()
+	preferences, ok := s.preferences[sessionID]
+	if !ok {
+		preferences = &Preferences{}
+		s.preferences[sessionID] = preferences
+	}
+	list := &preferences.MutedSessions
+	value := muted
+	if room != "" {
+		list, value = &preferences.MutedRooms, room
+	}
+	switch {
+	case on && !containsString(*list, value):
+		if len(preferences.MutedRooms)+len(preferences.MutedSessions) >= maxMutes {
+			return "", errTooManyMutes
+		}
+		*list = append(*list, value)
+	case !on:
+		*list = removeString(*list, value)
+	}
+	if preferences.empty() {
+		delete(s.preferences, sessionID)
+	}
+	s.persistPreferencesLocked()
+	return target, nil
+}
+
+func removeString(list []string, value string) []string {
+	kept := list[:0]
+	for _, item := range list {
+		if item != value {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// mutedBy returns the sessions that leave out events of authorID posted in room.
+func (s *ChatServer) mutedBy(authorID, room string) map[string]bool {
+	s.preferencesMu.Lock()
+	defer s.preferencesMu.Unlock()
+	var muted map[string]bool
+	for id, preferences := range s.preferences {
+		if preferences.mutes(authorID, room) {
+			if muted == nil {
+				muted = make(map[string]bool)
+			}
+			muted[id] = true
+		}
+	}
+	return muted
+}
+
+// mutes reports whether sessionID leaves out events of authorID posted in room.
+func (s *ChatServer) mutes(sessionID, authorID, room string) bool {
+	s.preferencesMu.Lock()
+	defer s.preferencesMu.Unlock()
+	preferences, ok := s.preferences[sessionID]
+	return ok && preferences.mutes(authorID, room)
+}
+
+// mutePreferences returns a copy of the preferences of every session that has any.
+func (s *ChatServer) mutePreferences() map[string]Preferences {
+	s.preferencesMu.Lock()
+	defer s.preferencesMu.Unlock()
+	copies := make(map[string]Preferences, len(s.preferences))
+	for id, preferences := range s.preferences {
+		copies[id] = Preferences{
+			MutedRooms:    append([]string(nil), preferences.MutedRooms...),
+			MutedSessions: append([]string(nil), preferences.MutedSessions...),
+			Threads:       preferences.Threads,
+		}
+	}
+	return copies
+}
+
+// withoutMuted returns the messages of a batch the preferences don't leave out, along with
+// their marks in keep, see sampleBatch.
+func (s *ChatServer) withoutMuted(messages []Message, keep []bool, preferences Preferences) ([]Message, []bool) {
+	var kept []Message
+	var keptMarks []bool
+	for i, message := range messages {
+		if message.Author == nil || message.FromApp || !preferences.mutes(s.sessionOfHandle(message.Author.ID), message.Room) {
+			kept = append(kept, message)
+			keptMarks = append(keptMarks, keep[i])
+		}
+	}
+	return kept, keptMarks
+}
+
+// persistPreferencesLocked writes the preferences to preferencesFile, if set.
+func (s *ChatServer) persistPreferencesLocked() {
+	if preferencesFile == "" {
+		return
+	}
+	if err := saveJSONFile(preferencesFile, s.preferences); err != nil {
+		slog.Error("Could not save preferences", "err", err)
+	}
+}
+
+// loadPreferences reads the preferences saved in preferencesFile, if it exists.
+func (s *ChatServer) loadPreferences() error {
+	if preferencesFile == "" {
+		return nil
+	}
+	var saved map[string]*Preferences
+	if err := loadJSONFile(preferencesFile, &saved); err != nil {
+		return fmt.Errorf("%s: %w", preferencesFile, err)
+	}
+	s.preferencesMu.Lock()
+	defer s.preferencesMu.Unlock()
+	for id, preferences := range saved {
+		s.preferences[id] = preferences
+	}
+	return nil
+}
+
+func (s *ChatServer) handleMuteCommand(sessionID, command string, args []string) {
+	reply := func(content string) {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: content})
+	}
+
+	if command == "mutes" {
+		preferences := s.mutePreferences()[sessionID]
+		var names []string
+		for _, room := range preferences.MutedRooms {
+			names = append(names, "#"+room)
+		}
+		for _, id := range preferences.MutedSessions {
+			if s.hasNickname(id) {
+				names = append(names, "["+escapeText(s.getNickname(id))+"]")
+			} else {
+				names = append(names, escapeText(id)+" (no nickname anymore)")
+			}
+		}
+		if len(names) == 0 {
+			reply("You haven't muted anything")
+			return
+		}
+		sort.Strings(names)
+		reply("Muted:<br>" + strings.Join(names, "<br>"))
+		return
+	}
+
+	// Given a duration, a moderator mute, see sanctions.go.
+	if command == "mute" && len(args) >= 2 && !strings.HasPrefix(args[0], "#") {
+		s.handleModMuteCommand(sessionID, args)
+		return
+	}
+	if len(args) != 1 || args[0] == "" {
+		reply(fmt.Sprintf("Usage: ;%s #&lt;room&gt;|&lt;nickname&gt;", command))
+		return
+	}
+	if command == "unmute" && s.isModerator(sessionID) && s.liftModMute(sessionID, s.findSession(args[0])) {
+		return
+	}
+	target, err := s.setMute(sessionID, args[0], command == "mute")
+	if err != nil {
+		reply(escapeText(err.Error()))
+		return
+	}
+	if command == "mute" {
+		where := " in every room"
+		if strings.HasPrefix(target, "#") {
+			where = ""
+		}
+		reply(fmt.Sprintf("Muted %s%s, ;unmute %s undoes it", escapeText(target), where, escapeText(target)))
+	} else {
+		reply(fmt.Sprintf("Unmuted %s", escapeText(target)))
+	}
+}
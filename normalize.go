@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Nicknames and messages, and whatever else members write for others to read (edits, snippets,
+// todos, timer labels, forms and their answers, component labels, appeals, bot descriptions),
+// are normalized as they come in, before being validated: composed to NFC so that the same name
+// typed two ways is the same name, without the invisible characters that let one look like
+// another or reverse the text after it (zero-width spaces, bidi controls, byte order marks), and
+// with runs of combining marks cut to maxCombiningMarks so that "zalgo" text can't spill over the
+// lines around it. Messages keep the zero-width joiner and non-joiner, which emoji sequences and
+// some scripts need; nicknames drop every format character.
+
+const maxCombiningMarks = 3
+
+// invisibleChars are the format characters dropped from messages.
+var invisibleChars = map[rune]bool{
+	'\u061c': true, // Arabic letter mark
+	'\u180e': true, // Mongolian vowel separator
+	'\u200b': true, // Zero-width space
+	'\u200e': true, // Left-to-right mark
+	'\u200f': true, // Right-to-left mark
+	'\u202a': true, // Bidi embeddings and overrides
+	'\u202b': true,
+	'\u202c': true,
+	'\u202d': true,
+	'\u202e': true,
+	'\u2060': true, // Word joiner and invisible operators
+	'\u2061': true,
+	'\u2062': true,
+	'\u2063': true,
+	'\u2064': true,
+	'\u2066': true, // Bidi isolates
+	'\u2067': true,
+	'\u2068': true,
+	'\u2069': true,
+	'\ufeff': true, // Byte order mark
+}
+
+// normalizeMessage returns text as it is sent, see above.
+func normalizeMessage(text string) string {
+	return normalizeText(text, func(r rune) bool { return invisibleChars[r] })
+}
+
+// normalizeNickname returns nickname as it is used, see above.
+func normalizeNickname(nickname string) string {
+	return normalizeText(nickname, func(r rune) bool { return unicode.Is(unicode.Cf, r) })
+}
+
+// normalizeText composes text, leaving out the runes drop reports and extra combining marks.
+func normalizeText(text string, drop func(rune) bool) string {
+	// Left for validation to refuse.
+	if !utf8.ValidString(text) {
+		return text
+	}
+	text = norm.NFC.String(text)
+	var out strings.Builder
+	out.Grow(len(text))
+	marks := 0
+	for _, r := range text {
+		if drop(r) {
+			continue
+		}
+		if unicode.In(r, unicode.Mn, unicode.Me) {
+			if marks++; marks > maxCombiningMarks {
+				continue
+			}
+		} else {
+			marks = 0
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"alantern/chattest"
+)
+
+func TestEntryPointsNormalize(t *testing.T) {
+	_, srv := newTestServer(t)
+	alice, bob := srv.Connect(), srv.Connect()
+	alice.SetNickname("alice")
+	bob.SetNickname("bob")
+	bob.Collect(settle)
+	reversed := "hello \u202edlrow"
+
+	for path, form := range map[string]url.Values{
+		"/api/v1/todos":    {"text": {reversed}},
+		"/api/v1/snippets": {"name": {"greeting"}, "content": {reversed}},
+		"/timers":          {"duration": {"1h"}, "label": {reversed}},
+	} {
+		status, body := alice.Do(http.MethodPost, path, form)
+		if status >= 300 {
+			t.Errorf("POST %s: %d %s", path, status, body)
+			continue
+		}
+		if strings.Contains(body, "\u202e") || strings.Contains(body, `\u202e`) {
+			t.Errorf("POST %s kept the bidi override: %s", path, body)
+		}
+	}
+
+	bob.Collect(settle)
+	message := postInteractive(t, alice, bob)
+	if status, body := alice.Do(http.MethodPost, "/api/v1/messages/update", url.Values{"id": {message.ID}, "content": {reversed}}); status != http.StatusNoContent {
+		t.Fatalf("edit: %d %s", status, body)
+	}
+	edit := bob.Expect(chattest.Kind("update"))[0]
+	if strings.Contains(edit.Content, "\u202e") {
+		t.Errorf("edit kept the bidi override: %q", edit.Content)
+	}
+}
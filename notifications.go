@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Messages can be replied to, by giving /send a "replyTo", and reacted to with /api/v1/reactions.
+// Their author then gets a private "notification" event, unless they replied to or reacted to
+// their own message. Notifications about the same message are batched for notificationDelay, so
+// a popular message makes one notification listing the first notificationNames people rather
+// than one per reply. Members who turn on do not disturb with ;dnd get theirs once they turn it
+// off, and those not connected when they go out get them on their next stream.
+
+const (
+	notificationDelay = 10 * time.Second
+	notificationNames = 3
+	// Most notifications held for a member with do not disturb on, the oldest dropped first.
+	maxHeldNotifications = 50
+	maxEmojiLength       = 32
+)
+
+var (
+	errUnknownMessage = errors.New("Message not found: it may be too old")
+	errInvalidEmoji   = errors.New("Invalid emoji: expected up to 32 bytes without spaces")
+)
+
+type Reaction struct {
+	// Identifier of the message reacted to.
+	MessageID string `json:"messageId"`
+	Emoji     string `json:"emoji"`
+	// How many members reacted to the message with Emoji, after this reaction.
+	Count int `json:"count"`
+}
+
+type Notification struct {
+	// "reply" or "reaction".
+	Kind string `json:"kind"`
+	// Identifier of the recipient's message that was replied or reacted to.
+	MessageID string `json:"messageId"`
+	// Nicknames of the first notificationNames who replied or reacted, and how many did in all.
+	From  []string `json:"from"`
+	Count int      `json:"count"`
+	// Emoji used, for reactions.
+	Emoji []string `json:"emoji,omitempty"`
+
+	recipient string
+	senders   map[string]bool
+}
+
+func (s *ChatServer) initNotifications() {
+	s.reactions = make(map[string]map[string]map[string]bool)
+	s.pendingNotifications = make(map[string]*Notification)
+	s.doNotDisturb = make(map[string]bool)
+	s.heldNotifications = make(map[string][]Notification)
+}
+
+// findMessage returns the logged message with identifier id, from the event log or a room's log.
+func (s *ChatServer) findMessage(id string) (Message, bool) {
+	if id == "" {
+		return Message{}, false
+	}
+	s.eventLogMu.Lock()
+	for i := len(s.eventLog) - 1; i >= 0; i-- {
+		if s.eventLog[i].ID == id {
+			message := s.eventLog[i]
+			s.eventLogMu.Unlock()
+			return message, true
+		}
+	}
+	s.eventLogMu.Unlock()
+
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	for _, room := range s.rooms {
+		for i := len(room.log) - 1; i >= 0; i-- {
+			if room.log[i].ID == id {
+				return room.log[i], true
+			}
+		}
+	}
+	return Message{}, false
+}
+
+// notify lets the author of message know that sessionID replied or reacted to it.
+func (s *ChatServer) notify(kind string, message Message, sessionID, emoji string) {
+	if message.Author == nil || message.FromApp || message.Author.ID == sessionHandle(sessionID) {
+		return
+	}
+	recipient := s.sessionOfHandle(message.Author.ID)
+	if s.mutes(recipient, sessionID, message.Room) {
+		return
+	}
+	key := recipient + "\n" + kind + "\n" + message.ID
+
+	s.notificationsMu.Lock()
+	defer s.notificationsMu.Unlock()
+	notification, ok := s.pendingNotifications[key]
+	if !ok {
+		notification = &Notification{Kind: kind, MessageID: message.ID, recipient: recipient, senders: make(map[string]bool)}
+		s.pendingNotifications[key] = notification
+		s.clock.AfterFunc(notificationDelay, func() { s.sendNotification(key) })
+	}
+	notification.Count++
+	if !notification.senders[sessionID] {
+		notification.senders[sessionID] = true
+		if len(notification.From) < notificationNames {
+			notification.From = append(notification.From, s.getNickname(sessionID))
+		}
+	}
+	if emoji != "" && !containsString(notification.Emoji, emoji) {
+		notification.Emoji = append(notification.Emoji, emoji)
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// sendNotification sends the batched notification key, or holds it if its recipient doesn't want
+// to be disturbed.
+func (s *ChatServer) sendNotification(key string) {
+	s.notificationsMu.Lock()
+	notification, ok := s.pendingNotifications[key]
+	delete(s.pendingNotifications, key)
+	if !ok {
+		s.notificationsMu.Unlock()
+		return
+	}
+	if s.doNotDisturb[notification.recipient] {
+		held := append(s.heldNotifications[notification.recipient], *notification)
+		if len(held) > maxHeldNotifications {
+			held = held[len(held)-maxHeldNotifications:]
+		}
+		s.heldNotifications[notification.recipient] = held
+		s.notificationsMu.Unlock()
+		return
+	}
+	s.notificationsMu.Unlock()
+	s.queueNotice(notification.recipient, notificationMessage(*notification))
+}
+
+func notificationMessage(notification Notification) Message {
+	names := make([]string, len(notification.From))
+	for i, name := range notification.From {
+		names[i] = "[" + escapeText(name) + "]"
+	}
+	who := strings.Join(names, ", ")
+	if others := len(notification.senders) - len(notification.From); others > 0 {
+		who += fmt.Sprintf(" and %d more", others)
+	}
+	content := who + " replied to your message"
+	if notification.Kind == "reaction" {
+		content = fmt.Sprintf("%s reacted %s to your message", who, escapeText(strings.Join(notification.Emoji, " ")))
+	}
+	return Message{Kind: "notification", Content: content, Notification: &notification}
+}
+
+// setDoNotDisturb turns do not disturb on or off for sessionID. Turning it off sends what was held.
+func (s *ChatServer) setDoNotDisturb(sessionID string, on bool) int {
+	s.notificationsMu.Lock()
+	held := s.heldNotifications[sessionID]
+	if on {
+		s.doNotDisturb[sessionID] = true
+		s.notificationsMu.Unlock()
+		return len(held)
+	}
+	delete(s.doNotDisturb, sessionID)
+	delete(s.heldNotifications, sessionID)
+	s.notificationsMu.Unlock()
+
+	for _, notification := range held {
+		s.queueNotice(sessionID, notificationMessage(notification))
+	}
+	return len(held)
+}
+
+func (s *ChatServer) handleDNDCommand(sessionID string, args []string) {
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Usage: ;dnd on|off"})
+		return
+	}
+	held := s.setDoNotDisturb(sessionID, args[0] == "on")
+	content := "Do not disturb is on: notifications about replies and reactions wait until ;dnd off"
+	if args[0] == "off" {
+		content = fmt.Sprintf("Do not disturb is off, %d held notifications sent", held)
+	}
+	s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: content})
+}
+
+func validateEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) {
+		return errInvalidEmoji
+	}
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return errInvalidEmoji
+		}
+	}
+	return nil
+}
+
+// react adds the reaction of sessionID with emoji to the message id, or takes it back if it was
+// there, and broadcasts the new count where the message was posted. The reactions of shadow muted
+// sessions aren't counted: they alone see them, as if they were.
+func (s *ChatServer) react(sessionID, id, emoji string) (Reaction, error) {
+	if err := validateEmoji(emoji); err != nil {
+		return Reaction{}, err
+	}
+	message, ok := s.findMessage(id)
+	if !ok || message.Author == nil || (message.Kind != "text" && message.Kind != "image") {
+		return Reaction{}, errUnknownMessage
+	}
+	if !s.inRoom(sessionID, message.Room) {
+		return Reaction{}, errNotInRoom
+	}
+	if s.shadowMuted(sessionID) {
+		reaction := Reaction{MessageID: id, Emoji: emoji, Count: s.reactionCounts(id)[emoji] + 1}
+		s.echoShadowMuted(message.Room, Message{Kind: "reaction", Content: escapeText(emoji), Author: s.authorOf(sessionID), Reaction: &reaction})
+		return reaction, nil
+	}
+
+	s.notificationsMu.Lock()
+	byEmoji, ok := s.reactions[id]
+	if !ok {
+		byEmoji = make(map[string]map[string]bool)
+		s.reactions[id] = byEmoji
+	}
+	if byEmoji[emoji] == nil {
+		byEmoji[emoji] = make(map[string]bool)
+	}
+	added := !byEmoji[emoji][sessionID]
+	if added {
+		byEmoji[emoji][sessionID] = true
+	} else {
+		delete(byEmoji[emoji], sessionID)
+	}
+	reaction := Reaction{MessageID: id, Emoji: emoji, Count: len(byEmoji[emoji])}
+	if reaction.Count == 0 {
+		delete(byEmoji, emoji)
+	}
+	s.notificationsMu.Unlock()
+
+	event := Message{Kind: "reaction", Content: escapeText(emoji), Author: s.authorOf(sessionID), Reaction: &reaction}
+	if message.Room != "" {
+		if _, err := s.broadcastToRoom(message.Room, event); err != nil {
+			return reaction, err
+		}
+	} else {
+		s.broadcastMessage(event)
+	}
+	if added {
+		s.notify("reaction", message, sessionID, emoji)
+		s.recordReaction(emoji)
+	}
+	return reaction, nil
+}
+
+// reactionCounts returns the reaction counts of the message id, by emoji.
+func (s *ChatServer) reactionCounts(id string) map[string]int {
+	s.notificationsMu.Lock()
+	defer s.notificationsMu.Unlock()
+	counts := make(map[string]int, len(s.reactions[id]))
+	for emoji, sessions := range s.reactions[id] {
+		counts[emoji] = len(sessions)
+	}
+	return counts
+}
+
+// expireReactions forgets the reactions to messages no longer logged.
+func (s *ChatServer) expireReactions() {
+	s.notificationsMu.Lock()
+	ids := make([]string, 0, len(s.reactions))
+	for id := range s.reactions {
+		ids = append(ids, id)
+	}
+	s.notificationsMu.Unlock()
+
+	for _, id := range ids {
+		if _, ok := s.findMessage(id); !ok {
+			s.notificationsMu.Lock()
+			delete(s.reactions, id)
+			s.notificationsMu.Unlock()
+		}
+	}
+}
+
+// handleReactions returns the reaction counts of the message "id" (GET), or toggles the session's
+// reaction "emoji" to it (POST).
+func (s *ChatServer) handleReactions(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		id := r.URL.Query().Get("id")
+		message, ok := s.findMessage(id)
+		if !ok || !s.inRoom(sessionID, message.Room) {
+			http.Error(w, errUnknownMessage.Error(), http.StatusNotFound)
+			return
+		}
+		counts := s.reactionCounts(id)
+		reactions := make([]Reaction, 0, len(counts))
+		for emoji, count := range counts {
+			reactions = append(reactions, Reaction{MessageID: id, Emoji: emoji, Count: count})
+		}
+		sort.Slice(reactions, func(i, j int) bool { return reactions[i].Emoji < reactions[j].Emoji })
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reactions)
+
+	case http.MethodPost:
+		// Reactions are posts too, held to the restrictions and limits of messages, besides slow
+		// mode, which paces what is said.
+		if s.inLobby(sessionID) {
+			http.Error(w, errInLobby.Error(), http.StatusForbidden)
+			return
+		}
+		restriction := s.muteRestriction(sessionID)
+		if restriction == "" {
+			restriction = s.raidRestriction(sessionID)
+		}
+		if restriction != "" {
+			http.Error(w, restriction, http.StatusForbidden)
+			return
+		}
+		if s.overRateLimit(r, sessionID, s.clock.Now()) {
+			http.Error(w, "Too many messages, wait before reacting", http.StatusTooManyRequests)
+			return
+		}
+
+		r.ParseForm()
+		reaction, err := s.react(sessionID, r.FormValue("id"), r.FormValue("emoji"))
+		switch err {
+		case nil:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(reaction)
+		case errInvalidEmoji:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case errNotInRoom:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
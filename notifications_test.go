@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"alantern/chattest"
+)
+
+func TestReactionsAreHeldToPostRestrictions(t *testing.T) {
+	s, srv := newTestServer(t, WithMessageLimiter(newTokenBucketLimiter(0.001, 2)))
+	alice, bob := srv.Connect(), srv.Connect()
+	alice.SetNickname("alice")
+	bob.SetNickname("bob")
+	alice.Collect(settle)
+	bob.Send("react to this")
+	message := alice.Expect(chattest.Text("react to this"))[0]
+	bob.Collect(settle)
+	react := url.Values{"id": {message.ID}, "emoji": {"👍"}}
+	aliceID := s.findSession("alice")
+
+	s.modMutesMu.Lock()
+	s.modMutes[aliceID] = s.clock.Now().Add(time.Hour)
+	s.modMutesMu.Unlock()
+	if status, body := alice.Do(http.MethodPost, "/api/v1/reactions", react); status != http.StatusForbidden {
+		t.Fatalf("muted reaction: %d %s, want 403", status, body)
+	}
+	bob.ExpectNone(settle)
+
+	s.modMutesMu.Lock()
+	delete(s.modMutes, aliceID)
+	s.shadowMutes[aliceID] = time.Time{}
+	s.modMutesMu.Unlock()
+	if status, body := alice.Do(http.MethodPost, "/api/v1/reactions", react); status != http.StatusOK {
+		t.Fatalf("shadow muted reaction: %d %s, want 200", status, body)
+	}
+	alice.Expect(chattest.Kind("reaction"))
+	bob.ExpectNone(settle)
+	if counts := s.reactionCounts(message.ID); len(counts) != 0 {
+		t.Errorf("a shadow muted reaction was counted: %v", counts)
+	}
+
+	s.modMutesMu.Lock()
+	delete(s.shadowMutes, aliceID)
+	s.modMutesMu.Unlock()
+	if status, body := alice.Do(http.MethodPost, "/api/v1/reactions", react); status != http.StatusOK {
+		t.Fatalf("reaction: %d %s, want 200", status, body)
+	}
+	bob.Expect(chattest.Kind("reaction"))
+	// The bucket of two held the shadow muted reaction and this one.
+	if status, body := alice.Do(http.MethodPost, "/api/v1/reactions", react); status != http.StatusTooManyRequests {
+		t.Fatalf("reaction over the rate limit: %d %s, want 429", status, body)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The OpenAPI document is maintained by hand, so these tests hold it to the handlers: every route
+// is documented and every documented path is routed, and what the endpoints answer matches the
+// schemas it gives.
+
+type openAPIDoc struct {
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	Responses map[string]struct {
+		Content map[string]struct {
+			Schema *schema `json:"schema"`
+		} `json:"content"`
+	} `json:"responses"`
+}
+
+// schema is the part of an OpenAPI schema the tests check.
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Required             []string           `json:"required"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	Enum                 []interface{}      `json:"enum"`
+	OneOf                []*schema          `json:"oneOf"`
+	Nullable             bool               `json:"nullable"`
+}
+
+func loadOpenAPI(t *testing.T) *openAPIDoc {
+	t.Helper()
+	var doc openAPIDoc
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatalf("openapi.json: %v", err)
+	}
+	return &doc
+}
+
+// validate returns where value doesn't match sch, or nil.
+func (doc *openAPIDoc) validate(path string, value interface{}, sch *schema) []string {
+	if sch == nil {
+		return nil
+	}
+	if sch.Ref != "" {
+		name := strings.TrimPrefix(sch.Ref, "#/components/schemas/")
+		ref, ok := doc.Components.Schemas[name]
+		if !ok {
+			return []string{fmt.Sprintf("%s: unknown schema %s", path, sch.Ref)}
+		}
+		return doc.validate(path, value, ref)
+	}
+	if value == nil {
+		if sch.Nullable || sch.Type == "" {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s: null, want %s", path, sch.Type)}
+	}
+	if len(sch.OneOf) > 0 {
+		for _, option := range sch.OneOf {
+			if doc.validate(path, value, option) == nil {
+				return nil
+			}
+		}
+		return []string{fmt.Sprintf("%s: matches none of oneOf", path)}
+	}
+	if len(sch.Enum) > 0 {
+		found := false
+		for _, allowed := range sch.Enum {
+			found = found || allowed == value
+		}
+		if !found {
+			return []string{fmt.Sprintf("%s: %v isn't one of %v", path, value, sch.Enum)}
+		}
+	}
+
+	var problems []string
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if sch.Type != "object" && sch.Type != "" {
+			return []string{fmt.Sprintf("%s: object, want %s", path, sch.Type)}
+		}
+		for _, name := range sch.Required {
+			if _, ok := v[name]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing required %q", path, name))
+			}
+		}
+		var extra *schema
+		if len(sch.AdditionalProperties) > 0 && string(sch.AdditionalProperties) != "false" && string(sch.AdditionalProperties) != "true" {
+			extra = new(schema)
+			json.Unmarshal(sch.AdditionalProperties, extra)
+		}
+		for name, field := range v {
+			property, ok := sch.Properties[name]
+			switch {
+			case ok:
+				problems = append(problems, doc.validate(path+"."+name, field, property)...)
+			case extra != nil:
+				problems = append(problems, doc.validate(path+"."+name, field, extra)...)
+			case sch.Properties != nil && string(sch.AdditionalProperties) != "true":
+				problems = append(problems, fmt.Sprintf("%s: undocumented property %q", path, name))
+			}
+		}
+	case []interface{}:
+		if sch.Type != "array" && sch.Type != "" {
+			return []string{fmt.Sprintf("%s: array, want %s", path, sch.Type)}
+		}
+		for i, item := range v {
+			problems = append(problems, doc.validate(fmt.Sprintf("%s[%d]", path, i), item, sch.Items)...)
+		}
+	case string:
+		if sch.Type != "string" && sch.Type != "" {
+			problems = append(problems, fmt.Sprintf("%s: string, want %s", path, sch.Type))
+		}
+	case bool:
+		if sch.Type != "boolean" && sch.Type != "" {
+			problems = append(problems, fmt.Sprintf("%s: boolean, want %s", path, sch.Type))
+		}
+	case float64:
+		if sch.Type == "integer" && v != float64(int64(v)) || sch.Type != "integer" && sch.Type != "number" && sch.Type != "" {
+			problems = append(problems, fmt.Sprintf("%s: number %v, want %s", path, v, sch.Type))
+		}
+	}
+	return problems
+}
+
+// handlerRoutes returns the patterns Handler registers, from its source.
+func handlerRoutes(t *testing.T) []string {
+	t.Helper()
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	var routes []string
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Name.Name != "Handler" || fn.Recv == nil {
+				continue
+			}
+			ast.Inspect(fn.Body, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok || len(call.Args) == 0 {
+					return true
+				}
+				sel, ok := call.Fun.(*ast.SelectorExpr)
+				if !ok || (sel.Sel.Name != "HandleFunc" && sel.Sel.Name != "Handle") {
+					return true
+				}
+				if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+					route, _ := strconv.Unquote(lit.Value)
+					routes = append(routes, route)
+				}
+				return true
+			})
+		}
+	}
+	if len(routes) == 0 {
+		t.Fatal("found no routes in Handler")
+	}
+	return routes
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	doc := loadOpenAPI(t)
+	documented := make(map[string]bool)
+	for path := range doc.Paths {
+		// Patterns ending in / route every path under them, such as /image/{id}.
+		if i := strings.Index(path, "{"); i >= 0 {
+			path = path[:i]
+		}
+		documented[path] = true
+	}
+	routed := make(map[string]bool)
+	for _, route := range handlerRoutes(t) {
+		routed[route] = true
+		// "/" serves the chat page, which isn't part of the API.
+		if route != "/" && !documented[route] {
+			t.Errorf("%s is routed but not in openapi.json", route)
+		}
+	}
+	var missing []string
+	for path := range documented {
+		if !routed[path] {
+			missing = append(missing, path)
+		}
+	}
+	sort.Strings(missing)
+	for _, path := range missing {
+		t.Errorf("%s is in openapi.json but not routed", path)
+	}
+}
+
+func TestOpenAPIServed(t *testing.T) {
+	_, srv := newTestServer(t)
+	resp, err := http.Get(srv.URL + "/api/spec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("/api/spec: %s, %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	if string(body) != string(openAPISpec) {
+		t.Fatal("/api/spec isn't openapi.json")
+	}
+}
+
+func TestOpenAPIResponsesMatchSchemas(t *testing.T) {
+	doc := loadOpenAPI(t)
+	_, srv := newTestServer(t)
+	alice := srv.Connect()
+	alice.SetNickname("alice")
+	bob := srv.Connect()
+	bob.SetNickname("bob")
+	alice.Send("hello @bob, see https://example.com")
+	bob.Send(";todo add write the tests")
+	bob.Send(";snippet save greeting hi there")
+	alice.Send(";room create games")
+	alice.Collect(settle)
+
+	for _, path := range []string{"/api/v1/events", "/api/v1/events?limit=1", "/members", "/pins", "/presence", "/api/v1/todos",
+		"/api/v1/rooms", "/api/v1/snippets", "/timers", "/calendar", "/sync", "/api/v1/activity"} {
+		status, body := alice.Do(http.MethodGet, path, nil)
+		if status != http.StatusOK {
+			t.Errorf("GET %s: %d %s", path, status, strings.TrimSpace(body))
+			continue
+		}
+		operation, ok := doc.Paths[strings.SplitN(path, "?", 2)[0]]["get"]
+		if !ok {
+			t.Errorf("GET %s isn't in openapi.json", path)
+			continue
+		}
+		content, ok := operation.Responses["200"].Content["application/json"]
+		if !ok {
+			t.Errorf("GET %s: openapi.json gives no JSON 200 response", path)
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(body), &value); err != nil {
+			t.Errorf("GET %s: %v", path, err)
+			continue
+		}
+		for _, problem := range doc.validate(path, value, content.Schema) {
+			t.Error(problem)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// "alantern user" and "alantern room" manage the server running on this host from a shell, for
+// scripts: they make the requests through its control socket, see ctl.go, so they need neither
+// ADMIN_TOKEN nor the admin API. "alantern snapshot" (see snapshot.go) makes its admin API
+// request with ADMIN_TOKEN, to the server on this host unless given -server.
+
+// How long the server has to answer.
+const opsTimeout = 10 * time.Second
+
+var errNoAdminToken = errors.New("ADMIN_TOKEN is not set, give it with -token")
+
+const userUsage = `Usage: alantern user <action> [flags] [arguments]
+
+Actions:
+  list                         list the sessions, most recently seen first
+  rename <session> <nickname>  change the nickname of a session
+  kick <session> [reason]      disconnect a session for a while
+  ban <session>                ban a session, -duration and -reason optional
+  unban <session identifier>   lift the ban of a session
+
+Sessions can be given by nickname. Every action takes -data-dir or -socket, to find the
+control socket of the server.
+`
+
+const roomUsage = `Usage: alantern room <action> [flags] [arguments]
+
+Actions:
+  list                     list every room, unlisted ones too
+  post <room> <message>    post a message in a room, as the app
+  announce <message>       post a message in the main room, as the app
+
+Every action takes -data-dir or -socket, to find the control socket of the server.
+`
+
+type adminClient struct {
+	server, token string
+}
+
+// adminFlags adds the flags saying which server to manage to flags.
+func adminFlags(flags *flag.FlagSet) *adminClient {
+	client := &adminClient{}
+	flags.StringVar(&client.server, "server", localServer(), "URL of the server")
+	flags.StringVar(&client.token, "token", adminToken, "admin token ($ADMIN_TOKEN)")
+	return client
+}
+
+// localServer returns the URL of the server on this host, as its settings have it serve.
+func localServer() string {
+	host := bindAddress
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	// Let's Encrypt certificates are only valid for the hosts they are for.
+	if autocertHosts != "" {
+		host, _, _ = strings.Cut(autocertHosts, ",")
+		host = strings.TrimSpace(host)
+	}
+	return scheme() + "://" + net.JoinHostPort(host, port)
+}
+
+// do makes the admin request, posting form unless it is nil, and decodes the answer into v
+// unless it is nil.
+func (c *adminClient) do(path string, form url.Values, v interface{}) error {
+	resp, err := c.request(path, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// request makes the admin request, posting form unless it is nil, and returns the answer if it
+// is a success.
+func (c *adminClient) request(path string, form url.Values) (*http.Response, error) {
+	if c.token == "" {
+		return nil, errNoAdminToken
+	}
+	method, body := http.MethodGet, io.Reader(nil)
+	if form != nil {
+		method, body = http.MethodPost, strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(c.server, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	resp, err := (&http.Client{Timeout: opsTimeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// opsAction splits args into the action and its own, printing usage if there is none.
+func opsAction(args []string, usage string) (string, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") || args[0] == "help" {
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+	return args[0], args[1:]
+}
+
+// opsDone exits with err, if any, or else prints done.
+func opsDone(err error, done string) {
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if done != "" {
+		fmt.Println(done)
+	}
+}
+
+func user(args []string) {
+	action, args := opsAction(args, userUsage)
+	flags := flag.NewFlagSet("user "+action, flag.ExitOnError)
+	useFlags := controlFlags(flags)
+	var duration, reason *string
+	if action == "ban" {
+		duration = flags.String("duration", "", "how long the ban lasts, such as 24h, for good unless set")
+		reason = flags.String("reason", "", "why, for the ban list")
+	}
+	flags.Parse(args)
+	useFlags()
+	args = flags.Args()
+
+	switch {
+	case action == "list" && len(args) == 0:
+		var sessions []struct {
+			ID        string    `json:"id"`
+			Nickname  string    `json:"nickname"`
+			Role      string    `json:"role"`
+			Connected bool      `json:"connected"`
+			Banned    bool      `json:"banned"`
+			Room      string    `json:"room"`
+			LastSeen  time.Time `json:"lastSeen"`
+		}
+		opsDone(callControlSocket("sessions", nil, &sessions), "")
+		table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "SESSION\tNICKNAME\tROLE\tCONNECTED\tBANNED\tROOM\tLAST SEEN")
+		for _, session := range sessions {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%t\t%t\t%s\t%s\n", session.ID, session.Nickname, session.Role,
+				session.Connected, session.Banned, session.Room, session.LastSeen.Format(time.RFC3339))
+		}
+		table.Flush()
+	case action == "rename" && len(args) == 2:
+		opsDone(callControlSocket("rename", map[string]string{"session": args[0], "nickname": args[1]}, nil), "Renamed")
+	case action == "kick" && len(args) >= 1:
+		params := map[string]string{"session": args[0], "reason": strings.Join(args[1:], " ")}
+		opsDone(callControlSocket("kick", params, nil), "Kicked")
+	case action == "ban" && len(args) == 1:
+		params := map[string]string{"session": args[0], "duration": *duration, "reason": *reason}
+		opsDone(callControlSocket("ban", params, nil), "Banned")
+	case action == "unban" && len(args) == 1:
+		opsDone(callControlSocket("unban", map[string]string{"session": args[0]}, nil), "Unbanned")
+	default:
+		fmt.Print(userUsage)
+		os.Exit(2)
+	}
+}
+
+func room(args []string) {
+	action, args := opsAction(args, roomUsage)
+	flags := flag.NewFlagSet("room "+action, flag.ExitOnError)
+	useFlags := controlFlags(flags)
+	flags.Parse(args)
+	useFlags()
+	args = flags.Args()
+
+	switch {
+	case action == "list" && len(args) == 0:
+		var rooms []Room
+		opsDone(callControlSocket("rooms", nil, &rooms), "")
+		table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "ROOM\tMEMBERS\tCATEGORY\tUNLISTED\tCREATED")
+		for _, room := range rooms {
+			fmt.Fprintf(table, "%s\t%d\t%s\t%t\t%s\n", room.Name, room.Members, room.Category, room.Unlisted, room.CreatedAt.Format(time.RFC3339))
+		}
+		table.Flush()
+	case action == "post" && len(args) >= 2:
+		params := map[string]string{"room": args[0], "message": strings.Join(args[1:], " ")}
+		opsDone(callControlSocket("announce", params, nil), "Posted")
+	case action == "announce" && len(args) >= 1:
+		opsDone(callControlSocket("announce", map[string]string{"message": strings.Join(args, " ")}, nil), "Posted")
+	default:
+		fmt.Print(roomUsage)
+		os.Exit(2)
+	}
+}
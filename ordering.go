@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Public broadcasts are totally ordered. broadcastMessage holds broadcastMu while logEvent numbers
+// the event with the next Seq and while it is queued for every client, so each client gets events
+// in Seq order. The exception is messages coalesced by livestream mode: they arrive in their
+// batch, after the events sent meanwhile. Messages of other rooms than the main room are ordered
+// and numbered by room, see broadcastToRoom.
+//
+// A client whose queue is full when an event is sent misses it. It then gets a private "gap"
+// event, as soon as its queue has room again, with the range of logged events it missed, to fetch
+// from /api/v1/events since the last event it got before the gap. Seq also jumps over events its
+// kind filter left out.
+//
+// Client queues hold CLIENT_BUFFER events. With SLOW_CLIENT_POLICY=disconnect, a /events stream
+// whose queue is full is closed instead, so a stalled client doesn't keep missing events while
+// it looks connected: it gets a last private message telling it to reconnect and catch up.
+// Events dropped and streams closed either way are counted in /metrics.
+
+const defaultClientBuffer = 256
+
+var (
+	// Events queued for a client before further ones are dropped for it.
+	clientBuffer = loadPositiveInt("CLIENT_BUFFER", defaultClientBuffer)
+	// Whether streams whose queue is full are closed, rather than told what they missed later.
+	evictSlowClients = os.Getenv("SLOW_CLIENT_POLICY") == "disconnect"
+)
+
+// How often clients that missed events are told about it, if no other event came in meanwhile.
+const gapNoticeInterval = time.Second
+
+// Gap is a run of events a client missed.
+type Gap struct {
+	// Identifiers and Seq of the first and last logged events of the main room missed. Empty if
+	// only other events, like private messages, were missed. Only Seq is set for events no
+	// longer logged, see catchUp.
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	FromSeq uint64 `json:"fromSeq,omitempty"`
+	ToSeq   uint64 `json:"toSeq,omitempty"`
+	// Events missed, logged or not.
+	Dropped int `json:"dropped"`
+}
+
+// add records the encoded event data as missed.
+func (g *Gap) add(data string) {
+	g.Dropped++
+	type logged struct {
+		ID   string `json:"id"`
+		Seq  uint64 `json:"seq"`
+		Room string `json:"room"`
+	}
+	var event struct {
+		logged
+		Messages []logged `json:"messages"`
+	}
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return
+	}
+	for _, message := range append([]logged{event.logged}, event.Messages...) {
+		if message.Seq == 0 || message.Room != "" {
+			continue
+		}
+		if g.FromSeq == 0 {
+			g.From, g.FromSeq = message.ID, message.Seq
+		}
+		g.To, g.ToSeq = message.ID, message.Seq
+	}
+}
+
+func queue(ch chan string, data string) bool {
+	select {
+	case ch <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// queueGapLocked queues the gap event of ch, if it missed events, and reports whether ch is
+// caught up.
+func (s *ChatServer) queueGapLocked(ch chan string) bool {
+	gap, ok := s.gaps[ch]
+	if !ok {
+		return true
+	}
+	data, err := json.Marshal(s.stamp(Message{FromApp: true, Kind: "gap", Private: true, Gap: gap}))
+	if err != nil || !queue(ch, string(data)) {
+		return false
+	}
+	delete(s.gaps, ch)
+	return true
+}
+
+// deliver queues data on ch after any gap event it is owed, or records it as missed if ch is full
+// rather than hold up every other client. It reports whether data was queued.
+func (s *ChatServer) deliver(ch chan string, data string) bool {
+	s.gapsMu.Lock()
+	defer s.gapsMu.Unlock()
+	if s.queueGapLocked(ch) && queue(ch, data) {
+		return true
+	}
+	s.dropped++
+	if evict, ok := s.evictions[ch]; ok {
+		close(evict)
+		delete(s.evictions, ch)
+		delete(s.gaps, ch)
+		s.evicted++
+		return false
+	}
+	gap, ok := s.gaps[ch]
+	if !ok {
+		gap = &Gap{}
+		s.gaps[ch] = gap
+	}
+	gap.add(data)
+	return false
+}
+
+// watchEviction returns a channel closed once the stream ch is evicted for a full queue, which
+// is never unless SLOW_CLIENT_POLICY is disconnect.
+func (s *ChatServer) watchEviction(ch chan string) <-chan struct{} {
+	if !evictSlowClients {
+		return nil
+	}
+	evict := make(chan struct{})
+	s.gapsMu.Lock()
+	s.evictions[ch] = evict
+	s.gapsMu.Unlock()
+	return evict
+}
+
+// forgetEviction stops watching the stream ch, once it ends.
+func (s *ChatServer) forgetEviction(ch chan string) {
+	s.gapsMu.Lock()
+	delete(s.evictions, ch)
+	s.gapsMu.Unlock()
+}
+
+// evictedMessage is the last one written to a stream evicted for a full queue.
+func (s *ChatServer) evictedMessage() string {
+	data, _ := json.Marshal(s.stamp(Message{FromApp: true, Kind: "text", Private: true, Content: "You fell too far behind and were disconnected: reconnect to catch up"}))
+	return string(data)
+}
+
+// notifyGaps queues the gap events clients are owed, and forgets those of disconnected clients.
+func (s *ChatServer) notifyGaps() {
+	connected := make(map[chan string]bool)
+	// Within the hub, so no client connects or disconnects until the gaps are queued.
+	s.hub.read(func(clients map[string]chan string) {
+		for _, ch := range clients {
+			connected[ch] = true
+		}
+		s.gapsMu.Lock()
+		defer s.gapsMu.Unlock()
+		for ch := range s.gaps {
+			if !connected[ch] {
+				delete(s.gaps, ch)
+				continue
+			}
+			s.queueGapLocked(ch)
+		}
+	})
+}
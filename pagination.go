@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// List endpoints are paginated the same way: they take an optional limit (default
+// defaultPageLimit, at most maxPageLimit) and the opaque cursor returned as next by the previous
+// page, and answer {"items": [...], "next": "..."}. next is absent on the last page.
+//
+// Every item has a unique sort key and a cursor holds the key of the last item returned, so
+// getting the next page continues right after it even if items were added or removed meanwhile:
+// an item is never returned twice, and only items inserted before the cursor are skipped.
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+var errInvalidPage = errors.New("Invalid cursor or limit")
+
+type Page[T any] struct {
+	Items []T    `json:"items"`
+	Next  string `json:"next,omitempty"`
+}
+
+// timeKey builds a sort key ordering by time, then identifier.
+func timeKey(at time.Time, id string) string {
+	return fmt.Sprintf("%020d|%s", at.UnixNano(), id)
+}
+
+// seqKey builds a sort key ordering by sequence number.
+func seqKey(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+// paginate returns the page of items requested by r, ordered by key.
+func paginate[T any](r *http.Request, items []T, key func(T) string) (Page[T], error) {
+	limit := defaultPageLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return Page[T]{}, errInvalidPage
+		}
+		limit = n
+	}
+
+	after := ""
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || len(decoded) == 0 {
+			return Page[T]{}, errInvalidPage
+		}
+		after = string(decoded)
+	}
+
+	sort.SliceStable(items, func(i, j int) bool { return key(items[i]) < key(items[j]) })
+	start := sort.Search(len(items), func(i int) bool { return key(items[i]) > after })
+
+	page := Page[T]{Items: items[start:]}
+	if page.Items == nil {
+		page.Items = []T{}
+	}
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		page.Next = base64.RawURLEncoding.EncodeToString([]byte(key(page.Items[limit-1])))
+	}
+	return page, nil
+}
+
+// writePage writes the requested page of items as JSON, or an error for a bad cursor or limit.
+func writePage[T any](w http.ResponseWriter, r *http.Request, items []T, key func(T) string) {
+	page, err := paginate(r, items, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// Message content is HTML, which bridges, digests and alerts have no use for: unescaping it
+// leaves tags behind, and stripping the tags first leaves entities such as &lt;. plainText
+// renders it as the text people read instead, line breaks as newlines and links followed by
+// where they go, and every kind's Text goes through it (see kinds.go). /api/v1/events.txt
+// serves the event log rendered that way for clients that can't show HTML, one message per
+// line as "<nickname> text", "* text" for the server's, with the same parameters as
+// /api/v1/events and a Link header to the next page when more events remain.
+
+// plainText returns HTML content as plain text.
+func plainText(content string) string {
+	if !strings.ContainsAny(content, "<&") {
+		return content
+	}
+
+	var out strings.Builder
+	dropping := ""
+	// Where the link being rendered goes, and where its text starts in out.
+	href, linkStart := "", 0
+	z := xhtml.NewTokenizer(strings.NewReader(content))
+	for {
+		tokenType := z.Next()
+		if tokenType == xhtml.ErrorToken {
+			break
+		}
+		token := z.Token()
+		if dropping != "" {
+			if tokenType == xhtml.EndTagToken && token.Data == dropping {
+				dropping = ""
+			}
+			continue
+		}
+
+		switch tokenType {
+		case xhtml.TextToken:
+			out.WriteString(token.Data)
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			switch {
+			case outboundPolicy.dropContent[token.Data]:
+				if tokenType == xhtml.StartTagToken {
+					dropping = token.Data
+				}
+			case token.Data == "br":
+				out.WriteString("\n")
+			case token.Data == "p" || token.Data == "div" || token.Data == "pre" || token.Data == "li":
+				newLine(&out)
+			case token.Data == "a":
+				href, linkStart = "", out.Len()
+				for _, attr := range token.Attr {
+					if attr.Key == "href" && safeLink(attr.Val) {
+						href = strings.TrimSpace(attr.Val)
+					}
+				}
+			}
+		case xhtml.EndTagToken:
+			switch token.Data {
+			case "p", "div", "pre", "li":
+				newLine(&out)
+			case "a":
+				text := strings.TrimSpace(out.String()[linkStart:])
+				if href != "" && href != text && strings.TrimPrefix(href, "mailto:") != text {
+					out.WriteString(" (" + href + ")")
+				}
+				href = ""
+			}
+		}
+	}
+	return strings.TrimSpace(out.String())
+}
+
+// newLine ends the line in out, unless it is empty.
+func newLine(out *strings.Builder) {
+	if text := out.String(); text != "" && !strings.HasSuffix(text, "\n") {
+		out.WriteString("\n")
+	}
+}
+
+// plainLine returns event as a line of a plain text transcript, its lines after the first
+// indented, or false if it isn't a message.
+func plainLine(event Message) (string, bool) {
+	if !contentKinds[event.Kind].Message || event.Private {
+		return "", false
+	}
+	text := strings.ReplaceAll(messageText(event), "\n", "\n  ")
+	if event.Author == nil || event.FromApp {
+		return "* " + text, true
+	}
+	return "<" + event.Author.Nickname + "> " + text, true
+}
+
+// handleEventsText returns the logged events like /api/v1/events, as a plain text transcript.
+func (s *ChatServer) handleEventsText(w http.ResponseWriter, r *http.Request) {
+	page, ok := s.replayPage(w, r)
+	if !ok {
+		return
+	}
+	if page.Next != "" {
+		query := r.URL.Query()
+		query.Set("since", page.Next)
+		w.Header().Set("Link", "<"+r.URL.Path+"?"+query.Encode()+`>; rel="next"`)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	var out strings.Builder
+	for _, event := range page.Items {
+		if line, ok := plainLine(event); ok {
+			out.WriteString(line + "\n")
+		}
+	}
+	w.Write([]byte(out.String()))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Presence counts are broadcast at most this often, and only when they changed.
+const presenceInterval = 10 * time.Second
+
+type Presence struct {
+	// Number of connected event streams.
+	Connected int `json:"connected"`
+	// Connected sessions that have set a nickname.
+	Members int `json:"members"`
+	// Connected sessions without a nickname, just watching.
+	Lurkers int `json:"lurkers"`
+}
+
+func (s *ChatServer) presence() Presence {
+	var ids []string
+	s.hub.read(func(clients map[string]chan string) {
+		ids = make([]string, 0, len(clients))
+		for id := range clients {
+			ids = append(ids, id)
+		}
+	})
+
+	p := Presence{Connected: len(ids)}
+	s.nicknamesMu.Lock()
+	for _, id := range ids {
+		if _, ok := s.nicknames[id]; ok {
+			p.Members++
+		}
+	}
+	s.nicknamesMu.Unlock()
+	p.Lurkers = p.Connected - p.Members
+	return p
+}
+
+func (s *ChatServer) broadcastPresence() {
+	p := s.presence()
+
+	s.lastPresenceMu.Lock()
+	if p == s.lastPresence {
+		s.lastPresenceMu.Unlock()
+		return
+	}
+	s.lastPresence = p
+	s.lastPresenceMu.Unlock()
+
+	s.broadcastMessage(Message{
+		FromApp:  true,
+		Kind:     "viewers",
+		Content:  strconv.Itoa(p.Connected),
+		Presence: &p,
+	})
+}
+
+type Member struct {
+	// Handle of the member's session, see sessionHandle.
+	ID string `json:"id"`
+	// Nickname of the member.
+	Nickname string `json:"nickname"`
+	// Nickname colour of the member, empty if none was picked.
+	Color string `json:"color"`
+	// Role of the member in the room.
+	Role Role `json:"role"`
+}
+
+// members lists the sessions that have set a nickname.
+func (s *ChatServer) members() []Member {
+	s.nicknamesMu.Lock()
+	members := make([]Member, 0, len(s.nicknames))
+	for id, nickname := range s.nicknames {
+		members = append(members, Member{ID: id, Nickname: nickname})
+	}
+	s.nicknamesMu.Unlock()
+
+	for i := range members {
+		s.nicknameColorsMu.Lock()
+		members[i].Color = s.nicknameColors[members[i].ID]
+		s.nicknameColorsMu.Unlock()
+		members[i].Role = s.roleOf(members[i].ID)
+		members[i].ID = sessionHandle(members[i].ID)
+	}
+	return members
+}
+
+// handleMembers lists members by session handle, a page at a time.
+func (s *ChatServer) handleMembers(w http.ResponseWriter, r *http.Request) {
+	writePage(w, r, s.members(), func(m Member) string { return m.ID })
+}
+
+func (s *ChatServer) handlePresence(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.presence())
+}
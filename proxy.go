@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /proxy?url= fetches images linked from other sites and serves them from the room's own origin,
+// so they show without mixed content warnings and without the other site seeing who looks at
+// them: no cookies, referrer or client address are passed on. Only hosts in PROXY_DOMAINS, a
+// comma-separated list where "example.com" also allows its subdomains, can be fetched, and the
+// proxy is off without it. Images are capped at PROXY_MAX_MB and cached for proxyCacheTTL within
+// PROXY_CACHE_MB, see fetchCache.
+
+const (
+	defaultProxyMaxMB   = 5
+	defaultProxyCacheMB = 64
+	proxyCacheTTL       = time.Hour
+	proxyFetchTimeout   = 10 * time.Second
+	// Most redirects followed, each to an allowed host too.
+	proxyMaxRedirects = 3
+)
+
+var (
+	proxyDomains    = loadProxyDomains()
+	proxyMaxBytes   = loadMegabytes("PROXY_MAX_MB", defaultProxyMaxMB)
+	proxyCacheBytes = loadMegabytes("PROXY_CACHE_MB", defaultProxyCacheMB)
+)
+
+var (
+	errProxyOff         = errors.New("The media proxy is off")
+	errInvalidProxyURL  = errors.New("Invalid url: expected an http or https link")
+	errProxyNotAllowed  = errors.New("This site isn't allowed through the media proxy")
+	errProxyTooLarge    = errors.New("Image is too large for the media proxy")
+	errProxyNotAnImage  = errors.New("Only images can go through the media proxy")
+	errProxyFetchFailed = errors.New("Could not fetch the image")
+)
+
+type proxiedMedia struct {
+	data        []byte
+	contentType string
+}
+
+func loadProxyDomains() []string {
+	var domains []string
+	for _, domain := range strings.Split(os.Getenv("PROXY_DOMAINS"), ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+func loadMegabytes(name string, fallback int64) int64 {
+	if mb, err := strconv.ParseInt(os.Getenv(name), 10, 64); err == nil && mb > 0 {
+		return mb << 20
+	}
+	return fallback << 20
+}
+
+// proxyAllowed reports whether target may be fetched by the proxy.
+func proxyAllowed(target *url.URL) bool {
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(target.Hostname())
+	for _, domain := range proxyDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+var proxyClient = &http.Client{
+	Timeout: proxyFetchTimeout,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) > proxyMaxRedirects || !proxyAllowed(req.URL) {
+			return errProxyNotAllowed
+		}
+		return nil
+	},
+}
+
+// proxyMedia returns the image at rawURL, from the cache if it was fetched recently.
+func (s *ChatServer) proxyMedia(rawURL string) (*proxiedMedia, error) {
+	if len(proxyDomains) == 0 {
+		return nil, errProxyOff
+	}
+	target, err := url.Parse(rawURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return nil, errInvalidProxyURL
+	}
+	if !proxyAllowed(target) {
+		return nil, errProxyNotAllowed
+	}
+	rawURL = target.String()
+
+	if media, ok := s.proxyCache.get(rawURL, s.clock.Now()); ok {
+		return media, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, errInvalidProxyURL
+	}
+	req.Header.Set("User-Agent", "alantern-media-proxy")
+	req.Header.Set("Accept", "image/*")
+	resp, err := proxyClient.Do(req)
+	if err != nil {
+		if errors.Is(err, errProxyNotAllowed) {
+			return nil, errProxyNotAllowed
+		}
+		return nil, errProxyFetchFailed
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errProxyFetchFailed
+	}
+	if resp.ContentLength > proxyMaxBytes {
+		return nil, errProxyTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, proxyMaxBytes+1))
+	if err != nil {
+		return nil, errProxyFetchFailed
+	}
+	if int64(len(data)) > proxyMaxBytes {
+		return nil, errProxyTooLarge
+	}
+	// The type is sniffed rather than taken from the other site, which rules out SVG and HTML.
+	contentType := http.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, errProxyNotAnImage
+	}
+
+	media := &proxiedMedia{data: data, contentType: contentType}
+	s.proxyCache.put(rawURL, media, int64(len(data)), proxyCacheTTL, s.clock.Now())
+	return media, nil
+}
+
+// handleProxy serves the image at "url" through the media proxy.
+func (s *ChatServer) handleProxy(w http.ResponseWriter, r *http.Request) {
+	if s.isBanned(s.getOrCreateSession(w, r)) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+
+	media, err := s.proxyMedia(r.URL.Query().Get("url"))
+	switch err {
+	case nil:
+	case errProxyOff:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errInvalidProxyURL:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errProxyNotAllowed:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case errProxyTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case errProxyNotAnImage:
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", media.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'")
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(proxyCacheTTL.Seconds())))
+	w.Write(media.data)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// How long raid mode stays on when ;raidmode on is given no duration.
+	defaultRaidDuration = 30 * time.Minute
+	// Sessions first seen less than this long before raid mode was switched on count as new.
+	raidNewSessionAge = 10 * time.Minute
+	// Minimum time between two messages from the same session while raid mode is on.
+	raidSlowmode = 10 * time.Second
+)
+
+type raidState struct {
+	// Whether or not raid mode is currently on.
+	active bool
+	// When raid mode was switched on.
+	since time.Time
+	// When raid mode switches itself off.
+	until time.Time
+	// Stops the timer that switches raid mode off at until.
+	stopTimer func() bool
+}
+
+func (s *ChatServer) raidActive() bool {
+	s.raidMu.Lock()
+	defer s.raidMu.Unlock()
+	return s.raid.active
+}
+
+func (s *ChatServer) enableRaidMode(by string, d time.Duration) {
+	s.raidMu.Lock()
+	if s.raid.stopTimer != nil {
+		s.raid.stopTimer()
+	}
+	now := s.clock.Now()
+	if !s.raid.active {
+		s.raid.since = now
+	}
+	s.raid.active = true
+	s.raid.until = now.Add(d)
+	s.raid.stopTimer = s.clock.AfterFunc(d, func() {
+		s.disableRaidMode("expired", true)
+	})
+	s.raidMu.Unlock()
+
+	s.logModAction(fmt.Sprintf("Raid mode was turned on for %s", d))
+	s.notifyModerators(Message{
+		Kind:    "text",
+		Content: fmt.Sprintf("Raid mode enabled by [%s] for %s", escapeText(s.getNickname(by)), d),
+	})
+	s.broadcastMessage(Message{
+		FromApp: true,
+		Kind:    "text",
+		Content: "Raid mode is on: new members can't send messages and uploads are disabled for now",
+	})
+}
+
+// disableRaidMode switches raid mode off. When fromTimer is set, nothing happens unless the
+// current raid window has actually run out, so a stale timer can't end an extended raid.
+func (s *ChatServer) disableRaidMode(reason string, fromTimer bool) {
+	s.raidMu.Lock()
+	if !s.raid.active || (fromTimer && s.clock.Now().Before(s.raid.until)) {
+		s.raidMu.Unlock()
+		return
+	}
+	if s.raid.stopTimer != nil {
+		s.raid.stopTimer()
+	}
+	s.raid = raidState{}
+	s.raidMu.Unlock()
+
+	s.logModAction("Raid mode was turned off")
+	s.notifyModerators(Message{
+		Kind:    "text",
+		Content: "Raid mode disabled (" + reason + ")",
+	})
+	s.broadcastMessage(Message{
+		FromApp: true,
+		Kind:    "text",
+		Content: "Raid mode is off",
+	})
+}
+
+// raidRestriction returns why sessionID may not send a message right now, or "" if it may.
+func (s *ChatServer) raidRestriction(sessionID string) string {
+	s.raidMu.Lock()
+	raid := s.raid
+	s.raidMu.Unlock()
+
+	if !raid.active || s.isModerator(sessionID) {
+		return ""
+	}
+	if s.raidBlocksNewMember(sessionID) {
+		return "Raid mode is on: new members can't send messages right now"
+	}
+
+	s.lastMessageTimeMu.Lock()
+	lastTime, exists := s.lastMessageTime[sessionID]
+	s.lastMessageTimeMu.Unlock()
+	if exists {
+		if wait := raidSlowmode - s.clock.Now().Sub(lastTime); wait > 0 {
+			return fmt.Sprintf("Slow mode is on: wait %s before sending another message", wait.Round(time.Second))
+		}
+	}
+	return ""
+}
+
+// raidBlocksNewMember reports whether raid mode is on and sessionID is too new to post.
+func (s *ChatServer) raidBlocksNewMember(sessionID string) bool {
+	s.raidMu.Lock()
+	raid := s.raid
+	s.raidMu.Unlock()
+
+	if !raid.active || s.isModerator(sessionID) {
+		return false
+	}
+	s.sessionFirstSeenMu.Lock()
+	firstSeen := s.sessionFirstSeen[sessionID]
+	s.sessionFirstSeenMu.Unlock()
+	return firstSeen.After(raid.since.Add(-raidNewSessionAge))
+}
+
+func (s *ChatServer) handleRaidCommand(sessionID string, args []string) {
+	if !s.isModerator(sessionID) {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Only moderators can use ;raidmode",
+		})
+		return
+	}
+
+	usage := Message{
+		Kind:    "text",
+		Content: "Usage: ;raidmode on [duration]|off|status",
+	}
+	if len(args) == 0 {
+		s.sendPrivateMessage(sessionID, usage)
+		return
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "on":
+		d := defaultRaidDuration
+		if len(args) > 1 {
+			parsed, err := time.ParseDuration(args[1])
+			if err != nil || parsed <= 0 {
+				s.sendPrivateMessage(sessionID, Message{
+					Kind:    "text",
+					Content: "Invalid duration, use something like 15m or 1h",
+				})
+				return
+			}
+			d = parsed
+		}
+		s.audit(sessionID, "raidmode.on", "", d.String())
+		s.enableRaidMode(sessionID, d)
+
+	case "off":
+		if !s.raidActive() {
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Raid mode is not on"})
+			return
+		}
+		s.audit(sessionID, "raidmode.off", "", "")
+		s.disableRaidMode(fmt.Sprintf("by [%s]", escapeText(s.getNickname(sessionID))), false)
+
+	case "status":
+		s.raidMu.Lock()
+		raid := s.raid
+		s.raidMu.Unlock()
+		messageContent := "Raid mode is off"
+		if raid.active {
+			messageContent = fmt.Sprintf("Raid mode is on, %s remaining", time.Until(raid.until).Round(time.Second))
+		}
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: messageContent})
+
+	default:
+		s.sendPrivateMessage(sessionID, usage)
+	}
+}
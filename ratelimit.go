@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How quickly members may post is up to a RateLimiter, a token bucket per session unless swapped
+// with WithMessageLimiter: each session can send MESSAGE_BURST messages at once, after which it
+// gets MESSAGE_RATE more a second. Commands count too. Those over the limit are told how long to
+// wait, and their message is dropped, which is a strike against them, see spam.go.
+
+const (
+	defaultMessageRate  = 0.5
+	defaultMessageBurst = 5
+)
+
+// RateLimiter decides how often each key, a session or an address, may do something.
+type RateLimiter interface {
+	// Allow reports whether key may do it once more at now, using it up if so, or else how long
+	// until it may.
+	Allow(key string, now time.Time) (ok bool, retryAfter time.Duration)
+	// Forget drops what is kept about key.
+	Forget(key string)
+	// Prune drops what is kept about the keys back to their full allowance at now.
+	Prune(now time.Time)
+}
+
+type tokenBucket struct {
+	tokens float64
+	// When tokens was last topped up.
+	last time.Time
+}
+
+type tokenBucketLimiter struct {
+	// Tokens added per second, and most a bucket holds.
+	rate  float64
+	burst float64
+
+	buckets map[string]*tokenBucket
+	mu      sync.Mutex
+}
+
+func newTokenBucketLimiter(rate, burst float64) *tokenBucketLimiter {
+	return &tokenBucketLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// loadMessageLimiter returns the token bucket limiter MESSAGE_RATE and MESSAGE_BURST describe.
+func loadMessageLimiter() *tokenBucketLimiter {
+	return loadTokenBucketLimiter("MESSAGE_RATE", "MESSAGE_BURST", defaultMessageRate, defaultMessageBurst)
+}
+
+// loadTokenBucketLimiter returns the token bucket limiter the rate and burst variables describe,
+// rate and burst unless they are set.
+func loadTokenBucketLimiter(rateVar, burstVar string, rate float64, burst int) *tokenBucketLimiter {
+	if value, err := strconv.ParseFloat(os.Getenv(rateVar), 64); err == nil && value > 0 && !math.IsInf(value, 1) {
+		rate = value
+	}
+	if value, err := strconv.Atoi(os.Getenv(burstVar)); err == nil && value > 0 {
+		burst = value
+	}
+	return newTokenBucketLimiter(rate, float64(burst))
+}
+
+func (l *tokenBucketLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+	if elapsed := now.Sub(bucket.last); elapsed > 0 {
+		bucket.tokens = min(l.burst, bucket.tokens+elapsed.Seconds()*l.rate)
+		bucket.last = now
+	}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+}
+
+func (l *tokenBucketLimiter) Forget(key string) {
+	l.mu.Lock()
+	delete(l.buckets, key)
+	l.mu.Unlock()
+}
+
+func (l *tokenBucketLimiter) Prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// WithMessageLimiter makes the server limit how often members post with limiter.
+func WithMessageLimiter(limiter RateLimiter) Option {
+	return func(s *ChatServer) {
+		s.messageLimiter = limiter
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Relay mode lets lightweight edge instances fan a busy room out to many viewers. The primary
+// publishes every public broadcast on /relay/stream (protected by RELAY_TOKEN). An edge started
+// with RELAY_UPSTREAM pointing at the primary subscribes to that stream and serves the chat page
+// and /events itself, while everything else (sending, nicknames, uploads, images) is proxied
+// to the primary. Private messages only reach clients connected to the primary directly.
+//
+// Edges reconnect with the identifier of the last logged event they got, and the primary sends
+// them the events logged since before going on with the live stream, so they miss nothing the
+// event log still has.
+
+// Relay subscribers that fall this many events behind miss events instead of slowing down the
+// primary. Edges are disconnected instead, to catch up when they reconnect.
+const relaySubscriberBuffer = 1024
+
+var (
+	relayToken    = os.Getenv("RELAY_TOKEN")
+	relayUpstream = os.Getenv("RELAY_UPSTREAM")
+)
+
+// publishToRelays hands a broadcast event to every subscribed edge instance and debug event viewer.
+func (s *ChatServer) publishToRelays(data string) {
+	s.relaySubscribersMu.Lock()
+	defer s.relaySubscribersMu.Unlock()
+	for id, ch := range s.relaySubscribers {
+		select {
+		case ch <- data:
+		default:
+			if s.relayEdges[id] {
+				close(ch)
+				delete(s.relaySubscribers, id)
+				delete(s.relayEdges, id)
+			}
+		}
+	}
+}
+
+// handleRelayStream streams broadcasts to an edge instance presenting the relay token, starting
+// with those logged after "since", if given.
+func (s *ChatServer) handleRelayStream(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if relayToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(relayToken)) != 1 {
+		http.Error(w, "Invalid relay token", http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// No broadcast comes in between taking the backlog and subscribing, so none is missed or
+	// sent twice. Messages waiting for the next livestream batch come with it.
+	id := s.newID()
+	ch := make(chan string, relaySubscriberBuffer)
+	var backlog []Message
+	s.broadcastMu.Lock()
+	if since := r.URL.Query().Get("since"); since != "" {
+		events, ok := s.eventsSince(since)
+		if !ok {
+			slog.Warn("Relay edge resumed from an event no longer in the log", "since", since)
+		}
+		backlog = s.unbatched(events)
+	}
+	s.relaySubscribersMu.Lock()
+	s.relaySubscribers[id] = ch
+	s.relayEdges[id] = true
+	s.relaySubscribersMu.Unlock()
+	s.broadcastMu.Unlock()
+
+	defer func() {
+		s.relaySubscribersMu.Lock()
+		delete(s.relaySubscribers, id)
+		delete(s.relayEdges, id)
+		s.relaySubscribersMu.Unlock()
+	}()
+
+	for _, event := range backlog {
+		if data, err := json.Marshal(event); err == nil {
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := s.clock.After(heartbeatInterval)
+	for {
+		select {
+		case data, ok := <-ch:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat:
+			if writeHeartbeat(w) != nil {
+				return
+			}
+			heartbeat = s.clock.After(heartbeatInterval)
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// relayPosition is the last logged event an edge got, to resume the relay stream from.
+type relayPosition struct {
+	id  string
+	seq uint64
+}
+
+// advance moves p past the logged events in event.
+func (p *relayPosition) advance(event Message) {
+	for _, message := range append([]Message{event}, event.Messages...) {
+		if message.Seq > p.seq {
+			p.id, p.seq = message.ID, message.Seq
+		}
+	}
+}
+
+// startRelayEdge subscribes to the primary's relay stream and rebroadcasts it locally,
+// reconnecting with a capped backoff whenever the stream drops.
+func (s *ChatServer) startRelayEdge(upstream string) {
+	go func() {
+		backoff := time.Second
+		var position relayPosition
+		for {
+			started := time.Now()
+			err := s.followRelayStream(upstream, &position)
+			if time.Since(started) > 30*time.Second {
+				backoff = time.Second
+			}
+			slog.Warn("Relay stream ended, reconnecting", "upstream", upstream, "err", err, "backoff", backoff)
+			time.Sleep(backoff)
+			if backoff < 30*time.Second {
+				backoff *= 2
+			}
+		}
+	}()
+}
+
+func (s *ChatServer) followRelayStream(upstream string, position *relayPosition) error {
+	req, err := http.NewRequest(http.MethodGet, upstream+"/relay/stream?since="+url.QueryEscape(position.id), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+relayToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("primary answered %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			position.advance(s.relayEvent(data))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed")
+}
+
+// relayEvent rebroadcasts the encoded event data on an edge and keeps the logged events in it,
+// for streams connecting with since. It returns the decoded event.
+func (s *ChatServer) relayEvent(data string) Message {
+	s.broadcastMu.Lock()
+	defer s.broadcastMu.Unlock()
+	s.broadcastRaw(data)
+
+	var event Message
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return event
+	}
+	s.eventLogMu.Lock()
+	defer s.eventLogMu.Unlock()
+	if event.Kind == "delete" {
+		s.forgetEventLocked(event.ID)
+	}
+	for _, message := range append([]Message{event}, event.Messages...) {
+		if message.Seq != 0 {
+			s.appendEventLocked(message)
+		}
+	}
+	return event
+}
+
+// handleRelayEvents serves /events on an edge instance. Edges don't track sessions: every
+// connection just receives the public broadcasts relayed from the primary, starting with those
+// logged after "since", if given.
+func (s *ChatServer) handleRelayEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	id := s.newID()
+	msgCh := make(chan string, clientBuffer)
+	var backlog []Message
+	s.broadcastMu.Lock()
+	migration, drained := s.migration()
+	if migration == "" {
+		if since := r.URL.Query().Get("since"); since != "" {
+			backlog, _ = s.eventsSince(since)
+		} else {
+			backlog = s.backlog(id, r)
+		}
+		s.hub.connect(id, msgCh)
+	}
+	s.broadcastMu.Unlock()
+
+	if migration != "" {
+		writeMessage(w, s.stamp(Message{FromApp: true, Kind: "migrate", Private: true, Content: migrateURL(migration, r.URL.Query().Get("since"))}), nil)
+		flusher.Flush()
+		return
+	}
+
+	evicted := s.watchEviction(msgCh)
+	defer s.forgetEviction(msgCh)
+	defer s.hub.disconnect(id, nil)
+
+	var lastID uint64
+	for _, event := range backlog {
+		writeMessage(w, event, &lastID)
+	}
+	flusher.Flush()
+
+	heartbeat := s.clock.After(heartbeatInterval)
+	for {
+		select {
+		case msg := <-msgCh:
+			if writeEvent(w, msg, &lastID) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat:
+			if writeHeartbeat(w) != nil {
+				return
+			}
+			heartbeat = s.clock.After(heartbeatInterval)
+		case <-evicted:
+			writeEvent(w, s.evictedMessage(), nil)
+			flusher.Flush()
+			return
+		case <-drained:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// relayEdgeHandler returns the handler of an edge instance, used in place of the usual one.
+func (s *ChatServer) relayEdgeHandler(upstream string) (http.Handler, error) {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			s.serveChatPage(w, r)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	})
+	mux.HandleFunc("/events", s.handleRelayEvents)
+	mux.HandleFunc("/api/admin/load", s.handleAdminLoad)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/api/admin/drain", s.handleAdminDrain)
+	mux.HandleFunc("/relay/stream", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Edge instances can't be relayed from", http.StatusNotFound)
+	})
+	return s.timeRequests(mux), nil
+}
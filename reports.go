@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Members report someone misbehaving with ;report <nickname> <reason>, which every moderator
+// connected is told about. Reports are kept until resolved, the last maxReports of them: the
+// admin API lists them with GET /api/admin/reports, "?status=open" for those still open, and
+// resolves one with a POST of its "id" and an optional "resolution" to
+// /api/admin/reports/resolve. A member can only have one open report about each session.
+
+const (
+	maxReports      = 1000
+	maxReportLength = 500
+)
+
+type Report struct {
+	// Report identifier.
+	ID string `json:"id"`
+	// Session identifier and nickname of who reported.
+	ReporterID string `json:"reporterId"`
+	Reporter   string `json:"reporter"`
+	// Session identifier and nickname of who was reported, as they were.
+	SessionID string `json:"sessionId"`
+	Nickname  string `json:"nickname"`
+	// Why, as written by the reporter.
+	Reason string `json:"reason"`
+	// Either "open" or "resolved".
+	Status     string    `json:"status"`
+	ReportedAt time.Time `json:"reportedAt"`
+	// When, by whom (a session identifier or "admin") and how the report was resolved. Only set
+	// once resolved.
+	ResolvedAt time.Time `json:"resolvedAt,omitempty"`
+	ResolvedBy string    `json:"resolvedBy,omitempty"`
+	Resolution string    `json:"resolution,omitempty"`
+}
+
+func (s *ChatServer) handleReportCommand(sessionID string, args []string) {
+	reason := strings.TrimSpace(strings.Join(args[min(1, len(args)):], " "))
+	if len(args) < 2 || reason == "" {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Usage: ;report &lt;nickname&gt; &lt;reason&gt;"})
+		return
+	}
+	if len(reason) > maxReportLength {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: fmt.Sprintf("Reasons can be at most %d characters", maxReportLength)})
+		return
+	}
+	target := s.findSession(args[0])
+	if target == "" {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: fmt.Sprintf("User %s not found", escapeText(args[0]))})
+		return
+	}
+	if target == sessionID {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "You can't report yourself"})
+		return
+	}
+
+	report := &Report{
+		ID:         s.newID(),
+		ReporterID: sessionID,
+		Reporter:   s.getNickname(sessionID),
+		SessionID:  target,
+		Nickname:   s.getNickname(target),
+		Reason:     reason,
+		Status:     "open",
+		ReportedAt: s.clock.Now(),
+	}
+	s.reportsMu.Lock()
+	for _, other := range s.reports {
+		if other.Status == "open" && other.ReporterID == sessionID && other.SessionID == target {
+			s.reportsMu.Unlock()
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "You already reported them, the moderators will look into it"})
+			return
+		}
+	}
+	s.addReportLocked(report)
+	s.reportsMu.Unlock()
+
+	s.audit(sessionID, "report", target, reason)
+	s.notifyModerators(Message{
+		Kind: "text",
+		Content: fmt.Sprintf("New report %s: [%s] reported [%s] (%s): %s", escapeText(report.ID), escapeText(report.Reporter),
+			escapeText(report.Nickname), sessionHandle(target), escapeText(reason)),
+	})
+	s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Thanks, the moderators have been told"})
+}
+
+// addReportLocked keeps report, dropping the oldest resolved one, or else the oldest, once there
+// are maxReports. Called with reportsMu held.
+func (s *ChatServer) addReportLocked(report *Report) {
+	if len(s.reports) >= maxReports {
+		drop := 0
+		for i, other := range s.reports {
+			if other.Status == "resolved" {
+				drop = i
+				break
+			}
+		}
+		s.reports = append(s.reports[:drop], s.reports[drop+1:]...)
+	}
+	s.reports = append(s.reports, report)
+}
+
+// listReports returns the reports, those still open only if open, latest first.
+func (s *ChatServer) listReports(open bool) []Report {
+	s.reportsMu.Lock()
+	reports := make([]Report, 0, len(s.reports))
+	for _, report := range s.reports {
+		if !open || report.Status == "open" {
+			reports = append(reports, *report)
+		}
+	}
+	s.reportsMu.Unlock()
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].ReportedAt.After(reports[j].ReportedAt) })
+	return reports
+}
+
+// resolveReport resolves the open report with identifier id, by by, and returns it.
+func (s *ChatServer) resolveReport(id, by, resolution string) (Report, bool) {
+	s.reportsMu.Lock()
+	defer s.reportsMu.Unlock()
+	for _, report := range s.reports {
+		if report.ID == id && report.Status == "open" {
+			report.Status = "resolved"
+			report.ResolvedAt = s.clock.Now()
+			report.ResolvedBy = by
+			report.Resolution = resolution
+			return *report, true
+		}
+	}
+	return Report{}, false
+}
+
+func (s *ChatServer) handleAdminReports(w http.ResponseWriter, r *http.Request) {
+	if !adminTokenAuthorized(r) {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && status != "open" {
+		http.Error(w, `status must be "open" if set`, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.listReports(status == "open"))
+}
+
+// handleAdminResolveReport resolves the open report "id", as "resolution" says if set.
+func (s *ChatServer) handleAdminResolveReport(w http.ResponseWriter, r *http.Request) {
+	if !s.adminPost(w, r) {
+		return
+	}
+	resolution := strings.TrimSpace(r.FormValue("resolution"))
+	report, ok := s.resolveReport(r.FormValue("id"), "admin", resolution)
+	if !ok {
+		http.Error(w, "No open report with that id", http.StatusNotFound)
+		return
+	}
+	s.audit("admin", "report.resolve", report.SessionID, strings.TrimSpace(report.ID+" "+resolution))
+	s.queueNotice(report.ReporterID, Message{
+		Kind:    "text",
+		Content: fmt.Sprintf("Your report of [%s] was looked into by the moderators, thanks", escapeText(report.Nickname)),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
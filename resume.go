@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Each /events stream starts with a private "resume" event whose Content is a token. When the
+// stream drops, on a phone switching networks say, the session stays connected for resumeWindow:
+// its events are queued and presence doesn't change. Reconnecting to /events?resume=<token> in
+// that time picks up where the stream left off, with what was sent meanwhile, and a new token.
+//
+// A session whose stream isn't resumed in time, or whose client said it was leaving with /leave
+// (as the chat page does when it is closed), is disconnected: its registration is removed right
+// away and everyone is told it left.
+
+const resumeWindow = 30 * time.Second
+
+type detachedStream struct {
+	sessionID string
+	ch        chan string
+	// Stops the timer disconnecting the session once resumeWindow is over.
+	stopExpiry func() bool
+}
+
+// detachStream keeps ch as the channel of sessionID for resumeWindow, so that the stream can be
+// resumed with token.
+func (s *ChatServer) detachStream(token, sessionID string, ch chan string) {
+	s.resumableMu.Lock()
+	defer s.resumableMu.Unlock()
+	s.resumable[token] = &detachedStream{
+		sessionID:  sessionID,
+		ch:         ch,
+		stopExpiry: s.clock.AfterFunc(resumeWindow, func() { s.expireDetached(token) }),
+	}
+}
+
+// resumeStream returns the channel of the stream detached with token, or nil if it can't be
+// resumed by sessionID, because the token is unknown or expired or another stream replaced it.
+func (s *ChatServer) resumeStream(sessionID, token string) chan string {
+	s.resumableMu.Lock()
+	detached, ok := s.resumable[token]
+	if ok && detached.sessionID == sessionID {
+		delete(s.resumable, token)
+	}
+	s.resumableMu.Unlock()
+	if !ok || detached.sessionID != sessionID {
+		return nil
+	}
+	detached.stopExpiry()
+
+	if ch, _ := s.hub.lookup(sessionID); ch != detached.ch {
+		return nil
+	}
+	return detached.ch
+}
+
+// expireDetached disconnects the session whose stream was detached with token, unless it
+// connected again since.
+func (s *ChatServer) expireDetached(token string) {
+	s.resumableMu.Lock()
+	detached, ok := s.resumable[token]
+	delete(s.resumable, token)
+	s.resumableMu.Unlock()
+	if !ok {
+		return
+	}
+
+	s.disconnectStream(detached.sessionID, detached.ch)
+}
+
+// endStream handles the end of the stream ch of sessionID, which is kept for resuming unless
+// the session said it was leaving.
+func (s *ChatServer) endStream(token, sessionID string, ch chan string) {
+	s.resumableMu.Lock()
+	leaving := s.leaving[sessionID]
+	delete(s.leaving, sessionID)
+	s.resumableMu.Unlock()
+	if leaving {
+		s.disconnectStream(sessionID, ch)
+	} else {
+		s.detachStream(token, sessionID, ch)
+	}
+}
+
+// disconnectStream removes ch as the stream of sessionID, unless it was replaced, and announces
+// that the session left.
+func (s *ChatServer) disconnectStream(sessionID string, ch chan string) {
+	if s.hub.disconnect(sessionID, ch) {
+		s.announceLeave(sessionID)
+	}
+}
+
+// leave disconnects sessionID, whose client is leaving: now if its stream already dropped, or
+// once it does. A session without a stream is announced as gone right away.
+func (s *ChatServer) leave(sessionID string) {
+	s.resumableMu.Lock()
+	for token, detached := range s.resumable {
+		if detached.sessionID == sessionID {
+			delete(s.resumable, token)
+			s.resumableMu.Unlock()
+			detached.stopExpiry()
+			s.disconnectStream(sessionID, detached.ch)
+			return
+		}
+	}
+	_, connected := s.hub.lookup(sessionID)
+	if connected {
+		s.leaving[sessionID] = true
+	}
+	s.resumableMu.Unlock()
+	if !connected {
+		s.announceLeave(sessionID)
+	}
+}
+
+func (s *ChatServer) announceLeave(sessionID string) {
+	// s.broadcastMessage(fmt.Sprintf(`<span class="highlight-admin-app">Alantern</span>: [%s] (%s) has left the room`, s.getNickname(sessionID), sessionID))
+	messageContent := fmt.Sprintf("[%s] (%s) has left the room", escapeText(s.getNickname(sessionID)), sessionHandle(sessionID))
+	s.broadcastMessage(Message{
+		Private:  false,
+		FromApp:  true,
+		Kind:     "text",
+		Content:  messageContent,
+		Activity: "leave",
+	})
+	s.broadcastPresence()
+}
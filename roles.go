@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+)
+
+// ownerKey is the secret used with ;claim to take ownership of the room, for initial setup or
+// when the owner's session is lost. Claiming is disabled when OWNER_KEY is not set.
+var ownerKey = os.Getenv("OWNER_KEY")
+
+// errRolesChanged is returned when a role change was made against an outdated version of the roles,
+// so that two moderators editing them at the same time don't silently overwrite each other.
+var errRolesChanged = errors.New("Roles were changed meanwhile, reload them and try again")
+
+// Role of a session in the room. Roles are ordered: each one can do everything the ones below it can.
+type Role int
+
+const (
+	RoleMember Role = iota
+	RoleModerator
+	RoleCoOwner
+	RoleOwner
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleModerator:
+		return "moderator"
+	case RoleCoOwner:
+		return "co-owner"
+	case RoleOwner:
+		return "owner"
+	default:
+		return "member"
+	}
+}
+
+func (r Role) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+type RoleAssignment struct {
+	// Handle of the session holding the role, see sessionHandle.
+	ID string `json:"id"`
+	// Nickname of the session.
+	Nickname string `json:"nickname"`
+	// Role held.
+	Role Role `json:"role"`
+}
+
+func (s *ChatServer) roleOf(sessionID string) Role {
+	s.rolesMu.Lock()
+	defer s.rolesMu.Unlock()
+	return s.roles[sessionID]
+}
+
+// lockRoles locks the roles for a change, unless ifMatch is set and no longer the current ETag.
+func (s *ChatServer) lockRoles(ifMatch string) error {
+	s.rolesMu.Lock()
+	if ifMatch != "" && ifMatch != "*" && ifMatch != s.rolesETagLocked() {
+		s.rolesMu.Unlock()
+		return errRolesChanged
+	}
+	return nil
+}
+
+func (s *ChatServer) rolesETagLocked() string {
+	return fmt.Sprintf(`"roles-%d"`, s.rolesVersion)
+}
+
+// roleAssignments returns the role holders along with the ETag of that version of the roles.
+func (s *ChatServer) roleAssignments() ([]RoleAssignment, string) {
+	s.rolesMu.Lock()
+	etag := s.rolesETagLocked()
+	assignments := make([]RoleAssignment, 0, len(s.roles))
+	for id, role := range s.roles {
+		if role > RoleMember {
+			assignments = append(assignments, RoleAssignment{ID: id, Role: role})
+		}
+	}
+	s.rolesMu.Unlock()
+
+	for i := range assignments {
+		assignments[i].Nickname = s.getNickname(assignments[i].ID)
+		assignments[i].ID = sessionHandle(assignments[i].ID)
+	}
+	sort.Slice(assignments, func(i, j int) bool {
+		if assignments[i].Role != assignments[j].Role {
+			return assignments[i].Role > assignments[j].Role
+		}
+		return assignments[i].Nickname < assignments[j].Nickname
+	})
+	return assignments, etag
+}
+
+// claimOwnership makes sessionID the owner. Any current owner is demoted to co-owner.
+func (s *ChatServer) claimOwnership(sessionID string) {
+	s.rolesMu.Lock()
+	for id, role := range s.roles {
+		if role == RoleOwner {
+			s.roles[id] = RoleCoOwner
+		}
+	}
+	s.roles[sessionID] = RoleOwner
+	s.rolesVersion++
+	s.rolesMu.Unlock()
+
+	s.audit(sessionID, "ownership.claim", sessionID, "")
+}
+
+// transferOwnership hands the room from the owner `from` to `to`, keeping `from` as a co-owner.
+func (s *ChatServer) transferOwnership(from, to, ifMatch string) error {
+	if from == to {
+		return fmt.Errorf("you already own the room")
+	}
+
+	if err := s.lockRoles(ifMatch); err != nil {
+		return err
+	}
+	if s.roles[from] != RoleOwner {
+		s.rolesMu.Unlock()
+		return fmt.Errorf("only the owner can transfer ownership")
+	}
+	s.roles[from] = RoleCoOwner
+	s.roles[to] = RoleOwner
+	s.rolesVersion++
+	s.rolesMu.Unlock()
+
+	s.audit(from, "ownership.transfer", to, "")
+	return nil
+}
+
+// setCoOwner adds (or with add unset, removes) `target` as a co-owner on behalf of the owner `by`.
+func (s *ChatServer) setCoOwner(by, target string, add bool, ifMatch string) error {
+	if err := s.lockRoles(ifMatch); err != nil {
+		return err
+	}
+	if s.roles[by] != RoleOwner {
+		s.rolesMu.Unlock()
+		return fmt.Errorf("only the owner can manage co-owners")
+	}
+	if target == by {
+		s.rolesMu.Unlock()
+		return fmt.Errorf("the owner can't change their own role, transfer ownership instead")
+	}
+	if add {
+		s.roles[target] = RoleCoOwner
+	} else {
+		if s.roles[target] != RoleCoOwner {
+			s.rolesMu.Unlock()
+			return fmt.Errorf("not a co-owner")
+		}
+		// Former co-owners stay moderators; use ;demote to remove that too.
+		s.roles[target] = RoleModerator
+	}
+	s.rolesVersion++
+	s.rolesMu.Unlock()
+
+	if add {
+		s.audit(by, "coowner.add", target, "")
+	} else {
+		s.audit(by, "coowner.remove", target, "")
+	}
+	return nil
+}
+
+// setModerator promotes `target` to moderator, or demotes them to member, on behalf of a co-owner
+// or the owner `by`. Roles at or above the actor's own can't be changed.
+func (s *ChatServer) setModerator(by, target string, promote bool, ifMatch string) error {
+	if err := s.lockRoles(ifMatch); err != nil {
+		return err
+	}
+	actor, current := s.roles[by], s.roles[target]
+	if actor < RoleCoOwner {
+		s.rolesMu.Unlock()
+		return fmt.Errorf("only co-owners and the owner can manage moderators")
+	}
+	if current >= actor || current > RoleModerator {
+		s.rolesMu.Unlock()
+		return fmt.Errorf("you can't change the role of a %s", current)
+	}
+	if promote {
+		s.roles[target] = RoleModerator
+	} else {
+		delete(s.roles, target)
+	}
+	s.rolesVersion++
+	s.rolesMu.Unlock()
+
+	if promote {
+		s.audit(by, "moderator.add", target, "")
+	} else {
+		s.audit(by, "moderator.remove", target, "")
+	}
+	return nil
+}
+
+// applyRoleAction runs one of the role management actions shared by the chat commands and the API.
+// When ifMatch is set, the action only applies if it is still the ETag of the current roles.
+func (s *ChatServer) applyRoleAction(by, action, target, ifMatch string) error {
+	switch action {
+	case "transfer":
+		return s.transferOwnership(by, target, ifMatch)
+	case "add-coowner":
+		return s.setCoOwner(by, target, true, ifMatch)
+	case "remove-coowner":
+		return s.setCoOwner(by, target, false, ifMatch)
+	case "promote":
+		return s.setModerator(by, target, true, ifMatch)
+	case "demote":
+		return s.setModerator(by, target, false, ifMatch)
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+}
+
+func (s *ChatServer) announceRoleChange(by, action, target string) {
+	var change string
+	switch action {
+	case "transfer":
+		change = "now the room owner"
+	case "add-coowner":
+		change = "now a co-owner"
+	case "remove-coowner":
+		change = "no longer a co-owner"
+	case "promote":
+		change = "now a moderator"
+	case "demote":
+		change = "no longer a moderator"
+	}
+
+	nickname := escapeText(s.getNickname(target))
+	s.logModAction(fmt.Sprintf("[%s] is %s", nickname, change))
+	s.notifyModerators(Message{
+		Kind:    "text",
+		Content: fmt.Sprintf("[%s] is %s (changed by [%s])", nickname, change, escapeText(s.getNickname(by))),
+	})
+	s.sendPrivateMessage(target, Message{
+		Kind:    "text",
+		Content: "You are " + change,
+	})
+}
+
+func (s *ChatServer) handleClaimCommand(sessionID string, args []string) {
+	if len(args) != 1 {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Usage: ;claim &lt;owner key&gt;",
+		})
+		return
+	}
+
+	if ownerKey == "" || subtle.ConstantTimeCompare([]byte(args[0]), []byte(ownerKey)) != 1 {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Invalid owner key",
+		})
+		return
+	}
+
+	s.claimOwnership(sessionID)
+	s.lobbyMu.Lock()
+	delete(s.lobbyPending, sessionID)
+	s.lobbyMu.Unlock()
+	s.announceRoleChange(sessionID, "transfer", sessionID)
+}
+
+// handleRoleCommand implements ;owner transfer, ;coowner add|remove, ;promote, ;demote and ;roles.
+// command is the command name without the leading ";".
+func (s *ChatServer) handleRoleCommand(sessionID, command string, args []string) {
+	var action, target string
+	switch {
+	case command == "owner" && len(args) == 2 && args[0] == "transfer":
+		action, target = "transfer", args[1]
+	case command == "coowner" && len(args) == 2 && (args[0] == "add" || args[0] == "remove"):
+		action, target = args[0]+"-coowner", args[1]
+	case (command == "promote" || command == "demote") && len(args) == 1:
+		action, target = command, args[0]
+	case command == "roles":
+		messageContent := "Room roles:"
+		assignments, _ := s.roleAssignments()
+		for _, assignment := range assignments {
+			messageContent += fmt.Sprintf(" [%s] (%s)", escapeText(assignment.Nickname), assignment.Role)
+		}
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: messageContent})
+		return
+	default:
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Usage: ;owner transfer &lt;nickname&gt;, ;coowner add|remove &lt;nickname&gt;, ;promote|;demote &lt;nickname&gt;, ;roles",
+		})
+		return
+	}
+
+	targetID := s.findSession(target)
+	if targetID == "" {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: fmt.Sprintf("User %s not found", escapeText(target)),
+		})
+		return
+	}
+
+	if err := s.applyRoleAction(sessionID, action, targetID, ""); err != nil {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Could not change role: " + escapeText(err.Error()),
+		})
+		return
+	}
+	s.announceRoleChange(sessionID, action, targetID)
+}
+
+// handleModRoles lists role holders (GET) or applies the role "action" (transfer, add-coowner,
+// remove-coowner, promote, demote) to the session in "target", a nickname or handle (POST). Responses carry an ETag
+// for the version of the roles; a POST with If-Match fails with 412 if they changed since.
+func (s *ChatServer) handleModRoles(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	if !s.isModerator(sessionID) {
+		http.Error(w, "Moderators only", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		assignments, etag := s.roleAssignments()
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(assignments)
+
+	case http.MethodPost:
+		r.ParseForm()
+		action := r.FormValue("action")
+		switch action {
+		case "transfer", "add-coowner", "remove-coowner", "promote", "demote":
+		default:
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+		target := s.findSession(r.FormValue("target"))
+		if target == "" {
+			http.Error(w, "Target not found", http.StatusNotFound)
+			return
+		}
+		if err := s.applyRoleAction(sessionID, action, target, r.Header.Get("If-Match")); err == errRolesChanged {
+			_, etag := s.roleAssignments()
+			w.Header().Set("ETag", etag)
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		s.announceRoleChange(sessionID, action, target)
+		assignments, etag := s.roleAssignments()
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(assignments)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
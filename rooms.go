@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Besides the main room everyone connected is in, members can open rooms to split conversations
+// off: ;join <room> creates the room if needed and switches to it, ;switch moves between joined
+// rooms and back to the main room, and ;leave leaves one. What someone sends goes to the room
+// they switched to, or to "room" when /send is given one. Room messages have Room set and only
+// reach the room's members. Each room numbers its messages with its own Seq and keeps the last
+// roomLogSize in its own log, read with /api/v1/events?room=. Bots, automation, federation and
+// relay edges only see the main room, though rooms opened from a template have automations of
+// their own, see templates.go. Rooms are removed once their last member leaves.
+
+const (
+	maxRooms    = 100
+	roomLogSize = 200
+)
+
+var roomNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+var (
+	errInvalidRoom  = errors.New("Invalid room: expected a name of 1 to 32 lowercase letters, digits, _ or -")
+	errTooManyRooms = errors.New("Too many rooms: join an existing one")
+	errUnknownRoom  = errors.New("Room not found")
+	errNotInRoom    = errors.New("Join the room first")
+)
+
+type Room struct {
+	Name      string    `json:"name"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	Members   int       `json:"members"`
+	// Template the room was created from, see templates.go.
+	Template string `json:"template,omitempty"`
+	// How the room shows in the room directory, see directory.go.
+	Category    string `json:"category,omitempty"`
+	Description string `json:"description,omitempty"`
+	Unlisted    bool   `json:"unlisted,omitempty"`
+
+	// Session identifiers of the members.
+	members map[string]bool
+	// Last messages, oldest first, and the Seq of the last one.
+	log []Message
+	seq uint64
+	// Whether animated images are turned off, see animations.go.
+	animationsOff bool
+	// Whether locations can be shared, see location.go.
+	locationsOn bool
+	// See slowmode.go.
+	slowmode slowmodeState
+	// From the room's template: its MOTD, the members who moderate it and its automations.
+	motd        string
+	moderators  map[string]bool
+	automations []AutomationRule
+}
+
+// normalizeRoom returns name as rooms are keyed, without a leading # and lowercased.
+func normalizeRoom(name string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "#"))
+}
+
+// joinRoom adds sessionID to the room name, creating it if needed, and switches it there.
+func (s *ChatServer) joinRoom(sessionID, name string) (string, error) {
+	name = normalizeRoom(name)
+	if !roomNamePattern.MatchString(name) {
+		return "", errInvalidRoom
+	}
+
+	s.roomsMu.Lock()
+	room, ok := s.rooms[name]
+	if !ok {
+		if len(s.rooms) >= maxRooms {
+			s.roomsMu.Unlock()
+			return "", errTooManyRooms
+		}
+		room = &Room{Name: name, CreatedBy: s.getNickname(sessionID), CreatedAt: s.clock.Now(), members: make(map[string]bool)}
+		s.rooms[name] = room
+	}
+	joined := !room.members[sessionID]
+	room.members[sessionID] = true
+	s.currentRooms[sessionID] = name
+	s.roomsMu.Unlock()
+
+	if joined {
+		s.welcomeToRoom(sessionID, name)
+	}
+	return name, nil
+}
+
+// leaveRoom removes sessionID from the room name, back to the main room if it was there.
+func (s *ChatServer) leaveRoom(sessionID, name string) (string, error) {
+	name = normalizeRoom(name)
+	s.roomsMu.Lock()
+	room, ok := s.rooms[name]
+	if !ok || !room.members[sessionID] {
+		s.roomsMu.Unlock()
+		return "", errNotInRoom
+	}
+	delete(room.members, sessionID)
+	if s.currentRooms[sessionID] == name {
+		delete(s.currentRooms, sessionID)
+	}
+	if len(room.members) == 0 {
+		delete(s.rooms, name)
+	}
+	s.roomsMu.Unlock()
+
+	s.broadcastToRoom(name, Message{FromApp: true, Kind: "text", Content: escapeText(s.getNickname(sessionID)) + " left #" + name})
+	return name, nil
+}
+
+// leaveAllRooms removes sessionID from every room, once the session is gone.
+func (s *ChatServer) leaveAllRooms(sessionID string) {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	delete(s.currentRooms, sessionID)
+	for name, room := range s.rooms {
+		delete(room.members, sessionID)
+		delete(room.slowmode.posts, sessionID)
+		if len(room.members) == 0 {
+			delete(s.rooms, name)
+		}
+	}
+}
+
+// switchRoom makes the room name, which sessionID must be in, where its messages go. An empty
+// name switches back to the main room.
+func (s *ChatServer) switchRoom(sessionID, name string) (string, error) {
+	name = normalizeRoom(name)
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	if name == "" {
+		delete(s.currentRooms, sessionID)
+		return "", nil
+	}
+	if room, ok := s.rooms[name]; !ok || !room.members[sessionID] {
+		return "", errNotInRoom
+	}
+	s.currentRooms[sessionID] = name
+	return name, nil
+}
+
+// currentRoom returns the room sessionID's messages go to, empty for the main room.
+func (s *ChatServer) currentRoom(sessionID string) string {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	return s.currentRooms[sessionID]
+}
+
+// inRoom reports whether sessionID may post to the room name, which anyone may for the main room.
+func (s *ChatServer) inRoom(sessionID, name string) bool {
+	if name == "" {
+		return true
+	}
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	room, ok := s.rooms[normalizeRoom(name)]
+	return ok && room.members[sessionID]
+}
+
+// canReadRoom reports whether sessionID may read what was said in the room name: its members and
+// the moderators may.
+func (s *ChatServer) canReadRoom(sessionID, name string) bool {
+	return s.inRoom(sessionID, name) || s.isModerator(sessionID)
+}
+
+func (s *ChatServer) roomExists(name string) bool {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	_, ok := s.rooms[normalizeRoom(name)]
+	return ok
+}
+
+func (s *ChatServer) roomList() []Room {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	rooms := make([]Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		listed := *room
+		listed.Members = len(room.members)
+		listed.members, listed.log, listed.moderators, listed.automations = nil, nil, nil, nil
+		rooms = append(rooms, listed)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms
+}
+
+// broadcastToRoom logs message in the room name and delivers it to the room's members, like
+// broadcastMessage does for the main room. It returns the message as sent.
+func (s *ChatServer) broadcastToRoom(name string, message Message) (Message, error) {
+	message = message.sanitized()
+	message.Room = name
+	message = s.stamp(message)
+
+	s.broadcastMu.Lock()
+	defer s.broadcastMu.Unlock()
+	s.roomsMu.Lock()
+	room, ok := s.rooms[name]
+	if !ok {
+		s.roomsMu.Unlock()
+		return message, errUnknownRoom
+	}
+	room.seq++
+	message.Seq = room.seq
+	if len(room.log) >= roomLogSize {
+		copy(room.log, room.log[1:])
+		room.log = room.log[:len(room.log)-1]
+	}
+	room.log = append(room.log, message)
+	members := make([]string, 0, len(room.members))
+	for id := range room.members {
+		members = append(members, id)
+	}
+	s.roomsMu.Unlock()
+	s.archive(message)
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return message, err
+	}
+	authorID := ""
+	if message.Author != nil && !message.FromApp {
+		authorID = s.sessionOfHandle(message.Author.ID)
+	}
+	muted := s.mutedBy(authorID, name)
+	s.countBroadcast()
+	s.hub.broadcastTo(members, func(id string, ch chan string) {
+		if !muted[id] {
+			s.deliver(ch, string(data))
+		}
+	})
+	return message, nil
+}
+
+// roomEventsSince is eventsSince for the log of the room name.
+func (s *ChatServer) roomEventsSince(name, since string) (events []Message, ok bool) {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	room, exists := s.rooms[normalizeRoom(name)]
+	if !exists {
+		return nil, false
+	}
+	if since == "" {
+		return append([]Message{}, room.log...), true
+	}
+	for i := len(room.log) - 1; i >= 0; i-- {
+		if room.log[i].ID == since {
+			return append([]Message{}, room.log[i+1:]...), true
+		}
+	}
+	return nil, false
+}
+
+func (s *ChatServer) handleRoomCommand(sessionID, command string, args []string) {
+	reply := func(content string) {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: content})
+	}
+
+	var err error
+	switch command {
+	case "join":
+		if len(args) != 1 {
+			reply("Usage: ;join &lt;room&gt;")
+			return
+		}
+		var name string
+		if name, err = s.joinRoom(sessionID, args[0]); err == nil {
+			reply(fmt.Sprintf("You joined #%s, your messages now go there. ;switch goes back to the main room", name))
+			s.sendPins(sessionID, name)
+		}
+
+	case "leave":
+		if len(args) != 1 {
+			reply("Usage: ;leave &lt;room&gt;")
+			return
+		}
+		var name string
+		if name, err = s.leaveRoom(sessionID, args[0]); err == nil {
+			reply(fmt.Sprintf("You left #%s", name))
+		}
+
+	case "switch":
+		if len(args) > 1 {
+			reply("Usage: ;switch [room]")
+			return
+		}
+		target := ""
+		if len(args) == 1 {
+			target = args[0]
+		}
+		var name string
+		if name, err = s.switchRoom(sessionID, target); err == nil {
+			if name == "" {
+				reply("Your messages now go to the main room")
+			} else {
+				reply(fmt.Sprintf("Your messages now go to #%s", name))
+			}
+		}
+
+	case "room":
+		if len(args) > 0 && (args[0] == "list" || args[0] == "unlist" || args[0] == "category" || args[0] == "describe") {
+			s.handleRoomDirectoryCommand(sessionID, args)
+		} else {
+			s.handleRoomTemplateCommand(sessionID, args)
+		}
+
+	case "rooms":
+		current := s.currentRoom(sessionID)
+		messageContent := ""
+		for _, room := range s.directory(sessionID) {
+			marker := ""
+			if room.Name == current {
+				marker = ", current"
+			} else if s.inRoom(sessionID, room.Name) {
+				marker = ", joined"
+			}
+			messageContent += fmt.Sprintf("<br>#%s (%d members%s)", room.Name, room.Members, marker)
+		}
+		if messageContent == "" {
+			messageContent = "<br>No rooms yet, ;join &lt;room&gt; opens one"
+		}
+		if roomsDirectory != "off" {
+			messageContent += `<br><a href="/rooms" target="_blank">Room directory</a>`
+		}
+		reply("Rooms:" + messageContent)
+	}
+	if err != nil {
+		reply(escapeText(err.Error()))
+	}
+}
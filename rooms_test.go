@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"alantern/chattest"
+)
+
+func TestRoomHistoryNeedsMembership(t *testing.T) {
+	key := moderatorKey
+	moderatorKey = "test-key"
+	t.Cleanup(func() { moderatorKey = key })
+
+	_, srv := newTestServer(t)
+	alice, bob, mod := srv.Connect(), srv.Connect(), srv.Connect()
+	alice.SetNickname("alice")
+	alice.Send(";room create games")
+	alice.Send(";switch games")
+	alice.Send("meet at the usual place")
+	mod.Send(";mod test-key")
+	alice.Collect(settle)
+	mod.Collect(settle)
+
+	for _, path := range []string{"/api/v1/events?room=games", "/api/v1/events.txt?room=games", "/pins?room=games"} {
+		if status, body := bob.Do(http.MethodGet, path, nil); status != http.StatusForbidden {
+			t.Errorf("GET %s by a stranger: %d %s, want 403", path, status, body)
+		}
+		for name, client := range map[string]*chattest.Client{"member": alice, "moderator": mod} {
+			if status, body := client.Do(http.MethodGet, path, nil); status != http.StatusOK {
+				t.Errorf("GET %s by the %s: %d %s, want 200", path, name, status, body)
+			}
+		}
+	}
+	if status, _ := bob.Do(http.MethodGet, "/pins?room=nowhere", nil); status != http.StatusNotFound {
+		t.Errorf("pins of an unknown room: %d, want 404", status)
+	}
+}
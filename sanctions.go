@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Moderators deal with someone misbehaving in steps. ;kick ends their stream, which can't
+// connect again for kickCooldown (see admin.go). ;mute <nickname> <duration>, given a duration
+// unlike a member's own ;mute, keeps what they post from being broadcast until it runs out, with
+// nothing said to the room; they are told they are muted when they try. ;shadowmute goes further
+// for spammers, who would only try again elsewhere: what they post is echoed back to them alone,
+// as if it had been broadcast, until ;unshadowmute or the optional duration runs out. ;ban blocks
+// their session, and the address it was last seen from, until unbanned (see bans.go). Moderators
+// can't be kicked, muted or banned.
+
+// Longest moderator mute.
+const maxModMute = 7 * 24 * time.Hour
+
+// modTarget returns the session of target for a moderator command, telling sessionID why if
+// it can't be sanctioned.
+func (s *ChatServer) modTarget(sessionID, command, target string) string {
+	if !s.isModerator(sessionID) {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: fmt.Sprintf("Only moderators can use ;%s", command)})
+		return ""
+	}
+	id := s.findSession(target)
+	if id == "" {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: fmt.Sprintf("User %s not found", escapeText(target))})
+		return ""
+	}
+	if s.isModerator(id) {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: fmt.Sprintf("Moderators can't be %s", sanctioned[command])})
+		return ""
+	}
+	return id
+}
+
+var sanctioned = map[string]string{"kick": "kicked", "mute": "muted", "shadowmute": "muted", "ban": "banned"}
+
+func (s *ChatServer) handleKickCommand(sessionID string, args []string) {
+	if len(args) == 0 {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Usage: ;kick &lt;nickname|session&gt; [reason]"})
+		return
+	}
+	target := s.modTarget(sessionID, "kick", args[0])
+	if target == "" {
+		return
+	}
+
+	reason := strings.Join(args[1:], " ")
+	nickname := s.getNickname(target)
+	s.kick(target, reason)
+	s.audit(sessionID, "session.kick", target, reason)
+	s.logModAction(fmt.Sprintf("[%s] was kicked", escapeText(nickname)))
+	s.notifyModerators(Message{
+		Kind:    "text",
+		Content: fmt.Sprintf("[%s] kicked [%s] (%s)", escapeText(s.getNickname(sessionID)), escapeText(nickname), sessionHandle(target)),
+	})
+}
+
+// handleModMuteCommand mutes args[0] for the duration args[1], for the reason in the rest.
+func (s *ChatServer) handleModMuteCommand(sessionID string, args []string) {
+	target := s.modTarget(sessionID, "mute", args[0])
+	if target == "" {
+		return
+	}
+	d, err := time.ParseDuration(args[1])
+	if err != nil || d <= 0 || d > maxModMute {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: fmt.Sprintf("Invalid duration, use something like 15m or 1h, at most %s", maxModMute)})
+		return
+	}
+
+	s.modMutesMu.Lock()
+	s.modMutes[target] = s.clock.Now().Add(d)
+	s.modMutesMu.Unlock()
+
+	reason := strings.Join(args[2:], " ")
+	s.audit(sessionID, "session.mute", target, strings.TrimSpace(d.String()+" "+reason))
+	s.logModAction(fmt.Sprintf("[%s] was muted for %s", escapeText(s.getNickname(target)), d))
+	s.notifyModerators(Message{
+		Kind: "text",
+		Content: fmt.Sprintf("[%s] muted [%s] (%s) for %s, ;unmute %s lifts it", escapeText(s.getNickname(sessionID)),
+			escapeText(s.getNickname(target)), sessionHandle(target), d, escapeText(args[0])),
+	})
+}
+
+// liftModMute lifts the moderator mute of target, done by sessionID, and reports whether there
+// was one.
+func (s *ChatServer) liftModMute(sessionID, target string) bool {
+	s.modMutesMu.Lock()
+	_, muted := s.modMutes[target]
+	delete(s.modMutes, target)
+	s.modMutesMu.Unlock()
+	if !muted {
+		return false
+	}
+
+	s.audit(sessionID, "session.unmute", target, "")
+	s.logModAction(fmt.Sprintf("[%s] was unmuted", escapeText(s.getNickname(target))))
+	s.notifyModerators(Message{
+		Kind:    "text",
+		Content: fmt.Sprintf("[%s] unmuted [%s] (%s)", escapeText(s.getNickname(sessionID)), escapeText(s.getNickname(target)), sessionHandle(target)),
+	})
+	return true
+}
+
+// muteRestriction returns why sessionID can't post, if a moderator muted it.
+func (s *ChatServer) muteRestriction(sessionID string) string {
+	s.modMutesMu.Lock()
+	defer s.modMutesMu.Unlock()
+	until, ok := s.modMutes[sessionID]
+	if !ok {
+		return ""
+	}
+	left := until.Sub(s.clock.Now())
+	if left <= 0 {
+		delete(s.modMutes, sessionID)
+		return ""
+	}
+	return fmt.Sprintf("You are muted by the moderators for %s", left.Round(time.Second))
+}
+
+func (s *ChatServer) handleShadowMuteCommand(sessionID, command string, args []string) {
+	if len(args) == 0 || (command == "unshadowmute" && len(args) != 1) || len(args) > 2 {
+		usage := "Usage: ;shadowmute &lt;nickname|session&gt; [duration]"
+		if command == "unshadowmute" {
+			usage = "Usage: ;unshadowmute &lt;nickname|session&gt;"
+		}
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: usage})
+		return
+	}
+	target := s.modTarget(sessionID, "shadowmute", args[0])
+	if target == "" {
+		return
+	}
+	who := fmt.Sprintf("[%s] (%s)", escapeText(s.getNickname(target)), sessionHandle(target))
+
+	if command == "unshadowmute" {
+		s.modMutesMu.Lock()
+		_, muted := s.shadowMutes[target]
+		delete(s.shadowMutes, target)
+		s.modMutesMu.Unlock()
+		if !muted {
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: who + " is not shadow muted"})
+			return
+		}
+		s.audit(sessionID, "session.unshadowmute", target, "")
+		s.notifyModerators(Message{Kind: "text", Content: fmt.Sprintf("[%s] lifted the shadow mute of %s", escapeText(s.getNickname(sessionID)), who)})
+		return
+	}
+
+	var until time.Time
+	length := "until lifted"
+	if len(args) == 2 {
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d <= 0 || d > maxModMute {
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: fmt.Sprintf("Invalid duration, use something like 15m or 1h, at most %s", maxModMute)})
+			return
+		}
+		until, length = s.clock.Now().Add(d), "for "+d.String()
+	}
+	s.modMutesMu.Lock()
+	s.shadowMutes[target] = until
+	s.modMutesMu.Unlock()
+
+	// Left out of the public moderation log, which would give it away.
+	s.audit(sessionID, "session.shadowmute", target, length)
+	s.notifyModerators(Message{
+		Kind:    "text",
+		Content: fmt.Sprintf("[%s] shadow muted %s %s, ;unshadowmute %s lifts it", escapeText(s.getNickname(sessionID)), who, length, escapeText(args[0])),
+	})
+}
+
+// shadowMuted reports whether what sessionID posts should only be echoed back to it.
+func (s *ChatServer) shadowMuted(sessionID string) bool {
+	s.modMutesMu.Lock()
+	defer s.modMutesMu.Unlock()
+	until, ok := s.shadowMutes[sessionID]
+	if ok && !until.IsZero() && !s.clock.Now().Before(until) {
+		delete(s.shadowMutes, sessionID)
+		return false
+	}
+	return ok
+}
+
+// echoShadowMuted sends message, posted by a shadow muted session in room, back to its author
+// alone, as it would have been broadcast.
+func (s *ChatServer) echoShadowMuted(room string, message Message) {
+	message.Room = room
+	s.sendTo(s.sessionOfHandle(message.Author.ID), s.stamp(message))
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMutedCantPostAnyOtherWay(t *testing.T) {
+	s, srv := newTestServer(t)
+	alice, bob := srv.Connect(), srv.Connect()
+	alice.SetNickname("alice")
+	bob.Collect(settle)
+	s.modMutesMu.Lock()
+	s.modMutes[s.findSession("alice")] = s.clock.Now().Add(time.Hour)
+	s.modMutesMu.Unlock()
+
+	if status, body := alice.Upload(testPNG(t), false); status != http.StatusForbidden {
+		t.Errorf("muted upload: %d %s, want 403", status, body)
+	}
+	if status, body := alice.Do(http.MethodPost, "/api/v1/todos", url.Values{"text": {"buy milk"}}); status != http.StatusForbidden {
+		t.Errorf("muted todo: %d %s, want 403", status, body)
+	}
+	if status, body := alice.Do(http.MethodPost, "/timers", url.Values{"duration": {"1m"}}); status != http.StatusForbidden {
+		t.Errorf("muted timer: %d %s, want 403", status, body)
+	}
+	alice.Send(";snippet save hi hello there")
+	alice.Send(";snippet get hi")
+	bob.ExpectNone(settle)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// Everything clients are sent goes through one pipeline. Text people wrote (messages, nicknames,
+// reasons, labels) is escaped with escapeText where it is put in a message, so that the markup
+// the server adds itself (line breaks, links, mentions) can be told apart from theirs. Then, as
+// messages are sent, outboundPolicy sanitizes the content of those with text, whatever put it
+// there: only the elements and attributes it allows are kept, links must go to this origin or
+// be http, https or mailto, and scripts, styles and the like are dropped along with what they
+// contain. A place that forgets to escape then gets unwanted markup removed rather than run.
+
+// escapeText escapes text from people for HTML content, as every message's content is.
+func escapeText(text string) string {
+	return html.EscapeString(text)
+}
+
+type sanitizePolicy struct {
+	// Attributes allowed on each allowed element.
+	elements map[string]map[string]bool
+	// Elements dropped along with their content, rather than just their tags.
+	dropContent map[string]bool
+}
+
+// outboundPolicy allows the markup the server puts in messages.
+var outboundPolicy = sanitizePolicy{
+	elements: map[string]map[string]bool{
+		"br":     {},
+		"b":      {},
+		"strong": {},
+		"i":      {},
+		"em":     {},
+		"u":      {},
+		"s":      {},
+		"code":   {},
+		"pre":    {},
+		"span":   {"class": true},
+		"a":      {"href": true, "target": true, "rel": true},
+	},
+	dropContent: map[string]bool{
+		"script": true, "style": true, "iframe": true, "object": true, "embed": true,
+		"template": true, "noscript": true, "textarea": true, "title": true,
+	},
+}
+
+// sanitize returns content with only the markup p allows, every tag left open closed.
+func (p sanitizePolicy) sanitize(content string) string {
+	if !strings.ContainsAny(content, "<&") {
+		return content
+	}
+
+	var out strings.Builder
+	var open []string
+	dropping := ""
+	z := xhtml.NewTokenizer(strings.NewReader(content))
+	for {
+		tokenType := z.Next()
+		if tokenType == xhtml.ErrorToken {
+			break
+		}
+		token := z.Token()
+		if dropping != "" {
+			if tokenType == xhtml.EndTagToken && token.Data == dropping {
+				dropping = ""
+			}
+			continue
+		}
+
+		switch tokenType {
+		case xhtml.TextToken:
+			out.WriteString(html.EscapeString(token.Data))
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			if p.dropContent[token.Data] {
+				if tokenType == xhtml.StartTagToken {
+					dropping = token.Data
+				}
+				continue
+			}
+			allowed, ok := p.elements[token.Data]
+			if !ok {
+				continue
+			}
+			out.WriteString("<" + token.Data)
+			for _, attr := range token.Attr {
+				if attr.Namespace != "" || !allowed[attr.Key] || (attr.Key == "href" && !safeLink(attr.Val)) {
+					continue
+				}
+				out.WriteString(" " + attr.Key + `="` + html.EscapeString(attr.Val) + `"`)
+			}
+			out.WriteString(">")
+			if tokenType == xhtml.StartTagToken && token.Data != "br" {
+				open = append(open, token.Data)
+			}
+		case xhtml.EndTagToken:
+			// Close whatever was left open inside the element, ignoring end tags that match none.
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] != token.Data {
+					continue
+				}
+				for j := len(open) - 1; j >= i; j-- {
+					out.WriteString("</" + open[j] + ">")
+				}
+				open = open[:i]
+				break
+			}
+		}
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		out.WriteString("</" + open[i] + ">")
+	}
+	return out.String()
+}
+
+// safeLink reports whether href is a link to this origin, or an http, https or mailto one.
+func safeLink(href string) bool {
+	target, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return false
+	}
+	switch target.Scheme {
+	case "":
+		return target.Host == "" && !strings.HasPrefix(href, "//")
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+// sanitized returns message ready to send, as its kind sanitizes it (see kinds.go).
+func (m Message) sanitized() Message {
+	if kind := contentKinds[m.Kind]; kind.Sanitize != nil {
+		return kind.Sanitize(m)
+	}
+	return m
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Text messages from members come with their content split into Segments, so that rich clients
+// can show mentions, links and emoji without parsing the HTML of Content: runs of plain text,
+// "@nickname" mentions of someone connected at the time, http and https links, and emoji. The
+// text of every segment is plain, to be shown as is, and the segments put together are the
+// message as sent. Messages that are all plain text have no Segments, Content being their text.
+
+type Segment struct {
+	// One of "text", "mention", "link" or "emoji".
+	Type string `json:"type"`
+	// Text of the segment, plain.
+	Text string `json:"text"`
+	// Handle of the session mentioned, see sessionHandle. Only set if Type is "mention".
+	SessionID string `json:"sessionId,omitempty"`
+	// Where the link goes. Only set if Type is "link".
+	URL string `json:"url,omitempty"`
+}
+
+// Trailing punctuation that ends a sentence rather than a link or mention.
+const segmentTrailing = ".,;:!?)]}'\""
+
+// segments splits text into segments, or returns nil if it is all plain text.
+func (s *ChatServer) segments(text string) []Segment {
+	var segments []Segment
+	plain := 0
+	// flush ends the plain text run at end.
+	flush := func(end int) {
+		if end > plain {
+			segments = append(segments, Segment{Type: "text", Text: text[plain:end]})
+		}
+	}
+
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		atWordStart := i == 0 || unicode.IsSpace(lastRune(text[:i]))
+
+		if atWordStart && (strings.HasPrefix(text[i:], "http://") || strings.HasPrefix(text[i:], "https://")) {
+			word := strings.TrimRight(wordAt(text, i), segmentTrailing)
+			if target, err := url.Parse(word); err == nil && target.Host != "" {
+				flush(i)
+				segments = append(segments, Segment{Type: "link", Text: word, URL: target.String()})
+				i += len(word)
+				plain = i
+				continue
+			}
+		}
+		if atWordStart && r == '@' {
+			if nickname, id := s.mentionAt(text, i+1); id != "" {
+				flush(i)
+				segments = append(segments, Segment{Type: "mention", Text: "@" + nickname, SessionID: sessionHandle(id)})
+				i += 1 + len(nickname)
+				plain = i
+				continue
+			}
+		}
+		if isEmoji(r) {
+			flush(i)
+			end := i + size
+			for end < len(text) {
+				next, nextSize := utf8.DecodeRuneInString(text[end:])
+				if !isEmoji(next) && !joinsEmoji(next) {
+					break
+				}
+				end += nextSize
+			}
+			segments = append(segments, Segment{Type: "emoji", Text: text[i:end]})
+			i = end
+			plain = i
+			continue
+		}
+		i += size
+	}
+
+	if len(segments) == 0 {
+		return nil
+	}
+	flush(len(text))
+	return segments
+}
+
+// mentionAt returns the nickname of a connected session starting at text[i:], with its session,
+// trailing punctuation aside.
+func (s *ChatServer) mentionAt(text string, i int) (string, string) {
+	word := wordAt(text, i)
+	for _, nickname := range []string{word, strings.TrimRight(word, segmentTrailing)} {
+		id := s.findSession(nickname)
+		if nickname == "" || id == "" || s.getNickname(id) != nickname {
+			continue
+		}
+		if _, connected := s.hub.lookup(id); connected {
+			return nickname, id
+		}
+	}
+	return "", ""
+}
+
+// wordAt returns the text from i to the next space.
+func wordAt(text string, i int) string {
+	if end := strings.IndexFunc(text[i:], unicode.IsSpace); end >= 0 {
+		return text[i : i+end]
+	}
+	return text[i:]
+}
+
+func lastRune(text string) rune {
+	r, _ := utf8.DecodeLastRuneInString(text)
+	return r
+}
+
+// isEmoji reports whether r starts an emoji: a pictograph, symbol or regional indicator.
+func isEmoji(r rune) bool {
+	return (r >= 0x1F000 && r <= 0x1FAFF && !joinsEmoji(r)) || (r >= 0x2600 && r <= 0x27BF) || r == 0x2B50 || r == 0x2B55
+}
+
+// joinsEmoji reports whether r continues the emoji before it: a zero-width joiner, variation
+// selector, keycap or skin tone.
+func joinsEmoji(r rune) bool {
+	return r == 0x200D || r == 0xFE0F || r == 0x20E3 || (r >= 0x1F3FB && r <= 0x1F3FF)
+}
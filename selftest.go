@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	mrand "math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Started with -selftest, the server soaks itself with synthetic traffic so operators can check
+// it keeps up before an event: -selftest-users members connect in process and post
+// -selftest-rate messages per second between them, through the same broadcaster as everyone
+// else, for -selftest-duration. Their messages have Test set and "[selftest]" in front, so
+// real clients connected meanwhile can tell them apart. Every selftestReportInterval, and at the
+// end, the server prints how many deliveries were made, missed and how long they took.
+
+const selftestReportInterval = 10 * time.Second
+
+type selftestConfig struct {
+	users    int
+	rate     float64
+	duration time.Duration
+}
+
+type selftestStats struct {
+	mu sync.Mutex
+	// When each message still expected was sent, by identifier.
+	sentAt    map[string]time.Time
+	sent      int
+	delivered int
+	dropped   int
+	latencies []time.Duration
+}
+
+// report prints the stats since the last report and resets them.
+func (stats *selftestStats) report(users int, final bool) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	sort.Slice(stats.latencies, func(i, j int) bool { return stats.latencies[i] < stats.latencies[j] })
+	percentile := func(p float64) time.Duration {
+		if len(stats.latencies) == 0 {
+			return 0
+		}
+		return stats.latencies[int(p*float64(len(stats.latencies)-1))]
+	}
+	label := "Selftest"
+	if final {
+		label = "Selftest done"
+	}
+	slog.Info(label, "users", users, "sent", stats.sent, "delivered", stats.delivered, "missed", stats.dropped,
+		"p50", percentile(0.5), "p99", percentile(0.99), "max", percentile(1))
+	stats.sent, stats.delivered, stats.dropped = 0, 0, 0
+	stats.latencies = stats.latencies[:0]
+}
+
+// runSelftest generates synthetic traffic as configured, then disconnects the synthetic members.
+func (s *ChatServer) runSelftest(config selftestConfig) {
+	stats := &selftestStats{sentAt: make(map[string]time.Time)}
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+
+	sessions := make([]string, config.users)
+	channels := make([]chan string, config.users)
+	for i := range sessions {
+		id := "selftest-" + s.newID()
+		sessions[i] = id
+		channels[i] = make(chan string, clientBuffer)
+		s.nicknamesMu.Lock()
+		s.nicknames[id] = fmt.Sprintf("selftest-%d", i+1)
+		s.nicknamesMu.Unlock()
+		s.nicknameColorsMu.Lock()
+		s.nicknameColors[id] = s.generateRandomColor()
+		s.nicknameColorsMu.Unlock()
+		s.hub.connect(id, channels[i])
+
+		readers.Add(1)
+		go func(ch chan string) {
+			defer readers.Done()
+			for {
+				select {
+				case data := <-ch:
+					stats.receive(s.clock.Now(), data)
+				case <-done:
+					return
+				}
+			}
+		}(channels[i])
+	}
+	slog.Info("Selftest started", "users", config.users, "rate", config.rate)
+
+	var end <-chan time.Time
+	if config.duration > 0 {
+		end = s.clock.After(config.duration)
+	}
+	interval := time.Duration(float64(time.Second) / config.rate)
+	report := s.clock.Now().Add(selftestReportInterval)
+	for n := 1; ; n++ {
+		select {
+		case <-end:
+			close(done)
+			readers.Wait()
+			for _, id := range sessions {
+				s.hub.disconnect(id, nil)
+			}
+			s.nicknamesMu.Lock()
+			for _, id := range sessions {
+				delete(s.nicknames, id)
+			}
+			s.nicknamesMu.Unlock()
+			s.nicknameColorsMu.Lock()
+			for _, id := range sessions {
+				delete(s.nicknameColors, id)
+			}
+			s.nicknameColorsMu.Unlock()
+			stats.report(config.users, true)
+			return
+		case <-s.clock.After(interval):
+		}
+
+		author := sessions[mrand.Intn(len(sessions))]
+		message := Message{
+			ID:      s.newID(),
+			Kind:    "text",
+			Content: fmt.Sprintf("[selftest] message %d", n),
+			Author:  s.authorOf(author),
+			Test:    true,
+		}
+		stats.mu.Lock()
+		stats.sentAt[message.ID] = s.clock.Now()
+		stats.sent++
+		stats.mu.Unlock()
+		s.broadcastMessage(message)
+
+		if now := s.clock.Now(); !now.Before(report) {
+			stats.forget(now.Add(-selftestReportInterval))
+			stats.report(config.users, false)
+			report = now.Add(selftestReportInterval)
+		}
+	}
+}
+
+// receive records the encoded event data as delivered at now to a synthetic member.
+func (stats *selftestStats) receive(now time.Time, data string) {
+	var event Message
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return
+	}
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	if event.Kind == "gap" && event.Gap != nil {
+		stats.dropped += event.Gap.Dropped
+		return
+	}
+	messages := append([]Message{event}, event.Messages...)
+	for _, message := range messages {
+		if !message.Test {
+			continue
+		}
+		if sentAt, ok := stats.sentAt[message.ID]; ok {
+			stats.delivered++
+			stats.latencies = append(stats.latencies, now.Sub(sentAt))
+		}
+	}
+}
+
+// forget stops expecting messages sent before cutoff.
+func (stats *selftestStats) forget(cutoff time.Time) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	for id, sentAt := range stats.sentAt {
+		if sentAt.Before(cutoff) {
+			delete(stats.sentAt, id)
+		}
+	}
+}
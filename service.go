@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// "alantern service" runs the server in the background for self-hosters without a process
+// manager of their own, with the one of the system: the Windows service manager, launchd on macOS
+// and systemd elsewhere. "install" registers it to start at boot (at login for launchd agents,
+// installed by users other than root) and restart if it fails, with the serve flags given to it
+// and the settings set in its environment, since services don't get the environment of a shell.
+// The server keeps its files in -data-dir, a directory of the system's unless given. The log goes
+// to the Event Log (start, stop and failures) and alantern.log in the data directory on Windows,
+// alantern.log on macOS, and the journal with systemd. "uninstall" removes the service, "start"
+// and "stop" start and stop it, and "run" is what the service manager runs.
+
+const (
+	serviceName        = "alantern"
+	serviceDisplayName = "Alantern"
+	serviceDescription = "Alantern chat server"
+)
+
+var errServiceInstalled = errors.New("the service is already installed, uninstall it first")
+
+const serviceUsage = `Usage: alantern service <action> [flags]
+
+Actions:
+  install [serve flags]  install the server as a service of the system, starting at boot
+  uninstall              remove the service
+  start                  start the service
+  stop                   stop the service
+  run [serve flags]      run the server, as the service manager does
+
+install records the settings set in its environment with the service, so set them first, or
+give them as flags. Installing and uninstalling usually needs an administrator or root.
+`
+
+// serviceConfig is how the service manager runs the server.
+type serviceConfig struct {
+	// Absolute path of alantern, and the arguments of "service run".
+	executable string
+	args       []string
+	// The settings recorded with the service, as NAME=value.
+	env     []string
+	dataDir string
+}
+
+func service(args []string) {
+	action, args := opsAction(args, serviceUsage)
+	switch action {
+	case "install":
+		config, err := newServiceConfig(args)
+		if err == nil {
+			err = installService(config)
+		}
+		opsDone(err, fmt.Sprintf("Installed the %s service, with its files in %s and its log %s", serviceName, config.dataDir, serviceLog(config)))
+	case "uninstall":
+		opsDone(uninstallService(), "Uninstalled the "+serviceName+" service")
+	case "start":
+		opsDone(startService(), "Started the "+serviceName+" service")
+	case "stop":
+		opsDone(stopService(), "Stopped the "+serviceName+" service")
+	case "run":
+		runService(args)
+	default:
+		fmt.Print(serviceUsage)
+		os.Exit(2)
+	}
+}
+
+// newServiceConfig returns how the service runs the server given the serve flags args.
+func newServiceConfig(args []string) (serviceConfig, error) {
+	flags := flag.NewFlagSet("service install", flag.ExitOnError)
+	options := serverFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		fmt.Print(serviceUsage)
+		os.Exit(2)
+	}
+
+	config := serviceConfig{dataDir: *options.dataDir}
+	if config.dataDir == "" {
+		config.dataDir = defaultServiceDataDir()
+	}
+	var err error
+	if config.dataDir, err = filepath.Abs(config.dataDir); err != nil {
+		return config, err
+	}
+	if config.executable, err = os.Executable(); err != nil {
+		return config, err
+	}
+	if config.executable, err = filepath.EvalSymlinks(config.executable); err != nil {
+		return config, err
+	}
+	config.args = append([]string{"service", "run"}, args...)
+	config.args = append(config.args, "-data-dir", config.dataDir)
+	for _, v := range configVars() {
+		if value, ok := os.LookupEnv(v.name); ok && v.name != "DATA_DIR" {
+			config.env = append(config.env, v.name+"="+value)
+		}
+	}
+	return config, os.MkdirAll(config.dataDir, 0o755)
+}
@@ -0,0 +1,124 @@
+//go:build darwin
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// launchd runs the server as a daemon when installed by root, or else as an agent of the user
+// installing it.
+
+func launchdPlist() string {
+	if os.Geteuid() == 0 {
+		return filepath.Join("/Library/LaunchDaemons", serviceName+".plist")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, "Library/LaunchAgents", serviceName+".plist")
+}
+
+func defaultServiceDataDir() string {
+	if os.Geteuid() == 0 {
+		return filepath.Join("/usr/local/var", serviceName)
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, "Library/Application Support", serviceName)
+}
+
+func serviceLogFile(config serviceConfig) string {
+	return filepath.Join(config.dataDir, "alantern.log")
+}
+
+func serviceLog(config serviceConfig) string {
+	return "in " + serviceLogFile(config)
+}
+
+func plistString(value string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(value))
+	return "<string>" + escaped.String() + "</string>"
+}
+
+func installService(config serviceConfig) error {
+	plist := launchdPlist()
+	if _, err := os.Stat(plist); err == nil {
+		return errServiceInstalled
+	}
+
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+`)
+	fmt.Fprintf(&b, "\t<key>Label</key>\n\t%s\n", plistString(serviceName))
+	b.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range append([]string{config.executable}, config.args...) {
+		fmt.Fprintf(&b, "\t\t%s\n", plistString(arg))
+	}
+	b.WriteString("\t</array>\n")
+	if len(config.env) > 0 {
+		b.WriteString("\t<key>EnvironmentVariables</key>\n\t<dict>\n")
+		for _, v := range config.env {
+			name, value, _ := strings.Cut(v, "=")
+			fmt.Fprintf(&b, "\t\t<key>%s</key>\n\t\t%s\n", name, plistString(value))
+		}
+		b.WriteString("\t</dict>\n")
+	}
+	fmt.Fprintf(&b, "\t<key>WorkingDirectory</key>\n\t%s\n", plistString(config.dataDir))
+	fmt.Fprintf(&b, "\t<key>StandardOutPath</key>\n\t%s\n", plistString(serviceLogFile(config)))
+	fmt.Fprintf(&b, "\t<key>StandardErrorPath</key>\n\t%s\n", plistString(serviceLogFile(config)))
+	// Started when loaded, and restarted if it exits unless it stopped cleanly.
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n\t<key>KeepAlive</key>\n\t<dict>\n\t\t<key>SuccessfulExit</key>\n\t\t<false/>\n\t</dict>\n")
+	b.WriteString("</dict>\n</plist>\n")
+
+	if err := os.MkdirAll(filepath.Dir(plist), 0o755); err != nil {
+		return err
+	}
+	// It may hold secrets, such as ADMIN_TOKEN.
+	if err := os.WriteFile(plist, b.Bytes(), 0o600); err != nil {
+		return err
+	}
+	if err := launchctl("load", "-w", plist); err != nil {
+		os.Remove(plist)
+		return err
+	}
+	return nil
+}
+
+func uninstallService() error {
+	plist := launchdPlist()
+	if _, err := os.Stat(plist); errors.Is(err, os.ErrNotExist) {
+		return errors.New("the service is not installed")
+	}
+	launchctl("unload", "-w", plist)
+	return os.Remove(plist)
+}
+
+func startService() error {
+	return launchctl("start", serviceName)
+}
+
+func stopService() error {
+	return launchctl("stop", serviceName)
+}
+
+func launchctl(args ...string) error {
+	out, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %s: %v %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// runService serves with the serve flags args, launchd stopping it with SIGTERM.
+func runService(args []string) {
+	serve(args)
+}
@@ -0,0 +1,91 @@
+//go:build !windows && !darwin
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// systemd runs the server as a system unit, logging to the journal.
+
+var systemdUnit = filepath.Join("/etc/systemd/system", serviceName+".service")
+
+func defaultServiceDataDir() string {
+	return filepath.Join("/var/lib", serviceName)
+}
+
+func serviceLog(config serviceConfig) string {
+	return "in the journal, see journalctl -u " + serviceName
+}
+
+// systemdQuote quotes value for a unit file, where % starts a specifier and $ a variable.
+func systemdQuote(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$", "\n", `\n`).Replace(value)
+	return `"` + value + `"`
+}
+
+func installService(config serviceConfig) error {
+	if _, err := os.Stat(systemdUnit); err == nil {
+		return errServiceInstalled
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\nDescription=%s\nAfter=network-online.target\nWants=network-online.target\n\n[Service]\n", serviceDescription)
+	command := []string{systemdQuote(config.executable)}
+	for _, arg := range config.args {
+		command = append(command, systemdQuote(arg))
+	}
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(command, " "))
+	fmt.Fprintf(&b, "WorkingDirectory=%s\n", config.dataDir)
+	for _, v := range config.env {
+		fmt.Fprintf(&b, "Environment=%s\n", systemdQuote(v))
+	}
+	b.WriteString("Restart=on-failure\nRestartSec=5\n\n[Install]\nWantedBy=multi-user.target\n")
+
+	// It may hold secrets, such as ADMIN_TOKEN.
+	if err := os.WriteFile(systemdUnit, []byte(b.String()), 0o600); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		os.Remove(systemdUnit)
+		return err
+	}
+	return systemctl("enable", serviceName)
+}
+
+func uninstallService() error {
+	if _, err := os.Stat(systemdUnit); errors.Is(err, os.ErrNotExist) {
+		return errors.New("the service is not installed")
+	}
+	systemctl("disable", "--now", serviceName)
+	if err := os.Remove(systemdUnit); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
+
+func startService() error {
+	return systemctl("start", serviceName)
+}
+
+func stopService() error {
+	return systemctl("stop", serviceName)
+}
+
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %v %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// runService serves with the serve flags args, systemd stopping it with SIGTERM.
+func runService(args []string) {
+	serve(args)
+}
@@ -0,0 +1,180 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// Event identifiers of what the service reports to the Event Log.
+const (
+	eventStarted = 1
+	eventStopped = 2
+	eventFailed  = 3
+)
+
+func defaultServiceDataDir() string {
+	return filepath.Join(os.Getenv("ProgramData"), serviceName)
+}
+
+func serviceLogFile(config serviceConfig) string {
+	return filepath.Join(config.dataDir, "alantern.log")
+}
+
+func serviceLog(config serviceConfig) string {
+	return "in " + serviceLogFile(config) + " and the Event Log"
+}
+
+func installService(config serviceConfig) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return errServiceInstalled
+	}
+
+	args := append(config.args, "-log-file", serviceLogFile(config))
+	s, err := m.CreateService(serviceName, config.executable, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: serviceDescription,
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	// Restarted when it fails, forgetting failures after a day.
+	if err := s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * time.Second}}, 24*60*60); err != nil {
+		s.Delete()
+		return err
+	}
+	if len(config.env) > 0 {
+		key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+serviceName, registry.SET_VALUE)
+		if err != nil {
+			s.Delete()
+			return err
+		}
+		err = key.SetStringsValue("Environment", config.env)
+		key.Close()
+		if err != nil {
+			s.Delete()
+			return err
+		}
+	}
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return err
+	}
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("the service is not installed: %w", err)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	eventlog.Remove(serviceName)
+	return nil
+}
+
+func startService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("the service is not installed: %w", err)
+	}
+	defer s.Close()
+	return s.Start()
+}
+
+func stopService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("the service is not installed: %w", err)
+	}
+	defer s.Close()
+	_, err = s.Control(svc.Stop)
+	return err
+}
+
+// runService serves with the serve flags args, under the service manager if it started it.
+func runService(args []string) {
+	if inService, err := svc.IsWindowsService(); err != nil || !inService {
+		serve(args)
+		return
+	}
+	events, err := eventlog.Open(serviceName)
+	if err != nil {
+		os.Exit(1)
+	}
+	defer events.Close()
+	if err := svc.Run(serviceName, &windowsService{args: args, events: events}); err != nil {
+		events.Error(eventFailed, fmt.Sprintf("%s failed: %v", serviceName, err))
+		os.Exit(1)
+	}
+}
+
+type windowsService struct {
+	args   []string
+	events *eventlog.Log
+}
+
+func (ws *windowsService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	stopped := make(chan struct{})
+	go func() {
+		// serve exits with 1 if the server can't start, which the service manager restarts.
+		serve(ws.args)
+		close(stopped)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	ws.events.Info(eventStarted, serviceName+" started, logging to its -log-file")
+
+	for {
+		select {
+		case <-stopped:
+			ws.events.Info(eventStopped, serviceName+" stopped")
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				select {
+				case stopRequests <- "service stopped":
+				default:
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// On SIGINT or SIGTERM, or when the Windows service manager stops it, the server shuts down
+// gracefully: jobs stop, every stream gets a private farewell message and shutdownFlushTimeout to
+// take what is still queued for it, then streams are closed and other requests get shutdownTimeout
+// to finish. Relay edges with MIGRATE_TARGET set drain to it first, so their clients move rather
+// than drop.
+
+const (
+	shutdownFlushTimeout = 2 * time.Second
+	shutdownTimeout      = 10 * time.Second
+)
+
+// stopRequests stops the server as SIGTERM does, with why, for the Windows service manager.
+var stopRequests = make(chan string, 1)
+
+// serve serves handler on addr until the process is told to stop.
+func (s *ChatServer) serve(addr string, handler http.Handler) error {
+	// Requests are cancelled with this once the farewell is out, which ends every stream.
+	streams, cancelStreams := context.WithCancel(context.Background())
+	defer cancelStreams()
+	server := &http.Server{
+		Addr:        addr,
+		Handler:     recoverPanics(securityHeaders(handler)),
+		BaseContext: func(net.Listener) context.Context { return streams },
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	errs := make(chan error, 1)
+	go func() { errs <- listenAndServe(server) }()
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		slog.Info("Shutting down", "signal", sig.String())
+	case reason := <-stopRequests:
+		slog.Info("Shutting down", "reason", reason)
+	}
+
+	s.shutdown()
+	cancelStreams()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Requests still running at shutdown", "err", err)
+		server.Close()
+	}
+	s.stopArchive()
+	s.stopMessages()
+	slog.Info("Server stopped")
+	return nil
+}
+
+// shutdown stops the jobs and says farewell to every stream, waiting for their queues to empty,
+// and then stops the hub.
+func (s *ChatServer) shutdown() {
+	close(s.stopping)
+	defer s.hub.stop()
+
+	if relayUpstream != "" && migrateTarget != "" {
+		if err := s.drain(migrateTarget); err == nil {
+			_, drained := s.migration()
+			<-drained
+			return
+		}
+	}
+
+	s.flushLivestream()
+	data, _ := json.Marshal(s.stamp(Message{FromApp: true, Private: true, Kind: "text", Content: "Server shutting down, reconnect in a moment"}))
+	s.broadcastMu.Lock()
+	s.broadcastRaw(string(data))
+	s.broadcastMu.Unlock()
+
+	deadline := s.clock.Now().Add(shutdownFlushTimeout)
+	for s.clock.Now().Before(deadline) && s.queued() > 0 {
+		<-s.clock.After(50 * time.Millisecond)
+	}
+}
+
+// queued returns how many events wait in client queues.
+func (s *ChatServer) queued() int {
+	total := 0
+	s.hub.read(func(clients map[string]chan string) {
+		for _, ch := range clients {
+			total += len(ch)
+		}
+	})
+	return total
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Moderators slow a room down with ;slowmode <interval> [duration], from inside it: members then
+// wait interval between two messages posted there, until ;slowmode off or the duration runs out,
+// and are told how long is left when they try sooner. ;slowmode alone says whether it is on.
+// Moderators of the room aren't slowed down. Automation rules can slow the main room down too,
+// see automation.go.
+
+// Longest wait between two messages.
+const maxSlowmodeInterval = time.Hour
+
+type slowmodeState struct {
+	// Minimum time between two messages from the same session, 0 when slow mode is off.
+	interval time.Duration
+	// When slow mode switches itself off, zero if it stays on.
+	until time.Time
+	// When each session last posted while it was on.
+	posts map[string]time.Time
+}
+
+func (state *slowmodeState) active(now time.Time) bool {
+	return state.interval > 0 && (state.until.IsZero() || now.Before(state.until))
+}
+
+// withSlowmode calls f with the slow mode of the room name, the main room if "", locked.
+func (s *ChatServer) withSlowmode(name string, f func(state *slowmodeState)) error {
+	if name == "" {
+		s.slowmodeMu.Lock()
+		defer s.slowmodeMu.Unlock()
+		f(&s.slowmode)
+		return nil
+	}
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	room, ok := s.rooms[name]
+	if !ok {
+		return errUnknownRoom
+	}
+	f(&room.slowmode)
+	return nil
+}
+
+// setSlowmode makes members wait interval between messages in the room name for d, or until
+// switched off if d is 0. An interval of 0 switches slow mode off.
+func (s *ChatServer) setSlowmode(name string, interval, d time.Duration) error {
+	return s.withSlowmode(name, func(state *slowmodeState) {
+		*state = slowmodeState{interval: interval}
+		if interval > 0 && d > 0 {
+			state.until = s.clock.Now().Add(d)
+		}
+	})
+}
+
+// slowmodeRestriction returns how long sessionID must wait before sending a message in the room
+// name, or "".
+func (s *ChatServer) slowmodeRestriction(sessionID, name string) string {
+	if s.moderatesRoom(sessionID, name) {
+		return ""
+	}
+	now := s.clock.Now()
+	var wait time.Duration
+	s.withSlowmode(name, func(state *slowmodeState) {
+		if last, ok := state.posts[sessionID]; ok && state.active(now) {
+			wait = state.interval - now.Sub(last)
+		}
+	})
+	if wait > 0 {
+		return fmt.Sprintf("Slow mode is on: wait %s before sending another message", wait.Round(time.Second))
+	}
+	return ""
+}
+
+// slowmodePosted notes that sessionID posted in the room name at now.
+func (s *ChatServer) slowmodePosted(sessionID, name string, now time.Time) {
+	s.withSlowmode(name, func(state *slowmodeState) {
+		if !state.active(now) {
+			state.posts = nil
+			return
+		}
+		if state.posts == nil {
+			state.posts = make(map[string]time.Time)
+		}
+		state.posts[sessionID] = now
+	})
+}
+
+func (s *ChatServer) handleSlowmodeCommand(sessionID string, args []string) {
+	room := s.currentRoom(sessionID)
+	if !s.moderatesRoom(sessionID, room) {
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Only moderators can use ;slowmode",
+		})
+		return
+	}
+	where := "the main room"
+	if room != "" {
+		where = "#" + room
+	}
+
+	if len(args) == 0 {
+		now := s.clock.Now()
+		content := "Slow mode is off in " + where
+		s.withSlowmode(room, func(state *slowmodeState) {
+			switch {
+			case !state.active(now):
+			case state.until.IsZero():
+				content = fmt.Sprintf("Slow mode is on in %s: one message every %s", where, state.interval)
+			default:
+				content = fmt.Sprintf("Slow mode is on in %s: one message every %s, %s remaining", where, state.interval, state.until.Sub(now).Round(time.Second))
+			}
+		})
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: content})
+		return
+	}
+
+	var interval, d time.Duration
+	if args[0] != "off" || len(args) > 1 {
+		var err error
+		valid := len(args) <= 2
+		if interval, err = time.ParseDuration(args[0]); err != nil || interval <= 0 || interval > maxSlowmodeInterval {
+			valid = false
+		}
+		if len(args) == 2 {
+			if d, err = time.ParseDuration(args[1]); err != nil || d <= 0 {
+				valid = false
+			}
+		}
+		if !valid {
+			s.sendPrivateMessage(sessionID, Message{
+				Kind:    "text",
+				Content: fmt.Sprintf("Usage: ;slowmode &lt;interval&gt; [duration]|off, with an interval such as 10s, at most %s", maxSlowmodeInterval),
+			})
+			return
+		}
+	}
+	if err := s.setSlowmode(room, interval, d); err != nil {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: escapeText(err.Error())})
+		return
+	}
+
+	content := fmt.Sprintf("Slow mode turned off in %s by [%s]", where, escapeText(s.getNickname(sessionID)))
+	if interval > 0 {
+		s.audit(sessionID, "slowmode.on", room, interval.String())
+		content = fmt.Sprintf("Slow mode turned on in %s by [%s]: one message every %s", where, escapeText(s.getNickname(sessionID)), interval)
+		if d > 0 {
+			content += ", for " + d.String()
+		}
+	} else {
+		s.audit(sessionID, "slowmode.off", room, "")
+	}
+	notice := Message{FromApp: true, Kind: "text", Content: content}
+	if room == "" {
+		s.broadcastMessage(notice)
+	} else {
+		s.broadcastToRoom(room, notice)
+	}
+}
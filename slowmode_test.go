@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"alantern/chattest"
+)
+
+func TestUploadsAreSlowedDown(t *testing.T) {
+	clock := newFakeClock()
+	s, srv := newTestServer(t, WithClock(clock))
+	alice := srv.Connect()
+	alice.SetNickname("alice")
+	alice.Collect(settle)
+	if err := s.setSlowmode("", time.Minute, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, body := alice.Upload(testPNG(t), false); status != http.StatusOK {
+		t.Fatalf("upload: %d %s", status, body)
+	}
+	if status, body := alice.Upload(testPNG(t), false); status != http.StatusForbidden {
+		t.Fatalf("second upload: %d %s, want 403", status, body)
+	}
+	alice.Collect(settle)
+	alice.Send("too soon")
+	alice.Expect(chattest.Private("Slow mode is on"))
+
+	clock.Advance(time.Minute)
+	if status, body := alice.Upload(testPNG(t), false); status != http.StatusOK {
+		t.Fatalf("upload after the interval: %d %s", status, body)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A room's history can be published once an event is over as a snapshot, a static site of it that
+// any web server can serve, without JavaScript: pages of snapshotPageSize messages, oldest first
+// and linked to each other, and the images that are still stored. The server renders it as a zip
+// archive at /api/admin/snapshot, of "room" or the main room, from the message store for the main
+// room when MESSAGE_DB is set, or else from the event log or the room's log, so what is too old to
+// be in those isn't in it either. Private messages, activity such as joins and system events are
+// left out, and edits are applied. Under legal hold they can be checked, see legalhold.go.
+// "alantern snapshot" downloads one from the running server into a directory, with ADMIN_TOKEN like
+// "alantern room".
+
+const (
+	snapshotPageSize = 100
+	// Most messages read from the message store.
+	maxSnapshotMessages = 100000
+)
+
+type snapshotEntry struct {
+	Nickname string
+	Color    string
+	FromApp  bool
+	// Content as HTML, sanitized when it was sent, or else as text.
+	HTML template.HTML
+	Text string
+	// File of the image in the snapshot, and whether it had expired.
+	Image        string
+	ImageExpired bool
+}
+
+type snapshotPage struct {
+	Title       string
+	Page, Pages int
+	Prev, Next  string
+	Entries     []snapshotEntry
+	GeneratedAt time.Time
+}
+
+var snapshotTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}{{if gt .Pages 1}}, page {{.Page}}{{end}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 48rem; margin: 2rem auto; padding: 0 1rem; line-height: 1.5; }
+.message { margin: 0.25rem 0; overflow-wrap: anywhere; }
+.nickname { font-weight: bold; }
+.app { color: #666; font-style: italic; }
+.message img { display: block; max-width: 100%; max-height: 30rem; margin: 0.25rem 0; }
+nav { display: flex; justify-content: space-between; margin: 1.5rem 0; }
+footer { color: #666; font-size: 0.875rem; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{- define "nav"}}{{if gt .Pages 1}}
+<nav><span>{{with .Prev}}<a href="{{.}}">Earlier</a>{{end}}</span><span>Page {{.Page}} of {{.Pages}}</span><span>{{with .Next}}<a href="{{.}}">Later</a>{{end}}</span></nav>
+{{- end}}{{end}}
+{{template "nav" .}}
+{{range .Entries}}<div class="message{{if .FromApp}} app{{end}}">
+{{- if not .FromApp}}<span class="nickname"{{with .Color}} style="color: {{.}}"{{end}}>{{.Nickname}}</span> {{end}}
+{{- if .Image}}<img src="{{.Image}}" alt="Image from {{.Nickname}}">
+{{- else if .ImageExpired}}<em>(image no longer stored)</em>
+{{- else if .HTML}}{{.HTML}}{{else}}{{.Text}}{{end}}</div>
+{{end}}
+{{- if not .Entries}}<p>No messages.</p>{{end}}
+{{template "nav" .}}
+<footer>Archived on {{.GeneratedAt.Format "2006-01-02 15:04 MST"}}.</footer>
+</body>
+</html>
+`))
+
+// snapshotMessages returns the messages of the room name kept, oldest first.
+func (s *ChatServer) snapshotMessages(name string) ([]Message, error) {
+	if name != "" {
+		events, ok := s.roomEventsSince(name, "")
+		if !ok {
+			return nil, errUnknownRoom
+		}
+		return events, nil
+	}
+	if s.messages != nil {
+		return s.messages.Recent(maxSnapshotMessages)
+	}
+	events, _ := s.eventsSince("")
+	return events, nil
+}
+
+// snapshotEntries returns what shows of events, with edits applied, and the images they show.
+func (s *ChatServer) snapshotEntries(events []Message) ([]snapshotEntry, map[string][]byte) {
+	var messages []Message
+	index := make(map[string]int)
+	for _, event := range events {
+		if event.Private || event.Test || event.Activity != "" || !contentKinds[event.Kind].Message {
+			continue
+		}
+		switch event.Kind {
+		case "update":
+			if i, ok := index[event.ID]; ok {
+				messages[i].Content = event.Content
+			}
+			continue
+		case "command", "interaction", "reaction", "form", "response":
+			continue
+		case "batch":
+			for _, coalesced := range event.Messages {
+				index[coalesced.ID] = len(messages)
+				messages = append(messages, coalesced)
+			}
+			continue
+		}
+		index[event.ID] = len(messages)
+		messages = append(messages, event)
+	}
+
+	entries := make([]snapshotEntry, len(messages))
+	images := make(map[string][]byte)
+	s.imageStoreMu.Lock()
+	defer s.imageStoreMu.Unlock()
+	for i, message := range messages {
+		entry := snapshotEntry{FromApp: message.FromApp || message.Author == nil}
+		if message.Author != nil {
+			entry.Nickname, entry.Color = message.Author.Nickname, message.Author.Color
+		}
+		switch message.Kind {
+		case "image":
+			data, ok := s.imageStore[message.Content]
+			if !ok {
+				entry.ImageExpired = true
+				break
+			}
+			contentType, _ := uploadContentType(data)
+			extension := strings.TrimPrefix(contentType, "image/")
+			if extension == contentType {
+				extension = "bin"
+			}
+			entry.Image = "images/" + message.Content + "." + extension
+			images[entry.Image] = data
+		case "text":
+			entry.HTML = template.HTML(message.Content)
+		default:
+			entry.Text = messageText(message)
+		}
+		entries[i] = entry
+	}
+	return entries, images
+}
+
+// snapshotPageFile returns the file of the page n of a snapshot, from 1.
+func snapshotPageFile(n int) string {
+	if n == 1 {
+		return "index.html"
+	}
+	return fmt.Sprintf("page-%d.html", n)
+}
+
+// writeSnapshot writes the snapshot of the room name, made of events, to w as a zip archive. Under
+// legal hold, it returns the hash of its SHA256SUMS.
+func (s *ChatServer) writeSnapshot(w io.Writer, name string, events []Message) (string, error) {
+	entries, images := s.snapshotEntries(events)
+	title := "Main room"
+	if name != "" {
+		title = "#" + name
+	}
+	pages := max(1, (len(entries)+snapshotPageSize-1)/snapshotPageSize)
+	now := s.clock.Now().UTC()
+
+	archive := zip.NewWriter(w)
+	sums := make(map[string][sha256.Size]byte)
+	for n := 1; n <= pages; n++ {
+		page := snapshotPage{Title: title, Page: n, Pages: pages, GeneratedAt: now}
+		page.Entries = entries[min(len(entries), (n-1)*snapshotPageSize):min(len(entries), n*snapshotPageSize)]
+		if n > 1 {
+			page.Prev = snapshotPageFile(n - 1)
+		}
+		if n < pages {
+			page.Next = snapshotPageFile(n + 1)
+		}
+		var html bytes.Buffer
+		if err := snapshotTemplate.Execute(&html, page); err != nil {
+			return "", err
+		}
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: snapshotPageFile(n), Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return "", err
+		}
+		if _, err := file.Write(html.Bytes()); err != nil {
+			return "", err
+		}
+		sums[snapshotPageFile(n)] = sha256.Sum256(html.Bytes())
+	}
+	for name, data := range images {
+		// Images are compressed already.
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: now})
+		if err != nil {
+			return "", err
+		}
+		if _, err := file.Write(data); err != nil {
+			return "", err
+		}
+		sums[name] = sha256.Sum256(data)
+	}
+	sumsHash := ""
+	if legalHold {
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: snapshotSums, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return "", err
+		}
+		if sumsHash, err = writeSums(file, sums); err != nil {
+			return "", err
+		}
+	}
+	return sumsHash, archive.Close()
+}
+
+// handleAdminSnapshot returns the snapshot of "room", or the main room, as a zip archive.
+func (s *ChatServer) handleAdminSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !adminTokenAuthorized(r) {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+	room := normalizeRoom(r.URL.Query().Get("room"))
+	events, err := s.snapshotMessages(room)
+	if err == errUnknownRoom {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Could not read the messages", http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	sumsHash, err := s.writeSnapshot(&buf, room, events)
+	if err != nil {
+		http.Error(w, "Could not render the snapshot", http.StatusInternalServerError)
+		return
+	}
+	detail := ""
+	if legalHold {
+		sum := sha256.Sum256(buf.Bytes())
+		detail = fmt.Sprintf("sha256 %s, %s %s", hex.EncodeToString(sum[:]), snapshotSums, sumsHash)
+	}
+	s.audit("admin", "snapshot", room, detail)
+	filename := "snapshot"
+	if room != "" {
+		filename += "-" + room
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.zip"`)
+	w.Write(buf.Bytes())
+}
+
+func snapshot(args []string) {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	client := adminFlags(flags)
+	room := flags.String("room", "", "room to snapshot, the main room by default")
+	output := flags.String("o", "", "directory to write the site to, snapshot[-<room>] by default")
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	dir := *output
+	if dir == "" {
+		dir = "snapshot"
+		if *room != "" {
+			dir += "-" + normalizeRoom(*room)
+		}
+	}
+
+	resp, err := client.request("/api/admin/snapshot?"+url.Values{"room": {*room}}.Encode(), nil)
+	opsDone(err, "")
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	opsDone(err, "")
+	n, err := extractSnapshot(data, dir)
+	opsDone(err, fmt.Sprintf("Wrote %d pages to %s", n, dir))
+}
+
+// extractSnapshot writes the files of the snapshot archive data to dir, which must not exist,
+// and returns how many pages there were.
+func extractSnapshot(data []byte, dir string) (int, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return 0, fmt.Errorf("%s exists, give another directory with -o", dir)
+	}
+	pages := 0
+	for _, file := range archive.File {
+		name := path.Clean(file.Name)
+		if strings.HasPrefix(name, "/") || strings.HasPrefix(name, "..") {
+			return pages, errors.New("the server sent a file outside of the snapshot: " + file.Name)
+		}
+		if path.Ext(name) == ".html" {
+			pages++
+		}
+		content, err := file.Open()
+		if err != nil {
+			return pages, err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(target), 0o755)
+		if err == nil {
+			err = writeSnapshotFile(target, content)
+		}
+		content.Close()
+		if err != nil {
+			return pages, err
+		}
+	}
+	return pages, nil
+}
+
+// writeSnapshotFile writes r to path, readable by the web server publishing it.
+func writeSnapshotFile(path string, r io.Reader) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
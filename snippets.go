@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snippets are named pieces of text, links or configs people share often, saved with ;snippet
+// save and posted again with ;snippet get. Anyone can save a new one; only whoever saved it, or a
+// moderator, can change or delete it. They are saved to SNIPPET_FILE, when set, and loaded from it
+// on start.
+
+var snippetFile = os.Getenv("SNIPPET_FILE")
+
+const maxSnippets = 200
+
+var snippetNamePattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+var (
+	errInvalidSnippet  = errors.New("Invalid snippet: expected a name of 1 to 32 lowercase letters, digits, _ or -, and some content")
+	errTooManySnippets = errors.New("Too many snippets: delete some first")
+	errUnknownSnippet  = errors.New("Snippet not found")
+	errSnippetNotYours = errors.New("Only whoever saved a snippet, or a moderator, can change or delete it")
+)
+
+type Snippet struct {
+	Name string `json:"name"`
+	// HTML-escaped content.
+	Content   string    `json:"content"`
+	UpdatedBy string    `json:"updatedBy"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// Session identifier of whoever first saved it, allowed to change it.
+	owner string
+}
+
+type savedSnippet struct {
+	Snippet
+	Owner string `json:"owner"`
+}
+
+func (s *ChatServer) snippetList() []Snippet {
+	s.snippetsMu.Lock()
+	defer s.snippetsMu.Unlock()
+	snippets := make([]Snippet, 0, len(s.snippets))
+	for _, snippet := range s.snippets {
+		snippets = append(snippets, *snippet)
+	}
+	sort.Slice(snippets, func(i, j int) bool { return snippets[i].Name < snippets[j].Name })
+	return snippets
+}
+
+func (s *ChatServer) snippet(name string) (Snippet, bool) {
+	s.snippetsMu.Lock()
+	defer s.snippetsMu.Unlock()
+	snippet, ok := s.snippets[strings.ToLower(name)]
+	if !ok {
+		return Snippet{}, false
+	}
+	return *snippet, true
+}
+
+// saveSnippet creates the snippet name, or replaces it if sessionID may.
+func (s *ChatServer) saveSnippet(sessionID, name, content string) (Snippet, error) {
+	name = strings.ToLower(name)
+	content = strings.TrimSpace(content)
+	if !snippetNamePattern.MatchString(name) || content == "" || validateMessage(content) != nil {
+		return Snippet{}, errInvalidSnippet
+	}
+	moderator := s.isModerator(sessionID)
+
+	s.snippetsMu.Lock()
+	defer s.snippetsMu.Unlock()
+	owner := sessionID
+	if existing, ok := s.snippets[name]; ok {
+		if existing.owner != sessionID && !moderator {
+			return Snippet{}, errSnippetNotYours
+		}
+		owner = existing.owner
+	} else if len(s.snippets) >= maxSnippets {
+		return Snippet{}, errTooManySnippets
+	}
+	snippet := &Snippet{
+		Name:      name,
+		Content:   escapeText(content),
+		UpdatedBy: s.getNickname(sessionID),
+		UpdatedAt: s.clock.Now(),
+		owner:     owner,
+	}
+	s.snippets[name] = snippet
+	s.persistSnippetsLocked()
+	return *snippet, nil
+}
+
+// deleteSnippet deletes the snippet name. Only whoever saved it and moderators can.
+func (s *ChatServer) deleteSnippet(sessionID, name string) error {
+	name = strings.ToLower(name)
+	moderator := s.isModerator(sessionID)
+
+	s.snippetsMu.Lock()
+	defer s.snippetsMu.Unlock()
+	snippet, ok := s.snippets[name]
+	if !ok {
+		return errUnknownSnippet
+	}
+	if snippet.owner != sessionID && !moderator {
+		return errSnippetNotYours
+	}
+	delete(s.snippets, name)
+	s.persistSnippetsLocked()
+	return nil
+}
+
+// persistSnippetsLocked writes the snippets to snippetFile, if set.
+func (s *ChatServer) persistSnippetsLocked() {
+	if snippetFile == "" {
+		return
+	}
+	saved := make([]savedSnippet, 0, len(s.snippets))
+	for _, snippet := range s.snippets {
+		saved = append(saved, savedSnippet{Snippet: *snippet, Owner: snippet.owner})
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Name < saved[j].Name })
+	if err := saveJSONFile(snippetFile, saved); err != nil {
+		slog.Error("Could not save snippets", "err", err)
+	}
+}
+
+// loadSnippets reads the snippets saved in snippetFile, if it exists.
+func (s *ChatServer) loadSnippets() error {
+	if snippetFile == "" {
+		return nil
+	}
+	var saved []savedSnippet
+	if err := loadJSONFile(snippetFile, &saved); err != nil {
+		return fmt.Errorf("%s: %w", snippetFile, err)
+	}
+	s.snippetsMu.Lock()
+	defer s.snippetsMu.Unlock()
+	for i := range saved {
+		saved[i].owner = saved[i].Owner
+		s.snippets[saved[i].Name] = &saved[i].Snippet
+	}
+	return nil
+}
+
+func (s *ChatServer) handleSnippetCommand(sessionID string, text string) {
+	usage := Message{Kind: "text", Content: "Usage: ;snippet save &lt;name&gt; &lt;content&gt;|get &lt;name&gt;|delete &lt;name&gt;|list"}
+	args := strings.SplitN(text, " ", 3)
+	if len(args) == 0 || args[0] == "" {
+		s.sendPrivateMessage(sessionID, usage)
+		return
+	}
+
+	var err error
+	switch strings.ToLower(args[0]) {
+	case "save":
+		if len(args) != 3 {
+			s.sendPrivateMessage(sessionID, usage)
+			return
+		}
+		var snippet Snippet
+		if snippet, err = s.saveSnippet(sessionID, args[1], args[2]); err == nil {
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: fmt.Sprintf("Saved snippet %s", snippet.Name)})
+		}
+
+	case "get":
+		if len(args) != 2 {
+			s.sendPrivateMessage(sessionID, usage)
+			return
+		}
+		snippet, ok := s.snippet(args[1])
+		if !ok {
+			err = errUnknownSnippet
+		} else if err = s.canPost(sessionID); err == nil {
+			s.broadcastMessage(Message{
+				Kind:    "text",
+				Content: snippet.Content,
+				Author:  s.authorOf(sessionID),
+			})
+		}
+
+	case "delete":
+		if len(args) != 2 {
+			s.sendPrivateMessage(sessionID, usage)
+			return
+		}
+		if err = s.deleteSnippet(sessionID, args[1]); err == nil {
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Deleted snippet " + escapeText(strings.ToLower(args[1]))})
+		}
+
+	case "list":
+		messageContent := ""
+		for _, snippet := range s.snippetList() {
+			messageContent += fmt.Sprintf("<br>%s (%s)", snippet.Name, escapeText(snippet.UpdatedBy))
+		}
+		if messageContent == "" {
+			messageContent = "<br>No snippets saved"
+		}
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Snippets:" + messageContent})
+
+	default:
+		s.sendPrivateMessage(sessionID, usage)
+	}
+	if err != nil {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: escapeText(err.Error())})
+	}
+}
+
+// handleSnippets lists snippets by name (GET), or the one named "name", saves "content" as "name"
+// (POST), or deletes the snippet "name" (DELETE).
+func (s *ChatServer) handleSnippets(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if name := r.URL.Query().Get("name"); name != "" {
+			snippet, ok := s.snippet(name)
+			if !ok {
+				http.Error(w, errUnknownSnippet.Error(), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(snippet)
+			return
+		}
+		writePage(w, r, s.snippetList(), func(snippet Snippet) string { return snippet.Name })
+
+	case http.MethodPost:
+		r.ParseForm()
+		snippet, err := s.saveSnippet(sessionID, r.FormValue("name"), normalizeMessage(r.FormValue("content")))
+		switch err {
+		case nil:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(snippet)
+		case errSnippetNotYours:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+
+	case http.MethodDelete:
+		switch err := s.deleteSnippet(sessionID, r.URL.Query().Get("name")); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errSnippetNotYours:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Each message dropped for going over the rate limits (see ratelimit.go and iplimits.go) is a
+// strike against its sender, and SPAM_STRIKES strikes within SPAM_WINDOW are an offence. Offences
+// are dealt with by the steps of SPAM_ESCALATION in turn, comma-separated: "warn" warns the
+// sender, "mute" mutes them as a moderator's ;mute does, and "ban" bans them as ;ban does, both
+// for SPAM_PENALTY unless the step gives its own duration, as in "mute:1h". Offences past the
+// last step get it again, and are forgotten spamMemory after the last one. Those muted and banned
+// are listed in the moderation log, and moderators are told; moderators get no strikes.
+
+const (
+	defaultSpamWindow     = time.Minute
+	defaultSpamStrikes    = 5
+	defaultSpamPenalty    = 15 * time.Minute
+	defaultSpamEscalation = "warn,mute,ban"
+	// How long offences are remembered after the last one.
+	spamMemory = 24 * time.Hour
+)
+
+type spamStep struct {
+	// "warn", "mute" or "ban".
+	action   string
+	duration time.Duration
+}
+
+type spamPolicy struct {
+	window     time.Duration
+	strikes    int
+	escalation []spamStep
+}
+
+// spamRecord is what a session did over the rate limits.
+type spamRecord struct {
+	// When its latest messages were dropped, within the window.
+	strikes []time.Time
+	// Offences so far, and when the last was.
+	offences    int
+	lastOffence time.Time
+}
+
+// parseSpamPolicy parses the spam settings, window, strikes, penalty and escalation.
+func parseSpamPolicy(window, strikes, penalty, escalation string) (spamPolicy, error) {
+	policy := spamPolicy{window: defaultSpamWindow, strikes: defaultSpamStrikes}
+	if window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil || d <= 0 {
+			return policy, fmt.Errorf("SPAM_WINDOW: expected a duration such as 1m, got %q", window)
+		}
+		policy.window = d
+	}
+	if strikes != "" {
+		n, err := strconv.Atoi(strikes)
+		if err != nil || n < 1 {
+			return policy, fmt.Errorf("SPAM_STRIKES: expected a positive number, got %q", strikes)
+		}
+		policy.strikes = n
+	}
+	defaultDuration := defaultSpamPenalty
+	if penalty != "" {
+		d, err := time.ParseDuration(penalty)
+		if err != nil || d <= 0 || d > maxModMute {
+			return policy, fmt.Errorf("SPAM_PENALTY: expected a duration such as 15m, at most %s, got %q", maxModMute, penalty)
+		}
+		defaultDuration = d
+	}
+	if escalation == "" {
+		escalation = defaultSpamEscalation
+	}
+	for _, value := range strings.Split(escalation, ",") {
+		action, duration, timed := strings.Cut(strings.TrimSpace(value), ":")
+		step := spamStep{action: action, duration: defaultDuration}
+		if action != "warn" && action != "mute" && action != "ban" {
+			return policy, fmt.Errorf(`SPAM_ESCALATION: %q is not "warn", "mute" or "ban"`, value)
+		}
+		if timed {
+			d, err := time.ParseDuration(duration)
+			if err != nil || d <= 0 || action == "warn" || (action == "mute" && d > maxModMute) {
+				return policy, fmt.Errorf("SPAM_ESCALATION: invalid duration in %q", value)
+			}
+			step.duration = d
+		}
+		policy.escalation = append(policy.escalation, step)
+	}
+	return policy, nil
+}
+
+func defaultSpamPolicy() spamPolicy {
+	policy, _ := parseSpamPolicy("", "", "", "")
+	return policy
+}
+
+// loadSpamPolicy reads the spam settings from the environment.
+func (s *ChatServer) loadSpamPolicy() (err error) {
+	s.spamPolicy, err = parseSpamPolicy(os.Getenv("SPAM_WINDOW"), os.Getenv("SPAM_STRIKES"), os.Getenv("SPAM_PENALTY"), os.Getenv("SPAM_ESCALATION"))
+	return err
+}
+
+// spamStrike counts a strike against sessionID, whose message was dropped at now, and deals with
+// the offence if that makes one. It reports whether sessionID was told about it.
+func (s *ChatServer) spamStrike(sessionID string, now time.Time) bool {
+	if s.isModerator(sessionID) {
+		return false
+	}
+
+	s.spamMu.Lock()
+	record, ok := s.spam[sessionID]
+	if !ok {
+		record = &spamRecord{}
+		s.spam[sessionID] = record
+	}
+	kept := record.strikes[:0]
+	for _, at := range record.strikes {
+		if now.Sub(at) < s.spamPolicy.window {
+			kept = append(kept, at)
+		}
+	}
+	record.strikes = append(kept, now)
+	if len(record.strikes) < s.spamPolicy.strikes {
+		s.spamMu.Unlock()
+		return false
+	}
+	record.strikes = nil
+	if now.Sub(record.lastOffence) > spamMemory {
+		record.offences = 0
+	}
+	record.offences++
+	record.lastOffence = now
+	step := s.spamPolicy.escalation[min(record.offences, len(s.spamPolicy.escalation))-1]
+	s.spamMu.Unlock()
+
+	s.spamPenalty(sessionID, step)
+	return true
+}
+
+// spamPenalty deals with an offence of sessionID as step says.
+func (s *ChatServer) spamPenalty(sessionID string, step spamStep) {
+	nickname := s.getNickname(sessionID)
+	switch step.action {
+	case "warn":
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "Slow down: keep flooding the chat and you will be muted",
+		})
+		return
+	case "mute":
+		s.modMutesMu.Lock()
+		s.modMutes[sessionID] = s.clock.Now().Add(step.duration)
+		s.modMutesMu.Unlock()
+		s.audit("spam", "session.mute", sessionID, step.duration.String()+" for spamming")
+		s.logModAction(fmt.Sprintf("[%s] was muted for %s for spamming", escapeText(nickname), step.duration))
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: fmt.Sprintf("You have been muted for %s for spamming", step.duration),
+		})
+	case "ban":
+		s.banSession(sessionID, "spam", "Spamming", step.duration)
+		s.audit("spam", "ban", sessionID, "for "+step.duration.String()+" for spamming")
+		s.logModAction(fmt.Sprintf("[%s] was banned for %s for spamming", escapeText(nickname), step.duration))
+		s.sendPrivateMessage(sessionID, Message{
+			Kind:    "text",
+			Content: "You have been banned for spamming. You can appeal once by sending a message to /appeal",
+		})
+	}
+	s.notifyModerators(Message{
+		Kind:    "text",
+		Content: fmt.Sprintf("[%s] (%s) was %s for %s for spamming", escapeText(nickname), sessionHandle(sessionID), sanctioned[step.action], step.duration),
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"alantern/chattest"
+)
+
+func TestSharedAddressLimitMakesNoStrikes(t *testing.T) {
+	s, srv := newTestServer(t, WithClock(newFakeClock()), WithMessageLimiter(newTokenBucketLimiter(1, 1)))
+	// The test clients all come from the same address.
+	s.addressMessages = newTokenBucketLimiter(1, 2)
+	alice, bob, carol := srv.Connect(), srv.Connect(), srv.Connect()
+	alice.SetNickname("alice")
+	bob.SetNickname("bob")
+	carol.SetNickname("carol")
+	alice.Collect(settle)
+	carol.Collect(settle)
+	strikes := func(nickname string) int {
+		s.spamMu.Lock()
+		defer s.spamMu.Unlock()
+		if record, ok := s.spam[s.findSession(nickname)]; ok {
+			return len(record.strikes)
+		}
+		return 0
+	}
+
+	alice.Send("one")
+	bob.Send("two")
+	carol.Send("three")
+	carol.Expect(chattest.Text("one"), chattest.Text("two"), chattest.Private("wait"))
+	if n := strikes("carol"); n != 0 {
+		t.Errorf("%d strikes for going over the limit of the address, want none", n)
+	}
+	alice.Collect(settle)
+	alice.Send("four")
+	alice.Expect(chattest.Private("wait"))
+	if n := strikes("alice"); n != 1 {
+		t.Errorf("%d strikes for going over the limit of the session, want 1", n)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// /events streams are typed. Each event has the SSE type of what it is: "join", "leave" or "nick"
+// for the app messages announcing those (see Message.Activity), "message" for what members send,
+// and "system" for everything else, from pins to private replies. Logged events of the main room
+// also carry their Seq as SSE id, never going down within a stream. Browsers send the last one
+// back as Last-Event-ID when they reconnect on their own, and the stream then starts with the
+// events logged after it instead of the usual history, after a "gap" event if the log no longer
+// goes back that far. Private messages and those of other rooms have no id: streams resumed with
+// their token get those too, see resume.go.
+//
+// Every SSE_HEARTBEAT (15s unless set, as a duration like "30s") streams get a ": ping" comment,
+// so that proxies don't close them for being idle, and so that a client that went away is noticed
+// when writing to it fails, rather than whenever something is next sent. Its stream then ends as
+// though it dropped: it is reaped once it isn't resumed in time.
+
+const defaultHeartbeatInterval = 15 * time.Second
+
+var heartbeatInterval = loadHeartbeatInterval()
+
+func loadHeartbeatInterval() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SSE_HEARTBEAT")); err == nil && d > 0 {
+		return d
+	}
+	return defaultHeartbeatInterval
+}
+
+// sseFields are the fields of an encoded event that decide how it is framed.
+type sseFields struct {
+	Kind     string `json:"kind"`
+	FromApp  bool   `json:"fromApp"`
+	Room     string `json:"room"`
+	Seq      uint64 `json:"seq"`
+	Activity string `json:"activity"`
+}
+
+func (f sseFields) eventType() string {
+	switch {
+	case f.Activity != "":
+		return f.Activity
+	case f.FromApp:
+		return "system"
+	}
+	if contentKinds[f.Kind].Message {
+		return "message"
+	}
+	return "system"
+}
+
+// writeEvent writes the encoded event data to a stream, with its type and, if it is logged in
+// the main room after the last id written, lastID, its id. lastID may be nil to write no id.
+func writeEvent(w io.Writer, data string, lastID *uint64) error {
+	var fields sseFields
+	json.Unmarshal([]byte(data), &fields)
+	id := ""
+	if lastID != nil && fields.Room == "" && fields.Seq > *lastID {
+		*lastID = fields.Seq
+		id = fmt.Sprintf("id: %d\n", fields.Seq)
+	}
+	_, err := fmt.Fprintf(w, "event: %s\n%sdata: %s\n\n", fields.eventType(), id, data)
+	return err
+}
+
+// writeMessage is writeEvent for a message not encoded yet.
+func writeMessage(w io.Writer, message Message, lastID *uint64) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return writeEvent(w, string(data), lastID)
+}
+
+// writeHeartbeat writes a heartbeat comment to a stream and flushes it, reporting whether the
+// client is still there.
+func writeHeartbeat(w http.ResponseWriter) error {
+	if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+		return err
+	}
+	return http.NewResponseController(w).Flush()
+}
+
+// lastEventID returns the Last-Event-ID r was sent with, if any.
+func lastEventID(r *http.Request) (uint64, bool) {
+	seq, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	return seq, err == nil
+}
+
+// eventsAfter returns the logged events with a Seq after seq, oldest first, and how many were
+// logged after seq but are no longer. ok is false if nothing was ever logged with seq, like after
+// a restart without a message store.
+func (s *ChatServer) eventsAfter(seq uint64) (events []Message, missed uint64, ok bool) {
+	s.eventLogMu.Lock()
+	defer s.eventLogMu.Unlock()
+	if len(s.eventLog) == 0 || s.eventLog[len(s.eventLog)-1].Seq < seq {
+		return nil, 0, false
+	}
+	if first := s.eventLog[0].Seq; first > seq+1 {
+		missed = first - seq - 1
+	}
+	for i, event := range s.eventLog {
+		if event.Seq > seq {
+			return append([]Message{}, s.eventLog[i:]...), missed, true
+		}
+	}
+	return nil, missed, true
+}
+
+// catchUp returns the events a stream reconnecting after the event seq starts with: a gap event,
+// if some are no longer logged, followed by those that are. ok is false if seq isn't known.
+// Called with broadcastMu held.
+func (s *ChatServer) catchUp(seq uint64) ([]Message, bool) {
+	events, missed, ok := s.eventsAfter(seq)
+	if !ok {
+		return nil, false
+	}
+	events = s.unbatched(events)
+	if missed > 0 {
+		gap := Message{FromApp: true, Kind: "gap", Private: true, Gap: &Gap{FromSeq: seq + 1, ToSeq: seq + missed, Dropped: int(missed)}}
+		events = append([]Message{gap}, events...)
+	}
+	return events, true
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Activity statistics. Messages and images members send, in any room, are counted by hour along
+// with who sent them and the emoji used, in reactions and in messages. The stats.aggregate job
+// sums up the last day and week from those every statsInterval, which /api/admin/stats returns,
+// to whoever may see /api/admin/load, and moderators get a summary of the week with ;stats.
+// Counts are kept for maxHeatmapDays, for the heatmaps of heatmap.go, in memory only.
+
+const (
+	statsInterval = 5 * time.Minute
+	statsWeek     = 7 * 24 * time.Hour
+	// Emoji listed by the statistics, the most used first.
+	topEmojiCount = 5
+)
+
+// hourActivity is what was sent during one hour.
+type hourActivity struct {
+	messages int
+	// Messages by room, "" for the main room.
+	rooms   map[string]int
+	senders map[string]bool
+	emoji   map[string]int
+}
+
+type EmojiCount struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+}
+
+type ActivityStats struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Messages and images sent.
+	Messages int `json:"messages"`
+	// Average messages per hour.
+	MessagesPerHour float64 `json:"messagesPerHour"`
+	// Sessions that sent at least one message.
+	ActiveUsers int `json:"activeUsers"`
+	// Most used emoji, in reactions and messages.
+	TopEmoji []EmojiCount `json:"topEmoji"`
+	// Messages by hour of the day, UTC, and the hours with the most, busiest first.
+	ByHour       [24]int `json:"byHour"`
+	BusiestHours []int   `json:"busiestHours"`
+}
+
+type Stats struct {
+	// When the statistics were computed, see statsInterval.
+	ComputedAt time.Time     `json:"computedAt"`
+	Day        ActivityStats `json:"day"`
+	Week       ActivityStats `json:"week"`
+}
+
+// hourActivityLocked returns the activity of the current hour. Called with statsMu held.
+func (s *ChatServer) hourActivityLocked() *hourActivity {
+	hour := s.clock.Now().Truncate(time.Hour).Unix()
+	activity, ok := s.activity[hour]
+	if !ok {
+		activity = &hourActivity{rooms: make(map[string]int), senders: make(map[string]bool), emoji: make(map[string]int)}
+		s.activity[hour] = activity
+	}
+	return activity
+}
+
+// recordMessage counts a message sessionID sent in room, with the emoji in its text.
+func (s *ChatServer) recordMessage(sessionID, room, text string) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	activity := s.hourActivityLocked()
+	activity.messages++
+	activity.rooms[room]++
+	activity.senders[sessionID] = true
+	for _, r := range text {
+		if unicode.Is(unicode.So, r) {
+			activity.emoji[string(r)]++
+		}
+	}
+}
+
+// recordReaction counts a reaction with emoji.
+func (s *ChatServer) recordReaction(emoji string) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	s.hourActivityLocked().emoji[emoji]++
+}
+
+// aggregateStats sums up the activity of the last day and week, and forgets activity older than
+// heatmaps go back.
+func (s *ChatServer) aggregateStats() {
+	now := s.clock.Now()
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	for hour := range s.activity {
+		if time.Unix(hour, 0).Before(now.AddDate(0, 0, -maxHeatmapDays).Truncate(24 * time.Hour)) {
+			delete(s.activity, hour)
+		}
+	}
+	s.stats = Stats{
+		ComputedAt: now,
+		Day:        s.activityStatsLocked(now.Add(-24*time.Hour), now),
+		Week:       s.activityStatsLocked(now.Add(-statsWeek), now),
+	}
+}
+
+// activityStatsLocked sums up the activity of the hours that started after from. Called with
+// statsMu held.
+func (s *ChatServer) activityStatsLocked(from, to time.Time) ActivityStats {
+	stats := ActivityStats{From: from, To: to, TopEmoji: []EmojiCount{}, BusiestHours: []int{}}
+	senders := make(map[string]bool)
+	emoji := make(map[string]int)
+	for hour, activity := range s.activity {
+		start := time.Unix(hour, 0).UTC()
+		if start.Before(from.Truncate(time.Hour)) {
+			continue
+		}
+		stats.Messages += activity.messages
+		stats.ByHour[start.Hour()] += activity.messages
+		for id := range activity.senders {
+			senders[id] = true
+		}
+		for e, count := range activity.emoji {
+			emoji[e] += count
+		}
+	}
+	stats.ActiveUsers = len(senders)
+	stats.MessagesPerHour = float64(stats.Messages) / to.Sub(from).Hours()
+
+	for e, count := range emoji {
+		stats.TopEmoji = append(stats.TopEmoji, EmojiCount{Emoji: e, Count: count})
+	}
+	sort.Slice(stats.TopEmoji, func(i, j int) bool {
+		if stats.TopEmoji[i].Count != stats.TopEmoji[j].Count {
+			return stats.TopEmoji[i].Count > stats.TopEmoji[j].Count
+		}
+		return stats.TopEmoji[i].Emoji < stats.TopEmoji[j].Emoji
+	})
+	if len(stats.TopEmoji) > topEmojiCount {
+		stats.TopEmoji = stats.TopEmoji[:topEmojiCount]
+	}
+
+	for hour, count := range stats.ByHour {
+		if count > 0 {
+			stats.BusiestHours = append(stats.BusiestHours, hour)
+		}
+	}
+	sort.SliceStable(stats.BusiestHours, func(i, j int) bool {
+		return stats.ByHour[stats.BusiestHours[i]] > stats.ByHour[stats.BusiestHours[j]]
+	})
+	if len(stats.BusiestHours) > 3 {
+		stats.BusiestHours = stats.BusiestHours[:3]
+	}
+	return stats
+}
+
+// currentStats returns the last statistics computed, computing them if none were yet.
+func (s *ChatServer) currentStats() Stats {
+	s.statsMu.Lock()
+	computed := !s.stats.ComputedAt.IsZero()
+	stats := s.stats
+	s.statsMu.Unlock()
+	if computed {
+		return stats
+	}
+	s.aggregateStats()
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return s.stats
+}
+
+func (s *ChatServer) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if !adminTokenAuthorized(r) {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.currentStats())
+}
+
+func (s *ChatServer) handleStatsCommand(sessionID string) {
+	if !s.isModerator(sessionID) {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Only moderators can see the statistics"})
+		return
+	}
+	week := s.currentStats().Week
+	content := fmt.Sprintf("This week: %d messages from %d people, %.1f an hour", week.Messages, week.ActiveUsers, week.MessagesPerHour)
+	if len(week.BusiestHours) > 0 {
+		hours := make([]string, len(week.BusiestHours))
+		for i, hour := range week.BusiestHours {
+			hours[i] = fmt.Sprintf("%02d:00", hour)
+		}
+		content += "<br>Busiest hours (UTC): " + strings.Join(hours, ", ")
+	}
+	if len(week.TopEmoji) > 0 {
+		emoji := make([]string, len(week.TopEmoji))
+		for i, e := range week.TopEmoji {
+			emoji[i] = fmt.Sprintf("%s %d", escapeText(e.Emoji), e.Count)
+		}
+		content += "<br>Top emoji: " + strings.Join(emoji, ", ")
+	}
+	s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: content})
+}
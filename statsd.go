@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// For deployments that can't be scraped, the metrics of /metrics are also pushed over UDP to the
+// StatsD agent at STATSD_ADDR, every STATSD_INTERVAL (10s unless set): gauges as they are, and
+// counters as how much they grew since the last push. Names are those of /metrics without
+// "alantern_" and "_total", after STATSD_PREFIX ("alantern." unless set), e.g.
+// "alantern.subscribers". With STATSD_FORMAT=datadog they are sent as DogStatsD, tagged with the
+// role of the instance and the comma-separated STATSD_TAGS; plain StatsD has no tags, so the role
+// goes in the name instead, e.g. "alantern.edge.subscribers".
+
+const defaultStatsDInterval = 10 * time.Second
+
+var errInvalidStatsD = errors.New(`STATSD_FORMAT must be "statsd" or "datadog", and STATSD_INTERVAL a positive duration`)
+
+type statsdEmitter struct {
+	conn     net.Conn
+	datadog  bool
+	prefix   string
+	tags     []string
+	interval time.Duration
+	// Counters as last pushed, by name. Only used by the push job.
+	counters map[string]float64
+}
+
+// loadStatsD returns the emitter STATSD_ADDR asks for, or nil if it is off.
+func loadStatsD() (*statsdEmitter, error) {
+	addr := os.Getenv("STATSD_ADDR")
+	if addr == "" {
+		return nil, nil
+	}
+	e := &statsdEmitter{prefix: envOr("STATSD_PREFIX", "alantern."), interval: defaultStatsDInterval, counters: make(map[string]float64)}
+	switch os.Getenv("STATSD_FORMAT") {
+	case "", "statsd":
+	case "datadog":
+		e.datadog = true
+	default:
+		return nil, errInvalidStatsD
+	}
+	if value := os.Getenv("STATSD_INTERVAL"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, errInvalidStatsD
+		}
+		e.interval = d
+	}
+	for _, tag := range strings.Split(os.Getenv("STATSD_TAGS"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			e.tags = append(e.tags, tag)
+		}
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	e.conn = conn
+	return e, nil
+}
+
+// startStatsD starts pushing the metrics, if StatsD is set up.
+func (s *ChatServer) startStatsD() {
+	if s.statsd != nil {
+		s.schedule("metrics.statsd", s.statsd.interval, 0, s.pushStatsD)
+	}
+}
+
+func (s *ChatServer) pushStatsD() {
+	load := s.currentLoad()
+	if _, err := s.statsd.conn.Write(s.statsd.packet(load)); err != nil {
+		slog.Debug("Could not push metrics to StatsD", "err", err)
+	}
+}
+
+// packet encodes load as a StatsD packet, a metric per line.
+func (e *statsdEmitter) packet(load Load) []byte {
+	prefix := e.prefix
+	suffix := ""
+	if e.datadog {
+		suffix = "|#" + strings.Join(append([]string{"role:" + load.Role}, e.tags...), ",")
+	} else {
+		prefix += load.Role + "."
+	}
+
+	var packet strings.Builder
+	for _, metric := range load.metrics() {
+		name := strings.TrimSuffix(strings.TrimPrefix(metric.name, "alantern_"), "_total")
+		value, kind := metric.value, "g"
+		if metric.kind == "counter" {
+			value, kind = metric.value-e.counters[name], "c"
+			e.counters[name] = metric.value
+		}
+		fmt.Fprintf(&packet, "%s%s:%v|%s%s\n", prefix, name, value, kind, suffix)
+	}
+	return []byte(packet.String())
+}
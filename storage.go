@@ -0,0 +1,198 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The room keeps uploaded images in memory, within a quota set in megabytes with STORAGE_QUOTA_MB.
+// When an upload doesn't fit, the oldest images are evicted first to make room. Moderators get a
+// warning once usage crosses storageWarnRatio of the quota.
+
+const (
+	defaultStorageQuotaMB = 256
+	storageWarnRatio      = 0.9
+)
+
+var storageQuota = loadStorageQuota()
+
+var errImageTooLarge = errors.New("Image is larger than the room's storage quota")
+
+func loadStorageQuota() int64 {
+	if mb, err := strconv.ParseInt(os.Getenv("STORAGE_QUOTA_MB"), 10, 64); err == nil && mb > 0 {
+		return mb << 20
+	}
+	return defaultStorageQuotaMB << 20
+}
+
+type StorageUsage struct {
+	// Bytes used by stored images.
+	UsedBytes int64 `json:"usedBytes"`
+	// Most bytes the room may use.
+	QuotaBytes int64 `json:"quotaBytes"`
+	// Number of stored images.
+	Images int `json:"images"`
+	// Upload time of the oldest stored image, the next to be evicted.
+	Oldest *time.Time `json:"oldest,omitempty"`
+	// Caches of fetches from other sites, next to the quota.
+	Caches []CacheUsage `json:"caches"`
+}
+
+// deleteImageLocked removes an image. imageStoreMu must be held.
+func (s *ChatServer) deleteImageLocked(id string) {
+	s.imageBytes -= int64(len(s.imageStore[id]))
+	delete(s.imageStore, id)
+	delete(s.imageExpiry, id)
+	delete(s.imageViewers, id)
+	delete(s.imageStoredAt, id)
+}
+
+// makeRoomLocked evicts the oldest images until size more bytes fit in the quota. imageStoreMu
+// must be held.
+func (s *ChatServer) makeRoomLocked(size int64) error {
+	if size > storageQuota {
+		return errImageTooLarge
+	}
+	for s.imageBytes+size > storageQuota {
+		oldest := ""
+		for id, at := range s.imageStoredAt {
+			if oldest == "" || at.Before(s.imageStoredAt[oldest]) {
+				oldest = id
+			}
+		}
+		s.deleteImageLocked(oldest)
+	}
+	return nil
+}
+
+// checkStorageWarning warns moderators the first time usage gets close to the quota.
+func (s *ChatServer) checkStorageWarning() {
+	s.imageStoreMu.Lock()
+	used := s.imageBytes
+	near := float64(used) >= storageWarnRatio*float64(storageQuota)
+	warn := near && !s.storageWarned
+	s.storageWarned = near
+	s.imageStoreMu.Unlock()
+
+	if warn {
+		s.notifyModerators(Message{
+			Kind: "text",
+			Content: fmt.Sprintf("Room storage is %d%% full (%.1f of %.1f MB), the oldest images will be evicted to make room",
+				used*100/storageQuota, float64(used)/(1<<20), float64(storageQuota)/(1<<20)),
+		})
+	}
+}
+
+func (s *ChatServer) storageUsage() StorageUsage {
+	s.imageStoreMu.Lock()
+	usage := StorageUsage{UsedBytes: s.imageBytes, QuotaBytes: storageQuota, Images: len(s.imageStore)}
+	for _, at := range s.imageStoredAt {
+		if usage.Oldest == nil || at.Before(*usage.Oldest) {
+			at := at
+			usage.Oldest = &at
+		}
+	}
+	s.imageStoreMu.Unlock()
+
+	usage.Caches = []CacheUsage{s.proxyCache.usage("proxy"), s.previewCache.usage("previews")}
+	return usage
+}
+
+// handleModStorage reports how much of the storage quota is used.
+func (s *ChatServer) handleModStorage(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	if !s.isModerator(sessionID) {
+		http.Error(w, "Moderators only", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.storageUsage())
+}
+
+// Fetches from other sites, by the media proxy and link previews, are cached in memory so popular
+// links are fetched once in a while rather than for everyone. Each cache keeps entries for their
+// own TTL within a size budget, evicting the least recently used first.
+
+type fetchCache[V any] struct {
+	mu       sync.Mutex
+	maxBytes int64
+	used     int64
+	entries  map[string]*list.Element
+	// Entries, most recently used first.
+	order *list.List
+}
+
+type fetchCacheEntry[V any] struct {
+	key     string
+	value   V
+	size    int64
+	expires time.Time
+}
+
+type CacheUsage struct {
+	Name     string `json:"name"`
+	Entries  int    `json:"entries"`
+	Bytes    int64  `json:"bytes"`
+	MaxBytes int64  `json:"maxBytes"`
+}
+
+func newFetchCache[V any](maxBytes int64) *fetchCache[V] {
+	return &fetchCache[V]{maxBytes: maxBytes, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns the value cached for key, unless it expired by now.
+func (c *fetchCache[V]) get(key string, now time.Time) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	entry := element.Value.(*fetchCacheEntry[V])
+	if !now.Before(entry.expires) {
+		c.removeLocked(element)
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+// put caches value, taking size bytes, for key until ttl after now.
+func (c *fetchCache[V]) put(key string, value V, size int64, ttl time.Duration, now time.Time) {
+	if size > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.removeLocked(element)
+	}
+	for c.used+size > c.maxBytes {
+		c.removeLocked(c.order.Back())
+	}
+	c.entries[key] = c.order.PushFront(&fetchCacheEntry[V]{key: key, value: value, size: size, expires: now.Add(ttl)})
+	c.used += size
+}
+
+func (c *fetchCache[V]) removeLocked(element *list.Element) {
+	entry := element.Value.(*fetchCacheEntry[V])
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.used -= entry.size
+}
+
+func (c *fetchCache[V]) usage(name string) CacheUsage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheUsage{Name: name, Entries: len(c.entries), Bytes: c.used, MaxBytes: c.maxBytes}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// An opt-in recap of the day in the main room, posted as an app message every day at
+// DAILY_SUMMARY_AT (HH:MM, UTC, midnight unless set). DAILY_SUMMARY picks the Summarizer writing
+// it: "local" lists the day's top keywords by TF-IDF, and "llm" has the chat completions endpoint
+// at SUMMARY_LLM_URL (OpenAI-compatible, with SUMMARY_LLM_MODEL and the bearer token
+// SUMMARY_LLM_KEY) write a few sentences, falling back to keywords if it fails. Either way the
+// recap ends with the most reacted messages. Only messages sent since the last recap count, up
+// to maxSummaryMessages of them, and they are kept in memory only.
+
+const (
+	maxSummaryMessages = 2000
+	summaryKeywords    = 8
+	summaryTopMessages = 3
+	summaryTimeout     = 30 * time.Second
+)
+
+var (
+	dailySummary   = os.Getenv("DAILY_SUMMARY")
+	dailySummaryAt = os.Getenv("DAILY_SUMMARY_AT")
+)
+
+var errInvalidSummary = errors.New(`DAILY_SUMMARY must be "local" or "llm", with SUMMARY_LLM_URL set for "llm", and DAILY_SUMMARY_AT HH:MM`)
+
+// SummaryMessage is a message of the day, as given to a Summarizer.
+type SummaryMessage struct {
+	ID       string
+	Nickname string
+	// As sent, not escaped.
+	Text string
+}
+
+// Summarizer writes the recap of a day's messages, as plain text.
+type Summarizer interface {
+	Summarize(ctx context.Context, messages []SummaryMessage) (string, error)
+}
+
+// loadSummarizer returns the Summarizer DAILY_SUMMARY asks for, or nil if it is off.
+func loadSummarizer() (Summarizer, error) {
+	if dailySummary == "" {
+		return nil, nil
+	}
+	if _, err := summaryTime(); err != nil {
+		return nil, err
+	}
+	switch dailySummary {
+	case "local":
+		return keywordSummarizer{}, nil
+	case "llm":
+		url := os.Getenv("SUMMARY_LLM_URL")
+		if url == "" {
+			return nil, errInvalidSummary
+		}
+		return &llmSummarizer{url: url, model: os.Getenv("SUMMARY_LLM_MODEL"), key: os.Getenv("SUMMARY_LLM_KEY")}, nil
+	}
+	return nil, errInvalidSummary
+}
+
+// summaryTime returns the minutes after midnight, UTC, the recap is posted at.
+func summaryTime() (int, error) {
+	if dailySummaryAt == "" {
+		return 0, nil
+	}
+	at, err := time.Parse("15:04", dailySummaryAt)
+	if err != nil {
+		return 0, errInvalidSummary
+	}
+	return at.Hour()*60 + at.Minute(), nil
+}
+
+// collectForSummary keeps message, sent as text, for the next recap.
+func (s *ChatServer) collectForSummary(message Message, text string) {
+	if s.summarizer == nil || message.Author == nil {
+		return
+	}
+	s.summaryMu.Lock()
+	defer s.summaryMu.Unlock()
+	if len(s.summaryMessages) >= maxSummaryMessages {
+		s.summaryMessages = s.summaryMessages[1:]
+	}
+	s.summaryMessages = append(s.summaryMessages, SummaryMessage{ID: message.ID, Nickname: message.Author.Nickname, Text: text})
+}
+
+// postDailySummary posts the recap once the time for today's has come.
+func (s *ChatServer) postDailySummary() {
+	now := s.clock.Now().UTC()
+	at, _ := summaryTime()
+	today := now.Format(time.DateOnly)
+	due := now.Hour()*60+now.Minute() >= at
+	s.summaryMu.Lock()
+	if s.summaryDay == "" {
+		// A server started after today's time posts its first recap tomorrow.
+		s.summaryDay = now.AddDate(0, 0, -1).Format(time.DateOnly)
+		if due {
+			s.summaryDay = today
+		}
+	}
+	if !due || s.summaryDay == today {
+		s.summaryMu.Unlock()
+		return
+	}
+	s.summaryDay = today
+	messages := s.summaryMessages
+	s.summaryMessages = nil
+	s.summaryMu.Unlock()
+	if len(messages) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), summaryTimeout)
+	defer cancel()
+	recap, err := s.summarizer.Summarize(ctx, messages)
+	if err != nil {
+		slog.Warn("Could not summarize the day", "err", err)
+		recap, _ = keywordSummarizer{}.Summarize(ctx, messages)
+	}
+	content := "Recap of the day: " + escapeText(recap)
+	if reacted := s.mostReacted(messages); len(reacted) > 0 {
+		content += "<br>Most reacted:<br>" + strings.Join(reacted, "<br>")
+	}
+	s.broadcastMessage(Message{FromApp: true, Kind: "text", Content: content})
+}
+
+// mostReacted describes the messages with the most reactions, if any.
+func (s *ChatServer) mostReacted(messages []SummaryMessage) []string {
+	type reacted struct {
+		message SummaryMessage
+		count   int
+	}
+	var top []reacted
+	for _, message := range messages {
+		count := 0
+		for _, n := range s.reactionCounts(message.ID) {
+			count += n
+		}
+		if count > 0 {
+			top = append(top, reacted{message, count})
+		}
+	}
+	sort.SliceStable(top, func(i, j int) bool { return top[i].count > top[j].count })
+	lines := make([]string, 0, summaryTopMessages)
+	for i := 0; i < len(top) && i < summaryTopMessages; i++ {
+		text := []rune(top[i].message.Text)
+		if len(text) > 80 {
+			text = append(text[:80], '…')
+		}
+		lines = append(lines, fmt.Sprintf("[%s]: %s (%d reactions)", escapeText(top[i].message.Nickname), escapeText(string(text)), top[i].count))
+	}
+	return lines
+}
+
+// keywordSummarizer lists the words that stand out in the day's messages: those used most, in
+// the fewest messages (TF-IDF, taking each message as a document).
+type keywordSummarizer struct{}
+
+var summaryStopwords = map[string]bool{}
+
+func init() {
+	for _, word := range strings.Fields(`about after again also and any are because been before but can could did does
+		doing don dont for from get got had has have her here him his how into its just like more most not now off
+		one only our out over really she should some than that thats the their them then there these they this
+		those too very was were what when where which while who why will with would yeah yes you your`) {
+		summaryStopwords[word] = true
+	}
+}
+
+func (keywordSummarizer) Summarize(ctx context.Context, messages []SummaryMessage) (string, error) {
+	counts := make(map[string]int)
+	documents := make(map[string]int)
+	for _, message := range messages {
+		seen := make(map[string]bool)
+		for _, word := range strings.FieldsFunc(strings.ToLower(message.Text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		}) {
+			if len([]rune(word)) < 3 || summaryStopwords[word] {
+				continue
+			}
+			counts[word]++
+			if !seen[word] {
+				seen[word] = true
+				documents[word]++
+			}
+		}
+	}
+
+	type keyword struct {
+		word  string
+		score float64
+	}
+	keywords := make([]keyword, 0, len(counts))
+	for word, count := range counts {
+		idf := math.Log(1 + float64(len(messages))/float64(documents[word]))
+		keywords = append(keywords, keyword{word, float64(count) * idf})
+	}
+	sort.Slice(keywords, func(i, j int) bool {
+		if keywords[i].score != keywords[j].score {
+			return keywords[i].score > keywords[j].score
+		}
+		return keywords[i].word < keywords[j].word
+	})
+	words := make([]string, 0, summaryKeywords)
+	for i := 0; i < len(keywords) && i < summaryKeywords; i++ {
+		words = append(words, keywords[i].word)
+	}
+	if len(words) == 0 {
+		return fmt.Sprintf("%d messages", len(messages)), nil
+	}
+	return fmt.Sprintf("%d messages, about %s", len(messages), strings.Join(words, ", ")), nil
+}
+
+// llmSummarizer has an OpenAI-compatible chat completions endpoint write the recap.
+type llmSummarizer struct {
+	url, model, key string
+}
+
+func (l *llmSummarizer) Summarize(ctx context.Context, messages []SummaryMessage) (string, error) {
+	var transcript strings.Builder
+	for _, message := range messages {
+		fmt.Fprintf(&transcript, "%s: %s\n", message.Nickname, message.Text)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"model": l.model,
+		"messages": []map[string]string{
+			{"role": "system", "content": "Summarize the topics of this day of chat in two or three plain sentences, without naming anyone."},
+			{"role": "user", "content": transcript.String()},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.key != "" {
+		req.Header.Set("Authorization", "Bearer "+l.key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("summarizer answered %s", resp.Status)
+	}
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		return "", err
+	}
+	if len(completion.Choices) == 0 || strings.TrimSpace(completion.Choices[0].Message.Content) == "" {
+		return "", errors.New("summarizer returned no summary")
+	}
+	return strings.TrimSpace(completion.Choices[0].Message.Content), nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// /sync catches a reconnecting client up in one request. It sends the identifier of the last
+// event it saw and the hashes of the members and pins it has, from its previous sync, and gets
+// the events since then and only the lists whose hash changed.
+
+type SyncHashes struct {
+	Members string `json:"members"`
+	Pins    string `json:"pins"`
+}
+
+type SyncResponse struct {
+	// Logged events after since, oldest first, filtered like /events.
+	Events []Message `json:"events"`
+	// Set when since is no longer in the log: Events are then every logged event, and the client
+	// should start over rather than append them.
+	Reset bool `json:"reset,omitempty"`
+	// Members by session identifier and pins, oldest first, null when their hash didn't change.
+	Members []Member `json:"members"`
+	Pins    []Pin    `json:"pins"`
+	// Hashes to send with the next sync.
+	Hashes SyncHashes `json:"hashes"`
+}
+
+// stateHash returns a short hash of v encoded as JSON.
+func stateHash(v interface{}) string {
+	data, _ := json.Marshal(v)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *ChatServer) sync(since string, hashes SyncHashes, filter kindFilter) SyncResponse {
+	var response SyncResponse
+	events, ok := s.eventsSince(since)
+	if !ok {
+		events, _ = s.eventsSince("")
+		response.Reset = true
+	}
+	response.Events = []Message{}
+	for _, event := range events {
+		if event, ok := filter.apply(event); ok {
+			response.Events = append(response.Events, event)
+		}
+	}
+
+	members := s.members()
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	response.Hashes.Members = stateHash(members)
+	if response.Hashes.Members != hashes.Members {
+		response.Members = members
+	}
+
+	pins := append([]Pin{}, s.pinsIn("")...)
+	response.Hashes.Pins = stateHash(pins)
+	if response.Hashes.Pins != hashes.Pins {
+		response.Pins = pins
+	}
+	return response
+}
+
+// handleSync returns what changed since the event "since", given the "members" and "pins"
+// hashes of the previous sync. Without them, everything is returned.
+func (s *ChatServer) handleSync(w http.ResponseWriter, r *http.Request) {
+	if s.isBanned(s.getOrCreateSession(w, r)) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	response := s.sync(query.Get("since"), SyncHashes{Members: query.Get("members"), Pins: query.Get("pins")}, parseKindFilter(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
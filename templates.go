@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Operators can describe the kinds of rooms they keep opening as templates, a JSON list of
+// RoomTemplate in ROOM_TEMPLATES_FILE, read on start. ;room create <name> --template=<template>
+// opens a room from one: it starts with the template's settings, its creator moderates it if the
+// template says so, its MOTD is sent privately to everyone who joins, and its automations run on
+// the messages posted in it and the members joining it. ;room templates lists them.
+
+var roomTemplatesFile = os.Getenv("ROOM_TEMPLATES_FILE")
+
+const maxMOTDLength = 500
+
+var (
+	errInvalidTemplate = errors.New("Invalid template: expected a room name, a category and description of up to 32 and 200 characters, a MOTD of up to 500, and automations with a message or join trigger and post actions only")
+	errUnknownTemplate = errors.New("Template not found, see ;room templates")
+	errRoomExists      = errors.New("Room already exists: ;join it instead")
+)
+
+type RoomTemplate struct {
+	Name string `json:"name"`
+	// Shown in the room directory for rooms opened from the template, and by ;room templates.
+	Category    string `json:"category,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Whether animated images start off in the room, see animations.go.
+	AnimationsOff bool `json:"animationsOff,omitempty"`
+	// Whether whoever creates the room may ;pin, ;unpin and turn ;animations on or off in it.
+	CreatorModerates bool `json:"creatorModerates,omitempty"`
+	// Sent privately to everyone who joins the room.
+	MOTD string `json:"motd,omitempty"`
+	// Rules for the room, with a "message" or "join" trigger and "post" actions, which post in
+	// the room. They are always enabled.
+	Automations []AutomationRule `json:"automations,omitempty"`
+}
+
+func (template *RoomTemplate) validate() error {
+	if !roomNamePattern.MatchString(template.Name) || len([]rune(template.MOTD)) > maxMOTDLength || validateMessage(template.MOTD) != nil {
+		return errInvalidTemplate
+	}
+	if len([]rune(template.Category)) > maxRoomCategory || len([]rune(template.Description)) > maxRoomDescription {
+		return errInvalidTemplate
+	}
+	for i := range template.Automations {
+		rule := &template.Automations[i]
+		if err := rule.validate(); err != nil {
+			return err
+		}
+		if rule.Trigger.Type == "schedule" {
+			return errInvalidTemplate
+		}
+		for _, action := range rule.Actions {
+			if action.Type != "post" {
+				return errInvalidTemplate
+			}
+		}
+		rule.Enabled = true
+	}
+	return nil
+}
+
+// loadRoomTemplates reads the templates in roomTemplatesFile, if set.
+func (s *ChatServer) loadRoomTemplates() error {
+	s.roomTemplates = make(map[string]RoomTemplate)
+	if roomTemplatesFile == "" {
+		return nil
+	}
+	var templates []RoomTemplate
+	if err := loadJSONFile(roomTemplatesFile, &templates); err != nil {
+		return fmt.Errorf("%s: %w", roomTemplatesFile, err)
+	}
+	for _, template := range templates {
+		if err := template.validate(); err != nil {
+			return fmt.Errorf("%s: template %q: %w", roomTemplatesFile, template.Name, err)
+		}
+		s.roomTemplates[template.Name] = template
+	}
+	return nil
+}
+
+// createRoom opens the room name, which must not exist yet, from the template called template
+// if one is given, with sessionID in it.
+func (s *ChatServer) createRoom(sessionID, name, template string) (string, error) {
+	name = normalizeRoom(name)
+	if !roomNamePattern.MatchString(name) {
+		return "", errInvalidRoom
+	}
+	var from RoomTemplate
+	if template != "" {
+		var ok bool
+		if from, ok = s.roomTemplates[template]; !ok {
+			return "", errUnknownTemplate
+		}
+	}
+
+	s.roomsMu.Lock()
+	if _, ok := s.rooms[name]; ok {
+		s.roomsMu.Unlock()
+		return "", errRoomExists
+	}
+	if len(s.rooms) >= maxRooms {
+		s.roomsMu.Unlock()
+		return "", errTooManyRooms
+	}
+	room := &Room{
+		Name:          name,
+		CreatedBy:     s.getNickname(sessionID),
+		CreatedAt:     s.clock.Now(),
+		Template:      from.Name,
+		Category:      from.Category,
+		Description:   from.Description,
+		members:       map[string]bool{sessionID: true},
+		animationsOff: from.AnimationsOff,
+		motd:          from.MOTD,
+		moderators:    make(map[string]bool),
+		automations:   append([]AutomationRule(nil), from.Automations...),
+	}
+	if from.CreatorModerates {
+		room.moderators[sessionID] = true
+	}
+	s.rooms[name] = room
+	s.currentRooms[sessionID] = name
+	s.roomsMu.Unlock()
+
+	if template != "" {
+		s.audit(sessionID, "room.create", name, template)
+	}
+	s.welcomeToRoom(sessionID, name)
+	return name, nil
+}
+
+// welcomeToRoom announces that sessionID joined the room name and sends it the room's MOTD.
+func (s *ChatServer) welcomeToRoom(sessionID, name string) {
+	s.broadcastToRoom(name, Message{FromApp: true, Kind: "text", Content: escapeText(s.getNickname(sessionID)) + " joined #" + name, Activity: "join"})
+
+	s.roomsMu.Lock()
+	motd := ""
+	if room, ok := s.rooms[name]; ok {
+		motd = room.motd
+	}
+	s.roomsMu.Unlock()
+	if motd != "" {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: fmt.Sprintf("#%s: %s", name, escapeText(motd))})
+	}
+	s.runRoomAutomation(name, "join", sessionID, "")
+}
+
+// moderatesRoom reports whether sessionID may moderate the room name: moderators everywhere, and
+// the creator of a room made from a template that lets them.
+func (s *ChatServer) moderatesRoom(sessionID, name string) bool {
+	if s.isModerator(sessionID) {
+		return true
+	}
+	if name == "" {
+		return false
+	}
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+	room, ok := s.rooms[name]
+	return ok && room.moderators[sessionID]
+}
+
+// runRoomAutomation runs the automations of the room name, like runAutomation does for the main
+// room.
+func (s *ChatServer) runRoomAutomation(name, trigger, sessionID, text string) {
+	now := s.clock.Now()
+	var matched []AutomationRule
+	s.roomsMu.Lock()
+	if room, ok := s.rooms[name]; ok {
+		for i := range room.automations {
+			if rule := &room.automations[i]; rule.due(trigger, text, now) {
+				rule.LastRun = now
+				matched = append(matched, *rule)
+			}
+		}
+	}
+	s.roomsMu.Unlock()
+
+	nickname := escapeText(s.getNickname(sessionID))
+	for _, rule := range matched {
+		for _, action := range rule.Actions {
+			s.broadcastToRoom(name, Message{
+				FromApp: true,
+				Kind:    "text",
+				Content: strings.ReplaceAll(escapeText(action.Text), "{nickname}", nickname),
+			})
+		}
+	}
+}
+
+func (s *ChatServer) handleRoomTemplateCommand(sessionID string, args []string) {
+	reply := func(content string) {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: content})
+	}
+	usage := "Usage: ;room create &lt;name&gt; [--template=&lt;template&gt;]|templates"
+
+	switch {
+	case len(args) == 1 && args[0] == "templates":
+		names := make([]string, 0, len(s.roomTemplates))
+		for name := range s.roomTemplates {
+			names = append(names, name)
+		}
+		if len(names) == 0 {
+			reply("No room templates")
+			return
+		}
+		sort.Strings(names)
+		content := "Room templates:"
+		for _, name := range names {
+			content += "<br>" + escapeText(name)
+			if description := s.roomTemplates[name].Description; description != "" {
+				content += ": " + escapeText(description)
+			}
+		}
+		reply(content)
+
+	case (len(args) == 2 || len(args) == 3) && args[0] == "create":
+		template := ""
+		if len(args) == 3 {
+			var ok bool
+			if template, ok = strings.CutPrefix(args[2], "--template="); !ok || template == "" {
+				reply(usage)
+				return
+			}
+		}
+		name, err := s.createRoom(sessionID, args[1], template)
+		if err != nil {
+			reply(escapeText(err.Error()))
+			return
+		}
+		reply(fmt.Sprintf("You opened #%s, your messages now go there. ;switch goes back to the main room", name))
+
+	default:
+		reply(usage)
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A thread is a message along with the replies to it, and the replies to those. Members follow
+// threads with ;follow <message id>, or by replying in them, and ;unfollow stops. Every reply in
+// a followed thread makes a private "thread" event for its followers, other than the replier and
+// the author of the message replied to, who gets a notification already. ;threads sets how they
+// come: "instant", the default, sends one per reply, "digest" batches a thread's replies into one
+// event every threadDigestInterval, and "never" stops them. Followers who aren't in the thread's
+// room or muted it or the replier get nothing. The setting is kept in the member's preferences,
+// see mutes.go; follows last as long as the thread's first message is logged.
+
+const (
+	threadDigestInterval = 5 * time.Minute
+	// Most threads one member can follow.
+	maxFollowedThreads = 100
+	// Most replies walked up to find the message a thread starts with.
+	maxThreadDepth = 50
+)
+
+var (
+	errTooManyFollows = errors.New("Too many threads followed: ;unfollow some first")
+	errInvalidThreads = errors.New("Usage: ;threads instant|digest|never")
+)
+
+type ThreadActivity struct {
+	// Identifier of the message the thread starts with.
+	ThreadID string `json:"threadId"`
+	// Room of the thread, empty for the main room.
+	Room string `json:"room,omitempty"`
+	// Nicknames of the first notificationNames who replied, how many replies there were in all,
+	// and the identifier of the latest.
+	From     []string `json:"from"`
+	Count    int      `json:"count"`
+	LatestID string   `json:"latestId"`
+
+	senders map[string]bool
+}
+
+func (s *ChatServer) initThreads() {
+	s.threadFollowers = make(map[string]map[string]bool)
+	s.pendingDigests = make(map[string][]*ThreadActivity)
+}
+
+// threadOf returns the identifier of the message the thread of message starts with.
+func (s *ChatServer) threadOf(message Message) string {
+	id, parent := message.ID, message.ReplyTo
+	for i := 0; parent != "" && i < maxThreadDepth; i++ {
+		repliedTo, ok := s.findMessage(parent)
+		if !ok {
+			break
+		}
+		id, parent = repliedTo.ID, repliedTo.ReplyTo
+	}
+	return id
+}
+
+// follow makes sessionID follow the thread of the message id, or stop following it, and returns
+// the thread's identifier.
+func (s *ChatServer) follow(sessionID, id string, on bool) (string, error) {
+	message, ok := s.findMessage(id)
+	if !ok || !s.inRoom(sessionID, message.Room) {
+		return "", errUnknownMessage
+	}
+	thread := s.threadOf(message)
+
+	s.threadsMu.Lock()
+	defer s.threadsMu.Unlock()
+	if !on {
+		delete(s.threadFollowers[thread], sessionID)
+		if len(s.threadFollowers[thread]) == 0 {
+			delete(s.threadFollowers, thread)
+		}
+		return thread, nil
+	}
+	return thread, s.followLocked(sessionID, thread)
+}
+
+func (s *ChatServer) followLocked(sessionID, thread string) error {
+	if s.threadFollowers[thread][sessionID] {
+		return nil
+	}
+	followed := 0
+	for _, followers := range s.threadFollowers {
+		if followers[sessionID] {
+			followed++
+		}
+	}
+	if followed >= maxFollowedThreads {
+		return errTooManyFollows
+	}
+	if s.threadFollowers[thread] == nil {
+		s.threadFollowers[thread] = make(map[string]bool)
+	}
+	s.threadFollowers[thread][sessionID] = true
+	return nil
+}
+
+// threadMode returns how sessionID wants to hear about replies in the threads it follows.
+func (s *ChatServer) threadMode(sessionID string) string {
+	s.preferencesMu.Lock()
+	defer s.preferencesMu.Unlock()
+	if preferences, ok := s.preferences[sessionID]; ok && preferences.Threads != "" {
+		return preferences.Threads
+	}
+	return "instant"
+}
+
+// setThreadMode sets how sessionID hears about replies in the threads it follows. Leaving
+// "digest" sends what was batched, or drops it for "never".
+func (s *ChatServer) setThreadMode(sessionID, mode string) error {
+	switch mode {
+	case "instant", "digest", "never":
+	default:
+		return errInvalidThreads
+	}
+
+	s.preferencesMu.Lock()
+	preferences, ok := s.preferences[sessionID]
+	if !ok {
+		preferences = &Preferences{}
+		s.preferences[sessionID] = preferences
+	}
+	preferences.Threads = mode
+	if mode == "instant" {
+		preferences.Threads = ""
+	}
+	if preferences.empty() {
+		delete(s.preferences, sessionID)
+	}
+	s.persistPreferencesLocked()
+	s.preferencesMu.Unlock()
+
+	if mode != "digest" {
+		s.sendThreadDigest(sessionID, mode == "instant")
+	}
+	return nil
+}
+
+// threadReply lets the followers of the thread of reply, sent in answer to repliedTo, know about
+// it, and makes its author follow the thread.
+func (s *ChatServer) threadReply(repliedTo, reply Message) {
+	if repliedTo.ID == "" || reply.Author == nil {
+		return
+	}
+	thread := s.threadOf(reply)
+	author := s.sessionOfHandle(reply.Author.ID)
+
+	s.threadsMu.Lock()
+	followers := make([]string, 0, len(s.threadFollowers[thread]))
+	for id := range s.threadFollowers[thread] {
+		followers = append(followers, id)
+	}
+	// Running out of follows doesn't stop anyone replying.
+	s.followLocked(author, thread)
+	s.threadsMu.Unlock()
+
+	for _, follower := range followers {
+		if follower == author || (repliedTo.Author != nil && sessionHandle(follower) == repliedTo.Author.ID) {
+			continue
+		}
+		if !s.inRoom(follower, reply.Room) || s.mutes(follower, author, reply.Room) {
+			continue
+		}
+		switch s.threadMode(follower) {
+		case "never":
+		case "digest":
+			s.addToDigest(follower, thread, reply)
+		default:
+			activity := ThreadActivity{ThreadID: thread, Room: reply.Room, Count: 1, LatestID: reply.ID}
+			activity.From = []string{reply.Author.Nickname}
+			activity.senders = map[string]bool{author: true}
+			s.queueNotice(follower, threadMessage(activity))
+		}
+	}
+}
+
+// addToDigest batches reply, in thread, into the next digest of sessionID.
+func (s *ChatServer) addToDigest(sessionID, thread string, reply Message) {
+	s.threadsMu.Lock()
+	defer s.threadsMu.Unlock()
+	pending := s.pendingDigests[sessionID]
+	if len(pending) == 0 {
+		s.clock.AfterFunc(threadDigestInterval, func() { s.sendThreadDigest(sessionID, true) })
+	}
+	var activity *ThreadActivity
+	for _, candidate := range pending {
+		if candidate.ThreadID == thread {
+			activity = candidate
+		}
+	}
+	if activity == nil {
+		activity = &ThreadActivity{ThreadID: thread, Room: reply.Room, senders: make(map[string]bool)}
+		s.pendingDigests[sessionID] = append(pending, activity)
+	}
+	activity.Count++
+	activity.LatestID = reply.ID
+	if !activity.senders[reply.Author.ID] {
+		activity.senders[reply.Author.ID] = true
+		if len(activity.From) < notificationNames {
+			activity.From = append(activity.From, reply.Author.Nickname)
+		}
+	}
+}
+
+// sendThreadDigest sends sessionID one event per thread with replies batched since its last
+// digest, or drops them unless send.
+func (s *ChatServer) sendThreadDigest(sessionID string, send bool) {
+	s.threadsMu.Lock()
+	pending := s.pendingDigests[sessionID]
+	delete(s.pendingDigests, sessionID)
+	s.threadsMu.Unlock()
+
+	if !send {
+		return
+	}
+	for _, activity := range pending {
+		s.queueNotice(sessionID, threadMessage(*activity))
+	}
+}
+
+func threadMessage(activity ThreadActivity) Message {
+	names := make([]string, len(activity.From))
+	for i, name := range activity.From {
+		names[i] = "[" + escapeText(name) + "]"
+	}
+	who := strings.Join(names, ", ")
+	if others := len(activity.senders) - len(activity.From); others > 0 {
+		who += fmt.Sprintf(" and %d more", others)
+	}
+	content := who + " replied in a thread you follow"
+	if activity.Count > 1 {
+		content = fmt.Sprintf("%s replied %d times in a thread you follow", who, activity.Count)
+	}
+	return Message{Kind: "thread", Content: content, Thread: &activity}
+}
+
+// expireThreads forgets the followers of threads whose first message is no longer logged.
+func (s *ChatServer) expireThreads() {
+	s.threadsMu.Lock()
+	threads := make([]string, 0, len(s.threadFollowers))
+	for thread := range s.threadFollowers {
+		threads = append(threads, thread)
+	}
+	s.threadsMu.Unlock()
+
+	for _, thread := range threads {
+		if _, ok := s.findMessage(thread); !ok {
+			s.threadsMu.Lock()
+			delete(s.threadFollowers, thread)
+			s.threadsMu.Unlock()
+		}
+	}
+}
+
+func (s *ChatServer) handleThreadCommand(sessionID, command string, args []string) {
+	reply := func(content string) {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: content})
+	}
+
+	if command == "threads" {
+		if len(args) != 1 {
+			reply(errInvalidThreads.Error())
+			return
+		}
+		if err := s.setThreadMode(sessionID, args[0]); err != nil {
+			reply(err.Error())
+			return
+		}
+		switch args[0] {
+		case "digest":
+			reply(fmt.Sprintf("Replies in threads you follow now come in a digest every %s", threadDigestInterval))
+		case "never":
+			reply("You no longer hear about replies in threads you follow")
+		default:
+			reply("Replies in threads you follow now come as they are sent")
+		}
+		return
+	}
+
+	if len(args) != 1 || args[0] == "" {
+		reply(fmt.Sprintf("Usage: ;%s &lt;message id&gt;", command))
+		return
+	}
+	thread, err := s.follow(sessionID, args[0], command == "follow")
+	if err != nil {
+		reply(escapeText(err.Error()))
+		return
+	}
+	if command == "follow" {
+		reply(fmt.Sprintf("Following the thread of %s, ;threads sets how replies in it come", escapeText(thread)))
+	} else {
+		reply(fmt.Sprintf("No longer following the thread of %s", escapeText(thread)))
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Timers count down in the room for breaks, standups and the like. Starting one posts a message,
+// and so does it running out, and halfway through when asked to. /timers lists the running ones
+// so that people who join late see them too.
+
+const (
+	minTimerDuration   = 10 * time.Second
+	maxTimerDuration   = 24 * time.Hour
+	maxTimers          = 20
+	maxTimersPerPerson = 3
+	maxTimerLabel      = 100
+	defaultTimerLabel  = "timer"
+)
+
+var (
+	errInvalidTimer  = errors.New("Invalid timer: expected a duration between 10s and 24h, such as 5m, and a label of at most 100 characters")
+	errTooManyTimers = errors.New("Too many timers are running: cancel some first")
+	errUnknownTimer  = errors.New("Timer not found, or already done")
+	errTimerNotYours = errors.New("Only whoever started a timer, or a moderator, can cancel it")
+)
+
+type Timer struct {
+	ID string `json:"id"`
+	// HTML-escaped label.
+	Label     string    `json:"label"`
+	StartedBy string    `json:"startedBy"`
+	StartedAt time.Time `json:"startedAt"`
+	Ends      time.Time `json:"ends"`
+	// Whether a message is posted halfway through.
+	Halfway bool `json:"halfway"`
+
+	startedBySession string
+	// Stop the timers posting the halfway and completion messages.
+	stops []func() bool
+}
+
+func (s *ChatServer) runningTimers() []Timer {
+	s.timersMu.Lock()
+	defer s.timersMu.Unlock()
+	timers := make([]Timer, 0, len(s.timers))
+	for _, timer := range s.timers {
+		copied := *timer
+		copied.stops = nil
+		timers = append(timers, copied)
+	}
+	sort.Slice(timers, func(i, j int) bool { return timers[i].Ends.Before(timers[j].Ends) })
+	return timers
+}
+
+// startTimer counts down d in the room, posting a message halfway through if halfway is set.
+func (s *ChatServer) startTimer(sessionID string, d time.Duration, label string, halfway bool) (Timer, error) {
+	if err := s.canPost(sessionID); err != nil {
+		return Timer{}, err
+	}
+	label = strings.TrimSpace(label)
+	if label == "" {
+		label = defaultTimerLabel
+	}
+	if d < minTimerDuration || d > maxTimerDuration || utf8.RuneCountInString(label) > maxTimerLabel || validateMessage(label) != nil {
+		return Timer{}, errInvalidTimer
+	}
+
+	now := s.clock.Now()
+	timer := &Timer{
+		ID:               s.newID(),
+		Label:            escapeText(label),
+		StartedBy:        s.getNickname(sessionID),
+		StartedAt:        now,
+		Ends:             now.Add(d),
+		Halfway:          halfway,
+		startedBySession: sessionID,
+	}
+
+	s.timersMu.Lock()
+	mine := 0
+	for _, running := range s.timers {
+		if running.startedBySession == sessionID {
+			mine++
+		}
+	}
+	if len(s.timers) >= maxTimers || mine >= maxTimersPerPerson {
+		s.timersMu.Unlock()
+		return Timer{}, errTooManyTimers
+	}
+	s.timers[timer.ID] = timer
+	if halfway {
+		timer.stops = append(timer.stops, s.clock.AfterFunc(d/2, func() {
+			s.broadcastMessage(Message{
+				FromApp: true,
+				Kind:    "text",
+				Content: fmt.Sprintf("Halfway through %s: %s left", timer.Label, (d - d/2).Round(time.Second)),
+			})
+		}))
+	}
+	timer.stops = append(timer.stops, s.clock.AfterFunc(d, func() { s.finishTimer(timer.ID) }))
+	started := *timer
+	s.timersMu.Unlock()
+
+	started.stops = nil
+	s.broadcastMessage(Message{
+		FromApp: true,
+		Kind:    "text",
+		Content: fmt.Sprintf("[%s] started a %s timer: %s", escapeText(started.StartedBy), d, started.Label),
+	})
+	return started, nil
+}
+
+func (s *ChatServer) finishTimer(id string) {
+	s.timersMu.Lock()
+	timer, ok := s.timers[id]
+	delete(s.timers, id)
+	s.timersMu.Unlock()
+	if !ok {
+		return
+	}
+
+	s.broadcastMessage(Message{
+		FromApp: true,
+		Kind:    "text",
+		Content: fmt.Sprintf("Time&#39;s up: %s", timer.Label),
+	})
+}
+
+// cancelTimer stops the timer id. Only whoever started it and moderators can.
+func (s *ChatServer) cancelTimer(sessionID, id string) error {
+	moderator := s.isModerator(sessionID)
+
+	s.timersMu.Lock()
+	timer, ok := s.timers[id]
+	if !ok {
+		s.timersMu.Unlock()
+		return errUnknownTimer
+	}
+	if timer.startedBySession != sessionID && !moderator {
+		s.timersMu.Unlock()
+		return errTimerNotYours
+	}
+	for _, stop := range timer.stops {
+		stop()
+	}
+	delete(s.timers, id)
+	s.timersMu.Unlock()
+
+	s.broadcastMessage(Message{
+		FromApp: true,
+		Kind:    "text",
+		Content: fmt.Sprintf("[%s] cancelled the %s timer", escapeText(s.getNickname(sessionID)), timer.Label),
+	})
+	return nil
+}
+
+func (s *ChatServer) handleTimerCommand(sessionID string, args []string) {
+	usage := Message{Kind: "text", Content: "Usage: ;timer &lt;duration&gt; [halfway] [label]|list|cancel &lt;id&gt;"}
+	if len(args) == 0 {
+		s.sendPrivateMessage(sessionID, usage)
+		return
+	}
+
+	var err error
+	switch strings.ToLower(args[0]) {
+	case "list":
+		messageContent := ""
+		for _, timer := range s.runningTimers() {
+			messageContent += fmt.Sprintf("<br>(%s) %s, %s left", escapeText(timer.ID), timer.Label, timer.Ends.Sub(s.clock.Now()).Round(time.Second))
+		}
+		if messageContent == "" {
+			messageContent = "<br>No timer is running"
+		}
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Timers:" + messageContent})
+		return
+
+	case "cancel":
+		if len(args) != 2 {
+			s.sendPrivateMessage(sessionID, usage)
+			return
+		}
+		err = s.cancelTimer(sessionID, args[1])
+
+	default:
+		d, parseErr := time.ParseDuration(args[0])
+		if parseErr != nil {
+			s.sendPrivateMessage(sessionID, usage)
+			return
+		}
+		args = args[1:]
+		halfway := len(args) > 0 && strings.ToLower(args[0]) == "halfway"
+		if halfway {
+			args = args[1:]
+		}
+		_, err = s.startTimer(sessionID, d, strings.Join(args, " "), halfway)
+	}
+	if err != nil {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: escapeText(err.Error())})
+	}
+}
+
+// handleTimers lists the running timers, soonest to end first (GET), starts one lasting
+// "duration" with an optional "label" and "halfway" message (POST), or cancels the timer "id"
+// (DELETE).
+func (s *ChatServer) handleTimers(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writePage(w, r, s.runningTimers(), func(t Timer) string { return timeKey(t.Ends, t.ID) })
+		return
+	}
+
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		r.ParseForm()
+		d, err := time.ParseDuration(r.FormValue("duration"))
+		if err != nil {
+			http.Error(w, errInvalidTimer.Error(), http.StatusBadRequest)
+			return
+		}
+		timer, err := s.startTimer(sessionID, d, normalizeMessage(r.FormValue("label")), r.FormValue("halfway") == "true")
+		switch err {
+		case nil:
+		case errInLobby, errRaidNewMember, errMuted:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(timer)
+
+	case http.MethodDelete:
+		switch err := s.cancelTimer(sessionID, r.URL.Query().Get("id")); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errTimerNotYours:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
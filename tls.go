@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The server speaks HTTPS itself, without a reverse proxy in front, with either a certificate of
+// its own, TLS_CERT_FILE and TLS_KEY_FILE (or serve's -tls-cert and -tls-key), or one it gets from
+// Let's Encrypt for the comma-separated AUTOCERT_HOSTS (-autocert). Certificates it gets are kept
+// in AUTOCERT_CACHE, "autocert" in the data directory or the working directory by default, and
+// renewed before they expire; AUTOCERT_EMAIL is who Let's Encrypt writes to about them. Since
+// Let's Encrypt checks the hosts over plain HTTP on port 80 unless the server listens on 443,
+// AUTOCERT_HTTP_PORT (80 unless set, "off" for none) answers those checks and redirects everything
+// else to HTTPS.
+
+var (
+	tlsCertFile      = os.Getenv("TLS_CERT_FILE")
+	tlsKeyFile       = os.Getenv("TLS_KEY_FILE")
+	autocertHosts    = os.Getenv("AUTOCERT_HOSTS")
+	autocertCache    = os.Getenv("AUTOCERT_CACHE")
+	autocertEmail    = os.Getenv("AUTOCERT_EMAIL")
+	autocertHTTPPort = envOr("AUTOCERT_HTTP_PORT", "80")
+)
+
+var errInvalidTLS = errors.New("TLS needs both a certificate and a key file, or autocert hosts, not both")
+
+func validateTLS() error {
+	if (tlsCertFile == "") != (tlsKeyFile == "") || (tlsCertFile != "" && autocertHosts != "") {
+		return errInvalidTLS
+	}
+	return nil
+}
+
+// scheme returns the scheme the server is reached with.
+func scheme() string {
+	if tlsCertFile != "" || autocertHosts != "" {
+		return "https"
+	}
+	return "http"
+}
+
+// listenAndServe serves with server, over TLS if it is set up.
+func listenAndServe(server *http.Server) error {
+	if tlsCertFile != "" {
+		return server.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+	}
+	if autocertHosts == "" {
+		return server.ListenAndServe()
+	}
+
+	var hosts []string
+	for _, host := range strings.Split(autocertHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	cache := autocertCache
+	if cache == "" {
+		cache = "autocert"
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(cache),
+		Email:      autocertEmail,
+	}
+	server.TLSConfig = manager.TLSConfig()
+	if autocertHTTPPort != "off" {
+		go func() {
+			addr := net.JoinHostPort(bindAddress, autocertHTTPPort)
+			if err := http.ListenAndServe(addr, manager.HTTPHandler(nil)); err != nil {
+				slog.Warn("Could not answer certificate checks", "addr", addr, "err", err)
+			}
+		}()
+	}
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// A small shared to-do list for the room, so teams can track quick action items without leaving
+// the chat. Anyone in the room adds items and marks them done with ;todo, or through
+// /api/v1/todos. They are saved to TODO_FILE, when set, and loaded from it on start.
+
+var todoFile = os.Getenv("TODO_FILE")
+
+const (
+	maxTodos    = 500
+	maxTodoText = 200
+)
+
+var (
+	errInvalidTodo  = errors.New("Invalid todo: expected 1 to 200 characters of text")
+	errTooManyTodos = errors.New("Too many todos: remove some first")
+	errUnknownTodo  = errors.New("Todo not found")
+	errTodoNotYours = errors.New("Only whoever added a todo, or a moderator, can remove it")
+)
+
+type Todo struct {
+	// Sequential, starting at 1.
+	ID int `json:"id"`
+	// HTML-escaped text.
+	Text      string    `json:"text"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	Done      bool      `json:"done"`
+	DoneBy    string    `json:"doneBy,omitempty"`
+	DoneAt    time.Time `json:"doneAt,omitempty"`
+
+	// Session identifier of whoever added it, allowed to remove it.
+	createdBySession string
+}
+
+// savedTodos is what todoFile holds.
+type savedTodos struct {
+	Seq   int         `json:"seq"`
+	Todos []savedTodo `json:"todos"`
+}
+
+type savedTodo struct {
+	Todo
+	Session string `json:"session"`
+}
+
+func (s *ChatServer) todoList() []Todo {
+	s.todosMu.Lock()
+	defer s.todosMu.Unlock()
+	return append([]Todo{}, s.todos...)
+}
+
+func (s *ChatServer) addTodo(sessionID, text string) (Todo, error) {
+	if err := s.canPost(sessionID); err != nil {
+		return Todo{}, err
+	}
+	text = strings.TrimSpace(text)
+	if text == "" || utf8.RuneCountInString(text) > maxTodoText || validateMessage(text) != nil {
+		return Todo{}, errInvalidTodo
+	}
+
+	s.todosMu.Lock()
+	if len(s.todos) >= maxTodos {
+		s.todosMu.Unlock()
+		return Todo{}, errTooManyTodos
+	}
+	s.todoSeq++
+	todo := Todo{
+		ID:               s.todoSeq,
+		Text:             escapeText(text),
+		CreatedBy:        s.getNickname(sessionID),
+		CreatedAt:        s.clock.Now(),
+		createdBySession: sessionID,
+	}
+	s.todos = append(s.todos, todo)
+	s.persistTodosLocked()
+	s.todosMu.Unlock()
+
+	s.broadcastMessage(Message{
+		FromApp: true,
+		Kind:    "text",
+		Content: fmt.Sprintf("[%s] added todo #%d: %s", escapeText(todo.CreatedBy), todo.ID, todo.Text),
+	})
+	return todo, nil
+}
+
+// completeTodo marks the todo id done. Doing so twice is not an error.
+func (s *ChatServer) completeTodo(sessionID string, id int) (Todo, error) {
+	if err := s.canPost(sessionID); err != nil {
+		return Todo{}, err
+	}
+	s.todosMu.Lock()
+	i := s.todoIndexLocked(id)
+	if i < 0 {
+		s.todosMu.Unlock()
+		return Todo{}, errUnknownTodo
+	}
+	todo := &s.todos[i]
+	if todo.Done {
+		done := *todo
+		s.todosMu.Unlock()
+		return done, nil
+	}
+	todo.Done = true
+	todo.DoneBy = s.getNickname(sessionID)
+	todo.DoneAt = s.clock.Now()
+	done := *todo
+	s.persistTodosLocked()
+	s.todosMu.Unlock()
+
+	s.broadcastMessage(Message{
+		FromApp: true,
+		Kind:    "text",
+		Content: fmt.Sprintf("[%s] finished todo #%d: %s", escapeText(done.DoneBy), done.ID, done.Text),
+	})
+	return done, nil
+}
+
+// removeTodo deletes the todo id. Only whoever added it and moderators can.
+func (s *ChatServer) removeTodo(sessionID string, id int) error {
+	moderator := s.isModerator(sessionID)
+
+	s.todosMu.Lock()
+	defer s.todosMu.Unlock()
+	i := s.todoIndexLocked(id)
+	if i < 0 {
+		return errUnknownTodo
+	}
+	if s.todos[i].createdBySession != sessionID && !moderator {
+		return errTodoNotYours
+	}
+	s.todos = append(s.todos[:i], s.todos[i+1:]...)
+	s.persistTodosLocked()
+	return nil
+}
+
+func (s *ChatServer) todoIndexLocked(id int) int {
+	for i, todo := range s.todos {
+		if todo.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// persistTodosLocked writes the todos to todoFile, if set.
+func (s *ChatServer) persistTodosLocked() {
+	if todoFile == "" {
+		return
+	}
+	saved := savedTodos{Seq: s.todoSeq, Todos: make([]savedTodo, len(s.todos))}
+	for i, todo := range s.todos {
+		saved.Todos[i] = savedTodo{Todo: todo, Session: todo.createdBySession}
+	}
+	if err := saveJSONFile(todoFile, saved); err != nil {
+		slog.Error("Could not save todos", "err", err)
+	}
+}
+
+// loadTodos reads the todos saved in todoFile, if it exists.
+func (s *ChatServer) loadTodos() error {
+	if todoFile == "" {
+		return nil
+	}
+	var saved savedTodos
+	if err := loadJSONFile(todoFile, &saved); err != nil {
+		return fmt.Errorf("%s: %w", todoFile, err)
+	}
+	s.todosMu.Lock()
+	defer s.todosMu.Unlock()
+	s.todoSeq = saved.Seq
+	for _, todo := range saved.Todos {
+		todo.createdBySession = todo.Session
+		s.todos = append(s.todos, todo.Todo)
+	}
+	return nil
+}
+
+func (s *ChatServer) handleTodoCommand(sessionID string, args []string) {
+	usage := Message{Kind: "text", Content: "Usage: ;todo add &lt;text&gt;|done &lt;id&gt;|remove &lt;id&gt;|list [all]"}
+	if len(args) == 0 {
+		s.sendPrivateMessage(sessionID, usage)
+		return
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "add":
+		if _, err := s.addTodo(sessionID, strings.Join(args[1:], " ")); err != nil {
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: escapeText(err.Error())})
+		}
+
+	case "done", "remove":
+		if len(args) != 2 {
+			s.sendPrivateMessage(sessionID, usage)
+			return
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(args[1], "#"))
+		if err != nil {
+			s.sendPrivateMessage(sessionID, usage)
+			return
+		}
+		if strings.ToLower(args[0]) == "done" {
+			_, err = s.completeTodo(sessionID, id)
+		} else if err = s.removeTodo(sessionID, id); err == nil {
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: fmt.Sprintf("Removed todo #%d", id)})
+		}
+		if err != nil {
+			s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: escapeText(err.Error())})
+		}
+
+	case "list":
+		all := len(args) > 1 && strings.ToLower(args[1]) == "all"
+		messageContent := ""
+		for _, todo := range s.todoList() {
+			if todo.Done && !all {
+				continue
+			}
+			status := "[ ]"
+			if todo.Done {
+				status = "[x]"
+			}
+			messageContent += fmt.Sprintf("<br>%s #%d %s (%s)", status, todo.ID, todo.Text, escapeText(todo.CreatedBy))
+		}
+		if messageContent == "" {
+			messageContent = "<br>Nothing to do"
+		}
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: "Todos:" + messageContent})
+
+	default:
+		s.sendPrivateMessage(sessionID, usage)
+	}
+}
+
+// handleTodos lists todos (GET), filtered with "status" open (the default), done or all, adds
+// one with "text" (POST), or removes the todo "id" (DELETE).
+func (s *ChatServer) handleTodos(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		status := r.URL.Query().Get("status")
+		if status == "" {
+			status = "open"
+		}
+		if status != "open" && status != "done" && status != "all" {
+			http.Error(w, "Invalid status: expected open, done or all", http.StatusBadRequest)
+			return
+		}
+		todos := []Todo{}
+		for _, todo := range s.todoList() {
+			if status == "all" || todo.Done == (status == "done") {
+				todos = append(todos, todo)
+			}
+		}
+		writePage(w, r, todos, func(t Todo) string { return seqKey(uint64(t.ID)) })
+
+	case http.MethodPost:
+		r.ParseForm()
+		todo, err := s.addTodo(sessionID, normalizeMessage(r.FormValue("text")))
+		switch err {
+		case nil:
+		case errInLobby, errRaidNewMember, errMuted:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(todo)
+
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, errUnknownTodo.Error(), http.StatusNotFound)
+			return
+		}
+		switch err := s.removeTodo(sessionID, id); err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case errTodoNotYours:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTodoDone marks the todo "id" done.
+func (s *ChatServer) handleTodoDone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessionID := s.getOrCreateSession(w, r)
+	if s.isBanned(sessionID) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+
+	r.ParseForm()
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, errUnknownTodo.Error(), http.StatusNotFound)
+		return
+	}
+	todo, err := s.completeTodo(sessionID, id)
+	switch err {
+	case nil:
+	case errInLobby, errRaidNewMember, errMuted:
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(todo)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Delivery tracing helps chase reports of missed messages. While on, a sampled share of
+// broadcasts records, for every client connected when it was sent, when it was queued for the
+// client, or dropped because its queue was full, and when its stream flushed it, or left it out
+// for its kind filter. Moderators turn it on with /mod/traces, or TRACE_SAMPLE_RATE at start, and
+// read the last maxTraces traces there. Batches sampled per viewer in livestream mode aren't
+// traced.
+
+const (
+	maxTraces = 50
+	// How long after a traced broadcast flushes are still recorded. Clients that flush it later,
+	// after resuming their stream say, show as queued only.
+	traceWindow = time.Minute
+)
+
+var errInvalidTraceRate = errors.New("Invalid sample rate: expected a number from 0 to 1")
+
+type tracingState struct {
+	// Share of broadcasts traced, 0 when off.
+	rate float64
+	// Last traces, oldest first.
+	traces []*DeliveryTrace
+	// Traces still recording flushes, by their encoded event.
+	active map[string]*DeliveryTrace
+}
+
+type DeliveryTrace struct {
+	// Identifier, Seq and kind of the traced event. Identifier and Seq are empty for those not
+	// logged, like updates.
+	ID     string    `json:"id,omitempty"`
+	Seq    uint64    `json:"seq,omitempty"`
+	Kind   string    `json:"kind"`
+	SentAt time.Time `json:"sentAt"`
+	// By session handle, see sessionHandle.
+	Subscribers []SubscriberDelivery `json:"subscribers"`
+
+	subscribers map[string]*SubscriberDelivery
+}
+
+type SubscriberDelivery struct {
+	SessionID string `json:"sessionId"`
+	Nickname  string `json:"nickname"`
+	// When the event was queued for the client, or whether it was dropped instead.
+	QueuedAt *time.Time `json:"queuedAt,omitempty"`
+	Dropped  bool       `json:"dropped,omitempty"`
+	// When the client's stream flushed the event, or whether its kind filter left it out.
+	FlushedAt *time.Time `json:"flushedAt,omitempty"`
+	Filtered  bool       `json:"filtered,omitempty"`
+}
+
+type TracingStatus struct {
+	Rate float64 `json:"rate"`
+	// Newest first.
+	Traces []DeliveryTrace `json:"traces"`
+}
+
+func (s *ChatServer) initTracing() {
+	s.tracing.active = make(map[string]*DeliveryTrace)
+	if rate, err := strconv.ParseFloat(os.Getenv("TRACE_SAMPLE_RATE"), 64); err == nil && rate > 0 && rate <= 1 {
+		s.tracing.rate = rate
+	}
+}
+
+func (s *ChatServer) setTraceRate(by string, rate float64) error {
+	if !(rate >= 0 && rate <= 1) {
+		return errInvalidTraceRate
+	}
+	s.tracingMu.Lock()
+	s.tracing.rate = rate
+	s.tracingMu.Unlock()
+	s.audit(by, "traces.rate", "", strconv.FormatFloat(rate, 'g', -1, 64))
+	return nil
+}
+
+// sampleTrace starts tracing the encoded event data, if it is sampled, and returns its trace.
+func (s *ChatServer) sampleTrace(data string) *DeliveryTrace {
+	s.tracingMu.Lock()
+	defer s.tracingMu.Unlock()
+	if s.tracing.rate == 0 || mrand.Float64() >= s.tracing.rate {
+		return nil
+	}
+	if _, ok := s.tracing.active[data]; ok {
+		return nil
+	}
+	var event Message
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return nil
+	}
+
+	trace := &DeliveryTrace{
+		ID:          event.ID,
+		Seq:         event.Seq,
+		Kind:        event.Kind,
+		SentAt:      s.clock.Now(),
+		subscribers: make(map[string]*SubscriberDelivery),
+	}
+	if len(s.tracing.traces) >= maxTraces {
+		copy(s.tracing.traces, s.tracing.traces[1:])
+		s.tracing.traces = s.tracing.traces[:len(s.tracing.traces)-1]
+	}
+	s.tracing.traces = append(s.tracing.traces, trace)
+	s.tracing.active[data] = trace
+	s.clock.AfterFunc(traceWindow, func() {
+		s.tracingMu.Lock()
+		delete(s.tracing.active, data)
+		s.tracingMu.Unlock()
+	})
+	return trace
+}
+
+// traceQueued records whether the traced event was queued for sessionID.
+func (s *ChatServer) traceQueued(trace *DeliveryTrace, sessionID string, queued bool) {
+	s.tracingMu.Lock()
+	defer s.tracingMu.Unlock()
+	delivery := &SubscriberDelivery{SessionID: sessionID, Dropped: !queued}
+	if queued {
+		now := s.clock.Now()
+		delivery.QueuedAt = &now
+	}
+	trace.subscribers[sessionID] = delivery
+}
+
+// traceFlushed records that the stream of sessionID flushed the encoded event data, if it is
+// traced, or left it out if filtered.
+func (s *ChatServer) traceFlushed(data, sessionID string, filtered bool) {
+	s.tracingMu.Lock()
+	defer s.tracingMu.Unlock()
+	if len(s.tracing.active) == 0 {
+		return
+	}
+	trace, ok := s.tracing.active[data]
+	if !ok {
+		return
+	}
+	delivery, ok := trace.subscribers[sessionID]
+	if !ok {
+		return
+	}
+	if filtered {
+		delivery.Filtered = true
+		return
+	}
+	now := s.clock.Now()
+	delivery.FlushedAt = &now
+}
+
+func (s *ChatServer) tracingStatus() TracingStatus {
+	s.tracingMu.Lock()
+	status := TracingStatus{Rate: s.tracing.rate, Traces: make([]DeliveryTrace, 0, len(s.tracing.traces))}
+	for i := len(s.tracing.traces) - 1; i >= 0; i-- {
+		trace := *s.tracing.traces[i]
+		trace.Subscribers = make([]SubscriberDelivery, 0, len(trace.subscribers))
+		for _, delivery := range trace.subscribers {
+			trace.Subscribers = append(trace.Subscribers, *delivery)
+		}
+		status.Traces = append(status.Traces, trace)
+	}
+	s.tracingMu.Unlock()
+
+	for i := range status.Traces {
+		subscribers := status.Traces[i].Subscribers
+		sort.Slice(subscribers, func(a, b int) bool { return subscribers[a].SessionID < subscribers[b].SessionID })
+		for j := range subscribers {
+			subscribers[j].Nickname = s.getNickname(subscribers[j].SessionID)
+			subscribers[j].SessionID = sessionHandle(subscribers[j].SessionID)
+		}
+	}
+	return status
+}
+
+// handleModTraces lists the last delivery traces (GET) or sets the share of broadcasts traced,
+// "rate" from 0 (off) to 1, and lists them (POST). Moderators only.
+func (s *ChatServer) handleModTraces(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	if !s.isModerator(sessionID) {
+		http.Error(w, "Moderators only", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		r.ParseForm()
+		rate, err := strconv.ParseFloat(r.FormValue("rate"), 64)
+		if err != nil {
+			rate = -1
+		}
+		if err := s.setTraceRate(sessionID, rate); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.tracingStatus())
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The chat page is the embedded index.html, or the one in the working directory if there is one,
+// unless a UI bundle replaced it: a zip archive of an index.html and the assets it loads, posted
+// to /api/admin/ui as the body, with Content-Type application/zip, as a theme is worked on. It
+// is checked whole before it is served instead, all at once, so that no page gets a mix of two
+// bundles, and saved to UI_BUNDLE so that it is served again after a restart. Its files are
+// served at the root, index.html at "/", so that relative links between them work. GET
+// /api/admin/ui says which bundle is served, and /api/admin/ui/rollback goes back to the default
+// page. Both changes are audited. A bundle is scripts run by every member, so these take
+// ADMIN_TOKEN, which the operator has, and not moderators.
+
+var uiBundleFile = os.Getenv("UI_BUNDLE")
+
+const (
+	// Largest bundle, compressed and not.
+	maxUIBundle      = 20 << 20
+	maxUIBundleFiles = 500
+)
+
+var (
+	errUIBundleInvalid  = errors.New("Invalid UI bundle: expected a zip archive")
+	errUIBundleTooLarge = fmt.Errorf("UI bundle too large: at most %d MB and %d files", maxUIBundle>>20, maxUIBundleFiles)
+	errUIBundleNoIndex  = errors.New("Invalid UI bundle: it has no index.html")
+)
+
+// UIBundle is a bundle replacing the default chat page.
+type UIBundle struct {
+	// SHA-256 of the archive.
+	Hash       string    `json:"hash"`
+	Files      []string  `json:"files"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploadedAt"`
+	UploadedBy string    `json:"uploadedBy,omitempty"`
+
+	files map[string][]byte
+}
+
+// uiState is what /api/admin/ui returns.
+type uiState struct {
+	// Whether the default page is served, without a bundle.
+	Default bool      `json:"default"`
+	Bundle  *UIBundle `json:"bundle,omitempty"`
+}
+
+// parseUIBundle reads the zip archive data. Files of a single top directory are taken as being
+// at the root.
+func parseUIBundle(data []byte) (*UIBundle, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errUIBundleInvalid
+	}
+	files := make(map[string][]byte)
+	var total int64
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		name := path.Clean(strings.ReplaceAll(file.Name, `\`, "/"))
+		if strings.HasPrefix(name, "/") || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("Invalid UI bundle: %s is outside of it", file.Name)
+		}
+		if len(files) >= maxUIBundleFiles {
+			return nil, errUIBundleTooLarge
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, errUIBundleInvalid
+		}
+		content, err := io.ReadAll(io.LimitReader(reader, maxUIBundle-total+1))
+		reader.Close()
+		if err != nil {
+			return nil, errUIBundleInvalid
+		}
+		if total += int64(len(content)); total > maxUIBundle {
+			return nil, errUIBundleTooLarge
+		}
+		files[name] = content
+	}
+
+	if _, ok := files["index.html"]; !ok {
+		var top string
+		for name := range files {
+			dir, _, _ := strings.Cut(name, "/")
+			if top == "" {
+				top = dir
+			} else if dir != top {
+				top = ""
+				break
+			}
+		}
+		if _, ok := files[top+"/index.html"]; top == "" || !ok {
+			return nil, errUIBundleNoIndex
+		}
+		root := make(map[string][]byte, len(files))
+		for name, content := range files {
+			root[strings.TrimPrefix(name, top+"/")] = content
+		}
+		files = root
+	}
+
+	hash := sha256.Sum256(data)
+	bundle := &UIBundle{Hash: hex.EncodeToString(hash[:]), Size: int64(len(data)), files: files}
+	for name := range files {
+		bundle.Files = append(bundle.Files, name)
+	}
+	sort.Strings(bundle.Files)
+	return bundle, nil
+}
+
+// loadUIBundle serves the bundle saved in uiBundleFile, if it exists.
+func (s *ChatServer) loadUIBundle() error {
+	if uiBundleFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(uiBundleFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	bundle, err := parseUIBundle(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", uiBundleFile, err)
+	}
+	if info, err := os.Stat(uiBundleFile); err == nil {
+		bundle.UploadedAt = info.ModTime()
+	}
+	s.uiMu.Lock()
+	s.ui = bundle
+	s.uiMu.Unlock()
+	return nil
+}
+
+// uiBundle returns the bundle served, nil for the default page.
+func (s *ChatServer) uiBundle() *UIBundle {
+	s.uiMu.RLock()
+	defer s.uiMu.RUnlock()
+	return s.ui
+}
+
+// swapUIBundle serves bundle, archived as data, instead of what was, or the default page if it
+// is nil, saving it to uiBundleFile first.
+func (s *ChatServer) swapUIBundle(bundle *UIBundle, data []byte) error {
+	s.uiMu.Lock()
+	defer s.uiMu.Unlock()
+	if uiBundleFile != "" {
+		if bundle == nil {
+			if err := os.Remove(uiBundleFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		} else {
+			tmp := uiBundleFile + ".tmp"
+			if err := os.WriteFile(tmp, data, 0o600); err != nil {
+				return err
+			}
+			if err := os.Rename(tmp, uiBundleFile); err != nil {
+				return err
+			}
+		}
+	}
+	s.ui = bundle
+	return nil
+}
+
+// serveUIBundleFile serves the file of bundle r asks for, and reports whether it has it.
+func serveUIBundleFile(w http.ResponseWriter, r *http.Request, bundle *UIBundle) bool {
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	if name == "" {
+		name = "index.html"
+	}
+	content, ok := bundle.files[name]
+	if !ok {
+		return false
+	}
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
+	}
+	w.Header().Set("Content-Type", contentType)
+	if strings.HasPrefix(contentType, "text/html") {
+		setPageHeaders(w)
+	}
+	// Bundles change under the same names.
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", `"`+bundle.Hash[:16]+`"`)
+	http.ServeContent(w, r, name, bundle.UploadedAt, bytes.NewReader(content))
+	return true
+}
+
+// handleAdminUI returns which bundle is served on GET, and serves the bundle in the body on POST.
+func (s *ChatServer) handleAdminUI(w http.ResponseWriter, r *http.Request) {
+	if !adminTokenAuthorized(r) {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+	if r.Method == http.MethodGet {
+		bundle := s.uiBundle()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(uiState{Default: bundle == nil, Bundle: bundle})
+		return
+	}
+	if !s.adminPost(w, r) {
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUIBundle))
+	if err != nil {
+		http.Error(w, errUIBundleTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	bundle, err := parseUIBundle(data)
+	if errors.Is(err, errUIBundleTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bundle.UploadedAt = s.clock.Now()
+	bundle.UploadedBy = "admin"
+	if err := s.swapUIBundle(bundle, data); err != nil {
+		http.Error(w, "Could not save the UI bundle", http.StatusInternalServerError)
+		return
+	}
+	s.audit("admin", "ui.upload", bundle.Hash, fmt.Sprintf("%d files", len(bundle.Files)))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uiState{Bundle: bundle})
+}
+
+// handleAdminUIRollback serves the default page again.
+func (s *ChatServer) handleAdminUIRollback(w http.ResponseWriter, r *http.Request) {
+	if !adminTokenAuthorized(r) {
+		http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+		return
+	}
+	if !s.adminPost(w, r) {
+		return
+	}
+	if s.uiBundle() == nil {
+		http.Error(w, "The default page is already served", http.StatusConflict)
+		return
+	}
+	if err := s.swapUIBundle(nil, nil); err != nil {
+		http.Error(w, "Could not remove the UI bundle", http.StatusInternalServerError)
+		return
+	}
+	s.audit("admin", "ui.rollback", "", "")
+	w.WriteHeader(http.StatusNoContent)
+}
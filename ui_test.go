@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUIBundleTakesTheAdminToken(t *testing.T) {
+	key, token := moderatorKey, adminToken
+	moderatorKey, adminToken = "test-key", "test-token"
+	t.Cleanup(func() { moderatorKey, adminToken = key, token })
+
+	_, srv := newTestServer(t)
+	mod := srv.Connect()
+	mod.Send(";mod test-key")
+	mod.Collect(settle)
+	if status, body := mod.Do(http.MethodGet, "/api/admin/ui", nil); status != http.StatusUnauthorized {
+		t.Errorf("GET /api/admin/ui as a moderator: %d %s, want 401", status, body)
+	}
+	if status, body := mod.Do(http.MethodPost, "/api/admin/ui", nil); status != http.StatusUnauthorized {
+		t.Errorf("POST /api/admin/ui as a moderator: %d %s, want 401", status, body)
+	}
+	if status, body := mod.Do(http.MethodPost, "/api/admin/ui/rollback", nil); status != http.StatusUnauthorized {
+		t.Errorf("rollback as a moderator: %d %s, want 401", status, body)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/admin/ui", nil)
+	req.Header.Set("Authorization", "Bearer test-token")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /api/admin/ui with the token: %s, want 200", resp.Status)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// /api/v1/unfurl?url= fetches the title and description of a linked page, for clients to show a
+// preview under messages with links. Pages are fetched from the sites allowed through the media
+// proxy only, and results are cached within PREVIEW_CACHE_MB: previews for previewCacheTTL and
+// failed fetches for previewFailureTTL, so a popular or broken link is fetched once in a while
+// however many clients show it.
+
+const (
+	defaultPreviewCacheMB = 8
+	previewCacheTTL       = 6 * time.Hour
+	previewFailureTTL     = 5 * time.Minute
+	// Most of a page read looking for its title, which is in the head.
+	previewMaxBytes = 256 << 10
+	// Longest title and description kept, in bytes.
+	previewMaxTitle       = 200
+	previewMaxDescription = 300
+)
+
+var previewCacheBytes = loadMegabytes("PREVIEW_CACHE_MB", defaultPreviewCacheMB)
+
+var (
+	titlePattern    = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	metaPattern     = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	metaAttrPattern = regexp.MustCompile(`(?is)(property|name|content)\s*=\s*("[^"]*"|'[^']*')`)
+)
+
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	// The error fetching the page, cached like a preview.
+	err error
+}
+
+// linkPreview returns the preview of the page at rawURL, from the cache if it was fetched recently.
+func (s *ChatServer) linkPreview(rawURL string) (LinkPreview, error) {
+	if len(proxyDomains) == 0 {
+		return LinkPreview{}, errProxyOff
+	}
+	target, err := url.Parse(rawURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return LinkPreview{}, errInvalidProxyURL
+	}
+	if !proxyAllowed(target) {
+		return LinkPreview{}, errProxyNotAllowed
+	}
+	rawURL = target.String()
+
+	if preview, ok := s.previewCache.get(rawURL, s.clock.Now()); ok {
+		return preview, preview.err
+	}
+	preview := fetchPreview(rawURL)
+	ttl := previewCacheTTL
+	if preview.err != nil {
+		ttl = previewFailureTTL
+	}
+	s.previewCache.put(rawURL, preview, int64(len(preview.URL)+len(preview.Title)+len(preview.Description)), ttl, s.clock.Now())
+	return preview, preview.err
+}
+
+func fetchPreview(rawURL string) LinkPreview {
+	preview := LinkPreview{URL: rawURL}
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		preview.err = errInvalidProxyURL
+		return preview
+	}
+	req.Header.Set("User-Agent", "alantern-link-preview")
+	req.Header.Set("Accept", "text/html")
+	resp, err := proxyClient.Do(req)
+	if err != nil {
+		preview.err = errProxyFetchFailed
+		return preview
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		preview.err = errProxyFetchFailed
+		return preview
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, previewMaxBytes))
+	if err != nil {
+		preview.err = errProxyFetchFailed
+		return preview
+	}
+
+	// Open Graph properties are preferred over the title and description meant for search engines.
+	meta := make(map[string]string)
+	for _, tag := range metaPattern.FindAll(page, -1) {
+		var key, content string
+		for _, attr := range metaAttrPattern.FindAllSubmatch(tag, -1) {
+			value := string(attr[2][1 : len(attr[2])-1])
+			if strings.EqualFold(string(attr[1]), "content") {
+				content = value
+			} else {
+				key = strings.ToLower(value)
+			}
+		}
+		if _, ok := meta[key]; key != "" && !ok {
+			meta[key] = content
+		}
+	}
+	preview.Title = meta["og:title"]
+	if preview.Title == "" {
+		if match := titlePattern.FindSubmatch(page); match != nil {
+			preview.Title = string(match[1])
+		}
+	}
+	preview.Description = meta["og:description"]
+	if preview.Description == "" {
+		preview.Description = meta["description"]
+	}
+	preview.Title = cleanPreviewText(preview.Title, previewMaxTitle)
+	preview.Description = cleanPreviewText(preview.Description, previewMaxDescription)
+	return preview
+}
+
+// cleanPreviewText returns text from a page as plain text on one line, cut to max bytes.
+func cleanPreviewText(text string, max int) string {
+	text = strings.Join(strings.Fields(html.UnescapeString(text)), " ")
+	if len(text) > max {
+		text = strings.ToValidUTF8(text[:max], "") + "…"
+	}
+	return text
+}
+
+// handleUnfurl returns the preview of the page at "url".
+func (s *ChatServer) handleUnfurl(w http.ResponseWriter, r *http.Request) {
+	if s.isBanned(s.getOrCreateSession(w, r)) {
+		http.Error(w, "You are banned", http.StatusForbidden)
+		return
+	}
+
+	preview, err := s.linkPreview(r.URL.Query().Get("url"))
+	switch err {
+	case nil:
+	case errProxyOff:
+		http.Error(w, "Link previews are off", http.StatusNotFound)
+		return
+	case errInvalidProxyURL:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errProxyNotAllowed:
+		http.Error(w, "This site isn't allowed for link previews", http.StatusForbidden)
+		return
+	default:
+		http.Error(w, "Could not fetch the page", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(preview)
+}
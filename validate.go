@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxNicknameLength = 32
+	maxMessageLength  = 4000
+)
+
+var (
+	errNicknameEmpty   = errors.New("Invalid nickname: either empty or contains spaces")
+	errNicknameLength  = fmt.Errorf("Invalid nickname: longer than %d characters", maxNicknameLength)
+	errNicknameChars   = errors.New("Invalid nickname: contains invisible or control characters")
+	errMessageEncoding = errors.New("Invalid message: not valid UTF-8")
+	errMessageLength   = fmt.Errorf("Invalid message: longer than %d characters", maxMessageLength)
+	errMessageChars    = errors.New("Invalid message: contains control characters")
+	errColor           = errors.New("Invalid color format. Use hexadecimal format like #ff0000 or predefined names like red")
+)
+
+// validateNickname reports why a nickname can't be used, if it can't.
+func validateNickname(nickname string) error {
+	if nickname == "" || !utf8.ValidString(nickname) {
+		return errNicknameEmpty
+	}
+	if utf8.RuneCountInString(nickname) > maxNicknameLength {
+		return errNicknameLength
+	}
+	for _, r := range nickname {
+		if unicode.IsSpace(r) {
+			return errNicknameEmpty
+		}
+		// Format characters include bidi overrides and zero-width joiners, which let names look like others.
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return errNicknameChars
+		}
+	}
+	return nil
+}
+
+// validateMessage reports why a message or command can't be sent, if it can't.
+func validateMessage(text string) error {
+	if !utf8.ValidString(text) {
+		return errMessageEncoding
+	}
+	if utf8.RuneCountInString(text) > maxMessageLength {
+		return errMessageLength
+	}
+	for _, r := range text {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return errMessageChars
+		}
+	}
+	return nil
+}
+
+// parseColor resolves a colour name or #rrggbb code to a hex code.
+func parseColor(color string) (string, error) {
+	if hex, ok := predefinedColors[strings.ToLower(color)]; ok {
+		return hex, nil
+	}
+	if len(color) != 7 || color[0] != '#' {
+		return "", errColor
+	}
+	for _, c := range color[1:] {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return "", errColor
+		}
+	}
+	return color, nil
+}
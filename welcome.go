@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// New members get a private welcome message the first time they connect to /events. It is a
+// template where {nickname}, {rules} (a link to RULES_URL) and {online} (how many are connected)
+// are filled in. It starts out as WELCOME_MESSAGE, and co-owners can change it with
+// /mod/welcome, saved to WELCOME_FILE when set. An empty template sends nothing.
+
+var welcomeFile = os.Getenv("WELCOME_FILE")
+
+var errInvalidWelcome = errors.New("Invalid welcome message: expected a valid message template and an http or https rules link")
+
+type WelcomeConfig struct {
+	Template string `json:"template"`
+	RulesURL string `json:"rulesUrl"`
+}
+
+func (config WelcomeConfig) validate() error {
+	if config.Template != "" && validateMessage(config.Template) != nil {
+		return errInvalidWelcome
+	}
+	if config.RulesURL != "" {
+		target, err := url.Parse(config.RulesURL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return errInvalidWelcome
+		}
+	}
+	return nil
+}
+
+// loadWelcome reads the welcome message saved in welcomeFile, if it exists, over the one from
+// the environment.
+func (s *ChatServer) loadWelcome() error {
+	config := WelcomeConfig{Template: os.Getenv("WELCOME_MESSAGE"), RulesURL: os.Getenv("RULES_URL")}
+	if welcomeFile != "" {
+		if err := loadJSONFile(welcomeFile, &config); err != nil {
+			return fmt.Errorf("%s: %w", welcomeFile, err)
+		}
+	}
+	if err := config.validate(); err != nil {
+		return err
+	}
+	s.welcomeMu.Lock()
+	s.welcome = config
+	s.welcomeMu.Unlock()
+	return nil
+}
+
+func (s *ChatServer) saveWelcome(by string, config WelcomeConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	s.welcomeMu.Lock()
+	s.welcome = config
+	if welcomeFile != "" {
+		if err := saveJSONFile(welcomeFile, config); err != nil {
+			slog.Error("Could not save the welcome message", "err", err)
+		}
+	}
+	s.welcomeMu.Unlock()
+
+	s.audit(by, "welcome.save", "", config.Template)
+	return nil
+}
+
+// renderWelcome fills in the welcome template for sessionID, "" if there is none.
+func (s *ChatServer) renderWelcome(sessionID string) string {
+	s.welcomeMu.Lock()
+	config := s.welcome
+	s.welcomeMu.Unlock()
+	if config.Template == "" {
+		return ""
+	}
+
+	rules := ""
+	if config.RulesURL != "" {
+		escaped := escapeText(config.RulesURL)
+		rules = fmt.Sprintf(`<a href="%s" target="_blank" rel="noopener noreferrer">%s</a>`, escaped, escaped)
+	}
+	online := s.hub.connected()
+
+	return strings.NewReplacer(
+		"{nickname}", escapeText(s.getNickname(sessionID)),
+		"{rules}", rules,
+		"{online}", strconv.Itoa(online),
+	).Replace(escapeText(config.Template))
+}
+
+// sendWelcome sends the welcome message to sessionID, unless it was already welcomed.
+func (s *ChatServer) sendWelcome(sessionID string) {
+	s.welcomeMu.Lock()
+	welcomed := s.welcomed[sessionID]
+	s.welcomed[sessionID] = true
+	s.welcomeMu.Unlock()
+	if welcomed {
+		return
+	}
+
+	if content := s.renderWelcome(sessionID); content != "" {
+		s.sendPrivateMessage(sessionID, Message{Kind: "text", Content: content})
+	}
+}
+
+// handleModWelcome shows (GET) or replaces (POST) the welcome message "template" and
+// "rulesUrl". Co-owners and the owner only.
+func (s *ChatServer) handleModWelcome(w http.ResponseWriter, r *http.Request) {
+	sessionID := s.getOrCreateSession(w, r)
+	if s.roleOf(sessionID) < RoleCoOwner {
+		http.Error(w, "Co-owners only", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		r.ParseForm()
+		if err := s.saveWelcome(sessionID, WelcomeConfig{Template: r.FormValue("template"), RulesURL: r.FormValue("rulesUrl")}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.welcomeMu.Lock()
+	config := s.welcome
+	s.welcomeMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}